@@ -0,0 +1,18 @@
+(module $AsciiOnly
+  (memory (export "memory") 1)
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0))
+  (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
+
+  ;; Scalar validator: returns 1 when every input byte is ASCII, 0 otherwise.
+  ;; With no output exports, a chain uses it as a guard.
+  (func $run (export "run") (param $input_size i32) (result i32)
+    (local $i i32)
+    (block $done
+      (loop $each
+        (br_if $done (i32.ge_u (local.get $i) (local.get $input_size)))
+        (if (i32.ge_u (i32.load8_u (local.get $i)) (i32.const 0x80))
+          (then (return (i32.const 0))))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $each)))
+    (i32.const 1))
+)
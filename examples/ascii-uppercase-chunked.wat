@@ -0,0 +1,39 @@
+(module $AsciiUppercaseChunked
+  ;; Streams input of any size through a fixed 64 KiB window.
+  ;; Input window at 0x10000, output window at 0x20000
+  (memory (export "memory") 3)
+
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0x10000))
+  (global $input_utf8_cap (export "input_utf8_cap") i32 (i32.const 0x10000))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0x20000))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 0x10000))
+
+  ;; run_chunk(chunk_size) -> output_size
+  ;; Called once per input window. Uppercases ASCII letters into the output window.
+  (func (export "run_chunk") (param $chunk_size i32) (result i32)
+    (local $i i32)
+    (local $c i32)
+    (block $done
+      (loop $next
+        (br_if $done (i32.ge_u (local.get $i) (local.get $chunk_size)))
+        (local.set $c (i32.load8_u (i32.add (global.get $input_ptr) (local.get $i))))
+        ;; 'a'..'z' -> 'A'..'Z'
+        (if (i32.lt_u (i32.sub (local.get $c) (i32.const 97)) (i32.const 26))
+          (then
+            (local.set $c (i32.sub (local.get $c) (i32.const 32)))
+          )
+        )
+        (i32.store8 (i32.add (global.get $output_ptr) (local.get $i)) (local.get $c))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $next)
+      )
+    )
+    (local.get $chunk_size)
+  )
+
+  ;; finish() -> output_size
+  ;; Called once after the last chunk. Nothing is held back between chunks.
+  (func (export "finish") (result i32)
+    (i32.const 0)
+  )
+)
@@ -0,0 +1,36 @@
+(module $ByteStats
+  (memory (export "memory") 2)
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0))
+  (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0x10000))
+  (global $output_f64_cap (export "output_f64_cap") i32 (i32.const 4))
+
+  ;; Outputs four f64 values describing the input bytes: count, min, max,
+  ;; and mean. Empty input produces no output.
+  (func $run (export "run") (param $input_size i32) (result i32)
+    (local $i i32)
+    (local $c i32)
+    (local $min i32)
+    (local $max i32)
+    (local $sum i64)
+    (if (i32.eqz (local.get $input_size))
+      (then (return (i32.const 0))))
+    (local.set $min (i32.const 255))
+    (block $done
+      (loop $each
+        (br_if $done (i32.ge_u (local.get $i) (local.get $input_size)))
+        (local.set $c (i32.load8_u (local.get $i)))
+        (local.set $sum (i64.add (local.get $sum) (i64.extend_i32_u (local.get $c))))
+        (local.set $min (select (local.get $c) (local.get $min) (i32.lt_u (local.get $c) (local.get $min))))
+        (local.set $max (select (local.get $c) (local.get $max) (i32.gt_u (local.get $c) (local.get $max))))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $each)))
+    (f64.store offset=0 (global.get $output_ptr) (f64.convert_i32_u (local.get $input_size)))
+    (f64.store offset=8 (global.get $output_ptr) (f64.convert_i32_u (local.get $min)))
+    (f64.store offset=16 (global.get $output_ptr) (f64.convert_i32_u (local.get $max)))
+    (f64.store offset=24 (global.get $output_ptr)
+      (f64.div
+        (f64.convert_i64_u (local.get $sum))
+        (f64.convert_i32_u (local.get $input_size))))
+    (i32.const 4))
+)
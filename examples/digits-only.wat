@@ -0,0 +1,33 @@
+(module $DigitsOnly
+  (memory (export "memory") 1)
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0))
+  (global $input_utf8_cap (export "input_utf8_cap") i32 (i32.const 0x4000))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0x4000))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 0x4000))
+  (global $error_message_ptr (export "error_message_ptr") i32 (i32.const 0x8000))
+  (global $error_message_size (export "error_message_size") (mut i32) (i32.const 0))
+
+  (data (i32.const 0x8000) "Input must contain only the digits 0-9")
+
+  ;; Copies the input to the output when every byte is an ASCII digit.
+  ;; Otherwise returns no output and sets error_message_size, so qip shows
+  ;; the reason instead of an empty result.
+  (func $run (export "run") (param $input_size i32) (result i32)
+    (local $i i32)
+    (local $c i32)
+    (global.set $error_message_size (i32.const 0))
+    (block $done
+      (loop $each
+        (br_if $done (i32.ge_u (local.get $i) (local.get $input_size)))
+        (local.set $c (i32.load8_u (local.get $i)))
+        (if (i32.or
+              (i32.lt_u (local.get $c) (i32.const 48))   ;; '0'
+              (i32.gt_u (local.get $c) (i32.const 57)))  ;; '9'
+          (then
+            (global.set $error_message_size (i32.const 38))
+            (return (i32.const 0))))
+        (i32.store8 (i32.add (global.get $output_ptr) (local.get $i)) (local.get $c))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $each)))
+    (local.get $input_size))
+)
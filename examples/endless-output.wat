@@ -0,0 +1,27 @@
+(module $EndlessOutput
+  ;; A chunked module whose output_more always reports more output, so qip
+  ;; must stop it. Used to test the execution time limit on output draining.
+  (memory (export "memory") 1)
+
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0))
+  (global $input_utf8_cap (export "input_utf8_cap") i32 (i32.const 0x100))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0x100))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 0x100))
+
+  (data (i32.const 0x100) "y")
+
+  ;; run_chunk(chunk_size) -> output_size
+  (func (export "run_chunk") (param $chunk_size i32) (result i32)
+    (i32.const 1)
+  )
+
+  ;; finish() -> output_size
+  (func (export "finish") (result i32)
+    (i32.const 0)
+  )
+
+  ;; output_more() -> output_size, never 0.
+  (func (export "output_more") (result i32)
+    (i32.const 1)
+  )
+)
@@ -0,0 +1,52 @@
+(module $HexEncode
+  ;; Hex output is twice the size of its input, so a full input buffer
+  ;; cannot fit in one output buffer. Remaining output is drained via output_more.
+  ;; Input at 0x10000, output at 0x20000, digit table at 0x100
+  (memory (export "memory") 3)
+
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0x10000))
+  (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0x20000))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 0x10000))
+
+  (global $input_size (mut i32) (i32.const 0))
+  (global $input_pos (mut i32) (i32.const 0))
+
+  (data (i32.const 0x100) "0123456789abcdef")
+
+  ;; Encode pending input until it runs out or the output buffer is full.
+  ;; Returns the number of bytes written at output_ptr.
+  (func $encode (result i32)
+    (local $out i32)
+    (local $c i32)
+    (block $done
+      (loop $next
+        (br_if $done (i32.ge_u (global.get $input_pos) (global.get $input_size)))
+        (br_if $done (i32.ge_u (local.get $out) (global.get $output_utf8_cap)))
+        (local.set $c (i32.load8_u (i32.add (global.get $input_ptr) (global.get $input_pos))))
+        (i32.store8
+          (i32.add (global.get $output_ptr) (local.get $out))
+          (i32.load8_u (i32.add (i32.const 0x100) (i32.shr_u (local.get $c) (i32.const 4)))))
+        (i32.store8
+          (i32.add (global.get $output_ptr) (i32.add (local.get $out) (i32.const 1)))
+          (i32.load8_u (i32.add (i32.const 0x100) (i32.and (local.get $c) (i32.const 15)))))
+        (local.set $out (i32.add (local.get $out) (i32.const 2)))
+        (global.set $input_pos (i32.add (global.get $input_pos) (i32.const 1)))
+        (br $next)
+      )
+    )
+    (local.get $out)
+  )
+
+  (func (export "run") (param $input_size i32) (result i32)
+    (global.set $input_size (local.get $input_size))
+    (global.set $input_pos (i32.const 0))
+    (call $encode)
+  )
+
+  ;; output_more() -> output_size
+  ;; Host calls this after run until it returns 0.
+  (func (export "output_more") (result i32)
+    (call $encode)
+  )
+)
@@ -0,0 +1,54 @@
+(module $LineCountAlloc
+  ;; Counts the lines of input of any size. Instead of a fixed input buffer,
+  ;; the host calls alloc with the exact input size and writes the input
+  ;; where it returns.
+  (memory (export "memory") 1)
+
+  ;; Next free byte; memory below 1024 holds the output and digit scratch.
+  (global $heap (mut i32) (i32.const 1024))
+  (global $input (mut i32) (i32.const 0))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 16))
+  ;; Declares UTF-8 input; with alloc a capacity of 0 means no limit.
+  (global $input_utf8_cap (export "input_utf8_cap") i32 (i32.const 0))
+
+  (func (export "alloc") (param $size i32) (result i32)
+    (local $end i32)
+    (local.set $end (i32.add (global.get $heap) (local.get $size)))
+    (if (i32.gt_u (local.get $end) (i32.mul (memory.size) (i32.const 65536)))
+      (then
+        (if (i32.eq
+              (memory.grow
+                (i32.sub
+                  (i32.shr_u (i32.add (local.get $end) (i32.const 65535)) (i32.const 16))
+                  (memory.size)))
+              (i32.const -1))
+          (then unreachable))))
+    (global.set $input (global.get $heap))
+    (global.set $heap (local.get $end))
+    (global.get $input))
+
+  (func (export "free") (param $ptr i32) (param $size i32)
+    (global.set $heap (local.get $ptr)))
+
+  (func (export "run") (param $size i32) (result i32)
+    (local $i i32)
+    (local $lines i32)
+    (local $p i32)
+    (block $done
+      (loop $next
+        (br_if $done (i32.ge_u (local.get $i) (local.get $size)))
+        (if (i32.eq (i32.load8_u (i32.add (global.get $input) (local.get $i))) (i32.const 10))
+          (then (local.set $lines (i32.add (local.get $lines) (i32.const 1)))))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $next)))
+    ;; Write the decimal digits backwards into 32..48, then move them to 0.
+    (local.set $p (i32.const 48))
+    (loop $digit
+      (local.set $p (i32.sub (local.get $p) (i32.const 1)))
+      (i32.store8 (local.get $p) (i32.add (i32.rem_u (local.get $lines) (i32.const 10)) (i32.const 48)))
+      (local.set $lines (i32.div_u (local.get $lines) (i32.const 10)))
+      (br_if $digit (i32.ne (local.get $lines) (i32.const 0))))
+    (memory.copy (i32.const 0) (local.get $p) (i32.sub (i32.const 48) (local.get $p)))
+    (i32.sub (i32.const 48) (local.get $p)))
+)
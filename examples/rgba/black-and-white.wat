@@ -1,4 +1,5 @@
 (module $BlackWhiteRGBA
+  (@custom "qip.meta" "{\"name\":\"black-and-white\",\"version\":\"1.0.0\",\"description\":\"Converts RGBA colors to grayscale.\",\"abi\":\"image\",\"uniforms\":[]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
@@ -1,4 +1,6 @@
 (module $BrightnessRGBA
+  ;; Describes the module to qip help, qip image, and qip dev.
+  (@custom "qip.meta" "{\"name\":\"brightness\",\"version\":\"1.0.0\",\"description\":\"Pushes RGBA colors toward white or black.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"brightness\",\"type\":\"f32\",\"description\":\"Positive pushes toward white, negative toward black.\",\"default\":0,\"min\":-1,\"max\":1}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
@@ -1,4 +1,5 @@
 (module $ColorHalftoneRGBA
+  (@custom "qip.meta" "{\"name\":\"color-halftone\",\"version\":\"1.0.0\",\"description\":\"Renders CMYK halftone dots.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"max_radius\",\"type\":\"f32\",\"description\":\"Largest dot radius in pixels.\",\"default\":6,\"min\":1,\"max\":24},{\"name\":\"angle_c\",\"type\":\"f32\",\"description\":\"Cyan screen angle in degrees.\",\"default\":0},{\"name\":\"angle_m\",\"type\":\"f32\",\"description\":\"Magenta screen angle in degrees.\",\"default\":0},{\"name\":\"angle_y\",\"type\":\"f32\",\"description\":\"Yellow screen angle in degrees.\",\"default\":0},{\"name\":\"angle_k\",\"type\":\"f32\",\"description\":\"Black screen angle in degrees.\",\"default\":0}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
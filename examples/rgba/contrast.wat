@@ -1,4 +1,5 @@
 (module $ContrastRGBA
+  (@custom "qip.meta" "{\"name\":\"contrast\",\"version\":\"1.0.0\",\"description\":\"Increases or reduces RGBA contrast around mid-gray.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"contrast\",\"type\":\"f32\",\"description\":\"Positive increases contrast, negative reduces it.\",\"default\":0,\"min\":-1,\"max\":1}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
@@ -1,4 +1,5 @@
 (module $CutoutRGBA
+  (@custom "qip.meta" "{\"name\":\"cutout\",\"version\":\"1.0.0\",\"description\":\"Flattens colors into levels with darkened edges, like cut paper.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"levels\",\"type\":\"f32\",\"description\":\"Color levels per channel.\",\"default\":4,\"min\":2,\"max\":16},{\"name\":\"edge_threshold\",\"type\":\"f32\",\"description\":\"Edge strength below which no outline is drawn.\",\"default\":0.25,\"min\":0,\"max\":0.99},{\"name\":\"edge_strength\",\"type\":\"f32\",\"description\":\"How dark outlines are.\",\"default\":0.7,\"min\":0,\"max\":1}]}")
   (memory (export "memory") 2)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x20000))
@@ -1,4 +1,5 @@
 (module $FindEdgesRGBA
+  (@custom "qip.meta" "{\"name\":\"find-edges\",\"version\":\"1.0.0\",\"description\":\"Draws edges as dark lines on white with a Sobel filter.\",\"abi\":\"image\",\"uniforms\":[]}")
   (memory (export "memory") 2)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x20000))
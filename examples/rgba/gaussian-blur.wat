@@ -1,4 +1,5 @@
 (module $GaussianBlurRGBA
+  (@custom "qip.meta" "{\"name\":\"gaussian-blur\",\"version\":\"1.0.0\",\"description\":\"Approximates a Gaussian blur with box blur passes.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"radius\",\"type\":\"f32\",\"description\":\"Blur radius in pixels; 0 leaves the image unchanged.\",\"default\":2,\"min\":0,\"max\":12}]}")
   (memory (export "memory") 12)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x60000))
@@ -1,4 +1,5 @@
 (module $HueRotateRGBA
+  (@custom "qip.meta" "{\"name\":\"hue-rotate\",\"version\":\"1.0.0\",\"description\":\"Rotates the hue of RGBA colors.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"hue_degrees\",\"type\":\"f32\",\"description\":\"Hue rotation in degrees, wrapped to -180 to 180.\",\"default\":0}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
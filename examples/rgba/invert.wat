@@ -1,4 +1,5 @@
 (module $InvertRGBA
+  (@custom "qip.meta" "{\"name\":\"invert\",\"version\":\"1.0.0\",\"description\":\"Inverts RGB colors, keeping alpha.\",\"abi\":\"image\",\"uniforms\":[]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
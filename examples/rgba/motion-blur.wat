@@ -1,4 +1,5 @@
 (module $MotionBlurRGBA
+  (@custom "qip.meta" "{\"name\":\"motion-blur\",\"version\":\"1.0.0\",\"description\":\"Blurs along a line at an angle.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"radius\",\"type\":\"f32\",\"description\":\"Blur radius in pixels; 0 leaves the image unchanged.\",\"default\":8,\"min\":0,\"max\":32},{\"name\":\"angle\",\"type\":\"f32\",\"description\":\"Direction of the blur in degrees.\",\"default\":0}]}")
   (memory (export "memory") 8)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x40000))
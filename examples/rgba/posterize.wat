@@ -1,4 +1,5 @@
 (module $PosterizeRGBA
+  (@custom "qip.meta" "{\"name\":\"posterize\",\"version\":\"1.0.0\",\"description\":\"Reduces each RGB channel to a number of levels.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"levels_count\",\"type\":\"i32\",\"description\":\"Levels per channel.\",\"default\":8,\"min\":2,\"max\":255}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
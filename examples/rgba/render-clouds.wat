@@ -1,4 +1,5 @@
 (module $RenderCloudsRGBA
+  (@custom "qip.meta" "{\"name\":\"render-clouds\",\"version\":\"1.0.0\",\"description\":\"Replaces the colors of the input with grayscale fractal noise clouds.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"scale\",\"type\":\"f32\",\"description\":\"Size of the largest features in pixels.\",\"default\":96,\"min\":8,\"max\":512},{\"name\":\"persistence\",\"type\":\"f32\",\"description\":\"How much each octave contributes relative to the last.\",\"default\":0.5,\"min\":0,\"max\":0.95},{\"name\":\"contrast\",\"type\":\"f32\",\"description\":\"Contrast of the result.\",\"default\":1.2,\"min\":0.1,\"max\":2.5},{\"name\":\"octaves\",\"type\":\"f32\",\"description\":\"Number of noise octaves, truncated to a whole number.\",\"default\":4,\"min\":1,\"max\":8},{\"name\":\"seed\",\"type\":\"f32\",\"description\":\"Noise seed, truncated to a whole number.\",\"default\":0}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
@@ -1,4 +1,5 @@
 (module $SaturationRGBA
+  (@custom "qip.meta" "{\"name\":\"saturation\",\"version\":\"1.0.0\",\"description\":\"Desaturates toward grayscale or boosts color saturation.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"saturation\",\"type\":\"f32\",\"description\":\"-1 is grayscale, 0 unchanged, 1 doubles saturation.\",\"default\":0,\"min\":-1,\"max\":1}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
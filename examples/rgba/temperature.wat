@@ -1,4 +1,5 @@
 (module $TemperatureRGBA
+  (@custom "qip.meta" "{\"name\":\"temperature\",\"version\":\"1.0.0\",\"description\":\"Warms or cools RGBA colors.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"temperature\",\"type\":\"f32\",\"description\":\"-1 cools, 1 warms.\",\"default\":0,\"min\":-1,\"max\":1}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
@@ -1,4 +1,5 @@
 (module $TintRGBA
+  (@custom "qip.meta" "{\"name\":\"tint\",\"version\":\"1.0.0\",\"description\":\"Shifts RGBA colors toward magenta or green.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"tint\",\"type\":\"f32\",\"description\":\"-1 adds magenta, 1 adds green.\",\"default\":0,\"min\":-1,\"max\":1}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
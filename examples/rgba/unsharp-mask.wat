@@ -1,4 +1,5 @@
 (module $UnsharpMaskRGBA
+  (@custom "qip.meta" "{\"name\":\"unsharp-mask\",\"version\":\"1.0.0\",\"description\":\"Sharpens by adding back the difference from a blurred copy.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"radius\",\"type\":\"f32\",\"description\":\"Radius in pixels of the underlying blur; 0 leaves the image unchanged.\",\"default\":2,\"min\":0,\"max\":10},{\"name\":\"amount\",\"type\":\"f32\",\"description\":\"How much of the difference to add back.\",\"default\":0.6,\"min\":0,\"max\":2},{\"name\":\"threshold\",\"type\":\"f32\",\"description\":\"Smallest difference that is sharpened.\",\"default\":0.02,\"min\":0,\"max\":1}]}")
   (memory (export "memory") 12)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x40000))
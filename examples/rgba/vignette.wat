@@ -1,4 +1,5 @@
 (module $VignetteRGBA
+  (@custom "qip.meta" "{\"name\":\"vignette\",\"version\":\"1.0.0\",\"description\":\"Darkens the corners of the image.\",\"abi\":\"image\",\"uniforms\":[{\"name\":\"amount\",\"type\":\"f32\",\"description\":\"0 is none, 1 full strength.\",\"default\":0.5,\"min\":0,\"max\":1},{\"name\":\"midpoint\",\"type\":\"f32\",\"description\":\"Distance from the center where darkening starts; 1 means no vignette.\",\"default\":0.75,\"min\":0,\"max\":1},{\"name\":\"feather\",\"type\":\"f32\",\"description\":\"0 is a hard edge, 1 very soft.\",\"default\":0.5,\"min\":0,\"max\":1}]}")
   (memory (export "memory") 1)
   (global $input_ptr (export "input_ptr") i32 (i32.const 0))
   (global $input_bytes_cap (export "input_bytes_cap") i32 (i32.const 0x10000))
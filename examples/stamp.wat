@@ -0,0 +1,53 @@
+(module $Stamp
+  ;; Prefixes the input with the run's time in Unix milliseconds and a random
+  ;; 64-bit nonce in hex, using qip_v1 host functions. Run it with
+  ;; --grant 0=log,now_unix_ms,random_fill.
+  (import "qip_v1" "log" (func $log (param i32 i32)))
+  (import "qip_v1" "now_unix_ms" (func $now_unix_ms (result i64)))
+  (import "qip_v1" "random_fill" (func $random_fill (param i32 i32)))
+  (memory (export "memory") 1)
+
+  ;; 0..8 holds the nonce, 32..56 the digits of the time.
+  (data (i32.const 64) "0123456789abcdef")
+  (data (i32.const 96) "stamped input")
+
+  (global $input_ptr (export "input_ptr") i32 (i32.const 1024))
+  (global $input_utf8_cap (export "input_utf8_cap") i32 (i32.const 4096))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 8192))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 4160))
+
+  (func (export "run") (param $size i32) (result i32)
+    (local $n i64)
+    (local $o i32)
+    (local $q i32)
+    (local $i i32)
+    (local $b i32)
+    (local.set $n (call $now_unix_ms))
+    (local.set $q (i32.const 56))
+    (loop $digit
+      (local.set $q (i32.sub (local.get $q) (i32.const 1)))
+      (i32.store8 (local.get $q)
+        (i32.add (i32.wrap_i64 (i64.rem_u (local.get $n) (i64.const 10))) (i32.const 48)))
+      (local.set $n (i64.div_u (local.get $n) (i64.const 10)))
+      (br_if $digit (i64.ne (local.get $n) (i64.const 0))))
+    (memory.copy (global.get $output_ptr) (local.get $q) (i32.sub (i32.const 56) (local.get $q)))
+    (local.set $o (i32.add (global.get $output_ptr) (i32.sub (i32.const 56) (local.get $q))))
+    (i32.store8 (local.get $o) (i32.const 32))
+    (local.set $o (i32.add (local.get $o) (i32.const 1)))
+
+    (call $random_fill (i32.const 0) (i32.const 8))
+    (loop $hex
+      (local.set $b (i32.load8_u (local.get $i)))
+      (i32.store8 (local.get $o) (i32.load8_u (i32.add (i32.const 64) (i32.shr_u (local.get $b) (i32.const 4)))))
+      (i32.store8 (i32.add (local.get $o) (i32.const 1)) (i32.load8_u (i32.add (i32.const 64) (i32.and (local.get $b) (i32.const 15)))))
+      (local.set $o (i32.add (local.get $o) (i32.const 2)))
+      (local.set $i (i32.add (local.get $i) (i32.const 1)))
+      (br_if $hex (i32.lt_u (local.get $i) (i32.const 8))))
+    (i32.store8 (local.get $o) (i32.const 32))
+    (local.set $o (i32.add (local.get $o) (i32.const 1)))
+
+    (memory.copy (local.get $o) (global.get $input_ptr) (local.get $size))
+    (local.set $o (i32.add (local.get $o) (local.get $size)))
+    (call $log (i32.const 96) (i32.const 13))
+    (i32.sub (local.get $o) (global.get $output_ptr)))
+)
@@ -0,0 +1,46 @@
+(module $TemplateFill
+  (memory (export "memory") 1)
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0))
+  (global $input_utf8_cap (export "input_utf8_cap") i32 (i32.const 0x4000))
+  (global $input_template_ptr (export "input_template_ptr") i32 (i32.const 0x4000))
+  (global $input_template_cap (export "input_template_cap") i32 (i32.const 0x4000))
+  (global $template_size (mut i32) (i32.const 0))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0x8000))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 0x8000))
+
+  ;; Declares the named input "template", bound with -i template=<path>.
+  (func $input_set_template_size (export "input_set_template_size") (param $size i32)
+    (global.set $template_size (local.get $size)))
+
+  ;; Outputs the template with every {} replaced by the primary input.
+  (func $run (export "run") (param $input_size i32) (result i32)
+    (local $i i32)
+    (local $out i32)
+    (local $c i32)
+    (block $done
+      (loop $each
+        (br_if $done (i32.ge_u (local.get $i) (global.get $template_size)))
+        (local.set $c (i32.load8_u offset=0x4000 (local.get $i)))
+        (if (i32.and
+              (i32.eq (local.get $c) (i32.const 0x7b))  ;; '{'
+              (i32.lt_u (i32.add (local.get $i) (i32.const 1)) (global.get $template_size)))
+          (then
+            (if (i32.eq (i32.load8_u offset=0x4001 (local.get $i)) (i32.const 0x7d))  ;; '}'
+              (then
+                (if (i32.gt_u (i32.add (local.get $out) (local.get $input_size)) (i32.const 0x8000))
+                  (then unreachable))
+                (memory.copy
+                  (i32.add (global.get $output_ptr) (local.get $out))
+                  (global.get $input_ptr)
+                  (local.get $input_size))
+                (local.set $out (i32.add (local.get $out) (local.get $input_size)))
+                (local.set $i (i32.add (local.get $i) (i32.const 2)))
+                (br $each)))))
+        (if (i32.ge_u (local.get $out) (i32.const 0x8000))
+          (then unreachable))
+        (i32.store8 offset=0x8000 (local.get $out) (local.get $c))
+        (local.set $out (i32.add (local.get $out) (i32.const 1)))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $each)))
+    (local.get $out))
+)
@@ -0,0 +1,50 @@
+(module $TextToSVG
+  (memory (export "memory") 1)
+  (global $input_ptr (export "input_ptr") i32 (i32.const 0))
+  (global $input_utf8_cap (export "input_utf8_cap") i32 (i32.const 0x1000))
+  (global $output_ptr (export "output_ptr") i32 (i32.const 0x1000))
+  (global $output_utf8_cap (export "output_utf8_cap") i32 (i32.const 0x8000))
+
+  ;; Declares the output's MIME type so qip dev serves it as SVG and
+  ;; qip run -o names the file .svg.
+  (global $output_content_type_ptr (export "output_content_type_ptr") i32 (i32.const 0xA300))
+  (global $output_content_type_size (export "output_content_type_size") i32 (i32.const 13))
+
+  (data (i32.const 0xA000) "<svg xmlns=\22http://www.w3.org/2000/svg\22 width=\22640\22 height=\2248\22><text x=\228\22 y=\2232\22 font-family=\22sans-serif\22 font-size=\2224\22>")
+  (data (i32.const 0xA100) "</text></svg>\n")
+  (data (i32.const 0xA200) "&lt;")
+  (data (i32.const 0xA210) "&gt;")
+  (data (i32.const 0xA220) "&amp;")
+  (data (i32.const 0xA300) "image/svg+xml")
+
+  ;; Appends size bytes from src to the output at offset out, returning the
+  ;; new offset.
+  (func $append (param $out i32) (param $src i32) (param $size i32) (result i32)
+    (memory.copy (i32.add (global.get $output_ptr) (local.get $out)) (local.get $src) (local.get $size))
+    (i32.add (local.get $out) (local.get $size)))
+
+  ;; Renders the input text as an SVG image, escaping <, >, and &.
+  (func $run (export "run") (param $input_size i32) (result i32)
+    (local $i i32)
+    (local $out i32)
+    (local $c i32)
+    (local.set $out (call $append (i32.const 0) (i32.const 0xA000) (i32.const 123)))
+    (block $done
+      (loop $each
+        (br_if $done (i32.ge_u (local.get $i) (local.get $input_size)))
+        (local.set $c (i32.load8_u (local.get $i)))
+        (if (i32.eq (local.get $c) (i32.const 0x3c))  ;; '<'
+          (then (local.set $out (call $append (local.get $out) (i32.const 0xA200) (i32.const 4))))
+          (else
+            (if (i32.eq (local.get $c) (i32.const 0x3e))  ;; '>'
+              (then (local.set $out (call $append (local.get $out) (i32.const 0xA210) (i32.const 4))))
+              (else
+                (if (i32.eq (local.get $c) (i32.const 0x26))  ;; '&'
+                  (then (local.set $out (call $append (local.get $out) (i32.const 0xA220) (i32.const 5))))
+                  (else
+                    (i32.store8 offset=0x1000 (local.get $out) (local.get $c))
+                    (local.set $out (i32.add (local.get $out) (i32.const 1)))))))))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $each)))
+    (call $append (local.get $out) (i32.const 0xA100) (i32.const 14)))
+)
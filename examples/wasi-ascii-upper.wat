@@ -0,0 +1,53 @@
+(module $WASIAsciiUpper
+  ;; A WASI command: copies stdin to stdout with ASCII letters uppercased.
+  ;; Non-ASCII input is reported on stderr with exit code 1.
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (param i32)))
+  (memory (export "memory") 1)
+
+  ;; 0..8 holds one iovec, 8 the count read or written, and 1024 the buffer.
+  (data (i32.const 16) "Input is not ASCII\n")
+
+  (func $write (param $fd i32) (param $ptr i32) (param $len i32)
+    (block $done
+      (loop $more
+        (br_if $done (i32.eqz (local.get $len)))
+        (i32.store (i32.const 0) (local.get $ptr))
+        (i32.store (i32.const 4) (local.get $len))
+        (if (call $fd_write (local.get $fd) (i32.const 0) (i32.const 1) (i32.const 8))
+          (then (call $proc_exit (i32.const 2))))
+        (local.set $ptr (i32.add (local.get $ptr) (i32.load (i32.const 8))))
+        (local.set $len (i32.sub (local.get $len) (i32.load (i32.const 8))))
+        (br $more))))
+
+  (func (export "_start")
+    (local $n i32)
+    (local $i i32)
+    (local $b i32)
+    (loop $read
+      (i32.store (i32.const 0) (i32.const 1024))
+      (i32.store (i32.const 4) (i32.const 4096))
+      (if (call $fd_read (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 8))
+        (then (call $proc_exit (i32.const 2))))
+      (local.set $n (i32.load (i32.const 8)))
+      (if (i32.eqz (local.get $n))
+        (then (return)))
+      (local.set $i (i32.const 0))
+      (block $done
+        (loop $byte
+          (br_if $done (i32.ge_u (local.get $i) (local.get $n)))
+          (local.set $b (i32.load8_u (i32.add (i32.const 1024) (local.get $i))))
+          (if (i32.ge_u (local.get $b) (i32.const 128))
+            (then
+              (call $write (i32.const 2) (i32.const 16) (i32.const 19))
+              (call $proc_exit (i32.const 1))))
+          (if (i32.lt_u (i32.sub (local.get $b) (i32.const 97)) (i32.const 26))
+            (then
+              (i32.store8 (i32.add (i32.const 1024) (local.get $i))
+                (i32.sub (local.get $b) (i32.const 32)))))
+          (local.set $i (i32.add (local.get $i) (i32.const 1)))
+          (br $byte)))
+      (call $write (i32.const 1) (i32.const 1024) (local.get $n))
+      (br $read)))
+)
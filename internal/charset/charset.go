@@ -0,0 +1,153 @@
+// Package charset transcodes text input in other character sets to UTF-8
+// before it reaches a module.
+package charset
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Charset names a character set that input can be transcoded from.
+type Charset string
+
+const (
+	// UTF8 leaves input unchanged.
+	UTF8 Charset = "utf-8"
+	// UTF16 is UTF-16 starting with a byte order mark, which picks big or
+	// little endian.
+	UTF16 Charset = "utf-16"
+	// Latin1 is ISO-8859-1, where each byte is the code point of the same
+	// value.
+	Latin1 Charset = "latin1"
+)
+
+// ErrInvalid is wrapped by errors for input that is not valid in its
+// charset.
+var ErrInvalid = errors.New("Invalid input")
+
+// Parse reads a charset name, ignoring case. The empty name is UTF-8.
+func Parse(name string) (Charset, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return UTF8, nil
+	case "utf-16", "utf16":
+		return UTF16, nil
+	case "latin1", "latin-1", "iso-8859-1":
+		return Latin1, nil
+	}
+	return "", fmt.Errorf("Unknown input charset %q (want utf-8, utf-16, or latin1)", name)
+}
+
+// NewReader returns a reader of r's text transcoded from c to UTF-8.
+func NewReader(r io.Reader, c Charset) io.Reader {
+	switch c {
+	case UTF16:
+		return &reader{src: bufio.NewReader(r), decode: decodeUTF16}
+	case Latin1:
+		return &reader{src: bufio.NewReader(r), decode: decodeLatin1}
+	}
+	return r
+}
+
+// Decode transcodes data from c to UTF-8.
+func Decode(data []byte, c Charset) ([]byte, error) {
+	if c == UTF8 || c == "" {
+		return data, nil
+	}
+	return io.ReadAll(NewReader(bytes.NewReader(data), c))
+}
+
+type reader struct {
+	src    *bufio.Reader
+	decode func(r *reader) (rune, error)
+	// offset counts the bytes consumed from src, for error messages.
+	offset int
+	// bigEndian is set from a UTF-16 byte order mark once read.
+	bigEndian *bool
+	out       []byte
+	err       error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.out) < len(p) && r.err == nil {
+		c, err := r.decode(r)
+		if err != nil {
+			r.err = err
+			break
+		}
+		r.out = utf8.AppendRune(r.out, c)
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	if n == 0 && r.err != nil {
+		return 0, r.err
+	}
+	return n, nil
+}
+
+func decodeLatin1(r *reader) (rune, error) {
+	b, err := r.src.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.offset++
+	return rune(b), nil
+}
+
+func decodeUTF16(r *reader) (rune, error) {
+	if r.bigEndian == nil {
+		unit, err := r.unit(true)
+		if err != nil {
+			return 0, err
+		}
+		var bigEndian bool
+		switch unit {
+		case 0xFEFF:
+			bigEndian = true
+		case 0xFFFE:
+			bigEndian = false
+		default:
+			return 0, fmt.Errorf("%w: UTF-16 input must start with a byte order mark", ErrInvalid)
+		}
+		r.bigEndian = &bigEndian
+	}
+	start := r.offset
+	unit, err := r.unit(*r.bigEndian)
+	if err != nil {
+		return 0, err
+	}
+	if !utf16.IsSurrogate(rune(unit)) {
+		return rune(unit), nil
+	}
+	low, err := r.unit(*r.bigEndian)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if c := utf16.DecodeRune(rune(unit), rune(low)); err == nil && c != utf8.RuneError {
+		return c, nil
+	}
+	return 0, fmt.Errorf("%w: unpaired UTF-16 surrogate at byte %d", ErrInvalid, start)
+}
+
+// unit reads one UTF-16 code unit.
+func (r *reader) unit(bigEndian bool) (uint16, error) {
+	hi, err := r.src.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	lo, err := r.src.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: UTF-16 input has an odd number of bytes", ErrInvalid)
+	}
+	r.offset += 2
+	if !bigEndian {
+		hi, lo = lo, hi
+	}
+	return uint16(hi)<<8 | uint16(lo), nil
+}
@@ -0,0 +1,56 @@
+package charset
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecode(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		charset Charset
+		input   []byte
+		want    string
+	}{
+		{name: "utf-8 unchanged", charset: UTF8, input: []byte("café"), want: "café"},
+		{name: "latin1", charset: Latin1, input: []byte("caf\xe9 \xbd"), want: "café ½"},
+		{name: "utf-16le", charset: UTF16, input: []byte("\xff\xfeh\x00\xe9\x00=\xd8\x00\xde"), want: "hé😀"},
+		{name: "utf-16be", charset: UTF16, input: []byte("\xfe\xff\x00h\x00\xe9\xd8=\xde\x00"), want: "hé😀"},
+		{name: "utf-16 empty", charset: UTF16, input: nil, want: ""},
+	} {
+		got, err := Decode(tt.input, tt.charset)
+		if err != nil || string(got) != tt.want {
+			t.Fatalf("%s: Decode=%q err=%v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeRejectsInvalidUTF16(t *testing.T) {
+	for name, input := range map[string][]byte{
+		"no byte order mark": []byte("h\x00i\x00"),
+		"odd length":         []byte("\xff\xfeh\x00i"),
+		"unpaired surrogate": []byte("\xff\xfe=\xd8h\x00"),
+		"truncated pair":     []byte("\xff\xfe=\xd8"),
+	} {
+		if _, err := Decode(input, UTF16); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("%s: err=%v, want ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestReaderHandlesShortReads(t *testing.T) {
+	input := bytes.Repeat([]byte("\xe9t\xe9 "), 1000)
+	got, err := io.ReadAll(iotest.OneByteReader(NewReader(iotest.HalfReader(bytes.NewReader(input)), Latin1)))
+	if err != nil {
+		t.Fatalf("ReadAll error: %v", err)
+	}
+	if want := bytes.Repeat([]byte("été "), 1000); !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+	if _, err := Parse("EBCDIC"); err == nil {
+		t.Fatal("expected error for unknown charset")
+	}
+}
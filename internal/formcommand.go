@@ -3,22 +3,21 @@ package qinternal
 import (
 	"bufio"
 	"context"
-	"crypto/sha256"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"strings"
 	"unicode/utf8"
 
+	"github.com/royalicing/qip/internal/modulesource"
 	"github.com/royalicing/qip/internal/wasmruntime"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 )
 
-const usageForm = "Usage: qip form [-v|--verbose] <wasm module URL or file>"
+const usageForm = "Usage: qip form [-v|--verbose] [--offline] [--locked] <wasm module URL or file>"
 
 const (
 	exportMemory           = "memory"
@@ -57,9 +56,14 @@ func RunFormCommand(args []string) error {
 	var verbose bool
 	fs.BoolVar(&verbose, "v", false, "enable verbose logging")
 	fs.BoolVar(&verbose, "verbose", false, "enable verbose logging")
+	sourceFlags := modulesource.RegisterFlags(fs)
 	if err := fs.Parse(args); err != nil {
 		return fmt.Errorf("%s %w", usageForm, err)
 	}
+	resolver, err := sourceFlags.Resolver()
+	if err != nil {
+		return err
+	}
 
 	rest := fs.Args()
 	if len(rest) != 1 {
@@ -67,7 +71,7 @@ func RunFormCommand(args []string) error {
 	}
 	modulePath := rest[0]
 
-	body, err := readFormModulePath(modulePath, verbose)
+	body, err := readFormModulePath(resolver, modulePath, verbose)
 	if err != nil {
 		return err
 	}
@@ -96,30 +100,15 @@ func RunFormCommand(args []string) error {
 	return runFormInteractive(ctx, fm, os.Stdin, os.Stdout)
 }
 
-func readFormModulePath(path string, verbose bool) ([]byte, error) {
-	var body []byte
-	if strings.HasPrefix(path, "https://") {
-		resp, err := http.Get(path)
-		if err != nil {
-			return nil, fmt.Errorf("Error fetching URL: %v", err)
-		}
-		defer resp.Body.Close()
-		body, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("Error reading response: %v", err)
-		}
-	} else {
-		var err error
-		body, err = os.ReadFile(path)
-		if err != nil {
-			return nil, fmt.Errorf("Error reading file: %v", err)
-		}
+func readFormModulePath(resolver *modulesource.Resolver, path string, verbose bool) ([]byte, error) {
+	module, err := resolver.Resolve(context.Background(), path)
+	if err != nil {
+		return nil, err
 	}
 	if verbose {
-		sum := sha256.Sum256(body)
-		fmt.Fprintf(os.Stderr, "module sha256: %x\n", sum)
+		fmt.Fprintf(os.Stderr, "module sha256: %s\n", module.SHA256)
 	}
-	return body, nil
+	return module.Body, nil
 }
 
 func resolveFormModule(mod api.Module) (formModule, error) {
@@ -0,0 +1,171 @@
+// Package hostmodule provides qip_v1, the host module whose functions give
+// modules capabilities they cannot have on their own: logging, the time,
+// and random bytes. A module may only import a function it was granted.
+package hostmodule
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ModuleName is the import module of version 1 of the host functions. A
+// later version with different functions would get a new name.
+const ModuleName = "qip_v1"
+
+// Capability names one host function that a module can be granted.
+type Capability string
+
+const (
+	// Log is log(ptr, len), which logs the UTF-8 message at ptr.
+	Log Capability = "log"
+	// NowUnixMS is now_unix_ms() -> i64, the time the run started in
+	// milliseconds since the Unix epoch. It does not advance during a run.
+	NowUnixMS Capability = "now_unix_ms"
+	// RandomFill is random_fill(ptr, len), which fills len bytes at ptr
+	// from a stream seeded by the run's seed, the stage's index, and the
+	// record or file being run.
+	RandomFill Capability = "random_fill"
+)
+
+// Capabilities lists every capability, in the order they are documented.
+var Capabilities = []Capability{Log, NowUnixMS, RandomFill}
+
+// ParseCapabilities reads a comma-separated list of capabilities.
+func ParseCapabilities(list string) ([]Capability, error) {
+	var capabilities []Capability
+	for name := range strings.SplitSeq(list, ",") {
+		c := Capability(strings.TrimSpace(name))
+		if !slices.Contains(Capabilities, c) {
+			return nil, fmt.Errorf("Unknown capability %q (want log, now_unix_ms, or random_fill)", name)
+		}
+		if !slices.Contains(capabilities, c) {
+			capabilities = append(capabilities, c)
+		}
+	}
+	return capabilities, nil
+}
+
+// Imports returns the names compiled imports from ModuleName, sorted. They
+// may include names that are not capabilities.
+func Imports(compiled wazero.CompiledModule) []Capability {
+	var imports []Capability
+	for _, fn := range compiled.ImportedFunctions() {
+		if module, name, _ := fn.Import(); module == ModuleName && !slices.Contains(imports, Capability(name)) {
+			imports = append(imports, Capability(name))
+		}
+	}
+	slices.Sort(imports)
+	return imports
+}
+
+// CheckGrants returns an error for the first function compiled imports from
+// ModuleName that is not in granted.
+func CheckGrants(compiled wazero.CompiledModule, granted []Capability) error {
+	for _, c := range Imports(compiled) {
+		if !slices.Contains(Capabilities, c) {
+			return fmt.Errorf("Wasm module imports %s.%s, which does not exist", ModuleName, c)
+		}
+		if !slices.Contains(granted, c) {
+			return fmt.Errorf("Wasm module imports %s.%s but was not granted %s", ModuleName, c, c)
+		}
+	}
+	return nil
+}
+
+// Instantiate makes the host functions available to modules in runtime. It
+// does nothing if they already are.
+func Instantiate(ctx context.Context, runtime wazero.Runtime) error {
+	if runtime.Module(ModuleName) != nil {
+		return nil
+	}
+	_, err := runtime.NewHostModuleBuilder(ModuleName).
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(logMessage), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, nil).
+		WithParameterNames("ptr", "len").
+		Export(string(Log)).
+		NewFunctionBuilder().
+		WithGoFunction(api.GoFunc(nowUnixMS), nil, []api.ValueType{api.ValueTypeI64}).
+		Export(string(NowUnixMS)).
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(randomFill), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, nil).
+		WithParameterNames("ptr", "len").
+		Export(string(RandomFill)).
+		Instantiate(ctx)
+	return err
+}
+
+// Stage is what the host functions see while one stage runs.
+type Stage struct {
+	// Index is the stage's position in its chain, which keeps each stage's
+	// random stream apart.
+	Index int
+	// NowUnixMS is returned by now_unix_ms.
+	NowUnixMS int64
+	// Seed seeds random_fill.
+	Seed uint64
+	// Record numbers the input a chain is running, such as a --split
+	// record or a batch file, so each gets its own random stream. A single
+	// input is record 0.
+	Record uint64
+	// Log receives each message passed to log.
+	Log func(message string)
+}
+
+type stageState struct {
+	Stage
+	random *rand.ChaCha8
+}
+
+type stageKey struct{}
+
+// WithStage returns a context for calls into a stage's module, so its host
+// functions use stage. Each call of WithStage starts a new random stream,
+// so a stage run twice with the same seed gets the same bytes.
+func WithStage(ctx context.Context, stage Stage) context.Context {
+	var seed [32]byte
+	binary.LittleEndian.PutUint64(seed[0:], stage.Seed)
+	binary.LittleEndian.PutUint64(seed[8:], uint64(stage.Index))
+	binary.LittleEndian.PutUint64(seed[16:], stage.Record)
+	return context.WithValue(ctx, stageKey{}, &stageState{Stage: stage, random: rand.NewChaCha8(seed)})
+}
+
+func stageFrom(ctx context.Context, name Capability) *stageState {
+	state, ok := ctx.Value(stageKey{}).(*stageState)
+	if !ok {
+		panic(fmt.Errorf("%s.%s was called outside a qip stage", ModuleName, name))
+	}
+	return state
+}
+
+func memoryRange(mod api.Module, name Capability, ptr, size uint32) []byte {
+	buf, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		panic(fmt.Errorf("%s.%s: %d bytes at %d are outside memory", ModuleName, name, size, ptr))
+	}
+	return buf
+}
+
+func logMessage(ctx context.Context, mod api.Module, stack []uint64) {
+	state := stageFrom(ctx, Log)
+	message := memoryRange(mod, Log, api.DecodeU32(stack[0]), api.DecodeU32(stack[1]))
+	if state.Log != nil {
+		state.Log(strings.TrimRight(strings.ToValidUTF8(string(message), "�"), "\n"))
+	}
+}
+
+func nowUnixMS(ctx context.Context, stack []uint64) {
+	stack[0] = api.EncodeI64(stageFrom(ctx, NowUnixMS).NowUnixMS)
+}
+
+func randomFill(ctx context.Context, mod api.Module, stack []uint64) {
+	state := stageFrom(ctx, RandomFill)
+	buf := memoryRange(mod, RandomFill, api.DecodeU32(stack[0]), api.DecodeU32(stack[1]))
+	_, _ = state.random.Read(buf)
+}
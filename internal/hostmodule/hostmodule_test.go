@@ -0,0 +1,21 @@
+package hostmodule
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	got, err := ParseCapabilities("random_fill, log,random_fill")
+	if err != nil {
+		t.Fatalf("ParseCapabilities error: %v", err)
+	}
+	if want := []Capability{RandomFill, Log}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, list := range []string{"", "clock", "log,"} {
+		if _, err := ParseCapabilities(list); err == nil {
+			t.Fatalf("ParseCapabilities(%q) succeeded, want error", list)
+		}
+	}
+}
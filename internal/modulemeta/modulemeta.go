@@ -0,0 +1,210 @@
+// Package modulemeta reads the qip.meta custom section, in which a module
+// describes itself: what it does, what it takes and returns, and the
+// uniforms it accepts.
+package modulemeta
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// SectionName is the name of the custom section holding a module's Meta as
+// JSON.
+const SectionName = "qip.meta"
+
+// ABIs lists the module contracts a Meta can declare.
+var ABIs = []string{"run", "chunked", "image", "wasi", "form", "router"}
+
+// UniformTypes lists the value types a uniform can have, matching the
+// parameter of its uniform_set_<name> export.
+var UniformTypes = []string{"i32", "i64", "f32", "f64"}
+
+// ErrInvalidUniform is wrapped by errors for uniform values a module's Meta
+// does not allow.
+var ErrInvalidUniform = errors.New("Invalid uniform")
+
+// Meta describes a module. Every field is optional.
+type Meta struct {
+	Name        string `json:"name,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Description string `json:"description,omitempty"`
+	// ABI is the contract the module follows, one of ABIs.
+	ABI string `json:"abi,omitempty"`
+	// Input and Output are the media types the module takes and returns,
+	// like "text/markdown" or "image/svg+xml".
+	Input  string `json:"input,omitempty"`
+	Output string `json:"output,omitempty"`
+	// Uniforms lists every uniform the module takes, in the order to show
+	// them. When it is nil, the module's uniforms are undeclared and any
+	// value is passed through.
+	Uniforms []Uniform `json:"uniforms,omitempty"`
+}
+
+// Uniform describes one uniform_set_<name> export.
+type Uniform struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Default     *float64 `json:"default,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+}
+
+// Parse reads and checks a qip.meta section. Unknown fields are ignored,
+// so older hosts can read sections written for newer ones.
+func Parse(data []byte) (*Meta, error) {
+	var meta Meta
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("Invalid %s section: %w", SectionName, err)
+	}
+	if err := meta.check(); err != nil {
+		return nil, fmt.Errorf("Invalid %s section: %w", SectionName, err)
+	}
+	return &meta, nil
+}
+
+func (meta *Meta) check() error {
+	if meta.ABI != "" && !slices.Contains(ABIs, meta.ABI) {
+		return fmt.Errorf("unknown abi %q (want %s)", meta.ABI, strings.Join(ABIs, ", "))
+	}
+	for _, mediaType := range []string{meta.Input, meta.Output} {
+		if mediaType == "" {
+			continue
+		}
+		if _, _, err := mime.ParseMediaType(mediaType); err != nil {
+			return fmt.Errorf("invalid media type %q", mediaType)
+		}
+	}
+	seen := make(map[string]bool, len(meta.Uniforms))
+	for _, u := range meta.Uniforms {
+		if u.Name == "" {
+			return errors.New("uniform without a name")
+		}
+		if seen[u.Name] {
+			return fmt.Errorf("uniform %q listed twice", u.Name)
+		}
+		seen[u.Name] = true
+		if !slices.Contains(UniformTypes, u.Type) {
+			return fmt.Errorf("uniform %q has type %q (want %s)", u.Name, u.Type, strings.Join(UniformTypes, ", "))
+		}
+		if u.Min != nil && u.Max != nil && *u.Min > *u.Max {
+			return fmt.Errorf("uniform %q has min above max", u.Name)
+		}
+		if u.Default != nil {
+			if err := u.check(*u.Default); err != nil {
+				return fmt.Errorf("default of %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// FromCompiled returns the Meta in compiled's qip.meta section, or nil if it
+// has none. The runtime must keep custom sections.
+func FromCompiled(compiled wazero.CompiledModule) (*Meta, error) {
+	for _, section := range compiled.CustomSections() {
+		if section.Name() == SectionName {
+			return Parse(section.Data())
+		}
+	}
+	return nil, nil
+}
+
+// Uniform returns the declared uniform called name.
+func (meta *Meta) Uniform(name string) (Uniform, bool) {
+	i := slices.IndexFunc(meta.Uniforms, func(u Uniform) bool { return u.Name == name })
+	if i < 0 {
+		return Uniform{}, false
+	}
+	return meta.Uniforms[i], true
+}
+
+// CheckUniforms returns an error wrapping ErrInvalidUniform for the first
+// value in uniforms that the module does not declare, that does not parse
+// as its type, or that is outside its range. Modules that do not declare
+// their uniforms accept anything here.
+func (meta *Meta) CheckUniforms(uniforms map[string]string) error {
+	if meta == nil || meta.Uniforms == nil {
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(uniforms)) {
+		u, ok := meta.Uniform(name)
+		if !ok {
+			names := make([]string, len(meta.Uniforms))
+			for i, u := range meta.Uniforms {
+				names[i] = u.Name
+			}
+			return fmt.Errorf("%w: module has no uniform %q; it takes %s", ErrInvalidUniform, name, strings.Join(names, ", "))
+		}
+		value, err := u.Parse(uniforms[name])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidUniform, err)
+		}
+		if err := u.check(value); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidUniform, err)
+		}
+	}
+	return nil
+}
+
+// Parse reads raw as a value of the uniform's type.
+func (u Uniform) Parse(raw string) (float64, error) {
+	switch u.Type {
+	case "i32":
+		v, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("uniform %q must be an i32, got %q", u.Name, raw)
+		}
+		return float64(v), nil
+	case "i64":
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("uniform %q must be an i64, got %q", u.Name, raw)
+		}
+		return float64(v), nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, fmt.Errorf("uniform %q must be an %s, got %q", u.Name, u.Type, raw)
+	}
+	return v, nil
+}
+
+func (u Uniform) check(value float64) error {
+	if (u.Type == "i32" || u.Type == "i64") && value != math.Trunc(value) {
+		return fmt.Errorf("uniform %q must be a whole number, got %s", u.Name, FormatNumber(value))
+	}
+	if (u.Min != nil && value < *u.Min) || (u.Max != nil && value > *u.Max) {
+		return fmt.Errorf("uniform %q is %s; it must be %s", u.Name, FormatNumber(value), u.Range())
+	}
+	return nil
+}
+
+// Range describes the uniform's allowed values, like "between -1 and 1" or
+// "at least 0", or is empty when any value is allowed.
+func (u Uniform) Range() string {
+	switch {
+	case u.Min != nil && u.Max != nil:
+		return "between " + FormatNumber(*u.Min) + " and " + FormatNumber(*u.Max)
+	case u.Min != nil:
+		return "at least " + FormatNumber(*u.Min)
+	case u.Max != nil:
+		return "at most " + FormatNumber(*u.Max)
+	}
+	return ""
+}
+
+// FormatNumber formats a uniform value as briefly as possible.
+func FormatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
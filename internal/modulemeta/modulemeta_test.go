@@ -0,0 +1,55 @@
+package modulemeta
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	meta, err := Parse([]byte(`{"name":"levels","abi":"image","future":true,"uniforms":[{"name":"count","type":"i32","default":4,"min":2,"max":16}]}`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if u, ok := meta.Uniform("count"); !ok || u.Range() != "between 2 and 16" {
+		t.Fatalf("count uniform = %+v, %v", u, ok)
+	}
+	for _, data := range []string{
+		`{"abi":"sideways"}`,
+		`{"input":"not a type/"}`,
+		`{"uniforms":[{"name":"x","type":"u8"}]}`,
+		`{"uniforms":[{"name":"x","type":"f32"},{"name":"x","type":"f32"}]}`,
+		`{"uniforms":[{"name":"x","type":"f32","min":1,"max":0}]}`,
+		`{"uniforms":[{"name":"x","type":"f32","default":2,"max":1}]}`,
+		`[`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Fatalf("Parse(%s) succeeded, want error", data)
+		}
+	}
+}
+
+func TestCheckUniforms(t *testing.T) {
+	meta, err := Parse([]byte(`{"uniforms":[{"name":"count","type":"i32","min":2,"max":16},{"name":"amount","type":"f32","min":0}]}`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if err := meta.CheckUniforms(map[string]string{"count": "8", "amount": "0.5"}); err != nil {
+		t.Fatalf("CheckUniforms error: %v", err)
+	}
+	for _, uniforms := range []map[string]string{
+		{"count": "1"},
+		{"count": "2.5"},
+		{"count": "many"},
+		{"amount": "-0.1"},
+		{"size": "3"},
+	} {
+		if err := meta.CheckUniforms(uniforms); !errors.Is(err, ErrInvalidUniform) {
+			t.Fatalf("CheckUniforms(%v) = %v, want ErrInvalidUniform", uniforms, err)
+		}
+	}
+
+	var undeclared *Meta
+	if err := undeclared.CheckUniforms(map[string]string{"anything": "x"}); err != nil {
+		t.Fatalf("CheckUniforms without meta = %v, want nil", err)
+	}
+}
@@ -0,0 +1,265 @@
+package modulesource
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	ErrOffline      = errors.New("module is not cached and --offline is set")
+	ErrCacheCorrupt = errors.New("cached module is corrupt")
+)
+
+// CacheDirEnv overrides the cache directory.
+const CacheDirEnv = "QIP_CACHE_DIR"
+
+const cacheIndexVersion = 1
+
+// Cache stores fetched modules under dir/sha256/<hex>, with an index mapping
+// each URL to the digest last fetched from it.
+type Cache struct {
+	dir string
+}
+
+// CacheEntry is the index record for one URL.
+type CacheEntry struct {
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+type cacheIndex struct {
+	Version int                   `json:"version"`
+	Modules map[string]CacheEntry `json:"modules"`
+}
+
+// DefaultCacheDir returns $QIP_CACHE_DIR, or qip under the user cache
+// directory.
+func DefaultCacheDir() (string, error) {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("Error finding cache directory (set %s): %w", CacheDirEnv, err)
+	}
+	return filepath.Join(base, "qip"), nil
+}
+
+// OpenCache returns a cache rooted at dir. The directory is created on the
+// first store.
+func OpenCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// Dir returns the cache's root directory.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.dir, "sha256", digest)
+}
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.dir, "index.json")
+}
+
+// Lookup returns the digest last fetched from location.
+func (c *Cache) Lookup(location string) (CacheEntry, bool, error) {
+	index, err := c.readIndex()
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	entry, ok := index.Modules[location]
+	return entry, ok, nil
+}
+
+// Read returns the cached module with the given digest, verifying its bytes.
+// A missing blob is reported with an error wrapping fs.ErrNotExist.
+func (c *Cache) Read(digest string) ([]byte, error) {
+	body, err := os.ReadFile(c.blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("%w: %s", ErrCacheCorrupt, c.blobPath(digest))
+	}
+	return body, nil
+}
+
+// Store saves body under its digest and records it as the latest fetch of
+// location.
+func (c *Cache) Store(location string, body []byte, digest string) error {
+	if err := os.MkdirAll(filepath.Join(c.dir, "sha256"), 0o755); err != nil {
+		return fmt.Errorf("Error creating cache directory: %w", err)
+	}
+	return c.updateIndex(func(index *cacheIndex) error {
+		if err := writeFileAtomic(c.blobPath(digest), body); err != nil {
+			return err
+		}
+		index.Modules[location] = CacheEntry{SHA256: digest, Size: int64(len(body)), FetchedAt: time.Now().UTC()}
+		return nil
+	})
+}
+
+// CachedModule is a cached URL and its index entry, as listed by Entries.
+type CachedModule struct {
+	Location string
+	CacheEntry
+}
+
+// Entries lists the cached URLs sorted by location.
+func (c *Cache) Entries() ([]CachedModule, error) {
+	index, err := c.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]CachedModule, 0, len(index.Modules))
+	for location, entry := range index.Modules {
+		entries = append(entries, CachedModule{Location: location, CacheEntry: entry})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Location < entries[j].Location
+	})
+	return entries, nil
+}
+
+// GC drops index entries whose blob is missing or, when maxAge is nonzero,
+// that were fetched more than maxAge ago. It then deletes blobs no entry
+// refers to and returns how many it removed.
+func (c *Cache) GC(maxAge time.Duration) (int, error) {
+	now := time.Now()
+	removed := 0
+	err := c.updateIndex(func(index *cacheIndex) error {
+		referenced := make(map[string]bool, len(index.Modules))
+		for location, entry := range index.Modules {
+			expired := maxAge > 0 && now.Sub(entry.FetchedAt) > maxAge
+			if _, err := os.Stat(c.blobPath(entry.SHA256)); expired || err != nil {
+				delete(index.Modules, location)
+			} else {
+				referenced[entry.SHA256] = true
+			}
+		}
+
+		blobs, err := os.ReadDir(filepath.Join(c.dir, "sha256"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading cache: %w", err)
+		}
+		for _, blob := range blobs {
+			if referenced[blob.Name()] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(c.dir, "sha256", blob.Name())); err != nil {
+				return fmt.Errorf("Error removing cached module: %w", err)
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Verify rehashes every cached blob and returns the paths of those whose
+// bytes no longer match their name.
+func (c *Cache) Verify() ([]string, error) {
+	blobs, err := os.ReadDir(filepath.Join(c.dir, "sha256"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading cache: %w", err)
+	}
+	var corrupt []string
+	for _, blob := range blobs {
+		if _, err := c.Read(blob.Name()); errors.Is(err, ErrCacheCorrupt) {
+			corrupt = append(corrupt, c.blobPath(blob.Name()))
+		} else if err != nil {
+			return corrupt, fmt.Errorf("Error reading cached module: %w", err)
+		}
+	}
+	return corrupt, nil
+}
+
+func (c *Cache) readIndex() (*cacheIndex, error) {
+	index := &cacheIndex{Version: cacheIndexVersion, Modules: map[string]CacheEntry{}}
+	data, err := os.ReadFile(c.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading cache index: %w", err)
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(index); err != nil {
+		return nil, fmt.Errorf("Invalid cache index %s: %v", c.indexPath(), err)
+	}
+	if index.Modules == nil {
+		index.Modules = map[string]CacheEntry{}
+	}
+	return index, nil
+}
+
+// updateIndex applies change to the index while holding the cache's lock,
+// so qip processes sharing the cache do not drop each other's entries or
+// collect blobs another has yet to index. The index is only written if
+// change succeeds.
+func (c *Cache) updateIndex(change func(*cacheIndex) error) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return fmt.Errorf("Error creating cache directory: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(c.dir, "index.lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error locking cache index: %w", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("Error locking cache index: %w", err)
+	}
+	defer unlockFile(lock)
+
+	index, err := c.readIndex()
+	if err != nil {
+		return err
+	}
+	if err := change(index); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.indexPath(), append(data, '\n'))
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it
+// into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("Error writing %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Error writing %s: %w", path, err)
+	}
+	return nil
+}
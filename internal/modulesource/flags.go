@@ -0,0 +1,53 @@
+package modulesource
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Flags are the module source options shared by every qip command that
+// loads modules.
+type Flags struct {
+	LockPath string
+	Locked   bool
+	Offline  bool
+	Refresh  bool
+}
+
+// RegisterFlags adds --lock-file, --locked, --offline and --refresh to fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.LockPath, "lock-file", DefaultLockfile, "lockfile pinning remote module digests")
+	fs.BoolVar(&f.Locked, "locked", false, "require every remote module to be pinned in the lockfile")
+	fs.BoolVar(&f.Offline, "offline", false, "use only cached remote modules; never fetch")
+	fs.BoolVar(&f.Refresh, "refresh", false, "fetch unpinned remote modules again instead of using cached copies")
+	return f
+}
+
+// Resolver returns the resolver for the parsed flags, backed by the default
+// module cache. Digests recorded in the lockfile are always enforced when it
+// exists; --locked also requires an entry for every remote module.
+func (f *Flags) Resolver() (*Resolver, error) {
+	if f.Offline && f.Refresh {
+		return nil, errors.New("--offline and --refresh cannot be used together")
+	}
+	lock, err := ReadLockfile(f.LockPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if f.Locked {
+			return nil, fmt.Errorf("--locked requires %s (run qip lock to create it)", f.LockPath)
+		}
+		lock = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cache *Cache
+	if dir, err := DefaultCacheDir(); err == nil {
+		cache = OpenCache(dir)
+	} else if f.Offline {
+		return nil, err
+	}
+	return &Resolver{Lock: lock, Locked: f.Locked, Cache: cache, Offline: f.Offline, Refresh: f.Refresh}, nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package modulesource
+
+import "os"
+
+// lockFile does nothing where flock is unavailable. Index writes are still
+// atomic renames, so readers never see a torn index, but concurrent stores
+// may drop each other's entries.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
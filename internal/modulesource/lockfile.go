@@ -0,0 +1,67 @@
+package modulesource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DefaultLockfile is the lockfile name qip looks for in the working directory.
+const DefaultLockfile = "qip.lock"
+
+const lockfileVersion = 1
+
+// Lockfile records the sha256 of every remote module a pipeline resolved,
+// keyed by URL without its fragment.
+type Lockfile struct {
+	Version int                  `json:"version"`
+	Modules map[string]LockEntry `json:"modules"`
+}
+
+type LockEntry struct {
+	SHA256 string `json:"sha256"`
+}
+
+// NewLockfile returns an empty lockfile.
+func NewLockfile() *Lockfile {
+	return &Lockfile{Version: lockfileVersion, Modules: map[string]LockEntry{}}
+}
+
+// ReadLockfile reads and validates the lockfile at path. A missing file is
+// reported with an error wrapping fs.ErrNotExist.
+func ReadLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lock := NewLockfile()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(lock); err != nil {
+		return nil, fmt.Errorf("Invalid lockfile %s: %v", path, err)
+	}
+	if lock.Version != lockfileVersion {
+		return nil, fmt.Errorf("Invalid lockfile %s: unsupported version %d", path, lock.Version)
+	}
+	for location, entry := range lock.Modules {
+		if !ValidDigest(entry.SHA256) {
+			return nil, fmt.Errorf("Invalid lockfile %s: %s: %q is not a lowercase hex sha256", path, location, entry.SHA256)
+		}
+	}
+	return lock, nil
+}
+
+// Set records the digest for a remote module location.
+func (lock *Lockfile) Set(location string, sha256 string) {
+	lock.Modules[location] = LockEntry{SHA256: sha256}
+}
+
+// Write saves the lockfile to path, replacing any existing file atomically.
+func (lock *Lockfile) Write(path string) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
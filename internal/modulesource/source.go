@@ -0,0 +1,244 @@
+// Package modulesource resolves wasm module locations (file paths and https
+// URLs) to module bytes, enforcing sha256 pins from URL fragments and
+// lockfiles.
+package modulesource
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	ErrInvalidPin     = errors.New("invalid sha256 pin")
+	ErrDigestMismatch = errors.New("module sha256 mismatch")
+	ErrNotLocked      = errors.New("module is not in lockfile")
+	ErrHTTPStatus     = errors.New("unexpected HTTP status")
+)
+
+const pinPrefix = "sha256="
+
+// Ref is a module location with an optional pinned digest taken from a
+// '#sha256=<hex>' URL fragment.
+type Ref struct {
+	Location string
+	Pin      string
+}
+
+// ParseRef splits a '#sha256=<hex>' fragment off an https URL. File paths are
+// returned as-is, since '#' is a valid file name character.
+func ParseRef(raw string) (Ref, error) {
+	if !strings.HasPrefix(raw, "https://") {
+		return Ref{Location: raw}, nil
+	}
+	location, fragment, found := strings.Cut(raw, "#")
+	if !found {
+		return Ref{Location: raw}, nil
+	}
+	pin, ok := strings.CutPrefix(fragment, pinPrefix)
+	if !ok {
+		return Ref{}, fmt.Errorf("%w: unsupported URL fragment %q in %s", ErrInvalidPin, fragment, raw)
+	}
+	pin = strings.ToLower(pin)
+	if !ValidDigest(pin) {
+		return Ref{}, fmt.Errorf("%w: %q is not 64 hex characters", ErrInvalidPin, pin)
+	}
+	return Ref{Location: location, Pin: pin}, nil
+}
+
+// Remote reports whether the module is fetched over the network.
+func (ref Ref) Remote() bool {
+	return strings.HasPrefix(ref.Location, "https://")
+}
+
+// String formats the ref back into its '#sha256=' pinned form.
+func (ref Ref) String() string {
+	if ref.Pin == "" {
+		return ref.Location
+	}
+	return ref.Location + "#" + pinPrefix + ref.Pin
+}
+
+// ValidDigest reports whether s is a lowercase hex sha256 digest.
+func ValidDigest(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// Module is a resolved module and the hex sha256 of its bytes.
+type Module struct {
+	Ref    Ref
+	Body   []byte
+	SHA256 string
+}
+
+// Resolver reads modules. The zero value reads files and fetches URLs with
+// http.DefaultClient, enforcing only fragment pins.
+type Resolver struct {
+	Client *http.Client
+	// Lock, when set, pins remote modules to the digests it records.
+	Lock *Lockfile
+	// Locked requires every remote module to have an entry in Lock.
+	Locked bool
+	// Cache, when set, serves remote modules fetched before and stores
+	// new fetches.
+	Cache *Cache
+	// Offline fails on remote modules that are not in Cache instead of
+	// fetching them.
+	Offline bool
+	// Refresh fetches remote modules that are neither pinned nor locked
+	// again, instead of reusing the digest last fetched from their URL.
+	Refresh bool
+}
+
+// Resolve reads the module at raw, which may carry a '#sha256=' pin. A pinned
+// or locked module whose bytes do not match fails before it is returned.
+func (r *Resolver) Resolve(ctx context.Context, raw string) (Module, error) {
+	ref, err := ParseRef(raw)
+	if err != nil {
+		return Module{}, err
+	}
+	if ref.Remote() {
+		if err := r.checkLocked(ref); err != nil {
+			return Module{}, err
+		}
+	}
+
+	var body []byte
+	if ref.Remote() {
+		body, err = r.readRemote(ctx, ref)
+	} else {
+		body, err = os.ReadFile(ref.Location)
+		if err != nil {
+			err = fmt.Errorf("Error reading file: %w", err)
+		}
+	}
+	if err != nil {
+		return Module{}, err
+	}
+
+	digest := sha256.Sum256(body)
+	module := Module{Ref: ref, Body: body, SHA256: hex.EncodeToString(digest[:])}
+	if err := r.Verify(module); err != nil {
+		return Module{}, err
+	}
+	return module, nil
+}
+
+// readRemote returns a remote module from the cache when it holds the
+// expected digest, otherwise fetches it and caches the result. Without a pin
+// or lock entry, the digest last fetched from the URL is expected, unless
+// Refresh is set.
+func (r *Resolver) readRemote(ctx context.Context, ref Ref) ([]byte, error) {
+	if r.Cache != nil {
+		digest := r.expectedDigest(ref)
+		if digest == "" && !r.Refresh {
+			entry, ok, err := r.Cache.Lookup(ref.Location)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				digest = entry.SHA256
+			}
+		}
+		if digest != "" {
+			body, err := r.Cache.Read(digest)
+			if err == nil {
+				return body, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrCacheCorrupt) {
+				return nil, fmt.Errorf("Error reading cached module: %w", err)
+			}
+		}
+	}
+	if r.Offline {
+		return nil, fmt.Errorf("%w: %s", ErrOffline, ref.Location)
+	}
+
+	body, err := r.fetch(ctx, ref.Location)
+	if err != nil {
+		return nil, err
+	}
+	if r.Cache != nil {
+		sum := sha256.Sum256(body)
+		digest := hex.EncodeToString(sum[:])
+		// Only cache bytes that pass verification, so a bad fetch never
+		// replaces a good entry. A cache that cannot be written, such as
+		// a read-only home directory in CI, must not fail the command.
+		if r.Verify(Module{Ref: ref, Body: body, SHA256: digest}) == nil {
+			_ = r.Cache.Store(ref.Location, body, digest)
+		}
+	}
+	return body, nil
+}
+
+func (r *Resolver) expectedDigest(ref Ref) string {
+	if ref.Pin != "" {
+		return ref.Pin
+	}
+	if r.Lock != nil {
+		if entry, ok := r.Lock.Modules[ref.Location]; ok {
+			return entry.SHA256
+		}
+	}
+	return ""
+}
+
+// Verify checks module bytes against the ref's pin and the lockfile.
+func (r *Resolver) Verify(module Module) error {
+	ref := module.Ref
+	if ref.Pin != "" && ref.Pin != module.SHA256 {
+		return fmt.Errorf("%w: %s is %s, pinned %s", ErrDigestMismatch, ref.Location, module.SHA256, ref.Pin)
+	}
+	if ref.Remote() && r.Lock != nil {
+		if entry, ok := r.Lock.Modules[ref.Location]; ok && entry.SHA256 != module.SHA256 {
+			return fmt.Errorf("%w: %s is %s, locked %s", ErrDigestMismatch, ref.Location, module.SHA256, entry.SHA256)
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) checkLocked(ref Ref) error {
+	if !r.Locked {
+		return nil
+	}
+	if r.Lock != nil {
+		if _, ok := r.Lock.Modules[ref.Location]; ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s (run qip lock to add it)", ErrNotLocked, ref.Location)
+}
+
+func (r *Resolver) fetch(ctx context.Context, location string) ([]byte, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching URL: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching URL: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Error fetching URL: %w: %s returned %s", ErrHTTPStatus, location, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response: %w", err)
+	}
+	return body, nil
+}
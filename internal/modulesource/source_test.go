@@ -0,0 +1,220 @@
+package modulesource
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var moduleBytes = []byte("\x00asm\x01\x00\x00\x00")
+
+func moduleDigest() string {
+	sum := sha256.Sum256(moduleBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+func newModuleServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/m.wasm" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(moduleBytes)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseRef(t *testing.T) {
+	digest := moduleDigest()
+	ref, err := ParseRef("https://example.com/m.wasm#sha256=" + strings.ToUpper(digest))
+	if err != nil {
+		t.Fatalf("ParseRef error: %v", err)
+	}
+	if ref.Location != "https://example.com/m.wasm" || ref.Pin != digest {
+		t.Fatalf("ref=%+v", ref)
+	}
+
+	ref, err = ParseRef("modules/a#b.wasm")
+	if err != nil || ref.Location != "modules/a#b.wasm" || ref.Pin != "" {
+		t.Fatalf("file path ref=%+v err=%v", ref, err)
+	}
+
+	for _, raw := range []string{
+		"https://example.com/m.wasm#sha256=abc",
+		"https://example.com/m.wasm#md5=" + digest,
+	} {
+		if _, err := ParseRef(raw); !errors.Is(err, ErrInvalidPin) {
+			t.Fatalf("ParseRef(%q) err=%v, want ErrInvalidPin", raw, err)
+		}
+	}
+}
+
+func TestResolvePinnedURL(t *testing.T) {
+	server := newModuleServer(t)
+	r := &Resolver{Client: server.Client()}
+	ctx := context.Background()
+
+	module, err := r.Resolve(ctx, server.URL+"/m.wasm#sha256="+moduleDigest())
+	if err != nil {
+		t.Fatalf("Resolve error: %v", err)
+	}
+	if module.SHA256 != moduleDigest() {
+		t.Fatalf("SHA256=%s", module.SHA256)
+	}
+
+	_, err = r.Resolve(ctx, server.URL+"/m.wasm#sha256="+strings.Repeat("0", 64))
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got: %v", err)
+	}
+
+	_, err = r.Resolve(ctx, server.URL+"/missing.wasm")
+	if !errors.Is(err, ErrHTTPStatus) {
+		t.Fatalf("expected ErrHTTPStatus, got: %v", err)
+	}
+}
+
+func TestResolveLocked(t *testing.T) {
+	server := newModuleServer(t)
+	ctx := context.Background()
+	location := server.URL + "/m.wasm"
+
+	r := &Resolver{Client: server.Client(), Lock: NewLockfile(), Locked: true}
+	if _, err := r.Resolve(ctx, location); !errors.Is(err, ErrNotLocked) {
+		t.Fatalf("expected ErrNotLocked, got: %v", err)
+	}
+
+	r.Lock.Set(location, strings.Repeat("0", 64))
+	if _, err := r.Resolve(ctx, location); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got: %v", err)
+	}
+
+	r.Lock.Set(location, moduleDigest())
+	if _, err := r.Resolve(ctx, location); err != nil {
+		t.Fatalf("Resolve error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), DefaultLockfile)
+	if err := r.Lock.Write(path); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	lock, err := ReadLockfile(path)
+	if err != nil {
+		t.Fatalf("ReadLockfile error: %v", err)
+	}
+	if lock.Modules[location].SHA256 != moduleDigest() {
+		t.Fatalf("lock entry=%+v", lock.Modules[location])
+	}
+}
+
+func TestResolveUsesCache(t *testing.T) {
+	server := newModuleServer(t)
+	ctx := context.Background()
+	location := server.URL + "/m.wasm"
+	cache := OpenCache(t.TempDir())
+
+	r := &Resolver{Client: server.Client(), Cache: cache}
+	if _, err := r.Resolve(ctx, location); err != nil {
+		t.Fatalf("Resolve error: %v", err)
+	}
+	server.Close()
+
+	offline := &Resolver{Cache: cache, Offline: true}
+	module, err := offline.Resolve(ctx, location)
+	if err != nil {
+		t.Fatalf("offline Resolve error: %v", err)
+	}
+	if module.SHA256 != moduleDigest() {
+		t.Fatalf("SHA256=%s", module.SHA256)
+	}
+
+	if _, err := offline.Resolve(ctx, server.URL+"/other.wasm"); !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected ErrOffline, got: %v", err)
+	}
+
+	entries, err := cache.Entries()
+	if err != nil || len(entries) != 1 || entries[0].Location != location {
+		t.Fatalf("entries=%+v err=%v", entries, err)
+	}
+}
+
+func TestResolveRefresh(t *testing.T) {
+	fetches := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		_, _ = w.Write(moduleBytes)
+	}))
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+	cache := OpenCache(t.TempDir())
+
+	for i, refresh := range []bool{false, false, true} {
+		r := &Resolver{Client: server.Client(), Cache: cache, Refresh: refresh}
+		if _, err := r.Resolve(ctx, server.URL+"/m.wasm"); err != nil {
+			t.Fatalf("Resolve %d error: %v", i, err)
+		}
+	}
+	if fetches != 2 {
+		t.Fatalf("fetches=%d, want the first resolve and the refresh", fetches)
+	}
+}
+
+func TestCacheConcurrentStores(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each store opens the cache separately, like another process.
+			if err := OpenCache(dir).Store(fmt.Sprintf("https://example.com/%d.wasm", i), moduleBytes, moduleDigest()); err != nil {
+				t.Errorf("Store %d error: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	entries, err := OpenCache(dir).Entries()
+	if err != nil || len(entries) != 16 {
+		t.Fatalf("%d entries, err=%v; want 16", len(entries), err)
+	}
+}
+
+func TestCacheVerifyAndGC(t *testing.T) {
+	cache := OpenCache(t.TempDir())
+	if err := cache.Store("https://example.com/m.wasm", moduleBytes, moduleDigest()); err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+	stray := strings.Repeat("a", 64)
+	if err := os.WriteFile(filepath.Join(cache.Dir(), "sha256", stray), []byte("stray"), 0o644); err != nil {
+		t.Fatalf("write stray blob: %v", err)
+	}
+
+	corrupt, err := cache.Verify()
+	if err != nil {
+		t.Fatalf("Verify error: %v", err)
+	}
+	if len(corrupt) != 1 || filepath.Base(corrupt[0]) != stray {
+		t.Fatalf("corrupt=%v, want the stray blob", corrupt)
+	}
+
+	removed, err := cache.GC(0)
+	if err != nil {
+		t.Fatalf("GC error: %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed=%d, want 1", removed)
+	}
+	if _, err := cache.Read(moduleDigest()); err != nil {
+		t.Fatalf("referenced blob was removed: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"time"
+)
+
+// chromeEvent is a complete ("X") event of the Chrome trace event format,
+// which Perfetto and chrome://tracing open. Times are in microseconds.
+type chromeEvent struct {
+	Name  string            `json:"name"`
+	Phase string            `json:"ph"`
+	TS    float64           `json:"ts"`
+	Dur   float64           `json:"dur"`
+	PID   int               `json:"pid"`
+	TID   uint64            `json:"tid"`
+	Args  map[string]string `json:"args,omitempty"`
+}
+
+type chromeTrace struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+// WriteChrome writes spans as Chrome trace event JSON. Timestamps are
+// relative to the earliest span, and each track becomes a thread.
+func WriteChrome(w io.Writer, spans []Span) error {
+	spans = slices.Clone(spans)
+	// Parents come before the children they enclose, even when both start
+	// at the same instant.
+	slices.SortStableFunc(spans, func(a, b Span) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return b.End.Compare(a.End)
+	})
+	var origin time.Time
+	if len(spans) > 0 {
+		origin = spans[0].Start
+	}
+	trace := chromeTrace{
+		TraceEvents:     make([]chromeEvent, 0, len(spans)),
+		DisplayTimeUnit: "ms",
+	}
+	for _, span := range spans {
+		event := chromeEvent{
+			Name:  span.Name,
+			Phase: "X",
+			TS:    microseconds(span.Start.Sub(origin)),
+			Dur:   microseconds(span.End.Sub(span.Start)),
+			PID:   1,
+			TID:   span.Track,
+		}
+		if len(span.Attributes) > 0 {
+			event.Args = make(map[string]string, len(span.Attributes))
+			for _, attribute := range span.Attributes {
+				event.Args[attribute.Key] = attribute.Value
+			}
+		}
+		trace.TraceEvents = append(trace.TraceEvents, event)
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(trace)
+}
+
+func microseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1e3
+}
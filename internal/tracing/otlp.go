@@ -0,0 +1,177 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// TraceID identifies one trace in OTLP.
+type TraceID [16]byte
+
+// RequestTraceID derives a trace ID from a qip dev request ID, prefixed
+// with random bytes fixed for the process so IDs from separate runs of the
+// server do not collide.
+func RequestTraceID(requestID uint64) TraceID {
+	var id TraceID
+	copy(id[:8], processPrefix[:])
+	binary.BigEndian.PutUint64(id[8:], requestID)
+	return id
+}
+
+// NewTraceID returns a random trace ID.
+func NewTraceID() TraceID {
+	var id TraceID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+var processPrefix = func() (prefix [8]byte) {
+	_, _ = rand.Read(prefix[:])
+	return prefix
+}()
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP
+// using the JSON encoding.
+type OTLPExporter struct {
+	// Endpoint is the collector's traces URL, such as
+	// http://localhost:4318/v1/traces.
+	Endpoint string
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+	Client      *http.Client
+}
+
+// NewOTLPExporter returns an exporter for endpoint. An endpoint without a
+// path gets the standard /v1/traces.
+func NewOTLPExporter(endpoint string, serviceName string) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid OTLP endpoint %q: want an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &OTLPExporter{
+		Endpoint:    u.String(),
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Export sends spans as one trace.
+func (e *OTLPExporter) Export(ctx context.Context, traceID TraceID, spans []Span) error {
+	body, err := json.Marshal(otlpRequest(e.ServiceName, traceID, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export to %s: %s", e.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpSpanKindInternal is SPAN_KIND_INTERNAL.
+const otlpSpanKindInternal = 1
+
+func otlpRequest(serviceName string, traceID TraceID, spans []Span) otlpExportRequest {
+	traceHex := hex.EncodeToString(traceID[:])
+	out := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		out[i] = otlpSpan{
+			TraceID:           traceHex,
+			SpanID:            spanID(span.ID),
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.Parent != 0 {
+			out[i].ParentSpanID = spanID(span.Parent)
+		}
+		for _, attribute := range span.Attributes {
+			out[i].Attributes = append(out[i].Attributes, otlpKeyValue{Key: attribute.Key, Value: otlpValue{StringValue: attribute.Value}})
+		}
+	}
+	return otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpKeyValue{
+				{Key: "service.name", Value: otlpValue{StringValue: serviceName}},
+			}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "qip"},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+// spanID encodes a recorder's span ID, which is unique within its trace and
+// never zero.
+func spanID(id uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	return hex.EncodeToString(b[:])
+}
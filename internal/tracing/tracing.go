@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Attribute is a key/value pair describing a span.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: strconv.Itoa(value)}
+}
+
+// Span is one timed operation. IDs are assigned by the recorder from 1;
+// Parent is 0 for a root span. Track groups spans that run one after
+// another, so concurrent work such as the files of a batch lands on separate
+// tracks.
+type Span struct {
+	ID         uint64
+	Parent     uint64
+	Track      uint64
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+}
+
+// Recorder collects finished spans. It is safe for concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	nextID uint64
+	spans  []Span
+}
+
+// NewRecorder returns an empty recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Spans returns the finished spans in the order they ended.
+func (r *Recorder) Spans() []Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Span(nil), r.spans...)
+}
+
+func (r *Recorder) newID() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	return r.nextID
+}
+
+func (r *Recorder) finish(span Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+type recorderKey struct{}
+
+type spanKey struct{}
+
+type spanContext struct {
+	id    uint64
+	track uint64
+}
+
+// WithRecorder returns a context whose spans are collected by r.
+func WithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+// Enabled reports whether spans started from ctx are recorded.
+func Enabled(ctx context.Context) bool {
+	r, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return r != nil
+}
+
+// Start begins a span as a child of the span in ctx, if any, and returns a
+// context carrying it along with a function that ends it. Without a
+// recorder in ctx it does nothing.
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, func()) {
+	return start(ctx, false, name, attributes)
+}
+
+// StartTrack is like Start but puts the span and its descendants on a track
+// of their own.
+func StartTrack(ctx context.Context, name string, attributes ...Attribute) (context.Context, func()) {
+	return start(ctx, true, name, attributes)
+}
+
+func start(ctx context.Context, newTrack bool, name string, attributes []Attribute) (context.Context, func()) {
+	r, _ := ctx.Value(recorderKey{}).(*Recorder)
+	if r == nil {
+		return ctx, func() {}
+	}
+	parent, _ := ctx.Value(spanKey{}).(spanContext)
+	span := Span{
+		ID:         r.newID(),
+		Parent:     parent.id,
+		Track:      parent.track,
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: attributes,
+	}
+	if newTrack {
+		span.Track = span.ID
+	}
+	ctx = context.WithValue(ctx, spanKey{}, spanContext{id: span.ID, track: span.Track})
+	return ctx, func() {
+		span.End = time.Now()
+		r.finish(span)
+	}
+}
@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func recordSample() *Recorder {
+	r := NewRecorder()
+	ctx, endRoot := Start(WithRecorder(context.Background(), r), "qip run")
+	_, endCompile := Start(ctx, "compile", Int("stage", 0))
+	endCompile()
+	for i := range 2 {
+		fileCtx, endFile := StartTrack(ctx, "file", Int("index", i))
+		_, endRun := Start(fileCtx, "run")
+		endRun()
+		endFile()
+	}
+	endRoot()
+	return r
+}
+
+func TestStartWithoutRecorderDoesNothing(t *testing.T) {
+	ctx := context.Background()
+	got, end := Start(ctx, "run")
+	end()
+	if got != ctx || Enabled(got) {
+		t.Fatal("expected Start to leave a context without a recorder unchanged")
+	}
+}
+
+func TestWriteChrome(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteChrome(&buf, recordSample().Spans()); err != nil {
+		t.Fatalf("WriteChrome error: %v", err)
+	}
+	var trace struct {
+		TraceEvents []chromeEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	var names []string
+	tracks := map[string][]uint64{}
+	for _, event := range trace.TraceEvents {
+		if event.Phase != "X" || event.TS < 0 || event.Dur < 0 {
+			t.Fatalf("event=%+v", event)
+		}
+		names = append(names, event.Name)
+		tracks[event.Name] = append(tracks[event.Name], event.TID)
+	}
+	if names[0] != "qip run" || len(names) != 6 {
+		t.Fatalf("names=%q", names)
+	}
+	if files := tracks["file"]; files[0] == files[1] || files[0] == tracks["qip run"][0] {
+		t.Fatalf("file tracks=%v, root track=%v", files, tracks["qip run"])
+	}
+	if runs, files := tracks["run"], tracks["file"]; runs[0] != files[0] || runs[1] != files[1] {
+		t.Fatalf("run tracks=%v, want %v", runs, files)
+	}
+}
+
+func TestOTLPExporterSendsSpans(t *testing.T) {
+	var got otlpExportRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(collector.URL, "qip dev")
+	if err != nil {
+		t.Fatalf("NewOTLPExporter error: %v", err)
+	}
+	traceID := RequestTraceID(42)
+	if err := exporter.Export(context.Background(), traceID, recordSample().Spans()); err != nil {
+		t.Fatalf("Export error: %v", err)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("request=%+v", got)
+	}
+	if attrs := got.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Value.StringValue != "qip dev" {
+		t.Fatalf("resource attributes=%+v", attrs)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 6 {
+		t.Fatalf("spans=%d, want 6", len(spans))
+	}
+	ids := map[string]otlpSpan{}
+	for _, span := range spans {
+		if span.TraceID != hex.EncodeToString(traceID[:]) || len(span.SpanID) != 16 {
+			t.Fatalf("span=%+v", span)
+		}
+		ids[span.SpanID] = span
+	}
+	for _, span := range spans {
+		if span.Name == "qip run" {
+			if span.ParentSpanID != "" {
+				t.Fatalf("root span has parent %q", span.ParentSpanID)
+			}
+			continue
+		}
+		if _, ok := ids[span.ParentSpanID]; !ok {
+			t.Fatalf("span %q has unknown parent %q", span.Name, span.ParentSpanID)
+		}
+	}
+
+	if _, err := NewOTLPExporter("localhost:4318", "qip dev"); err == nil {
+		t.Fatal("expected error for endpoint without scheme")
+	}
+}
@@ -0,0 +1,204 @@
+package wasmprofile
+
+import (
+	"compress/gzip"
+	"io"
+	"slices"
+)
+
+// Field numbers from pprof's profile.proto.
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileMapping           = 3
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	labelKey = 1
+	labelStr = 2
+
+	mappingID           = 1
+	mappingFilename     = 5
+	mappingHasFunctions = 7
+
+	locationID        = 1
+	locationMappingID = 2
+	locationLine      = 4
+
+	lineFunctionID = 1
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+)
+
+// WritePprof writes the recorded call tree as a gzipped pprof profile with
+// two sample values, calls and time in nanoseconds. Each sample is labelled
+// with its module, so `go tool pprof -tagfocus module=<path>` narrows a
+// profile of several modules to one.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	strings := stringTable{index: map[string]int64{"": 0}, values: []string{""}}
+	var out protoBuffer
+	for _, valueType := range [][2]string{{"calls", "count"}, {"time", "nanoseconds"}} {
+		var vt protoBuffer
+		vt.int(valueTypeType, strings.add(valueType[0]))
+		vt.int(valueTypeUnit, strings.add(valueType[1]))
+		out.message(profileSampleType, vt)
+	}
+
+	modules := make([]string, 0, len(p.roots))
+	for module := range p.roots {
+		modules = append(modules, module)
+	}
+	slices.Sort(modules)
+	moduleKey := strings.add("module")
+	for _, module := range modules {
+		var stack []uint64
+		var walk func(n *node)
+		walk = func(n *node) {
+			stack = append(stack, n.fn)
+			var sample protoBuffer
+			locations := slices.Clone(stack)
+			slices.Reverse(locations)
+			sample.packed(sampleLocationID, locations)
+			sample.packed(sampleValue, []uint64{uint64(n.calls), uint64(n.self.Nanoseconds())})
+			var label protoBuffer
+			label.int(labelKey, moduleKey)
+			label.int(labelStr, strings.add(module))
+			sample.message(sampleLabel, label)
+			out.message(profileSample, sample)
+			for _, child := range sortedChildren(n) {
+				walk(child)
+			}
+			stack = stack[:len(stack)-1]
+		}
+		for _, child := range sortedChildren(p.roots[module]) {
+			walk(child)
+		}
+	}
+
+	// Wasm has no addresses for pprof to symbolize, so one mapping marked as
+	// already symbolized covers every location.
+	var mapping protoBuffer
+	mapping.int(mappingID, 1)
+	mapping.int(mappingFilename, strings.add("wasm"))
+	mapping.int(mappingHasFunctions, 1)
+	out.message(profileMapping, mapping)
+
+	for i, fn := range p.functions {
+		id := uint64(i + 1)
+		var line protoBuffer
+		line.int(lineFunctionID, int64(id))
+		var location protoBuffer
+		location.int(locationID, int64(id))
+		location.int(locationMappingID, 1)
+		location.message(locationLine, line)
+		out.message(profileLocation, location)
+
+		var fnMessage protoBuffer
+		fnMessage.int(functionID, int64(id))
+		name := strings.add(fn.name)
+		fnMessage.int(functionName, name)
+		fnMessage.int(functionSystemName, name)
+		fnMessage.int(functionFilename, strings.add(fn.module))
+		out.message(profileFunction, fnMessage)
+	}
+
+	var period protoBuffer
+	period.int(valueTypeType, strings.add("time"))
+	period.int(valueTypeUnit, strings.add("nanoseconds"))
+	out.message(profilePeriodType, period)
+	out.int(profilePeriod, 1)
+	out.int(profileTimeNanos, p.start.UnixNano())
+	out.int(profileDurationNanos, p.total.Nanoseconds())
+	out.int(profileDefaultSampleType, strings.add("time"))
+	for _, s := range strings.values {
+		out.bytes(profileStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func sortedChildren(n *node) []*node {
+	children := make([]*node, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	slices.SortFunc(children, func(a, b *node) int {
+		return int(a.fn) - int(b.fn)
+	})
+	return children
+}
+
+type stringTable struct {
+	index  map[string]int64
+	values []string
+}
+
+func (t *stringTable) add(s string) int64 {
+	if i, ok := t.index[s]; ok {
+		return i
+	}
+	i := int64(len(t.values))
+	t.index[s] = i
+	t.values = append(t.values, s)
+	return i
+}
+
+// protoBuffer appends protobuf wire-format fields.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuffer) int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(uint64(v))
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) message(field int, m protoBuffer) {
+	b.bytes(field, m)
+}
+
+func (b *protoBuffer) packed(field int, values []uint64) {
+	var m protoBuffer
+	for _, v := range values {
+		m.varint(v)
+	}
+	b.bytes(field, m)
+}
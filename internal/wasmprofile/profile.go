@@ -0,0 +1,157 @@
+// Package wasmprofile attributes time spent inside wasm modules to their
+// functions using wazero's function listeners, and writes the result as a
+// pprof profile.
+package wasmprofile
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Profiler records a call tree of wasm functions with the calls made and the
+// time spent in each node, excluding time spent in callees. Listeners are
+// attached at compile time, so modules must be compiled with a context from
+// WithProfiler.
+//
+// A Profiler tracks one call stack, so calls into profiled modules must not
+// run concurrently.
+type Profiler struct {
+	mu        sync.Mutex
+	roots     map[string]*node
+	current   *node
+	last      time.Time
+	start     time.Time
+	total     time.Duration
+	functions []function
+	ids       map[function]uint64
+}
+
+type function struct {
+	module string
+	name   string
+}
+
+// node is one call path. Module roots have no function and no parent.
+type node struct {
+	fn       uint64
+	parent   *node
+	module   string
+	children map[uint64]*node
+	calls    int64
+	self     time.Duration
+}
+
+// New returns an empty profiler.
+func New() *Profiler {
+	return &Profiler{
+		roots: map[string]*node{},
+		ids:   map[function]uint64{},
+	}
+}
+
+// WithProfiler returns a context for compiling a module so its functions
+// report to p. The module label, usually the module path, names the module
+// in the profile.
+func WithProfiler(ctx context.Context, p *Profiler, module string) context.Context {
+	return experimental.WithFunctionListenerFactory(ctx, p.factory(module))
+}
+
+func (p *Profiler) factory(module string) experimental.FunctionListenerFactory {
+	return experimental.FunctionListenerFactoryFunc(func(def api.FunctionDefinition) experimental.FunctionListener {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.roots[module]; !ok {
+			p.roots[module] = &node{module: module, children: map[uint64]*node{}}
+		}
+		return &listener{profiler: p, root: p.roots[module], fn: p.intern(function{module: module, name: FunctionName(def)})}
+	})
+}
+
+// intern returns the 1-based ID of fn, which doubles as its pprof function
+// and location ID.
+func (p *Profiler) intern(fn function) uint64 {
+	if id, ok := p.ids[fn]; ok {
+		return id
+	}
+	p.functions = append(p.functions, fn)
+	id := uint64(len(p.functions))
+	p.ids[fn] = id
+	return id
+}
+
+// FunctionName names a function from the module's name section, falling back
+// to its first export name and then its index.
+func FunctionName(def api.FunctionDefinition) string {
+	if name := def.Name(); name != "" {
+		return name
+	}
+	if exports := def.ExportNames(); len(exports) > 0 {
+		return exports[0]
+	}
+	return fmt.Sprintf("func[%d]", def.Index())
+}
+
+type listener struct {
+	profiler *Profiler
+	root     *node
+	fn       uint64
+}
+
+func (l *listener) Before(context.Context, api.Module, api.FunctionDefinition, []uint64, experimental.StackIterator) {
+	now := time.Now()
+	p := l.profiler
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	parent := p.current
+	if parent == nil {
+		parent = l.root
+		if p.start.IsZero() {
+			p.start = now
+		}
+	} else {
+		p.charge(now)
+	}
+	child, ok := parent.children[l.fn]
+	if !ok {
+		child = &node{fn: l.fn, parent: parent, children: map[uint64]*node{}}
+		parent.children[l.fn] = child
+	}
+	child.calls++
+	p.current = child
+	p.last = now
+}
+
+func (l *listener) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {
+	l.profiler.leave(time.Now())
+}
+
+func (l *listener) Abort(context.Context, api.Module, api.FunctionDefinition, error) {
+	l.profiler.leave(time.Now())
+}
+
+func (p *Profiler) leave(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		return
+	}
+	p.charge(now)
+	p.current = p.current.parent
+	if p.current != nil && p.current.parent == nil {
+		// Back at a module root: the outermost call returned.
+		p.current = nil
+	}
+	p.last = now
+}
+
+// charge adds the time since the last event to the current function.
+func (p *Profiler) charge(now time.Time) {
+	elapsed := now.Sub(p.last)
+	p.current.self += elapsed
+	p.total += elapsed
+}
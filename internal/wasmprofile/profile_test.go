@@ -0,0 +1,78 @@
+package wasmprofile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// squareModule has a name section naming both functions:
+//
+//	(module
+//	  (func $square (param i32) (result i32)
+//	    (i32.mul (local.get 0) (local.get 0)))
+//	  (func $main (export "run") (param i32) (result i32)
+//	    (call $square (call $square (local.get 0)))))
+var squareModule = []byte("\x00\x61\x73\x6d\x01\x00\x00\x00\x01\x06\x01\x60\x01\x7f\x01\x7f\x03\x03\x02\x00\x00\x07\x07\x01\x03\x72\x75\x6e\x00\x01\x0a\x12\x02\x07\x00\x20\x00\x20\x00\x6c\x0b\x08\x00\x20\x00\x10\x00\x10\x00\x0b\x00\x16\x04\x6e\x61\x6d\x65\x01\x0f\x02\x00\x06\x73\x71\x75\x61\x72\x65\x01\x04\x6d\x61\x69\x6e")
+
+func TestProfilerRecordsCallTree(t *testing.T) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	p := New()
+	compiled, err := runtime.CompileModule(WithProfiler(ctx, p, "square.wasm"), squareModule)
+	if err != nil {
+		t.Fatalf("CompileModule error: %v", err)
+	}
+	mod, err := runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatalf("InstantiateModule error: %v", err)
+	}
+	for range 3 {
+		results, err := mod.ExportedFunction("run").Call(ctx, 3)
+		if err != nil || results[0] != 81 {
+			t.Fatalf("run=%v err=%v", results, err)
+		}
+	}
+
+	root := p.roots["square.wasm"]
+	if len(root.children) != 1 {
+		t.Fatalf("root children=%d, want 1", len(root.children))
+	}
+	for _, main := range root.children {
+		if name := p.functions[main.fn-1].name; name != "main" || main.calls != 3 {
+			t.Fatalf("top frame=%s calls=%d, want main calls=3", name, main.calls)
+		}
+		for _, square := range main.children {
+			if name := p.functions[square.fn-1].name; name != "square" || square.calls != 6 {
+				t.Fatalf("child frame=%s calls=%d, want square calls=6", name, square.calls)
+			}
+		}
+	}
+	if p.current != nil {
+		t.Fatal("expected no open frames after calls return")
+	}
+
+	var buf bytes.Buffer
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatalf("WritePprof error: %v", err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("profile is not gzipped: %v", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("read profile: %v", err)
+	}
+	for _, want := range []string{"main", "square", "square.wasm", "nanoseconds"} {
+		if !bytes.Contains(raw, []byte(want)) {
+			t.Fatalf("profile is missing string %q", want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package wasmruntime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Kind classifies why running a module failed, so commands can report each
+// kind with its own exit code.
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	// KindTimeout is a call that ran past its execution time limit.
+	KindTimeout
+	// KindCanceled is a call stopped because its context was canceled.
+	KindCanceled
+	// KindTrap is a module that trapped, such as on unreachable or an out
+	// of bounds memory access.
+	KindTrap
+	// KindContract is a module that does not follow the module contract,
+	// such as a missing export or a pointer outside its memory.
+	KindContract
+	// KindCapacity is input or output that does not fit a module's
+	// capacities or the resource policy.
+	KindCapacity
+	// KindCompile is a module that could not be compiled or instantiated.
+	KindCompile
+	// KindInvalidInput is input the host could not decode for a module,
+	// such as an image that is not a BMP.
+	KindInvalidInput
+	// KindModule is a module that reported its own error message through
+	// error_message_ptr and error_message_size instead of producing output.
+	KindModule
+)
+
+// Error is a module failure of a known Kind. Its message is the one shown
+// to users; Err is the underlying cause, if any.
+type Error struct {
+	Kind Kind
+	// TrapCode names the trap for KindTrap, such as "unreachable" or
+	// "integer divide by zero".
+	TrapCode string
+	Message  string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf returns an *Error of kind with a formatted message. A %w verb wraps
+// its operand as the cause.
+func Errorf(kind Kind, format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Kind: kind, Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+// KindOf returns the kind of the first *Error in err's chain, or KindUnknown.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindUnknown
+}
+
+// HumanizeExecutionError turns an error from calling a module function into
+// an *Error: a timeout or cancellation with a message focused on the module's
+// execution limit, or a trap carrying its trap code.
+func HumanizeExecutionError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	timeoutText := ""
+	if timeout, ok := ctx.Value(executionTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		timeoutText = " (" + timeout.String() + ")"
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case sys.ExitCodeDeadlineExceeded:
+			return &Error{Kind: KindTimeout, Message: "Wasm module exceeded the execution time limit" + timeoutText, Err: err}
+		case sys.ExitCodeContextCanceled:
+			return &Error{Kind: KindCanceled, Message: "Wasm module execution was canceled", Err: err}
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Kind: KindTimeout, Message: "Wasm module exceeded the execution time limit" + timeoutText, Err: err}
+	}
+	if errors.Is(err, context.Canceled) {
+		return &Error{Kind: KindCanceled, Message: "Wasm module execution was canceled", Err: err}
+	}
+	return &Error{Kind: KindTrap, TrapCode: trapCode(err), Message: err.Error(), Err: err}
+}
+
+// trapCode extracts the trap name from wazero's "wasm error: <code>" message,
+// whose error types are internal to wazero.
+func trapCode(err error) string {
+	message, _, _ := strings.Cut(err.Error(), "\n")
+	if code, ok := strings.CutPrefix(message, "wasm error: "); ok {
+		return code
+	}
+	return ""
+}
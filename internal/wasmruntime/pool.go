@@ -0,0 +1,424 @@
+package wasmruntime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Pool keeps warm instances of one compiled module so repeated calls skip
+// instantiation. Instances returned with Put are reset to a snapshot of the
+// linear memory and exported mutable globals taken right after the pool's
+// first instantiation. Compile the module from ExportMutableGlobals so that
+// its private globals, like a stack pointer, are reset too. Tables are not
+// restored.
+type Pool struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	globals  []string
+	name     string
+	maxIdle  int
+
+	mu       sync.Mutex
+	idle     []api.Module
+	snapshot *instanceSnapshot
+	seq      uint64
+	closed   bool
+}
+
+type instanceSnapshot struct {
+	memory  []byte
+	globals map[string]uint64
+}
+
+// NewPool returns a pool of compiled instances named name-<n>, keeping at
+// most maxIdle of them between uses. globals lists the module's exported
+// global names, as returned by ExportedGlobalNames.
+func NewPool(runtime wazero.Runtime, compiled wazero.CompiledModule, globals []string, name string, maxIdle int) *Pool {
+	return &Pool{
+		runtime:  runtime,
+		compiled: compiled,
+		globals:  globals,
+		name:     name,
+		maxIdle:  maxIdle,
+	}
+}
+
+// Get returns an idle instance, or instantiates a new one. reused reports
+// whether the instance came from the pool.
+func (p *Pool) Get(ctx context.Context) (mod api.Module, reused bool, err error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		mod = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return mod, true, nil
+	}
+	p.seq++
+	name := fmt.Sprintf("%s-%d", p.name, p.seq)
+	p.mu.Unlock()
+
+	mod, err = p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().WithName(name))
+	if err != nil {
+		return nil, false, err
+	}
+	p.mu.Lock()
+	if p.snapshot == nil {
+		p.snapshot = takeSnapshot(mod, p.globals)
+	}
+	p.mu.Unlock()
+	return mod, false, nil
+}
+
+// Put resets mod to the post-instantiation snapshot and keeps it for the
+// next Get. Instances whose memory grew, or that do not fit in the pool, are
+// closed instead.
+func (p *Pool) Put(ctx context.Context, mod api.Module) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= p.maxIdle || !p.snapshot.restore(mod) {
+		_ = mod.Close(ctx)
+		return
+	}
+	p.idle = append(p.idle, mod)
+}
+
+// Discard closes an instance that must not be reused, such as one whose call
+// trapped or timed out.
+func (p *Pool) Discard(ctx context.Context, mod api.Module) {
+	_ = mod.Close(ctx)
+}
+
+// Close closes every idle instance. Instances still checked out are closed
+// when they are returned.
+func (p *Pool) Close(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, mod := range p.idle {
+		_ = mod.Close(ctx)
+	}
+	p.idle = nil
+	p.closed = true
+}
+
+func takeSnapshot(mod api.Module, globals []string) *instanceSnapshot {
+	snapshot := &instanceSnapshot{globals: make(map[string]uint64)}
+	if mem := mod.Memory(); mem != nil {
+		view, _ := mem.Read(0, mem.Size())
+		snapshot.memory = append([]byte(nil), view...)
+	}
+	for _, name := range globals {
+		if global, ok := mod.ExportedGlobal(name).(api.MutableGlobal); ok {
+			snapshot.globals[name] = global.Get()
+		}
+	}
+	return snapshot
+}
+
+func (s *instanceSnapshot) restore(mod api.Module) bool {
+	if s == nil || mod.IsClosed() {
+		return false
+	}
+	if mem := mod.Memory(); mem != nil {
+		if mem.Size() != uint32(len(s.memory)) || !mem.Write(0, s.memory) {
+			return false
+		}
+	}
+	for name, value := range s.globals {
+		global, ok := mod.ExportedGlobal(name).(api.MutableGlobal)
+		if !ok {
+			return false
+		}
+		global.Set(value)
+	}
+	return true
+}
+
+var errMalformedModule = errors.New("malformed wasm module")
+
+// ExportMutableGlobals returns wasm with every mutable global it defines
+// also exported, as qip.global.<index>, so a Pool can reset globals the
+// module keeps private. Imported globals belong to the host and are left
+// alone. wasm is returned unchanged if it has nothing to add.
+func ExportMutableGlobals(wasm []byte) ([]byte, error) {
+	const (
+		importSectionID = 2
+		globalSectionID = 6
+		exportSectionID = 7
+		kindGlobal      = 3
+	)
+	if len(wasm) < 8 || string(wasm[:4]) != "\x00asm" {
+		return nil, errMalformedModule
+	}
+	type section struct {
+		id         byte
+		start, end int // of the section's contents
+	}
+	var sections []section
+	r := wasmReader{data: wasm, pos: 8}
+	for r.pos < len(r.data) {
+		id := r.byte()
+		size := r.u32()
+		if r.err != nil || uint64(size) > uint64(len(r.data)-r.pos) {
+			return nil, errMalformedModule
+		}
+		sections = append(sections, section{id: id, start: r.pos, end: r.pos + int(size)})
+		r.pos += int(size)
+	}
+
+	var importedGlobals uint32
+	var mutable []uint32
+	exported := make(map[uint32]bool)
+	exportIndex := -1
+	for i, sec := range sections {
+		r := wasmReader{data: wasm[:sec.end], pos: sec.start}
+		switch sec.id {
+		case importSectionID:
+			for n := r.u32(); n > 0 && r.err == nil; n-- {
+				r.name()
+				r.name()
+				kind := r.byte()
+				if kind == kindGlobal {
+					importedGlobals++
+				}
+				r.skipImportDesc(kind)
+			}
+		case globalSectionID:
+			for n, j := r.u32(), uint32(0); j < n && r.err == nil; j++ {
+				r.byte() // value type
+				if r.byte() == 1 {
+					mutable = append(mutable, importedGlobals+j)
+				}
+				r.skipConstExpr()
+			}
+		case exportSectionID:
+			exportIndex = i
+			for n := r.u32(); n > 0 && r.err == nil; n-- {
+				r.name()
+				kind := r.byte()
+				index := r.u32()
+				if kind == kindGlobal {
+					exported[index] = true
+				}
+			}
+		}
+		if r.err != nil {
+			return nil, errMalformedModule
+		}
+	}
+
+	var added []byte
+	var count uint32
+	for _, index := range mutable {
+		if exported[index] {
+			continue
+		}
+		name := fmt.Sprintf("qip.global.%d", index)
+		added = appendU32(added, uint32(len(name)))
+		added = append(added, name...)
+		added = append(added, kindGlobal)
+		added = appendU32(added, index)
+		count++
+	}
+	if count == 0 {
+		return wasm, nil
+	}
+
+	var entries []byte
+	if exportIndex >= 0 {
+		sec := sections[exportIndex]
+		r := wasmReader{data: wasm[:sec.end], pos: sec.start}
+		count += r.u32()
+		entries = wasm[r.pos:sec.end]
+	}
+	contents := appendU32(nil, count)
+	contents = append(contents, entries...)
+	contents = append(contents, added...)
+
+	out := append([]byte(nil), wasm[:8]...)
+	written := false
+	for _, sec := range sections {
+		if sec.id == exportSectionID {
+			continue
+		}
+		// The export section goes right after the global section, which
+		// must exist for there to be anything to export.
+		out = append(out, sec.id)
+		out = appendU32(out, uint32(sec.end-sec.start))
+		out = append(out, wasm[sec.start:sec.end]...)
+		if sec.id == globalSectionID && !written {
+			out = append(out, exportSectionID)
+			out = appendU32(out, uint32(len(contents)))
+			out = append(out, contents...)
+			written = true
+		}
+	}
+	return out, nil
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// ExportedGlobalNames lists the names of the globals a wasm binary exports.
+// wazero only reports exported functions and memories for compiled modules,
+// so the export section is read directly.
+func ExportedGlobalNames(wasm []byte) ([]string, error) {
+	const (
+		exportSectionID  = 7
+		exportKindGlobal = 3
+	)
+	if len(wasm) < 8 || string(wasm[:4]) != "\x00asm" {
+		return nil, errMalformedModule
+	}
+	r := wasmReader{data: wasm, pos: 8}
+	for r.pos < len(r.data) {
+		id := r.byte()
+		size := r.u32()
+		if r.err != nil || uint64(size) > uint64(len(r.data)-r.pos) {
+			return nil, errMalformedModule
+		}
+		if id != exportSectionID {
+			r.pos += int(size)
+			continue
+		}
+		var names []string
+		count := r.u32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			name := r.name()
+			kind := r.byte()
+			r.u32()
+			if kind == exportKindGlobal {
+				names = append(names, name)
+			}
+		}
+		if r.err != nil {
+			return nil, errMalformedModule
+		}
+		return names, nil
+	}
+	return nil, nil
+}
+
+type wasmReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil || r.pos >= len(r.data) {
+		r.err = errMalformedModule
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *wasmReader) u32() uint32 {
+	var value uint32
+	for shift := 0; shift < 35; shift += 7 {
+		b := r.byte()
+		value |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value
+		}
+	}
+	r.err = errMalformedModule
+	return 0
+}
+
+// skipLEB skips a signed or unsigned LEB128 number of up to 64 bits.
+func (r *wasmReader) skipLEB() {
+	for range 10 {
+		if r.byte()&0x80 == 0 {
+			return
+		}
+	}
+	r.err = errMalformedModule
+}
+
+// skipImportDesc skips the description of an import of kind.
+func (r *wasmReader) skipImportDesc(kind byte) {
+	switch kind {
+	case 0: // func: type index
+		r.u32()
+	case 1: // table: reference type and limits
+		r.byte()
+		r.skipLimits()
+	case 2: // memory: limits
+		r.skipLimits()
+	case 3: // global: value type and mutability
+		r.byte()
+		r.byte()
+	case 4: // tag: attribute and type index
+		r.byte()
+		r.u32()
+	default:
+		r.err = errMalformedModule
+	}
+}
+
+func (r *wasmReader) skipLimits() {
+	flags := r.byte()
+	r.skipLEB()
+	if flags&1 != 0 {
+		r.skipLEB()
+	}
+}
+
+// skipConstExpr skips a constant expression, up to and including its end.
+func (r *wasmReader) skipConstExpr() {
+	for r.err == nil {
+		switch op := r.byte(); op {
+		case 0x0b: // end
+			return
+		case 0x41, 0x42: // i32.const, i64.const
+			r.skipLEB()
+		case 0x43: // f32.const
+			r.skip(4)
+		case 0x44: // f64.const
+			r.skip(8)
+		case 0x23, 0xd2: // global.get, ref.func
+			r.u32()
+		case 0xd0: // ref.null
+			r.byte()
+		case 0x6a, 0x6b, 0x6c, 0x7c, 0x7d, 0x7e: // extended const arithmetic
+		case 0xfd: // v128.const
+			if r.u32() != 12 {
+				r.err = errMalformedModule
+			}
+			r.skip(16)
+		default:
+			r.err = errMalformedModule
+		}
+	}
+}
+
+func (r *wasmReader) skip(n int) {
+	if r.err != nil || n > len(r.data)-r.pos {
+		r.err = errMalformedModule
+		return
+	}
+	r.pos += n
+}
+
+func (r *wasmReader) name() string {
+	size := r.u32()
+	if r.err != nil || uint64(size) > uint64(len(r.data)-r.pos) {
+		r.err = errMalformedModule
+		return ""
+	}
+	name := string(r.data[r.pos : r.pos+int(size)])
+	r.pos += int(size)
+	return name
+}
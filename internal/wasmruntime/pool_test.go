@@ -0,0 +1,109 @@
+package wasmruntime
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+)
+
+// counterModule increments both an exported mutable global and the i32 at
+// address 0, returning their sum:
+//
+//	(module
+//	  (memory (export "memory") 1)
+//	  (global $calls (export "calls") (mut i32) (i32.const 0))
+//	  (func (export "run") (param i32) (result i32)
+//	    (global.set $calls (i32.add (global.get $calls) (i32.const 1)))
+//	    (i32.store (i32.const 0) (i32.add (i32.load (i32.const 0)) (i32.const 1)))
+//	    (i32.add (global.get $calls) (i32.load (i32.const 0)))))
+var counterModule = []byte("\x00\x61\x73\x6d\x01\x00\x00\x00\x01\x06\x01\x60\x01\x7f\x01\x7f\x03\x02\x01\x00\x05\x03\x01\x00\x01\x06\x06\x01\x7f\x01\x41\x00\x0b\x07\x18\x03\x06\x6d\x65\x6d\x6f\x72\x79\x02\x00\x05\x63\x61\x6c\x6c\x73\x03\x00\x03\x72\x75\x6e\x00\x00\x0a\x20\x01\x1e\x00\x23\x00\x41\x01\x6a\x24\x00\x41\x00\x41\x00\x28\x02\x00\x41\x01\x6a\x36\x02\x00\x23\x00\x41\x00\x28\x02\x00\x6a\x0b")
+
+// privateCounterModule is counterModule without the export of $calls.
+var privateCounterModule = []byte("\x00\x61\x73\x6d\x01\x00\x00\x00\x01\x06\x01\x60\x01\x7f\x01\x7f\x03\x02\x01\x00\x05\x03\x01\x00\x01\x06\x06\x01\x7f\x01\x41\x00\x0b\x07\x10\x02\x06\x6d\x65\x6d\x6f\x72\x79\x02\x00\x03\x72\x75\x6e\x00\x00\x0a\x20\x01\x1e\x00\x23\x00\x41\x01\x6a\x24\x00\x41\x00\x41\x00\x28\x02\x00\x41\x01\x6a\x36\x02\x00\x23\x00\x41\x00\x28\x02\x00\x6a\x0b")
+
+func TestExportedGlobalNames(t *testing.T) {
+	names, err := ExportedGlobalNames(counterModule)
+	if err != nil {
+		t.Fatalf("ExportedGlobalNames error: %v", err)
+	}
+	if !slices.Equal(names, []string{"calls"}) {
+		t.Fatalf("names=%v, want [calls]", names)
+	}
+	if _, err := ExportedGlobalNames(counterModule[:40]); err == nil {
+		t.Fatal("expected error for truncated module")
+	}
+}
+
+func TestExportMutableGlobals(t *testing.T) {
+	if got, err := ExportMutableGlobals(counterModule); err != nil || !bytes.Equal(got, counterModule) {
+		t.Fatalf("ExportMutableGlobals changed a module exporting its globals: err=%v", err)
+	}
+	wasm, err := ExportMutableGlobals(privateCounterModule)
+	if err != nil {
+		t.Fatalf("ExportMutableGlobals error: %v", err)
+	}
+	names, err := ExportedGlobalNames(wasm)
+	if err != nil || !slices.Equal(names, []string{"qip.global.0"}) {
+		t.Fatalf("names=%v err=%v, want [qip.global.0]", names, err)
+	}
+	if _, err := ExportMutableGlobals(privateCounterModule[:40]); err == nil {
+		t.Fatal("expected error for truncated module")
+	}
+}
+
+func TestPoolRestoresSnapshot(t *testing.T) {
+	t.Run("exported", func(t *testing.T) { testPoolRestoresSnapshot(t, counterModule) })
+	t.Run("private", func(t *testing.T) {
+		wasm, err := ExportMutableGlobals(privateCounterModule)
+		if err != nil {
+			t.Fatalf("ExportMutableGlobals error: %v", err)
+		}
+		testPoolRestoresSnapshot(t, wasm)
+	})
+}
+
+func testPoolRestoresSnapshot(t *testing.T, wasm []byte) {
+	ctx := context.Background()
+	runtime := New(ctx)
+	defer runtime.Close(ctx)
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatalf("CompileModule error: %v", err)
+	}
+	globals, err := ExportedGlobalNames(wasm)
+	if err != nil {
+		t.Fatalf("ExportedGlobalNames error: %v", err)
+	}
+	pool := NewPool(runtime, compiled, globals, "counter", 1)
+	defer pool.Close(ctx)
+
+	for i, wantReused := range []bool{false, true, true} {
+		mod, reused, err := pool.Get(ctx)
+		if err != nil {
+			t.Fatalf("Get %d error: %v", i, err)
+		}
+		if reused != wantReused {
+			t.Fatalf("Get %d reused=%v, want %v", i, reused, wantReused)
+		}
+		result, err := mod.ExportedFunction("run").Call(ctx, 0)
+		if err != nil {
+			t.Fatalf("run %d error: %v", i, err)
+		}
+		if result[0] != 2 {
+			t.Fatalf("run %d returned %d, want 2 from a reset instance", i, result[0])
+		}
+		pool.Put(ctx, mod)
+	}
+
+	first, _, _ := pool.Get(ctx)
+	second, reused, err := pool.Get(ctx)
+	if err != nil || reused {
+		t.Fatalf("second concurrent Get reused=%v err=%v, want a new instance", reused, err)
+	}
+	pool.Put(ctx, first)
+	pool.Put(ctx, second)
+	if !second.IsClosed() {
+		t.Fatal("instance beyond maxIdle was kept")
+	}
+}
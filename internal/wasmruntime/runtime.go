@@ -2,8 +2,6 @@ package wasmruntime
 
 import (
 	"context"
-	"errors"
-	"strings"
 	"time"
 
 	"github.com/tetratelabs/wazero"
@@ -11,7 +9,24 @@ import (
 
 // New returns a wazero runtime configured to terminate function execution when call context is canceled or times out.
 func New(ctx context.Context) wazero.Runtime {
-	runtimeConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	return NewWithConfig(ctx, Config{})
+}
+
+// Config bounds the resources modules may reserve in a runtime.
+type Config struct {
+	// MemoryLimitPages caps each module's linear memory in 64 KiB pages.
+	// Modules declaring a larger minimum fail to compile and memory.grow
+	// beyond the limit fails. Zero keeps the wazero default of 65536 pages.
+	MemoryLimitPages uint32
+}
+
+// NewWithConfig is like New but also applies the limits in cfg. Compiled
+// modules keep their custom sections, so hosts can read a module's qip.meta.
+func NewWithConfig(ctx context.Context, cfg Config) wazero.Runtime {
+	runtimeConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true).WithCustomSections(true)
+	if cfg.MemoryLimitPages > 0 {
+		runtimeConfig = runtimeConfig.WithMemoryLimitPages(cfg.MemoryLimitPages)
+	}
 	return wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
 }
 
@@ -23,22 +38,3 @@ func WithExecutionTimeout(parent context.Context, timeout time.Duration) (contex
 	ctx, cancel := context.WithTimeout(parent, timeout)
 	return context.WithValue(ctx, executionTimeoutKey{}, timeout), cancel
 }
-
-// HumanizeExecutionError rewrites low-level runtime cancellation/timeout errors
-// into messages focused on wasm module execution behavior.
-func HumanizeExecutionError(ctx context.Context, err error) error {
-	if err == nil {
-		return nil
-	}
-	timeoutText := ""
-	if timeout, ok := ctx.Value(executionTimeoutKey{}).(time.Duration); ok && timeout > 0 {
-		timeoutText = " (" + timeout.String() + ")"
-	}
-	if errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), "context deadline exceeded") {
-		return errors.New("Wasm module exceeded the execution time limit" + timeoutText)
-	}
-	if errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "context canceled") {
-		return errors.New("Wasm module execution was canceled")
-	}
-	return err
-}
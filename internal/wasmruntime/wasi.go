@@ -0,0 +1,52 @@
+package wasmruntime
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// ImportsWASI reports whether compiled imports any function from WASI
+// preview1, which makes it a command that reads stdin and writes stdout
+// rather than a module following the run contract.
+func ImportsWASI(compiled wazero.CompiledModule) bool {
+	for _, fn := range compiled.ImportedFunctions() {
+		if module, _, _ := fn.Import(); module == wasi_snapshot_preview1.ModuleName {
+			return true
+		}
+	}
+	return false
+}
+
+// InstantiateWASI makes the WASI preview1 host functions available to
+// modules in runtime. It does nothing if they already are.
+func InstantiateWASI(ctx context.Context, runtime wazero.Runtime) error {
+	if runtime.Module(wasi_snapshot_preview1.ModuleName) != nil {
+		return nil
+	}
+	_, err := wasi_snapshot_preview1.Instantiate(ctx, runtime)
+	return err
+}
+
+// WASIConfig returns the configuration of a sandboxed WASI command instance
+// named name. It gets no arguments, no environment variables and no
+// preopened directories, so no filesystem or sockets. The clocks are
+// fixed at the Unix epoch, sleeping returns at once, and random bytes come
+// from a fixed seed, so a command given the same stdin writes the same
+// stdout. The start function is not run; call _start on the instance.
+func WASIConfig(name string, stdin io.Reader, stdout, stderr io.Writer) wazero.ModuleConfig {
+	return wazero.NewModuleConfig().
+		WithName(name).
+		WithStdin(stdin).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithStartFunctions().
+		WithWalltime(func() (int64, int32) { return 0, 0 }, sys.ClockResolution(1)).
+		WithNanotime(func() int64 { return 0 }, sys.ClockResolution(1)).
+		WithNanosleep(func(int64) {}).
+		WithRandSource(rand.NewChaCha8([32]byte{}))
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"html"
 	"image"
 	"image/draw"
@@ -20,6 +23,7 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"maps"
 	"math"
 	"mime"
 	"net/http"
@@ -29,6 +33,8 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	goruntime "runtime"
+	"runtime/debug"
 	"slices"
 	"sort"
 	"strconv"
@@ -41,9 +47,16 @@ import (
 	"unsafe"
 
 	qinternal "github.com/royalicing/qip/internal"
+	"github.com/royalicing/qip/internal/charset"
+	"github.com/royalicing/qip/internal/hostmodule"
+	"github.com/royalicing/qip/internal/modulemeta"
+	"github.com/royalicing/qip/internal/modulesource"
+	"github.com/royalicing/qip/internal/tracing"
+	"github.com/royalicing/qip/internal/wasmprofile"
 	"github.com/royalicing/qip/internal/wasmruntime"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
 )
 
 type dataEncoding uint8
@@ -52,11 +65,130 @@ const (
 	dataEncodingRaw dataEncoding = iota
 	dataEncodingUTF8
 	dataEncodingArrayI32
+	dataEncodingArrayF32
+	dataEncodingArrayF64
+	dataEncodingArrayI64
+	dataEncodingArrayU8
 )
 
+// itemSize returns the size in bytes of one output item: an array element
+// for typed arrays, otherwise a byte.
+func (encoding dataEncoding) itemSize() int {
+	switch encoding {
+	case dataEncodingArrayI32, dataEncodingArrayF32:
+		return 4
+	case dataEncodingArrayF64, dataEncodingArrayI64:
+		return 8
+	default:
+		return 1
+	}
+}
+
+// typedArray reports whether the encoding is an array of numbers rather
+// than bytes or text.
+func (encoding dataEncoding) typedArray() bool {
+	return encoding != dataEncodingRaw && encoding != dataEncodingUTF8
+}
+
+// utf8Checker validates text that a module's *_utf8_cap exports promise is
+// UTF-8, one chunk at a time. A character split across chunks is held until
+// the next chunk completes it. A nil checker accepts anything.
+type utf8Checker struct {
+	kind wasmruntime.Kind
+	// side is "Input" or "Output", naming the boundary in errors.
+	side    string
+	offset  int
+	pending []byte
+}
+
+// newUTF8Checker returns a checker for text at side of a module whose
+// encoding is encoding, or nil when the encoding is not UTF-8. Invalid input
+// is reported as invalid input, invalid output as a broken contract.
+func newUTF8Checker(encoding dataEncoding, side string) *utf8Checker {
+	if encoding != dataEncodingUTF8 {
+		return nil
+	}
+	kind := wasmruntime.KindInvalidInput
+	if side == "Output" {
+		kind = wasmruntime.KindContract
+	}
+	return &utf8Checker{kind: kind, side: side}
+}
+
+// checkUTF8 validates a whole input or output of a module with encoding.
+func checkUTF8(encoding dataEncoding, side string, data []byte) error {
+	checker := newUTF8Checker(encoding, side)
+	if err := checker.check(data); err != nil {
+		return err
+	}
+	return checker.finish()
+}
+
+func (c *utf8Checker) check(chunk []byte) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.pending) > 0 {
+		head := append(c.pending, chunk[:min(len(chunk), utf8.UTFMax-len(c.pending))]...)
+		if !utf8.FullRune(head) {
+			c.pending = head
+			return nil
+		}
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size <= 1 {
+			return c.invalid(0)
+		}
+		chunk = chunk[size-len(c.pending):]
+		c.offset += size
+		c.pending = c.pending[:0]
+	}
+	complete := len(chunk) - incompleteRuneSuffix(chunk)
+	if !utf8.Valid(chunk[:complete]) {
+		for i := 0; i < complete; {
+			r, size := utf8.DecodeRune(chunk[i:complete])
+			if r == utf8.RuneError && size <= 1 {
+				return c.invalid(i)
+			}
+			i += size
+		}
+	}
+	c.offset += complete
+	c.pending = append(c.pending, chunk[complete:]...)
+	return nil
+}
+
+// finish reports text that ends partway through a character.
+func (c *utf8Checker) finish() error {
+	if c == nil || len(c.pending) == 0 {
+		return nil
+	}
+	return c.invalid(0)
+}
+
+func (c *utf8Checker) invalid(at int) error {
+	return wasmruntime.Errorf(c.kind, "%s is not valid UTF-8 at byte %d", c.side, c.offset+at)
+}
+
+// incompleteRuneSuffix returns the length of a character at the end of b
+// that has been started but not finished.
+func incompleteRuneSuffix(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
 const tileSize = 64
 
 type tileStage struct {
+	// index and path identify the stage in errors.
+	index       int
+	path        string
 	mod         api.Module
 	mem         api.Memory
 	tileFunc    api.Function
@@ -68,14 +200,30 @@ type tileStage struct {
 	tileSpan    int
 }
 
-type imageModuleSpec struct {
+// moduleSpec is one stage of a chain as given on the command line or in a
+// pipeline manifest. Everything but path is optional.
+type moduleSpec struct {
 	path     string
+	sha256   string
 	uniforms map[string]string
+	timeout  time.Duration
+	// inputEncoding and outputEncoding name the contract encodings ("utf8",
+	// "bytes", "i32", "f32", "f64", "i64", "u8") the stage is declared to use.
+	inputEncoding  string
+	outputEncoding string
+	// guard makes a stage with output exports act as a guard that accepts
+	// its input when it produces any output.
+	guard bool
+	// grants lists the qip_v1 host functions the stage may import.
+	grants []hostmodule.Capability
 }
 
 type contentData struct {
 	bytes    []byte
 	encoding dataEncoding
+	// contentType is the MIME type declared by the module that produced
+	// the bytes, if any.
+	contentType string
 }
 
 type runtimeMode string
@@ -88,20 +236,216 @@ const (
 type options struct {
 	verbose bool
 	mode    runtimeMode
+	policy  resourcePolicy
+	modules *modulesource.Resolver
+	// reuseInstances pools warm run stage instances in module chains.
+	reuseInstances bool
+	// format renders typed array output in qip run.
+	format outputFormat
+	// inputs holds the named inputs bound with qip run -i name=path. Every
+	// stage that declares an input of that name receives it.
+	inputs map[string][]byte
+	// traceDir, when set, makes module chains keep each stage's output so
+	// runs can be written out with --trace.
+	traceDir string
+	// now is what qip_v1.now_unix_ms returns. When zero, each chain run
+	// freezes the time it started.
+	now time.Time
+	// seed seeds qip_v1.random_fill.
+	seed uint64
+	// moduleLog receives qip_v1.log messages. When nil, they are verbose
+	// output.
+	moduleLog io.Writer
+}
+
+// resourcePolicy bounds what each module stage may consume. Zero values mean
+// no limit, except stageTimeout which every command sets.
+type resourcePolicy struct {
+	maxMemoryPages uint32
+	stageTimeout   time.Duration
+	maxOutputBytes uint64
+	maxInputBytes  uint64
+}
+
+// resourcePolicyFile is the JSON form of a resource policy read via --policy.
+type resourcePolicyFile struct {
+	MaxMemoryPages uint32 `json:"max_memory_pages"`
+	TimeoutMS      int64  `json:"timeout_ms"`
+	MaxOutputBytes uint64 `json:"max_output_bytes"`
+	MaxInputBytes  uint64 `json:"max_input_bytes"`
+}
+
+type policyFlags struct {
+	path           string
+	maxMemoryPages uint
+	timeoutMS      int
+	maxOutputBytes uint64
+	maxInputBytes  uint64
+}
+
+func registerPolicyFlags(fs *flag.FlagSet, defaultTimeoutMS int) *policyFlags {
+	pf := &policyFlags{timeoutMS: defaultTimeoutMS}
+	fs.StringVar(&pf.path, "policy", "", "resource policy JSON file")
+	fs.UintVar(&pf.maxMemoryPages, "max-memory-pages", 0, "max linear memory per module in 64 KiB pages")
+	fs.IntVar(&pf.timeoutMS, "timeout-ms", defaultTimeoutMS, "per-stage execution timeout in milliseconds")
+	fs.Uint64Var(&pf.maxOutputBytes, "max-output-bytes", 0, "max output bytes per stage")
+	fs.Uint64Var(&pf.maxInputBytes, "max-input-bytes", 0, "max input bytes per stage")
+	return pf
+}
+
+// resolve builds the policy from defaults, then the --policy file, then any
+// policy flags explicitly set on the command line.
+func (pf *policyFlags) resolve(fs *flag.FlagSet) (resourcePolicy, error) {
+	policy := resourcePolicy{}
+	defaultTimeout, err := strconv.Atoi(fs.Lookup("timeout-ms").DefValue)
+	if err != nil {
+		return resourcePolicy{}, err
+	}
+	policy.stageTimeout = time.Duration(defaultTimeout) * time.Millisecond
+
+	if pf.path != "" {
+		filePolicy, err := readResourcePolicyFile(pf.path)
+		if err != nil {
+			return resourcePolicy{}, err
+		}
+		if filePolicy.MaxMemoryPages != 0 {
+			policy.maxMemoryPages = filePolicy.MaxMemoryPages
+		}
+		if filePolicy.TimeoutMS < 0 {
+			return resourcePolicy{}, fmt.Errorf("Invalid policy timeout_ms: %d", filePolicy.TimeoutMS)
+		}
+		if filePolicy.TimeoutMS != 0 {
+			policy.stageTimeout = time.Duration(filePolicy.TimeoutMS) * time.Millisecond
+		}
+		if filePolicy.MaxOutputBytes != 0 {
+			policy.maxOutputBytes = filePolicy.MaxOutputBytes
+		}
+		if filePolicy.MaxInputBytes != 0 {
+			policy.maxInputBytes = filePolicy.MaxInputBytes
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-memory-pages":
+			policy.maxMemoryPages = uint32(min(pf.maxMemoryPages, math.MaxUint32))
+		case "timeout-ms":
+			policy.stageTimeout = time.Duration(pf.timeoutMS) * time.Millisecond
+		case "max-output-bytes":
+			policy.maxOutputBytes = pf.maxOutputBytes
+		case "max-input-bytes":
+			policy.maxInputBytes = pf.maxInputBytes
+		}
+	})
+
+	if policy.stageTimeout <= 0 {
+		return resourcePolicy{}, fmt.Errorf("Invalid timeout-ms: %d", policy.stageTimeout.Milliseconds())
+	}
+	if policy.maxMemoryPages > 65536 {
+		return resourcePolicy{}, fmt.Errorf("Invalid max-memory-pages: %d (wasm32 allows at most 65536)", policy.maxMemoryPages)
+	}
+	return policy, nil
+}
+
+func readResourcePolicyFile(path string) (resourcePolicyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return resourcePolicyFile{}, fmt.Errorf("Error reading policy file: %w", err)
+	}
+	var filePolicy resourcePolicyFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&filePolicy); err != nil {
+		return resourcePolicyFile{}, fmt.Errorf("Invalid policy file %s: %v", path, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return resourcePolicyFile{}, fmt.Errorf("Invalid policy file %s: unexpected content after the policy object", path)
+	}
+	return filePolicy, nil
+}
+
+// compileError explains why a module failed to compile, calling out memory
+// declarations that the runtime rejected against max_memory_pages.
+func (policy resourcePolicy) compileError(err error) error {
+	if policy.maxMemoryPages > 0 && strings.Contains(err.Error(), "over limit of") {
+		return wasmruntime.Errorf(wasmruntime.KindCapacity, "Wasm module memory exceeds policy max_memory_pages (%d)", policy.maxMemoryPages)
+	}
+	return wasmruntime.Errorf(wasmruntime.KindCompile, "Wasm module could not be compiled")
+}
+
+// runtimeConfig returns the wasm runtime limits for this policy.
+func (policy resourcePolicy) runtimeConfig() wasmruntime.Config {
+	return wasmruntime.Config{MemoryLimitPages: policy.maxMemoryPages}
+}
+
+func (policy resourcePolicy) checkInputSize(size uint64) error {
+	if policy.maxInputBytes > 0 && size > policy.maxInputBytes {
+		return wasmruntime.Errorf(wasmruntime.KindCapacity, "Input of %d bytes exceeds policy max_input_bytes (%d)", size, policy.maxInputBytes)
+	}
+	return nil
+}
+
+func (policy resourcePolicy) checkOutputSize(size uint64) error {
+	if policy.maxOutputBytes > 0 && size > policy.maxOutputBytes {
+		return wasmruntime.Errorf(wasmruntime.KindCapacity, "Module output exceeds policy max_output_bytes (%d)", policy.maxOutputBytes)
+	}
+	return nil
+}
+
+// limitOutput wraps emit so the total bytes passed through it are held to
+// the policy's max output bytes.
+func (policy resourcePolicy) limitOutput(emit func([]byte) error) func([]byte) error {
+	if policy.maxOutputBytes == 0 {
+		return emit
+	}
+	var total uint64
+	return func(chunk []byte) error {
+		total += uint64(len(chunk))
+		if err := policy.checkOutputSize(total); err != nil {
+			return err
+		}
+		return emit(chunk)
+	}
+}
+
+// stageContext applies the wall time for the given stages to ctx. Each stage
+// gets its own timeout if it declares one, otherwise the policy's. Stages that
+// run interleaved, like a block of image stages, share the sum of their limits.
+func (policy resourcePolicy) stageContext(ctx context.Context, specs ...moduleSpec) (context.Context, context.CancelFunc) {
+	var total time.Duration
+	for _, spec := range specs {
+		total += policy.timeoutFor(spec)
+	}
+	if total <= 0 {
+		return ctx, func() {}
+	}
+	return wasmruntime.WithExecutionTimeout(ctx, total)
+}
+
+func (policy resourcePolicy) timeoutFor(spec moduleSpec) time.Duration {
+	if spec.timeout > 0 {
+		return spec.timeout
+	}
+	return policy.stageTimeout
 }
 
-const usageMain = "Usage: qip <command> [args]\n\nCommands:\n  run   Run a chain of wasm modules on input\n  bench Compare one or more wasm modules for output parity and performance\n  image Run wasm filters on an input image\n  dev   Start a dev server for a content directory with optional recipes\n  form  Run an interactive wasm form module in the terminal\n  help  Show command help"
-const usageRun = "Usage: qip run [-v] [-i <input>] <wasm module URL or file>..."
-const usageBench = "Usage: qip bench -i <input> [-r <benchmark runs> | --benchtime=<duration>] [--timeout-ms <ms>] <module1> [module2 ...]"
-const usageImage = "Usage: qip image -i <input image path or -> -o <output image path> [--timeout-ms <ms>] [-v] <wasm module URL or file> [?key=value ...] ..."
-const usageDev = "Usage: qip dev <content_dir> [--recipes <recipes_dir>] [--forms <forms_dir>] [--mode <dev|prod>] [-p <port>] [-v|--verbose]"
-const usageForm = "Usage: qip form [-v|--verbose] <wasm module URL or file>"
-const usageHelp = "Usage: qip help [command]"
+const usageMain = "Usage: qip <command> [args]\n\nCommands:\n  run    Run a chain of wasm modules on input\n  bench  Compare one or more wasm modules for output parity and performance\n  image  Run wasm filters on an input image\n  dev    Start a dev server for a content directory with optional recipes\n  form   Run an interactive wasm form module in the terminal\n  lock   Record the sha256 of remote modules in qip.lock\n  verify Re-run a receipt written by run --receipt and check its digests\n  cache  List, clean, or verify the remote module cache\n  help   Show command help"
+const usageRun = "Usage: qip run [-v] [-i <input or glob> ...] [-i <name>=<path> ...] [-o <output file or directory>] [--out-name <template>] [--split=line|nul|<delim>] [--jobs <n>] [--on-error=skip|fail|mark] [--format=hex|dec|json|csv|raw] [--trace <dir>] [--trace-format=dump|chrome] [--receipt <file>] [--input-charset=utf-8|utf-16|latin1] [--grant <stage>=<capability>,...] [--now <time>] [--seed <n>] [policy flags] [module source flags] (-f <pipeline.json> | <wasm module URL or file> [?key=value ...] ...)"
+const usageBench = "Usage: qip bench -i <input> [-r <benchmark runs> | --benchtime=<duration>] [--profile <file.pprof>] [policy flags] [module source flags] (-f <pipeline.json> | <module1> [module2 ...])"
+const usageImage = "Usage: qip image -i <input image path, glob, or -> ... -o <output image path or directory> [--out-name <template>] [--jobs <n>] [--trace <dir>] [--trace-format=dump|chrome] [policy flags] [module source flags] [-v] (-f <pipeline.json> | <wasm module URL or file> [?key=value ...] ...)"
+const usageDev = "Usage: qip dev <content_dir> [--recipes <recipes_dir>] [--forms <forms_dir>] [--mode <dev|prod>] [-p <port>] [--no-instance-reuse] [--query-uniforms] [--trace <dir>] [--trace-format=dump|chrome] [--otlp-endpoint <url>] [policy flags] [module source flags] [-v|--verbose]"
+const usageModuleSource = "Module source flags:\n  --offline                Use only cached remote modules; never fetch\n  --refresh                Fetch unpinned remote modules again instead of using cached copies\n  --locked                 Require every remote module to be pinned in the lockfile\n  --lock-file <path>       Lockfile to read (default qip.lock)"
+const usagePolicy = "Policy flags:\n  --policy <file>          JSON file with max_memory_pages, timeout_ms, max_output_bytes, max_input_bytes\n  --max-memory-pages <n>   Max linear memory per module in 64 KiB pages\n  --timeout-ms <ms>        Per-stage execution timeout (run/dev 100, bench 250, image 4000)\n  --max-output-bytes <n>   Max output bytes per stage\n  --max-input-bytes <n>    Max input bytes per stage\n  Flags override values from the policy file."
+const usageForm = "Usage: qip form [-v|--verbose] [--offline] [--refresh] [--locked] <wasm module URL or file>"
+const usageCache = "Usage: qip cache <ls|gc|verify>\n\n  ls                     List cached remote modules\n  gc [--max-age <dur>]   Remove unreferenced modules, and entries older than --max-age\n  verify                 Rehash cached modules and report corrupt ones\n\nThe cache lives in $QIP_CACHE_DIR, or qip under the user cache directory."
+const usageVerify = "Usage: qip verify <receipt.json> [-i <input>] [-i <name>=<path> ...] [policy flags] [module source flags]\n\nRe-runs the chain recorded by qip run --receipt and checks that the input, every module, and the output match their sha256 digests. Module paths are resolved as they were given to qip run. Floating-point results can differ between wazero versions, so a receipt is only sure to verify with the wazero version that made it."
+const usageLock = "Usage: qip lock [--lock-file <path>] (-f <pipeline.json> | <wasm module URL>...)"
+const usageHelp = "Usage: qip help [command | module]"
 
 var qipFormTagPattern = regexp.MustCompile(`(?is)<qip-form\b[^>]*>`)
 var qipFormNamePattern = regexp.MustCompile("(?is)\\bname\\s*=\\s*(?:\"([^\"]*)\"|'([^']*)'|([^\\s\"'=<>`]+))")
 
-const helpRun = "Usage: qip run [-v] [-i <input>] <wasm module URL or file>...\n\nModule contracts:\n  Run mode:\n    - Exports run(input_size), input_ptr, and input_utf8_cap or input_bytes_cap\n    - Exports output_ptr and output_utf8_cap or output_bytes_cap or output_i32_cap\n  Image mode:\n    - Exports tile_rgba_f32_64x64, input_ptr, input_bytes_cap\n    - Optional: uniform_set_width_and_height, calculate_halo_px\n\nComposition:\n  If a module exports tile_rgba_f32_64x64, qip run composes a contiguous image stage block.\n  Input to that block must be BMP bytes and the block outputs BMP bytes.\n  Run stages may follow and will receive BMP bytes.\n\nExample:\n  echo '<svg width=\"32\" height=\"32\"><rect width=\"32\" height=\"32\" fill=\"#d52b1e\" /><rect x=\"13\" y=\"6\" width=\"6\" height=\"20\" fill=\"#ffffff\" /><rect x=\"6\" y=\"13\" width=\"20\" height=\"6\" fill=\"#ffffff\" /></svg>' | ./qip run examples/svg-rasterize.wasm examples/bmp-double.wasm examples/bmp-to-ico.wasm > out.ico"
+const helpRun = "Usage: qip run [-v] [-i <input or glob> ...] [-i <name>=<path> ...] [-o <output file or directory>] [--out-name <template>] [-f <pipeline.json>] [--split=line|nul|<delim>] [--jobs <n>] [--on-error=skip|fail|mark] [--format=hex|dec|json|csv|raw] [--trace <dir>] [--trace-format=dump|chrome] [--receipt <file>] [--input-charset=utf-8|utf-16|latin1] [--grant <stage>=<capability>,...] [--now <time>] [--seed <n>] [policy flags] [module source flags] <wasm module URL or file>...\n\nModule contracts:\n  Run mode:\n    - Exports run(input_size), input_ptr, and input_utf8_cap or input_bytes_cap\n    - Exports output_ptr and output_utf8_cap or output_bytes_cap\n    - Or a typed array: output_i32_cap, output_i64_cap, output_f32_cap, output_f64_cap, or output_u8_cap\n  Chunked run mode:\n    - Exports run_chunk(chunk_size) and finish() instead of run(input_size)\n    - Input of any size is written one input_*_cap window at a time\n  Output continuation:\n    - Optional: output_more() returns the size of further output at output_ptr, 0 when done\n  Error messages:\n    - Optional: error_message_ptr and error_message_size explain a trap or empty output\n  Content type:\n    - Optional: output_content_type_ptr and output_content_type_size declare the output's MIME type\n  Named inputs:\n    - Optional: input_set_<name>_size(size), input_<name>_ptr, input_<name>_cap\n    - Bind each with -i <name>=<path>\n  Image mode:\n    - Exports tile_rgba_f32_64x64, input_ptr, input_bytes_cap\n    - Optional: uniform_set_width_and_height, calculate_halo_px\n  Host functions:\n    - Optional: import log(ptr, len), now_unix_ms(), or random_fill(ptr, len) from qip_v1\n    - Each stage must be granted what it imports with --grant <stage>=<capability>,...\n  WASI command:\n    - Imports wasi_snapshot_preview1 and exports _start\n    - Reads the input from stdin and writes the output to stdout, with no filesystem, network, arguments, or environment\n  Metadata:\n    - Optional: a qip.meta custom section declares the module's name, contract, and uniform types and ranges; see qip help <module>\n\nBatch records:\n  --split=line|nul|<delim>  Run each record through the chain, writing outputs in input order\n  --jobs <n>                Records or files to run concurrently (default: number of CPUs)\n  --on-error=skip|fail|mark What to do when a record fails (default: fail)\n\nOutput file:\n  -o <output>  Write output to a file, adding an extension from the declared content type if it has none\n\nBatch files:\n  -i <glob> ... -o <dir>  Run each input file through the chain, writing one output file each\n  --out-name <template>   Output file name, using {name} and {ext} (default: {name}{ext})\n\nTracing:\n  --trace <dir>                     Write each stage's output and a trace.json of timings and digests to dir\n  --trace-format=dump|chrome        With chrome, write chrome-trace.json of spans for Perfetto instead (default: dump)\n\nReceipts:\n  --receipt <file>  Write the digests of the input, each module, and the output, with sources and uniforms, as JSON\n  qip verify <file> re-runs the chain and checks every digest\n\nText:\n  Input to a module exporting input_utf8_cap, and output from one exporting output_utf8_cap, must be valid UTF-8\n  --input-charset=utf-16|latin1  Transcode input to UTF-8 before the first stage; UTF-16 needs a byte order mark\n\nHost functions:\n  --grant <stage>=log,now_unix_ms,random_fill  Let a stage import qip_v1 host functions (repeatable)\n  --now <ms or RFC 3339>                      Time now_unix_ms returns (default: when the command starts)\n  --seed <n>                                  Seed for random_fill, combined with the stage index and record number (default: 0)\n\nTyped array output:\n  --format=hex|dec|json|csv|raw  How to print it (default: hex for i32, dec otherwise)\n\nComposition:\n  If a module exports tile_rgba_f32_64x64, qip run composes a contiguous image stage block.\n  Input to that block must be BMP bytes and the block outputs BMP bytes.\n  Run stages may follow and will receive BMP bytes.\n\nExample:\n  echo '<svg width=\"32\" height=\"32\"><rect width=\"32\" height=\"32\" fill=\"#d52b1e\" /><rect x=\"13\" y=\"6\" width=\"6\" height=\"20\" fill=\"#ffffff\" /><rect x=\"6\" y=\"13\" width=\"20\" height=\"6\" fill=\"#ffffff\" /></svg>' | ./qip run examples/svg-rasterize.wasm examples/bmp-double.wasm examples/bmp-to-ico.wasm > out.ico"
 
 func main() {
 	args := os.Args[1:]
@@ -126,6 +470,12 @@ func main() {
 		devCmd(args[1:])
 	} else if args[0] == "form" {
 		formCmd(args[1:])
+	} else if args[0] == "lock" {
+		lockCmd(args[1:])
+	} else if args[0] == "cache" {
+		cacheCmd(args[1:])
+	} else if args[0] == "verify" {
+		verifyCmd(args[1:])
 	} else {
 		gameOver(usageMain)
 	}
@@ -141,2949 +491,6677 @@ func helpCmd(args []string) {
 	switch args[0] {
 	case "run":
 		fmt.Println(helpRun)
+		fmt.Println()
+		fmt.Println(usagePolicy)
+		fmt.Println()
+		fmt.Println(usageModuleSource)
 	case "bench":
 		fmt.Println(usageBench)
+		fmt.Println()
+		fmt.Println(usagePolicy)
+		fmt.Println()
+		fmt.Println(usageModuleSource)
 	case "image":
 		fmt.Println(usageImage)
+		fmt.Println()
+		fmt.Println(usagePolicy)
+		fmt.Println()
+		fmt.Println(usageModuleSource)
 	case "dev":
 		fmt.Println(usageDev)
+		fmt.Println()
+		fmt.Println(usagePolicy)
+		fmt.Println()
+		fmt.Println(usageModuleSource)
 	case "form":
 		fmt.Println(usageForm)
+	case "lock":
+		fmt.Println(usageLock)
+	case "cache":
+		fmt.Println(usageCache)
+	case "verify":
+		fmt.Println(usageVerify)
+		fmt.Println()
+		fmt.Println(usagePolicy)
+		fmt.Println()
+		fmt.Println(usageModuleSource)
 	default:
+		if strings.HasSuffix(args[0], ".wasm") || strings.HasPrefix(args[0], "https://") || strings.HasPrefix(args[0], "http://") {
+			if err := moduleHelp(os.Stdout, args[0]); err != nil {
+				gameOver("%v", err)
+			}
+			return
+		}
 		gameOver(usageHelp)
 	}
 }
 
-func formCmd(args []string) {
-	if err := qinternal.RunFormCommand(args); err != nil {
-		gameOver("%v", err)
+// moduleHelp describes the module at path from its qip.meta section, or
+// from its exports when it has none.
+func moduleHelp(w io.Writer, path string) error {
+	body, err := readModulePath(path, options{})
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	runtime := wasmruntime.New(ctx)
+	defer runtime.Close(ctx)
+	cm, err := runtime.CompileModule(ctx, body)
+	if err != nil {
+		return wasmruntime.Errorf(wasmruntime.KindCompile, "%w", err)
+	}
+	meta, err := modulemeta.FromCompiled(cm)
+	if err != nil {
+		return wasmruntime.Errorf(wasmruntime.KindContract, "%w", err)
+	}
+	exportedFuncs := cm.ExportedFunctions()
+	kind := stageKindRun
+	if _, ok := exportedFuncs["tile_rgba_f32_64x64"]; ok {
+		kind = stageKindTile
+	} else if wasmruntime.ImportsWASI(cm) {
+		kind = stageKindWASI
+	}
+	_, chunked := exportedFuncs["run_chunk"]
+	if meta == nil {
+		meta = &modulemeta.Meta{}
 	}
-}
-
-func readModulePath(path string, opts options) ([]byte, error) {
-	var body []byte
 
-	if strings.HasPrefix(path, "https://") {
-		resp, err := http.Get(path)
-		if err != nil {
-			return nil, fmt.Errorf("Error fetching URL: %v", err)
-		}
-		defer resp.Body.Close()
+	title := path
+	if meta.Name != "" {
+		title = strings.TrimSpace(meta.Name + " " + meta.Version)
+	}
+	fmt.Fprintln(w, title)
+	if meta.Description != "" {
+		fmt.Fprintf(w, "  %s\n", meta.Description)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "ABI: %s\n", cmp.Or(meta.ABI, stageABI(kind, chunked)))
+	if meta.Input != "" {
+		fmt.Fprintf(w, "Input: %s\n", meta.Input)
+	}
+	if meta.Output != "" {
+		fmt.Fprintf(w, "Output: %s\n", meta.Output)
+	}
+	if imports := hostmodule.Imports(cm); len(imports) > 0 {
+		fmt.Fprintf(w, "Imports from %s: %v\n", hostmodule.ModuleName, imports)
+	}
 
-		body, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("Error reading response: %v", err)
+	uniforms := meta.Uniforms
+	if uniforms == nil {
+		// Undeclared uniforms are listed from their setters' parameter types.
+		for _, name := range slices.Sorted(maps.Keys(exportedFuncs)) {
+			key, ok := strings.CutPrefix(name, "uniform_set_")
+			if !ok || key == "width_and_height" {
+				continue
+			}
+			u := modulemeta.Uniform{Name: key}
+			if params := exportedFuncs[name].ParamTypes(); len(params) == 1 {
+				u.Type = api.ValueTypeName(params[0])
+			}
+			uniforms = append(uniforms, u)
 		}
-	} else {
-		var err error
-		body, err = os.ReadFile(path)
-		if err != nil {
-			return nil, fmt.Errorf("Error reading file: %v", err)
+	}
+	if len(uniforms) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Uniforms:")
+		for _, u := range uniforms {
+			details := []string{u.Type}
+			if r := u.Range(); r != "" {
+				details = append(details, r)
+			}
+			if u.Default != nil {
+				details = append(details, "default "+modulemeta.FormatNumber(*u.Default))
+			}
+			fmt.Fprintf(w, "  %s (%s)\n", u.Name, strings.Join(details, ", "))
+			if u.Description != "" {
+				fmt.Fprintf(w, "      %s\n", u.Description)
+			}
 		}
 	}
 
-	if opts.verbose {
-		moduleDigest := sha256.Sum256(body)
-		vlogf(opts, "module %s sha256: %x", path, moduleDigest)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Example:")
+	example := path
+	if len(uniforms) > 0 {
+		u := uniforms[0]
+		value := "0"
+		if u.Default != nil {
+			value = modulemeta.FormatNumber(*u.Default)
+		} else if u.Min != nil {
+			value = modulemeta.FormatNumber(*u.Min)
+		}
+		example += " '?" + u.Name + "=" + value + "'"
 	}
-
-	return body, nil
+	if kind == stageKindTile {
+		fmt.Fprintf(w, "  qip image -i input.png -o output.png %s\n", example)
+	} else {
+		fmt.Fprintf(w, "  qip run -i input %s\n", example)
+	}
+	return nil
 }
 
-func run(args []string) {
+// lockCmd fetches remote modules and records their digests in the lockfile,
+// keeping entries for modules it was not asked about.
+func lockCmd(args []string) {
 	opts := options{}
-	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs := flag.NewFlagSet("lock", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
-	var runVerbose bool
-	var inputPath string
-	fs.BoolVar(&runVerbose, "v", false, "enable verbose logging")
-	fs.BoolVar(&runVerbose, "verbose", false, "enable verbose logging")
-	fs.StringVar(&inputPath, "i", "", "input file path")
+	var lockVerbose bool
+	var manifestPath string
+	var lockPath string
+	fs.BoolVar(&lockVerbose, "v", false, "enable verbose logging")
+	fs.BoolVar(&lockVerbose, "verbose", false, "enable verbose logging")
+	fs.StringVar(&manifestPath, "f", "", "pipeline manifest path")
+	fs.StringVar(&lockPath, "lock-file", modulesource.DefaultLockfile, "lockfile to write")
 	if err := fs.Parse(args); err != nil {
-		gameOver("%s %v", usageRun, err)
-	}
-	opts.verbose = opts.verbose || runVerbose
-
-	modules := fs.Args()
-	if len(modules) < 1 {
-		gameOver(usageRun)
+		gameOver("%s %v", usageLock, err)
 	}
+	opts.verbose = lockVerbose
 
-	var input []byte
-	if inputPath == "-" {
+	specs := moduleSpecsFromArgs(fs.Args())
+	if manifestPath != "" {
+		if len(specs) > 0 {
+			gameOver("Use either -f <manifest> or module arguments, not both")
+		}
 		var err error
-		input, err = io.ReadAll(os.Stdin)
+		specs, err = loadPipelineManifest(manifestPath)
 		if err != nil {
-			gameOver("Error reading stdin: %v", err)
+			gameOver("%v", err)
 		}
-	} else if inputPath != "" {
-		var err error
-		input, err = os.ReadFile(inputPath)
+	}
+	if len(specs) == 0 {
+		gameOver(usageLock)
+	}
+
+	lock, err := modulesource.ReadLockfile(lockPath)
+	if errors.Is(err, os.ErrNotExist) {
+		lock = modulesource.NewLockfile()
+	} else if err != nil {
+		gameOver("%v", err)
+	}
+
+	resolver := &modulesource.Resolver{}
+	locked := 0
+	for _, spec := range specs {
+		ref, err := modulesource.ParseRef(spec.path)
 		if err != nil {
-			gameOver("Error reading input file: %v", err)
+			gameOver("%v", err)
 		}
-	} else {
-		stat, err := os.Stdin.Stat()
+		if !ref.Remote() {
+			vlogf(opts, "skipping local module %s", spec.path)
+			continue
+		}
+		module, err := resolver.Resolve(context.Background(), spec.path)
 		if err != nil {
-			gameOver("Error checking stdin: %v", err)
+			gameOver("%v", err)
 		}
-
-		// Check if stdin is a pipe or file (not a terminal)
-		if (stat.Mode() & os.ModeCharDevice) == 0 {
-			input, err = io.ReadAll(os.Stdin)
-			if err != nil {
-				gameOver("Error reading stdin: %v", err)
-			}
+		if spec.sha256 != "" && spec.sha256 != module.SHA256 {
+			gameOver("Module %s sha256 mismatch: got %s, want %s", spec.path, module.SHA256, spec.sha256)
 		}
+		lock.Set(ref.Location, module.SHA256)
+		fmt.Printf("%s %s\n", module.SHA256, ref.Location)
+		locked++
 	}
-
-	if opts.verbose {
-		inputDigest := sha256.Sum256(input)
-		vlogf(opts, "input sha256: %x", inputDigest)
+	if locked == 0 {
+		gameOver("No remote modules to lock")
 	}
-
-	start := time.Now()
-	defer func() {
-		if opts.verbose {
-			vlogf(opts, "command took %dms", time.Since(start).Milliseconds())
-		}
-	}()
-
-	chain, err := buildModuleChain(context.Background(), modules, opts)
-	if err != nil {
+	if err := lock.Write(lockPath); err != nil {
 		gameOver("%v", err)
 	}
-	defer chain.Close(context.Background())
-
-	execCtx := context.Background()
-	execCtx, cancel := wasmruntime.WithExecutionTimeout(execCtx, 100*time.Millisecond)
-	defer cancel()
+}
 
-	result, err := chain.run(execCtx, input, 0)
+func cacheCmd(args []string) {
+	if len(args) == 0 {
+		gameOver(usageCache)
+	}
+	dir, err := modulesource.DefaultCacheDir()
 	if err != nil {
 		gameOver("%v", err)
 	}
+	cache := modulesource.OpenCache(dir)
 
-	if result.output.encoding == dataEncodingRaw {
-		if _, err := os.Stdout.Write(result.output.bytes); err != nil {
-			gameOver("Error writing raw output: %v", err)
+	switch args[0] {
+	case "ls":
+		if len(args) != 1 {
+			gameOver(usageCache)
 		}
-	} else if result.output.encoding == dataEncodingUTF8 {
-		fmt.Printf("%s\n", result.output.bytes)
-	} else if result.output.encoding == dataEncodingArrayI32 {
-		if opts.verbose {
-			fmt.Fprintln(os.Stderr, result.output.bytes)
-		}
-
-		count := len(result.output.bytes) / 4
-		if count >= 1 {
-			bufSize := count * 9
-			writer := bufio.NewWriterSize(os.Stdout, bufSize)
-			defer writer.Flush()
-			for i := range count {
-				v := binary.LittleEndian.Uint32(result.output.bytes[i*4:])
-				if opts.verbose {
-					vlogf(opts, "u32: %d", v)
-				}
-				if _, err := fmt.Fprintf(writer, "%08x\n", v); err != nil {
-					gameOver("Error writing i32 output: %v", err)
-				}
-			}
+		entries, err := cache.Entries()
+		if err != nil {
+			gameOver("%v", err)
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s %10d %s %s\n", entry.SHA256, entry.Size, entry.FetchedAt.Format(time.RFC3339), entry.Location)
+		}
+	case "gc":
+		fs := flag.NewFlagSet("cache gc", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		var maxAge time.Duration
+		fs.DurationVar(&maxAge, "max-age", 0, "also remove entries fetched longer ago than this")
+		if err := fs.Parse(args[1:]); err != nil {
+			gameOver("%s %v", usageCache, err)
+		}
+		if fs.NArg() != 0 || maxAge < 0 {
+			gameOver(usageCache)
+		}
+		removed, err := cache.GC(maxAge)
+		if err != nil {
+			gameOver("%v", err)
+		}
+		fmt.Printf("removed %d cached modules from %s\n", removed, cache.Dir())
+	case "verify":
+		if len(args) != 1 {
+			gameOver(usageCache)
 		}
+		corrupt, err := cache.Verify()
+		if err != nil {
+			gameOver("%v", err)
+		}
+		for _, path := range corrupt {
+			fmt.Printf("corrupt: %s\n", path)
+		}
+		if len(corrupt) > 0 {
+			gameOver("%d cached modules are corrupt; they will be refetched on next use", len(corrupt))
+		}
+		fmt.Printf("cache ok: %s\n", cache.Dir())
+	default:
+		gameOver(usageCache)
 	}
 }
 
-type benchSample struct {
-	total          time.Duration
-	instantiation  time.Duration
-	run            time.Duration
-	memoryBytes    uint64
-	inputCapBytes  uint64
-	outputCapBytes uint64
+func formCmd(args []string) {
+	if err := qinternal.RunFormCommand(args); err != nil {
+		gameOver("%v", err)
+	}
 }
 
-type durationStats struct {
-	mean   time.Duration
-	min    time.Duration
-	max    time.Duration
-	stddev time.Duration
-	p95    time.Duration
-}
+func readModulePath(path string, opts options) ([]byte, error) {
+	resolver := opts.modules
+	if resolver == nil {
+		resolver = &modulesource.Resolver{}
+	}
+	module, err := resolver.Resolve(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
 
-type benchSummary struct {
-	total   durationStats
-	run     durationStats
-	inst    durationStats
-	meanMem uint64
-	peakMem uint64
+	if opts.verbose {
+		vlogf(opts, "module %s sha256: %s", path, module.SHA256)
+	}
+
+	return module.Body, nil
 }
 
-func benchCmd(args []string) {
-	opts := options{}
-	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-
-	var benchVerbose bool
-	var inputPath string
-	benchRuns := 1000
-	benchtimeStr := ""
-	timeoutMS := 250
-
-	fs.BoolVar(&benchVerbose, "v", false, "enable verbose logging")
-	fs.BoolVar(&benchVerbose, "verbose", false, "enable verbose logging")
-	fs.StringVar(&inputPath, "i", "", "input file path ('-' for stdin)")
-	fs.IntVar(&benchRuns, "r", benchRuns, "benchmark runs per module")
-	fs.StringVar(&benchtimeStr, "benchtime", benchtimeStr, "target measured time per module (e.g. 3s)")
-	fs.IntVar(&timeoutMS, "timeout-ms", timeoutMS, "per-run timeout in milliseconds")
+// readModuleSpec reads the module for spec and checks it against the spec's
+// pinned sha256, if any.
+func readModuleSpec(spec moduleSpec, opts options) ([]byte, error) {
+	body, err := readModulePath(spec.path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if spec.sha256 != "" {
+		digest := sha256.Sum256(body)
+		if got := hex.EncodeToString(digest[:]); got != spec.sha256 {
+			return nil, fmt.Errorf("%w: %s is %s, pinned %s", modulesource.ErrDigestMismatch, spec.path, got, spec.sha256)
+		}
+	}
+	return body, nil
+}
 
+func run(args []string) {
+	opts := options{}
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var runVerbose bool
+	var inputs runInputFlag
+	var manifestPath string
+	var splitRaw string
+	var onErrorRaw string
+	var formatRaw string
+	var outputPath string
+	var outputName string
+	var receiptPath string
+	var charsetRaw string
+	var nowRaw string
+	grants := grantFlag{}
+	jobs := goruntime.NumCPU()
+	fs.BoolVar(&runVerbose, "v", false, "enable verbose logging")
+	fs.BoolVar(&runVerbose, "verbose", false, "enable verbose logging")
+	fs.Var(&inputs, "i", "input file path or glob, or name=path for a named input (repeatable)")
+	fs.StringVar(&manifestPath, "f", "", "pipeline manifest path")
+	fs.StringVar(&outputPath, "o", "", "output file path; without an extension, one is added from the output's content type. With several inputs, the output directory")
+	fs.StringVar(&outputName, "out-name", defaultBatchNameTemplate, "with several inputs, output file name template using {name} and {ext}")
+	fs.StringVar(&splitRaw, "split", "", "run each record separately: line, nul, or a delimiter string")
+	fs.IntVar(&jobs, "jobs", jobs, "records or files to run concurrently")
+	fs.StringVar(&onErrorRaw, "on-error", string(onErrorFail), "with --split, what to do when a record fails: skip, fail, or mark")
+	fs.StringVar(&formatRaw, "format", "", "render typed array output as hex, dec, json, csv, or raw")
+	fs.StringVar(&receiptPath, "receipt", "", "write a JSON receipt of the input, module, and output digests")
+	fs.StringVar(&charsetRaw, "input-charset", "", "transcode input from utf-16 (with a byte order mark) or latin1 to UTF-8 before the first stage")
+	fs.Var(grants, "grant", "let a stage import qip_v1 host functions: <stage>=log,now_unix_ms,random_fill (repeatable)")
+	fs.StringVar(&nowRaw, "now", "", "time for qip_v1.now_unix_ms, as Unix milliseconds or RFC 3339 (default: when the run starts)")
+	fs.Uint64Var(&opts.seed, "seed", 0, "seed for qip_v1.random_fill")
+	traceFlags := registerTraceFlags(fs, "write each stage's output and timings to a directory")
+	policyFlags := registerPolicyFlags(fs, 100)
+	sourceFlags := modulesource.RegisterFlags(fs)
 	if err := fs.Parse(args); err != nil {
-		gameOver("%s %v", usageBench, err)
+		gameOver("%s %v", usageRun, err)
 	}
-	opts.verbose = benchVerbose
-
-	modules := fs.Args()
-	if inputPath == "" || len(modules) < 1 {
-		gameOver(usageBench)
+	opts.verbose = opts.verbose || runVerbose
+	policy, err := policyFlags.resolve(fs)
+	if err != nil {
+		gameOver("%v", err)
 	}
-	if benchRuns <= 0 {
-		gameOver("Invalid benchmark runs: %d", benchRuns)
+	moduleResolver, err := sourceFlags.Resolver()
+	if err != nil {
+		gameOver("%v", err)
 	}
-	if timeoutMS <= 0 {
-		gameOver("Invalid timeout-ms: %d", timeoutMS)
+	opts.policy = policy
+	opts.modules = moduleResolver
+	opts.format, err = parseOutputFormat(formatRaw)
+	if err != nil {
+		gameOver("%v", err)
 	}
-	var benchtime time.Duration
-	if benchtimeStr != "" {
-		parsed, err := time.ParseDuration(benchtimeStr)
+	opts.inputs, err = inputs.read()
+	if err != nil {
+		gameOver("%v", err)
+	}
+	if _, err := traceFlags.resolve(&opts); err != nil {
+		gameOver("%v", err)
+	}
+	inputCharset, err := charset.Parse(charsetRaw)
+	if err != nil {
+		gameOver("%v", err)
+	}
+	// Frozen for the whole command, so split records and batch files all
+	// see the same time.
+	opts.now = time.Now()
+	if nowRaw != "" {
+		opts.now, err = parseNow(nowRaw)
 		if err != nil {
-			gameOver("Invalid benchtime: %v", err)
-		}
-		if parsed <= 0 {
-			gameOver("Invalid benchtime: must be > 0")
+			gameOver("%v", err)
 		}
-		benchtime = parsed
 	}
+	opts.moduleLog = os.Stderr
 
-	var inputBytes []byte
-	var err error
-	if inputPath == "-" {
-		inputBytes, err = io.ReadAll(os.Stdin)
+	var split splitConfig
+	if splitRaw != "" {
+		split, err = parseSplitConfig(splitRaw, onErrorRaw, jobs)
 		if err != nil {
-			gameOver("Error reading stdin: %v", err)
+			gameOver("%v", err)
 		}
-	} else {
-		inputBytes, err = os.ReadFile(inputPath)
+	}
+	var batch batchConfig
+	if isBatch(inputs.paths, outputPath) {
+		if split.delimiter != nil {
+			gameOver("Use either --split or several inputs, not both")
+		}
+		batch, err = parseBatchConfig(inputs.paths, outputPath, outputName, jobs)
 		if err != nil {
-			gameOver("Error reading input file: %v", err)
+			gameOver("%v", err)
 		}
 	}
-
-	if opts.verbose {
-		inputDigest := sha256.Sum256(inputBytes)
-		vlogf(opts, "bench input sha256: %x", inputDigest)
+	if receiptPath != "" && (split.delimiter != nil || batch.inputs != nil) {
+		gameOver("A receipt records a single run; use --receipt without --split or several inputs")
 	}
 
-	ctx := context.Background()
-	runtime := wasmruntime.New(ctx)
-	defer runtime.Close(ctx)
-
-	moduleCount := len(modules)
-	compiled := make([]wazero.CompiledModule, moduleCount)
-	compileDur := make([]time.Duration, moduleCount)
-	moduleSizes := make([]uint64, moduleCount)
-	moduleGzipSizes := make([]uint64, moduleCount)
-	for i, modulePath := range modules {
-		body, err := readModulePath(modulePath, opts)
-		if err != nil {
-			gameOver("%v", err)
+	specs, err := parseModuleSpecs(fs.Args())
+	if err != nil {
+		gameOver("%s %v", usageRun, err)
+	}
+	if manifestPath != "" {
+		if len(specs) > 0 {
+			gameOver("Use either -f <manifest> or module arguments, not both")
 		}
-		moduleSizes[i] = uint64(len(body))
-		gzipSize, err := gzipSizeBytes(body)
+		specs, err = loadPipelineManifest(manifestPath)
 		if err != nil {
-			gameOver("Error gzipping module %s: %v", modulePath, err)
+			gameOver("%v", err)
 		}
-		moduleGzipSizes[i] = gzipSize
-		start := time.Now()
-		cm, err := runtime.CompileModule(ctx, body)
-		compileDur[i] = time.Since(start)
-		if err != nil {
-			gameOver("Wasm module could not be compiled")
+	}
+	if len(specs) < 1 {
+		gameOver(usageRun)
+	}
+	if err := grants.apply(specs); err != nil {
+		gameOver("%v", err)
+	}
+
+	start := time.Now()
+	defer func() {
+		if opts.verbose {
+			vlogf(opts, "command took %dms", time.Since(start).Milliseconds())
 		}
-		compiled[i] = cm
-		defer compiled[i].Close(ctx)
+	}()
+
+	ctx, finishTrace := traceFlags.startChrome(context.Background(), "qip run")
+	defer finishTrace()
+	var outputFile *runOutputFile
+	// fail exits like gameOver, first writing the trace and removing the
+	// unfinished -o file.
+	fail := func(format string, args ...any) {
+		outputFile.discard()
+		finishTrace()
+		gameOver(format, args...)
 	}
 
-	perRunTimeout := time.Duration(timeoutMS) * time.Millisecond
-	moduleInputCaps := make([]uint64, moduleCount)
-	moduleOutputCaps := make([]uint64, moduleCount)
-	firstSample, expected, err := runBenchSample(ctx, runtime, compiled[0], inputBytes, opts, "bench-0-check", perRunTimeout)
+	chain, err := buildModuleChainFromSpecs(ctx, specs, opts)
 	if err != nil {
-		gameOver("bench check failed for %s: %v", modules[0], err)
+		fail("%v", err)
 	}
-	moduleInputCaps[0] = firstSample.inputCapBytes
-	moduleOutputCaps[0] = firstSample.outputCapBytes
-	for i := 1; i < moduleCount; i++ {
-		sample, output, err := runBenchSample(ctx, runtime, compiled[i], inputBytes, opts, fmt.Sprintf("bench-%d-check", i), perRunTimeout)
+	defer chain.Close(context.Background())
+
+	if batch.inputs != nil {
+		summary, err := runBatch(ctx, batch, opts, func(ctx context.Context, index int, input []byte) ([]byte, string, error) {
+			input, err := charset.Decode(input, inputCharset)
+			if err != nil {
+				return nil, "", err
+			}
+			result, err := chain.run(ctx, input, uint64(index))
+			if opts.traceDir != "" {
+				if traceErr := chain.writeTrace(filepath.Join(opts.traceDir, filepath.Base(batch.inputs[index])), input, result, err); traceErr != nil && err == nil {
+					err = traceErr
+				}
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			output, err := formatOutputBytes(result.output, opts.format)
+			return output, extensionForContentType(result.output.contentType), err
+		})
 		if err != nil {
-			gameOver("bench check failed for %s: %v", modules[i], err)
+			fail("%v", err)
 		}
-		moduleInputCaps[i] = sample.inputCapBytes
-		moduleOutputCaps[i] = sample.outputCapBytes
-		if mismatch := describeContentMismatch(expected, output); mismatch != "" {
-			gameOver("bench mismatch for %s vs %s: %s", modules[i], modules[0], mismatch)
+		if opts.verbose {
+			vlogf(opts, "converted %d files with %d jobs", summary.files, batch.jobs)
 		}
+		return
 	}
 
-	samples := make([][]benchSample, moduleCount)
-	for i := range moduleCount {
-		samples[i] = make([]benchSample, 0, benchRuns)
+	stdout := bufio.NewWriter(os.Stdout)
+	if outputPath != "" {
+		outputFile, err = createRunOutputFile(outputPath)
+		if err != nil {
+			fail("%v", err)
+		}
+		stdout = bufio.NewWriter(outputFile.temp)
 	}
-	benchTimeTotals := make([]time.Duration, moduleCount)
-	for i := 0; ; i++ {
-		if benchtime == 0 && i >= benchRuns {
-			break
+	defer stdout.Flush()
+	// Output to stdout ends with a newline after text; an -o file gets the
+	// output exactly.
+	newlineAfter := func(encoding dataEncoding) bool {
+		return outputFile == nil && opts.format.newlineAfter(encoding)
+	}
+
+	if split.delimiter != nil {
+		inputReader, err := openRunInput(inputs.paths.single())
+		if err != nil {
+			fail("%v", err)
 		}
-		startIndex := i % moduleCount
-		for j := range moduleCount {
-			moduleIndex := (startIndex + j) % moduleCount
-			sample, output, err := runBenchSample(
-				ctx,
-				runtime,
-				compiled[moduleIndex],
-				inputBytes,
-				opts,
-				fmt.Sprintf("bench-%d-run-%d", moduleIndex, i),
-				perRunTimeout,
-			)
-			if err != nil {
-				gameOver("bench run failed for %s (run %d): %v", modules[moduleIndex], i+1, err)
-			}
-			if mismatch := describeContentMismatch(expected, output); mismatch != "" {
-				gameOver("bench output mismatch for %s (run %d): %s", modules[moduleIndex], i+1, mismatch)
+		defer inputReader.Close()
+		summary, err := chain.runSplit(ctx, charset.NewReader(inputReader, inputCharset), split, stdout)
+		if err != nil {
+			stdout.Flush()
+			fail("%v", err)
+		}
+		if summary.failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d of %d records failed\n", summary.failed, summary.records)
+		}
+		if err := closeRunOutput(stdout, outputFile, "", opts); err != nil {
+			fail("%v", err)
+		}
+		if opts.verbose {
+			vlogf(opts, "ran %d records with %d jobs", summary.records, split.jobs)
+		}
+		return
+	}
+
+	// Tracing keeps every stage's whole output, so it does not stream.
+	if chain.streaming() && opts.traceDir == "" {
+		inputReader, err := openRunInput(inputs.paths.single())
+		if err != nil {
+			fail("%v", err)
+		}
+		defer inputReader.Close()
+		inputDigest := newDigestWriter()
+		outputDigest := newDigestWriter()
+		out := newRunOutputWriter(stdout, opts.format)
+		final, err := chain.runStream(ctx, charset.NewReader(io.TeeReader(inputReader, inputDigest), inputCharset), 0, func(chunk contentData) error {
+			outputDigest.Write(chunk.bytes)
+			vlogTypedArray(opts, chunk)
+			return out.write(chunk)
+		})
+		if err == nil {
+			err = out.end(final.encoding)
+		}
+		if err != nil {
+			fail("%v", err)
+		}
+		if newlineAfter(final.encoding) {
+			if err := stdout.WriteByte('\n'); err != nil {
+				fail("Error writing output: %v", err)
 			}
-			samples[moduleIndex] = append(samples[moduleIndex], sample)
-			benchTimeTotals[moduleIndex] += sample.total
 		}
-		if benchtime > 0 && allDurationsAtLeast(benchTimeTotals, benchtime) {
-			break
+		if err := closeRunOutput(stdout, outputFile, final.contentType, opts); err != nil {
+			fail("%v", err)
+		}
+		if opts.verbose {
+			vlogf(opts, "input sha256: %x", inputDigest.hash.Sum(nil))
+		}
+		if receiptPath != "" {
+			receipt := chain.receipt(inputDigest.data(dataEncodingRaw, ""), inputCharset, outputDigest.data(final.encoding, final.contentType))
+			if err := writeReceipt(receiptPath, receipt); err != nil {
+				fail("%v", err)
+			}
 		}
+		return
 	}
 
-	summaries := make([]benchSummary, moduleCount)
-	for i := range moduleCount {
-		summaries[i] = summarizeBench(samples[i])
+	inputReader, err := openRunInput(inputs.paths.single())
+	if err != nil {
+		fail("%v", err)
+	}
+	rawInput, err := io.ReadAll(inputReader)
+	inputReader.Close()
+	if err != nil {
+		fail("Error reading input: %v", err)
 	}
 
-	digest := sha256.Sum256(expected.bytes)
-	if moduleCount == 1 {
-		fmt.Printf("bench: baseline output captured\n")
-	} else {
-		fmt.Printf("bench: outputs match\n")
+	if opts.verbose {
+		inputDigest := sha256.Sum256(rawInput)
+		vlogf(opts, "input sha256: %x", inputDigest)
 	}
-	fmt.Printf("  encoding: %s\n", encodingName(expected.encoding))
-	fmt.Printf("  bytes:    %d\n", len(expected.bytes))
-	fmt.Printf("  sha256:   %x\n", digest)
-	if benchtime > 0 {
-		fmt.Printf("  benchtime target: %s per module\n", benchtime)
+	input, err := charset.Decode(rawInput, inputCharset)
+	if err != nil {
+		fail("%v", err)
 	}
-	fmt.Printf("  measured: %d runs/module\n", len(samples[0]))
-	fmt.Printf("  timeout:  %s per run\n\n", perRunTimeout)
 
-	for i := range moduleCount {
-		printBenchBenchmarkReport(
-			i+1,
-			modules[i],
-			moduleSizes[i],
-			moduleGzipSizes[i],
-			moduleInputCaps[i],
-			moduleOutputCaps[i],
-			compileDur[i],
-			summaries[i],
-		)
+	result, err := chain.run(ctx, input, 0)
+	if opts.traceDir != "" {
+		if traceErr := chain.writeTrace(opts.traceDir, input, result, err); traceErr != nil {
+			fail("%v", traceErr)
+		}
+	}
+	if err != nil {
+		fail("%v", err)
 	}
 
-	if moduleCount > 1 {
-		bestIdx := 0
-		worstIdx := 0
-		lowestPeakMemIdx := 0
-		for i := 1; i < moduleCount; i++ {
-			if summaries[i].total.mean < summaries[bestIdx].total.mean {
-				bestIdx = i
-			}
-			if summaries[i].total.mean > summaries[worstIdx].total.mean {
-				worstIdx = i
-			}
-			if summaries[i].peakMem < summaries[lowestPeakMemIdx].peakMem {
-				lowestPeakMemIdx = i
-			}
+	vlogTypedArray(opts, result.output)
+	if err := newRunOutputWriter(stdout, opts.format).writeComplete(result.output); err != nil {
+		fail("%v", err)
+	}
+	if newlineAfter(result.output.encoding) {
+		if err := stdout.WriteByte('\n'); err != nil {
+			fail("Error writing output: %v", err)
 		}
-		fastestMean := summaries[bestIdx].total.mean
-		slowestMean := summaries[worstIdx].total.mean
-		fmt.Printf("Summary\n")
-		fmt.Printf("  fastest: %q (mean total time %s)\n", modules[bestIdx], fastestMean)
-		if fastestMean > 0 && slowestMean > 0 && bestIdx != worstIdx {
-			ratio := float64(slowestMean) / float64(fastestMean)
-			fmt.Printf("  speedup vs slowest: %.2fx over %q\n", ratio, modules[worstIdx])
+	}
+	if err := closeRunOutput(stdout, outputFile, result.output.contentType, opts); err != nil {
+		fail("%v", err)
+	}
+	if receiptPath != "" {
+		receipt := chain.receipt(newTraceData(contentData{bytes: rawInput, encoding: dataEncodingRaw}, ""), inputCharset, newTraceData(result.output, ""))
+		if err := writeReceipt(receiptPath, receipt); err != nil {
+			fail("%v", err)
 		}
-		fmt.Printf("  lowest peak memory: %q (peak %s, mean %s)\n", modules[lowestPeakMemIdx], formatBytesIEC(summaries[lowestPeakMemIdx].peakMem), formatBytesIEC(summaries[lowestPeakMemIdx].meanMem))
 	}
 }
 
-func runBenchSample(
-	parent context.Context,
-	runtime wazero.Runtime,
-	compiled wazero.CompiledModule,
-	inputBytes []byte,
-	opts options,
-	moduleName string,
-	timeout time.Duration,
-) (benchSample, contentData, error) {
-	ctx := parent
-	cancel := func() {}
-	if timeout > 0 {
-		ctxWithTimeout, cancelWithTimeout := wasmruntime.WithExecutionTimeout(parent, timeout)
-		ctx = ctxWithTimeout
-		cancel = cancelWithTimeout
-	}
-	defer cancel()
+// runOutputFile is the -o file of qip run. Output is written to a temporary
+// file in the same directory and renamed into place by closeRunOutput, so a
+// run that fails leaves no partial file behind.
+type runOutputFile struct {
+	path string
+	temp *os.File
+}
 
-	exec, err := executeModuleWithInput(ctx, runtime, compiled, inputBytes, opts, moduleName)
+func createRunOutputFile(path string) (*runOutputFile, error) {
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
-		return benchSample{}, contentData{}, err
+		return nil, fmt.Errorf("Error creating output file: %w", err)
 	}
-	sample := benchSample{
-		total:          exec.total,
-		instantiation:  exec.instantiation,
-		run:            exec.run,
-		memoryBytes:    exec.memoryBytes,
-		inputCapBytes:  exec.inputCapBytes,
-		outputCapBytes: exec.outputCapBytes,
+	if err := temp.Chmod(0o644); err != nil {
+		_ = temp.Close()
+		_ = os.Remove(temp.Name())
+		return nil, fmt.Errorf("Error creating output file: %w", err)
 	}
-	return sample, exec.output, nil
+	return &runOutputFile{path: path, temp: temp}, nil
 }
 
-func summarizeBench(samples []benchSample) benchSummary {
-	totalValues := make([]time.Duration, len(samples))
-	runValues := make([]time.Duration, len(samples))
-	instValues := make([]time.Duration, len(samples))
-	memValues := make([]uint64, len(samples))
-
-	for i, sample := range samples {
-		totalValues[i] = sample.total
-		runValues[i] = sample.run
-		instValues[i] = sample.instantiation
-		memValues[i] = sample.memoryBytes
+// discard removes the temporary file. It does nothing for a nil file.
+func (file *runOutputFile) discard() {
+	if file == nil {
+		return
 	}
+	_ = file.temp.Close()
+	_ = os.Remove(file.temp.Name())
+}
 
-	meanMem, peakMem := summarizeMemory(memValues)
-	return benchSummary{
-		total:   summarizeDurations(totalValues),
-		run:     summarizeDurations(runValues),
-		inst:    summarizeDurations(instValues),
-		meanMem: meanMem,
-		peakMem: peakMem,
+// closeRunOutput flushes qip run output and moves the -o file, if any, into
+// place. A file path without an extension gains the one matching
+// contentType; replacing an existing file at that path is warned about,
+// since it is not the path that was given.
+func closeRunOutput(w *bufio.Writer, file *runOutputFile, contentType string, opts options) error {
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("Error writing output: %w", err)
+	}
+	if file == nil {
+		return nil
+	}
+	if err := file.temp.Close(); err != nil {
+		return fmt.Errorf("Error writing output: %w", err)
+	}
+	path := file.path
+	if extension := extensionForContentType(contentType); filepath.Ext(path) == "" && extension != "" {
+		path += extension
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(os.Stderr, "Replacing existing %s\n", path)
+		}
+	}
+	if err := os.Rename(file.temp.Name(), path); err != nil {
+		return fmt.Errorf("Error writing output file: %w", err)
 	}
+	if opts.verbose && path != file.path {
+		vlogf(opts, "wrote %s", path)
+	}
+	return nil
 }
 
-func summarizeDurations(values []time.Duration) durationStats {
-	if len(values) == 0 {
-		return durationStats{}
-	}
+// runInputFlag collects qip run -i flags: paths or globs for the primary
+// input, or name=path for a named input.
+type runInputFlag struct {
+	paths pathsFlag
+	named map[string]string
+}
 
-	n := len(values)
-	ns := make([]float64, n)
-	sorted := make([]int64, n)
-	var sum float64
-	for i, value := range values {
-		x := float64(value.Nanoseconds())
-		ns[i] = x
-		sum += x
-		sorted[i] = value.Nanoseconds()
+func (f *runInputFlag) String() string {
+	return f.paths.String()
+}
+
+func (f *runInputFlag) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok || !validInputName(name) {
+		return f.paths.Set(value)
 	}
-	slices.Sort(sorted)
+	if path == "" {
+		return fmt.Errorf("missing path for input %q", name)
+	}
+	if _, dup := f.named[name]; dup {
+		return fmt.Errorf("input %q given more than once", name)
+	}
+	if f.named == nil {
+		f.named = make(map[string]string)
+	}
+	f.named[name] = path
+	return nil
+}
 
-	mean := sum / float64(n)
-	var variance float64
-	for _, x := range ns {
-		delta := x - mean
-		variance += delta * delta
+// read reads the named inputs' files.
+func (f *runInputFlag) read() (map[string][]byte, error) {
+	if len(f.named) == 0 {
+		return nil, nil
 	}
-	variance /= float64(n)
+	inputs := make(map[string][]byte, len(f.named))
+	for name, path := range f.named {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading input %q: %w", name, err)
+		}
+		inputs[name] = data
+	}
+	return inputs, nil
+}
 
-	p95Index := max(int(math.Ceil(0.95*float64(n)))-1, 0)
-	if p95Index >= n {
-		p95Index = n - 1
+// grantFlag collects qip run --grant <stage>=<capability>[,...] values.
+type grantFlag map[int][]hostmodule.Capability
+
+func (f grantFlag) String() string {
+	return ""
+}
+
+func (f grantFlag) Set(value string) error {
+	stage, list, ok := strings.Cut(value, "=")
+	index, err := strconv.Atoi(stage)
+	if !ok || err != nil || index < 0 {
+		return fmt.Errorf("grant %q must be <stage>=<capability>[,<capability>...]", value)
+	}
+	capabilities, err := hostmodule.ParseCapabilities(list)
+	if err != nil {
+		return err
+	}
+	for _, c := range capabilities {
+		if !slices.Contains(f[index], c) {
+			f[index] = append(f[index], c)
+		}
 	}
+	return nil
+}
 
-	return durationStats{
-		mean:   time.Duration(int64(math.Round(mean))),
-		min:    time.Duration(sorted[0]),
-		max:    time.Duration(sorted[n-1]),
-		stddev: time.Duration(int64(math.Round(math.Sqrt(variance)))),
-		p95:    time.Duration(sorted[p95Index]),
+// apply adds the granted capabilities to specs.
+func (f grantFlag) apply(specs []moduleSpec) error {
+	for _, index := range slices.Sorted(maps.Keys(f)) {
+		if index >= len(specs) {
+			return fmt.Errorf("Cannot grant to stage %d of a %d stage chain", index, len(specs))
+		}
+		for _, c := range f[index] {
+			if !slices.Contains(specs[index].grants, c) {
+				specs[index].grants = append(specs[index].grants, c)
+			}
+		}
 	}
+	return nil
 }
 
-func summarizeMemory(values []uint64) (mean, peak uint64) {
-	if len(values) == 0 {
-		return 0, 0
+// parseNow reads qip run --now, as Unix milliseconds or an RFC 3339 time.
+func parseNow(raw string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
 	}
-	var sum float64
-	for _, v := range values {
-		sum += float64(v)
-		if v > peak {
-			peak = v
-		}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid --now %q: want Unix milliseconds or an RFC 3339 time", raw)
 	}
-	return uint64(math.Round(sum / float64(len(values)))), peak
+	return t, nil
 }
 
-func allDurationsAtLeast(values []time.Duration, threshold time.Duration) bool {
-	for _, value := range values {
-		if value < threshold {
+// validInputName reports whether name can name an input: a lowercase letter
+// followed by lowercase letters, digits, and underscores.
+func validInputName(name string) bool {
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
 			return false
 		}
 	}
 	return true
 }
 
-func gzipSizeBytes(data []byte) (uint64, error) {
-	var buf bytes.Buffer
-	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
-	if err != nil {
-		return 0, err
+// openRunInput opens the input for qip run: a file, '-' for stdin, or stdin
+// when it is a pipe or file rather than a terminal. Otherwise input is empty.
+func openRunInput(inputPath string) (io.ReadCloser, error) {
+	if inputPath == "-" {
+		return io.NopCloser(os.Stdin), nil
 	}
-	if _, err := zw.Write(data); err != nil {
-		_ = zw.Close()
-		return 0, err
+	if inputPath != "" {
+		f, err := os.Open(inputPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading input file: %w", err)
+		}
+		return f, nil
 	}
-	if err := zw.Close(); err != nil {
-		return 0, err
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Error checking stdin: %w", err)
 	}
-	return uint64(buf.Len()), nil
+
+	// Check if stdin is a pipe or file (not a terminal)
+	if (stat.Mode() & os.ModeCharDevice) == 0 {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return io.NopCloser(bytes.NewReader(nil)), nil
 }
 
-func formatBytesIEC(bytes uint64) string {
-	const unit = uint64(1024)
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
+type onErrorPolicy string
+
+const (
+	onErrorSkip onErrorPolicy = "skip"
+	onErrorFail onErrorPolicy = "fail"
+	onErrorMark onErrorPolicy = "mark"
+)
+
+// splitConfig describes how qip run --split breaks input into records that
+// each run through the chain on their own.
+type splitConfig struct {
+	delimiter []byte
+	trimCR    bool
+	jobs      int
+	onError   onErrorPolicy
+}
+
+type splitSummary struct {
+	records int
+	failed  int
+}
+
+// maxSplitRecordBytes bounds a single record so a missing delimiter cannot
+// buffer unbounded input.
+const maxSplitRecordBytes = 64 * 1024 * 1024
+
+func parseSplitConfig(splitRaw string, onErrorRaw string, jobs int) (splitConfig, error) {
+	config := splitConfig{jobs: jobs}
+	switch splitRaw {
+	case "line":
+		config.delimiter = []byte{'\n'}
+		config.trimCR = true
+	case "nul":
+		config.delimiter = []byte{0}
+	case "":
+		return splitConfig{}, errors.New("Invalid split: delimiter must not be empty")
+	default:
+		config.delimiter = []byte(splitRaw)
 	}
-	div, exp := unit, 0
-	for n := bytes / unit; n >= unit && exp < 5; n /= unit {
-		div *= unit
-		exp++
+	switch onErrorPolicy(onErrorRaw) {
+	case onErrorSkip, onErrorFail, onErrorMark:
+		config.onError = onErrorPolicy(onErrorRaw)
+	default:
+		return splitConfig{}, fmt.Errorf("Invalid on-error: %q (want skip, fail, or mark)", onErrorRaw)
 	}
-	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+	if jobs <= 0 {
+		return splitConfig{}, fmt.Errorf("Invalid jobs: %d", jobs)
+	}
+	return config, nil
 }
 
-func printBenchBenchmarkReport(index int, modulePath string, binarySize uint64, gzipSize uint64, inputCapBytes uint64, outputCapBytes uint64, compileDuration time.Duration, summary benchSummary) {
-	fmt.Printf("Benchmark %d: %s\n", index, modulePath)
-	fmt.Printf("  Time (mean ± stddev): %s ± %s [min: %s, p95: %s, max: %s]\n",
-		summary.total.mean,
-		summary.total.stddev,
-		summary.total.min,
-		summary.total.p95,
-		summary.total.max,
-	)
-	fmt.Printf("  Breakdown: run mean %s, instantiation mean %s, compile %s\n",
-		summary.run.mean,
-		summary.inst.mean,
-		compileDuration,
-	)
-	fmt.Printf("  Memory allocated: mean %s, peak %s\n", formatBytesIEC(summary.meanMem), formatBytesIEC(summary.peakMem))
-	fmt.Printf("  Capacity: input %s, output %s\n", formatBytesIEC(inputCapBytes), formatBytesIEC(outputCapBytes))
-	fmt.Printf("  Binary size: %d bytes, gzip %d bytes\n", binarySize, gzipSize)
-	fmt.Printf("\n")
+// splitRecords returns a scanner split function that yields the records
+// between delimiters. A trailing delimiter does not produce an empty record.
+func splitRecords(delimiter []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, delimiter); i >= 0 {
+			return i + len(delimiter), data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
 }
 
-func parseImageModuleSpecs(args []string) ([]imageModuleSpec, error) {
-	specs := make([]imageModuleSpec, 0, len(args))
-	for _, arg := range args {
-		if strings.HasPrefix(arg, "?") {
-			if len(specs) == 0 {
-				return nil, fmt.Errorf("image uniform query %q must follow a wasm module path", arg)
+type splitRecord struct {
+	index  int
+	input  []byte
+	result chainResult
+	err    error
+	done   chan struct{}
+}
+
+// runSplit runs every record of input through the chain on a pool of
+// config.jobs workers, writing outputs to w in input order, each followed by
+// the delimiter. Failed records are reported on stderr and then skipped,
+// marked in the output, or end the batch according to config.onError.
+func (chain *moduleChain) runSplit(ctx context.Context, input io.Reader, config splitConfig, w *bufio.Writer) (splitSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan *splitRecord)
+	// ordered holds records in input order; its capacity bounds how far
+	// workers may run ahead of the writer.
+	ordered := make(chan *splitRecord, config.jobs*2)
+
+	var wg sync.WaitGroup
+	for range config.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range work {
+				if ctx.Err() == nil {
+					recordCtx, endSpan := tracing.StartTrack(ctx, "record", tracing.Int("record", record.index+1))
+					record.result, record.err = chain.run(recordCtx, record.input, uint64(record.index))
+					endSpan()
+					if dir := chain.opts.traceDir; dir != "" {
+						traceErr := chain.writeTrace(filepath.Join(dir, fmt.Sprintf("record-%d", record.index+1)), record.input, record.result, record.err)
+						if record.err == nil {
+							record.err = traceErr
+						}
+					}
+				} else {
+					record.err = ctx.Err()
+				}
+				close(record.done)
 			}
-			if len(arg) == 1 {
-				return nil, errors.New("image uniform query must not be empty")
+		}()
+	}
+
+	var scanErr error
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(make([]byte, 64*1024), maxSplitRecordBytes)
+		scanner.Split(splitRecords(config.delimiter))
+		for index := 0; scanner.Scan(); index++ {
+			data := append([]byte(nil), scanner.Bytes()...)
+			if config.trimCR {
+				data = bytes.TrimSuffix(data, []byte{'\r'})
 			}
-			values, err := url.ParseQuery(arg[1:])
-			if err != nil {
-				return nil, fmt.Errorf("invalid image uniform query %q: %w", arg, err)
+			record := &splitRecord{
+				index: index,
+				input: data,
+				done:  make(chan struct{}),
 			}
-			if len(values) == 0 {
-				return nil, fmt.Errorf("image uniform query %q must contain key=value pairs", arg)
+			select {
+			case ordered <- record:
+			case <-ctx.Done():
+				return
 			}
-			last := &specs[len(specs)-1]
-			for key, vals := range values {
-				if key == "" {
-					return nil, fmt.Errorf("invalid image uniform query %q: empty key", arg)
-				}
-				if len(vals) == 0 {
-					return nil, fmt.Errorf("invalid image uniform query %q: missing value for %q", arg, key)
+			work <- record
+		}
+		if err := scanner.Err(); err != nil {
+			scanErr = fmt.Errorf("Error reading input: %w", err)
+		}
+	}()
+
+	summary := splitSummary{}
+	out := newRunOutputWriter(w, chain.opts.format)
+	var returnErr error
+	for record := range ordered {
+		<-record.done
+		if returnErr != nil {
+			continue
+		}
+		summary.records++
+		if record.err != nil {
+			summary.failed++
+			if config.onError == onErrorFail {
+				returnErr = fmt.Errorf("Record %d failed: %w", record.index+1, record.err)
+				cancel()
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "record %d: %v\n", record.index+1, record.err)
+			switch config.onError {
+			case onErrorSkip:
+				continue
+			case onErrorMark:
+				if _, err := fmt.Fprintf(w, "error: %v", record.err); err != nil {
+					returnErr = fmt.Errorf("Error writing output: %w", err)
+					cancel()
+					continue
 				}
-				last.uniforms[key] = vals[len(vals)-1]
 			}
-			continue
+		} else {
+			vlogTypedArray(chain.opts, record.result.output)
+			if err := out.writeComplete(record.result.output); err != nil {
+				returnErr = err
+				cancel()
+				continue
+			}
+		}
+		if _, err := w.Write(config.delimiter); err != nil {
+			returnErr = fmt.Errorf("Error writing output: %w", err)
+			cancel()
 		}
-
-		specs = append(specs, imageModuleSpec{
-			path:     arg,
-			uniforms: make(map[string]string),
-		})
 	}
-	return specs, nil
+	wg.Wait()
+	if returnErr != nil {
+		return summary, returnErr
+	}
+	return summary, scanErr
 }
 
-func formatCapacityBytes(size uint64) string {
-	if size == 0 {
-		return "n/a"
-	}
-	return fmt.Sprintf("%s (%d bytes)", formatBytesIEC(size), size)
+// pathsFlag collects a repeatable flag's values in order.
+type pathsFlag []string
+
+func (f *pathsFlag) String() string {
+	return strings.Join(*f, ",")
 }
 
-func describeContentMismatch(expected, actual contentData) string {
-	if expected.encoding != actual.encoding {
-		return fmt.Sprintf("encoding differs (expected %s, actual %s)", encodingName(expected.encoding), encodingName(actual.encoding))
-	}
-	if bytes.Equal(expected.bytes, actual.bytes) {
+func (f *pathsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// single returns the only path, or "" when there is none.
+func (f pathsFlag) single() string {
+	if len(f) == 0 {
 		return ""
 	}
-	diffAt := firstDiffIndex(expected.bytes, actual.bytes)
-	expSum := sha256.Sum256(expected.bytes)
-	actSum := sha256.Sum256(actual.bytes)
-	if diffAt >= 0 {
-		return fmt.Sprintf(
-			"output differs at byte %d (expected len=%d sha256=%x, actual len=%d sha256=%x)",
-			diffAt,
-			len(expected.bytes),
-			expSum,
-			len(actual.bytes),
-			actSum,
-		)
-	}
-	return fmt.Sprintf(
-		"output size differs (expected size=%d sha256=%x, actual size=%d sha256=%x)",
-		len(expected.bytes),
-		expSum,
-		len(actual.bytes),
-		actSum,
-	)
+	return f[0]
 }
 
-func firstDiffIndex(a, b []byte) int {
-	limit := min(len(b), len(a))
-	for i := range limit {
-		if a[i] != b[i] {
-			return i
-		}
-	}
-	if len(a) != len(b) {
-		return limit
-	}
-	return -1
+// batchConfig describes a batch conversion: every input file runs through
+// the chain on its own and is written to outDir under a name rendered from
+// nameTemplate.
+type batchConfig struct {
+	inputs       []string
+	outDir       string
+	nameTemplate string
+	jobs         int
 }
 
-func encodingName(encoding dataEncoding) string {
-	switch encoding {
-	case dataEncodingRaw:
-		return "raw"
-	case dataEncodingUTF8:
-		return "utf8"
-	case dataEncodingArrayI32:
-		return "i32[]"
-	default:
-		return fmt.Sprintf("unknown(%d)", encoding)
-	}
+type batchFailure struct {
+	input string
+	err   error
 }
 
-func loadTileStage(ctx context.Context, mod api.Module) (tileStage, error) {
-	tileFunc := mod.ExportedFunction("tile_rgba_f32_64x64")
-	if tileFunc == nil {
-		return tileStage{}, errors.New("Wasm module must export tile_rgba_f32_64x64")
-	}
-	uniformFunc := mod.ExportedFunction("uniform_set_width_and_height")
-	haloFunc := mod.ExportedFunction("calculate_halo_px")
-	mem := mod.Memory()
-	inputPtrValue, ok, err := getExportedValue(ctx, mod, "input_ptr")
-	if err != nil {
-		return tileStage{}, wasmruntime.HumanizeExecutionError(ctx, err)
+type batchSummary struct {
+	files  int
+	failed []batchFailure
+}
+
+// batchError reports a batch with failed files. It unwraps to the first
+// failure so the exit status reflects its kind.
+type batchError struct {
+	summary batchSummary
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("%d of %d files failed", len(e.summary.failed), e.summary.files)
+}
+
+func (e *batchError) Unwrap() error {
+	return e.summary.failed[0].err
+}
+
+// defaultBatchNameTemplate keeps each input's name with the extension of
+// its output.
+const defaultBatchNameTemplate = "{name}{ext}"
+
+// isBatch reports whether input paths and the -o path ask for a batch
+// conversion: several inputs, a glob, or an output directory.
+func isBatch(inputs []string, outputPath string) bool {
+	if len(inputs) > 1 {
+		return true
 	}
-	if !ok {
-		return tileStage{}, errors.New("Wasm module must export input_ptr as global or function")
+	for _, input := range inputs {
+		if hasGlobMeta(input) {
+			return true
+		}
 	}
-	inputCap, ok, err := getExportedValue(ctx, mod, "input_bytes_cap")
-	if err != nil {
-		return tileStage{}, wasmruntime.HumanizeExecutionError(ctx, err)
+	if outputPath == "" {
+		return false
 	}
-	if !ok {
-		return tileStage{}, errors.New("Wasm module must export input_bytes_cap as global or function")
+	if strings.HasSuffix(outputPath, "/") || strings.HasSuffix(outputPath, string(filepath.Separator)) {
+		return true
 	}
-	return tileStage{
-		mod:         mod,
-		mem:         mem,
-		tileFunc:    tileFunc,
-		inputPtr:    uint32(inputPtrValue),
-		uniformFunc: uniformFunc,
-		haloFunc:    haloFunc,
-		inputCap:    inputCap,
-	}, nil
+	info, err := os.Stat(outputPath)
+	return err == nil && info.IsDir()
 }
 
-func closeTileStages(ctx context.Context, stages []tileStage) {
-	for _, stage := range stages {
-		if stage.mod != nil {
-			_ = stage.mod.Close(ctx)
-		}
-	}
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
 }
 
-func runTileStages(ctx context.Context, stages []tileStage, inputRGBA *image.RGBA) (*image.RGBA, []time.Duration, error) {
-	if len(stages) == 0 {
-		return inputRGBA, []time.Duration{}, nil
+// parseBatchConfig expands input globs, in order and without duplicates,
+// and checks the name template gives every input its own output file.
+func parseBatchConfig(patterns []string, outDir string, nameTemplate string, jobs int) (batchConfig, error) {
+	if outDir == "" {
+		return batchConfig{}, errors.New("Batch input needs -o <output directory>")
 	}
-
-	bounds := inputRGBA.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-	outputRGBA := image.NewRGBA(bounds)
-
-	for i := range stages {
-		stage := &stages[i]
-		if stage.uniformFunc != nil {
-			if _, err := stage.uniformFunc.Call(
-				ctx,
-				api.EncodeF32(float32(width)),
-				api.EncodeF32(float32(height)),
-			); err != nil {
-				return nil, nil, fmt.Errorf("Error running uniform_set_width_and_height: %v", err)
-			}
+	if jobs <= 0 {
+		return batchConfig{}, fmt.Errorf("Invalid jobs: %d", jobs)
+	}
+	if !strings.Contains(nameTemplate, "{name}") {
+		return batchConfig{}, fmt.Errorf("Invalid output name %q: must contain {name}", nameTemplate)
+	}
+	config := batchConfig{outDir: outDir, nameTemplate: nameTemplate, jobs: jobs}
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		if pattern == "-" {
+			return batchConfig{}, errors.New("Batch input cannot read stdin")
 		}
-		if stage.haloFunc != nil {
-			values, err := stage.haloFunc.Call(ctx)
+		matches := []string{pattern}
+		if hasGlobMeta(pattern) {
+			var err error
+			matches, err = filepath.Glob(pattern)
 			if err != nil {
-				return nil, nil, fmt.Errorf("Error running calculate_halo_px: %v", err)
+				return batchConfig{}, fmt.Errorf("Invalid input pattern %q: %w", pattern, err)
 			}
-			if len(values) > 0 {
-				stage.haloPx = int(int32(values[0]))
+			if len(matches) == 0 {
+				return batchConfig{}, fmt.Errorf("No files match %q", pattern)
 			}
 		}
-		if stage.haloPx < 0 {
-			stage.haloPx = 0
-		}
-		stage.tileSpan = tileSize + stage.haloPx*2
-		tileF32Size := uint64(stage.tileSpan) * uint64(stage.tileSpan) * 4 * 4
-		if tileF32Size > stage.inputCap {
-			return nil, nil, errors.New("Tile buffer exceeds module input_bytes_cap")
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				config.inputs = append(config.inputs, match)
+			}
 		}
 	}
+	if len(config.inputs) == 0 {
+		return batchConfig{}, errors.New("Output directory needs input files given with -i")
+	}
 
-	const inv255 = 1.0 / 255.0
-	useHalo := false
-	for _, stage := range stages {
-		if stage.haloPx > 0 {
-			useHalo = true
-			break
+	// Collisions depend on each output's extension, so runBatch checks for
+	// them once it is known; the template itself is checked here.
+	for _, input := range config.inputs {
+		if _, err := config.outputName(input, filepath.Ext(input)); err != nil {
+			return batchConfig{}, err
 		}
 	}
+	return config, nil
+}
 
-	stageDurations := make([]time.Duration, len(stages))
+// outputName renders the name template for input: {name} is the input's
+// file name without its extension and {ext} is extension.
+func (config batchConfig) outputName(input string, extension string) (string, error) {
+	base := filepath.Base(input)
+	name := strings.NewReplacer(
+		"{name}", strings.TrimSuffix(base, filepath.Ext(base)),
+		"{ext}", extension,
+	).Replace(config.nameTemplate)
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("Invalid output name %q for %s", name, input)
+	}
+	return name, nil
+}
 
-	if useHalo {
-		floatSrc := make([]float32, width*height*4)
-		floatDst := make([]float32, len(floatSrc))
-		pix := inputRGBA.Pix
-		stride := inputRGBA.Stride
-		for y := range height {
-			srcRow := y * stride
-			dstRow := y * width * 4
-			for x := range width {
-				s := srcRow + x*4
-				d := dstRow + x*4
-				floatSrc[d] = float32(pix[s]) * inv255
-				floatSrc[d+1] = float32(pix[s+1]) * inv255
-				floatSrc[d+2] = float32(pix[s+2]) * inv255
-				floatSrc[d+3] = float32(pix[s+3]) * inv255
+// runBatch converts every input with convert on a pool of config.jobs
+// workers, writing each output to config.outDir. convert returns the output
+// and its file extension, or "" to keep the input's. Failures are reported
+// on stderr in input order once all files are done.
+func runBatch(ctx context.Context, config batchConfig, opts options, convert func(ctx context.Context, index int, input []byte) ([]byte, string, error)) (batchSummary, error) {
+	if err := os.MkdirAll(config.outDir, 0o755); err != nil {
+		return batchSummary{}, fmt.Errorf("Error creating output directory: %w", err)
+	}
+	inputPaths := make(map[string]bool, len(config.inputs))
+	for _, input := range config.inputs {
+		if abs, err := filepath.Abs(input); err == nil {
+			inputPaths[abs] = true
+		}
+	}
+	// written maps each output path claimed in this batch to its input, so
+	// two inputs never write the same file.
+	var writtenMu sync.Mutex
+	written := make(map[string]string, len(config.inputs))
+
+	convertFile := func(index int, input string) error {
+		ctx, endSpan := tracing.StartTrack(ctx, "file", tracing.String("input", input))
+		defer endSpan()
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return fmt.Errorf("Error reading input file: %w", err)
+		}
+		output, extension, err := convert(ctx, index, data)
+		if err != nil {
+			return err
+		}
+		if extension == "" {
+			extension = filepath.Ext(input)
+		}
+		name, err := config.outputName(input, extension)
+		if err != nil {
+			return err
+		}
+		outputPath := filepath.Join(config.outDir, name)
+		if abs, err := filepath.Abs(outputPath); err == nil && inputPaths[abs] {
+			return fmt.Errorf("Output %s would overwrite an input", outputPath)
+		}
+		writtenMu.Lock()
+		other, claimed := written[outputPath]
+		if !claimed {
+			written[outputPath] = input
+		}
+		writtenMu.Unlock()
+		if claimed {
+			return fmt.Errorf("Inputs %s and %s would both write %s", other, input, outputPath)
+		}
+		if err := os.WriteFile(outputPath, output, 0o644); err != nil {
+			return fmt.Errorf("Error writing output file: %w", err)
+		}
+		vlogf(opts, "wrote %s", outputPath)
+		return nil
+	}
+
+	errs := make([]error, len(config.inputs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range min(config.jobs, len(config.inputs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range work {
+				errs[index] = convertFile(index, config.inputs[index])
 			}
+		}()
+	}
+	for index := range config.inputs {
+		work <- index
+	}
+	close(work)
+	wg.Wait()
+
+	summary := batchSummary{files: len(config.inputs)}
+	for index, err := range errs {
+		if err != nil {
+			summary.failed = append(summary.failed, batchFailure{input: config.inputs[index], err: err})
+			fmt.Fprintf(os.Stderr, "%s: %v\n", config.inputs[index], err)
 		}
+	}
+	if len(summary.failed) > 0 {
+		return summary, &batchError{summary: summary}
+	}
+	return summary, nil
+}
 
-		for stageIndex := range stages {
-			stageStart := time.Now()
-			stage := &stages[stageIndex]
-			halo := stage.haloPx
-			tileSpan := stage.tileSpan
-			tileFloats := tileSpan * tileSpan * 4
-			tileF32 := make([]float32, tileFloats)
-			tileBytes := unsafe.Slice((*byte)(unsafe.Pointer(&tileF32[0])), len(tileF32)*4)
+// outputFormat controls how qip run renders typed array output.
+type outputFormat string
 
-			for y := 0; y < height; y += tileSize {
-				tileH := tileSize
-				if y+tileH > height {
-					tileH = height - y
-				}
-				for x := 0; x < width; x += tileSize {
-					tileW := tileSize
-					if x+tileW > width {
-						tileW = width - x
-					}
-					for row := range tileSpan {
-						srcY := y + row - halo
-						if srcY < 0 {
-							srcY = 0
-						} else if srcY >= height {
-							srcY = height - 1
-						}
-						srcRow := srcY * width * 4
-						dstRow := row * tileSpan * 4
-						for col := range tileSpan {
-							srcX := x + col - halo
-							if srcX < 0 {
-								srcX = 0
-							} else if srcX >= width {
-								srcX = width - 1
-							}
-							s := srcRow + srcX*4
-							d := dstRow + col*4
-							tileF32[d] = floatSrc[s]
-							tileF32[d+1] = floatSrc[s+1]
-							tileF32[d+2] = floatSrc[s+2]
-							tileF32[d+3] = floatSrc[s+3]
-						}
-					}
+const (
+	// outputFormatDefault renders i32 arrays as hex and other typed arrays
+	// as decimal.
+	outputFormatDefault outputFormat = ""
+	outputFormatHex     outputFormat = "hex"
+	outputFormatDec     outputFormat = "dec"
+	outputFormatJSON    outputFormat = "json"
+	outputFormatCSV     outputFormat = "csv"
+	outputFormatRaw     outputFormat = "raw"
+)
 
-					if !stage.mem.Write(stage.inputPtr, tileBytes) {
-						return nil, nil, errors.New("Could not write tile to wasm memory")
-					}
-					tileX := x - halo
-					tileY := y - halo
-					if _, err := stage.tileFunc.Call(
-						ctx,
-						api.EncodeF32(float32(tileX)),
-						api.EncodeF32(float32(tileY)),
-					); err != nil {
-						return nil, nil, fmt.Errorf("Error running tile_rgba_f32_64x64: %w", wasmruntime.HumanizeExecutionError(ctx, err))
-					}
-					tileOutBytes, ok := stage.mem.Read(stage.inputPtr, uint32(len(tileBytes)))
-					if !ok {
-						return nil, nil, errors.New("Could not read tile from wasm memory")
-					}
-					copy(tileBytes, tileOutBytes)
+func parseOutputFormat(raw string) (outputFormat, error) {
+	switch format := outputFormat(raw); format {
+	case outputFormatDefault, outputFormatHex, outputFormatDec, outputFormatJSON, outputFormatCSV, outputFormatRaw:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Invalid format: %q (want hex, dec, json, csv, or raw)", raw)
+	}
+}
 
-					srcBase := (halo*tileSpan + halo) * 4
-					for row := 0; row < tileH; row++ {
-						src := srcBase + row*tileSpan*4
-						dst := ((y + row) * width) * 4
-						for col := 0; col < tileW; col++ {
-							s := src + col*4
-							d := dst + (x+col)*4
-							floatDst[d] = tileF32[s]
-							floatDst[d+1] = tileF32[s+1]
-							floatDst[d+2] = tileF32[s+2]
-							floatDst[d+3] = tileF32[s+3]
-						}
-					}
-				}
-			}
+// resolve returns the format used for output of encoding.
+func (format outputFormat) resolve(encoding dataEncoding) outputFormat {
+	if format != outputFormatDefault {
+		return format
+	}
+	if encoding == dataEncodingArrayI32 {
+		return outputFormatHex
+	}
+	return outputFormatDec
+}
 
-			floatSrc, floatDst = floatDst, floatSrc
-			stageDurations[stageIndex] = time.Since(stageStart)
+// newlineAfter reports whether qip run ends output of encoding with a
+// newline: text and single-line typed array formats do not end in one.
+func (format outputFormat) newlineAfter(encoding dataEncoding) bool {
+	if encoding == dataEncodingUTF8 {
+		return true
+	}
+	if !encoding.typedArray() {
+		return false
+	}
+	switch format.resolve(encoding) {
+	case outputFormatJSON, outputFormatCSV:
+		return true
+	default:
+		return false
+	}
+}
+
+// runOutputWriter writes output to w in the form qip run prints it. Typed
+// arrays may arrive over several writes when a chain streams, so it tracks
+// the items written until end closes the array.
+type runOutputWriter struct {
+	w      *bufio.Writer
+	format outputFormat
+	items  int
+}
+
+func newRunOutputWriter(w *bufio.Writer, format outputFormat) *runOutputWriter {
+	return &runOutputWriter{w: w, format: format}
+}
+
+// write writes output bytes as-is, or renders them when they are a typed
+// array. UTF-8 output is written as-is; the caller appends the trailing
+// newline.
+func (ow *runOutputWriter) write(output contentData) error {
+	if !output.encoding.typedArray() {
+		if _, err := ow.w.Write(output.bytes); err != nil {
+			return fmt.Errorf("Error writing output: %w", err)
+		}
+		return nil
+	}
+	format := ow.format.resolve(output.encoding)
+	if format == outputFormatRaw {
+		if _, err := ow.w.Write(output.bytes); err != nil {
+			return fmt.Errorf("Error writing output: %w", err)
+		}
+		return nil
+	}
+	size := output.encoding.itemSize()
+	var buf []byte
+	for i := 0; i+size <= len(output.bytes); i += size {
+		item := output.bytes[i : i+size]
+		switch format {
+		case outputFormatHex:
+			buf = fmt.Appendf(buf, "%0*x\n", size*2, littleEndianUint(item))
+		case outputFormatDec:
+			buf = appendTypedItem(buf, output.encoding, item, false)
+			buf = append(buf, '\n')
+		case outputFormatJSON:
+			if ow.items == 0 {
+				buf = append(buf, '[')
+			} else {
+				buf = append(buf, ',')
+			}
+			buf = appendTypedItem(buf, output.encoding, item, true)
+		case outputFormatCSV:
+			if ow.items > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendTypedItem(buf, output.encoding, item, false)
 		}
+		ow.items++
+	}
+	if _, err := ow.w.Write(buf); err != nil {
+		return fmt.Errorf("Error writing output: %w", err)
+	}
+	return nil
+}
 
-		outPix := outputRGBA.Pix
-		outStride := outputRGBA.Stride
-		for y := range height {
-			srcRow := y * width * 4
-			dstRow := y * outStride
-			for x := range width {
-				s := srcRow + x*4
-				d := dstRow + x*4
-				v := floatSrc[s]
-				if v <= 0 {
-					outPix[d] = 0
-				} else if v >= 1 {
-					outPix[d] = 255
-				} else {
-					outPix[d] = uint8(v*255 + 0.5)
-				}
-				v = floatSrc[s+1]
-				if v <= 0 {
-					outPix[d+1] = 0
-				} else if v >= 1 {
-					outPix[d+1] = 255
-				} else {
-					outPix[d+1] = uint8(v*255 + 0.5)
-				}
-				v = floatSrc[s+2]
-				if v <= 0 {
-					outPix[d+2] = 0
-				} else if v >= 1 {
-					outPix[d+2] = 255
-				} else {
-					outPix[d+2] = uint8(v*255 + 0.5)
-				}
-				v = floatSrc[s+3]
-				if v <= 0 {
-					outPix[d+3] = 0
-				} else if v >= 1 {
-					outPix[d+3] = 255
-				} else {
-					outPix[d+3] = uint8(v*255 + 0.5)
-				}
-			}
-		}
-	} else {
-		pix := inputRGBA.Pix
-		stride := inputRGBA.Stride
-		outputPix := outputRGBA.Pix
-		outputStride := outputRGBA.Stride
-		tileF32 := make([]float32, tileSize*tileSize*4)
-		tileBytes := unsafe.Slice((*byte)(unsafe.Pointer(&tileF32[0])), len(tileF32)*4)
-		for y := 0; y < height; y += tileSize {
-			tileH := tileSize
-			if y+tileH > height {
-				tileH = height - y
-			}
-			rowBase := y * stride
-			for x := 0; x < width; x += tileSize {
-				tileW := tileSize
-				if x+tileW > width {
-					tileW = width - x
-				}
-				srcRow := rowBase + x*4
-				if tileW != tileSize || tileH != tileSize {
-					clear(tileF32)
-				}
-				for row := 0; row < tileH; row++ {
-					src := srcRow + row*stride
-					dst := row * tileSize * 4
-					for col := 0; col < tileW; col++ {
-						s := src + col*4
-						d := dst + col*4
-						tileF32[d] = float32(pix[s]) * inv255
-						tileF32[d+1] = float32(pix[s+1]) * inv255
-						tileF32[d+2] = float32(pix[s+2]) * inv255
-						tileF32[d+3] = float32(pix[s+3]) * inv255
-					}
-				}
-				for stageIndex := range stages {
-					stage := &stages[stageIndex]
-					if !stage.mem.Write(stage.inputPtr, tileBytes) {
-						return nil, nil, errors.New("Could not write tile to wasm memory")
-					}
-					if _, err := stage.tileFunc.Call(
-						ctx,
-						api.EncodeF32(float32(x)),
-						api.EncodeF32(float32(y)),
-					); err != nil {
-						return nil, nil, fmt.Errorf("Error running tile_rgba_f32_64x64: %w", wasmruntime.HumanizeExecutionError(ctx, err))
-					}
-					tileOutBytes, ok := stage.mem.Read(stage.inputPtr, uint32(len(tileBytes)))
-					if !ok {
-						return nil, nil, errors.New("Could not read tile from wasm memory")
-					}
-					copy(tileBytes, tileOutBytes)
-				}
-				tileOutF32 := tileF32
-				for row := 0; row < tileH; row++ {
-					src := row * tileSize * 4
-					dst := (y+row)*outputStride + x*4
-					for col := 0; col < tileW; col++ {
-						s := src + col*4
-						d := dst + col*4
-						v := tileOutF32[s]
-						if v <= 0 {
-							outputPix[d] = 0
-						} else if v >= 1 {
-							outputPix[d] = 255
-						} else {
-							outputPix[d] = uint8(v*255 + 0.5)
-						}
-						v = tileOutF32[s+1]
-						if v <= 0 {
-							outputPix[d+1] = 0
-						} else if v >= 1 {
-							outputPix[d+1] = 255
-						} else {
-							outputPix[d+1] = uint8(v*255 + 0.5)
-						}
-						v = tileOutF32[s+2]
-						if v <= 0 {
-							outputPix[d+2] = 0
-						} else if v >= 1 {
-							outputPix[d+2] = 255
-						} else {
-							outputPix[d+2] = uint8(v*255 + 0.5)
-						}
-						v = tileOutF32[s+3]
-						if v <= 0 {
-							outputPix[d+3] = 0
-						} else if v >= 1 {
-							outputPix[d+3] = 255
-						} else {
-							outputPix[d+3] = uint8(v*255 + 0.5)
-						}
-					}
-				}
-			}
-		}
+// end finishes output whose final encoding is encoding, closing a JSON
+// array, and readies the writer for the next output.
+func (ow *runOutputWriter) end(encoding dataEncoding) error {
+	items := ow.items
+	ow.items = 0
+	if !encoding.typedArray() || ow.format.resolve(encoding) != outputFormatJSON {
+		return nil
 	}
-
-	return outputRGBA, stageDurations, nil
+	closing := "]"
+	if items == 0 {
+		closing = "[]"
+	}
+	if _, err := ow.w.WriteString(closing); err != nil {
+		return fmt.Errorf("Error writing output: %w", err)
+	}
+	return nil
 }
 
-func runTileStagesCompiled(ctx context.Context, runtime wazero.Runtime, compiled []wazero.CompiledModule, inputRGBA *image.RGBA, moduleNamePrefix string, stageOffset int) (*image.RGBA, []time.Duration, []time.Duration, error) {
-	stages := make([]tileStage, len(compiled))
-	instDurations := make([]time.Duration, len(compiled))
-
-	for i, cm := range compiled {
-		instStart := time.Now()
-		mod, err := runtime.InstantiateModule(ctx, cm, wazero.NewModuleConfig().WithName(fmt.Sprintf("%s-%d", moduleNamePrefix, stageOffset+i)))
-		instDurations[i] = time.Since(instStart)
-		if err != nil {
-			closeTileStages(ctx, stages)
-			return nil, instDurations, nil, errors.New("Wasm module could not be instantiated")
-		}
-		stage, err := loadTileStage(ctx, mod)
-		if err != nil {
-			closeTileStages(ctx, stages)
-			return nil, instDurations, nil, err
-		}
-		stages[i] = stage
+// writeComplete writes output that arrived whole, then ends it.
+func (ow *runOutputWriter) writeComplete(output contentData) error {
+	if err := ow.write(output); err != nil {
+		return err
 	}
-	defer closeTileStages(ctx, stages)
+	return ow.end(output.encoding)
+}
 
-	outputRGBA, stageDurations, err := runTileStages(ctx, stages, inputRGBA)
-	if err != nil {
-		return nil, instDurations, stageDurations, err
+// vlogTypedArray logs typed array output item by item in verbose mode,
+// whatever --format prints.
+func vlogTypedArray(opts options, output contentData) {
+	if !opts.verbose || !output.encoding.typedArray() {
+		return
+	}
+	vlogf(opts, "output bytes: %v", output.bytes)
+	name := contractEncodingName(output.encoding)
+	size := output.encoding.itemSize()
+	for i := 0; i+size <= len(output.bytes); i += size {
+		vlogf(opts, "%s: %s", name, appendTypedItem(nil, output.encoding, output.bytes[i:i+size], false))
 	}
-	return outputRGBA, instDurations, stageDurations, nil
 }
 
-func applyImageUniforms(ctx context.Context, mod api.Module, uniforms map[string]string) error {
-	if len(uniforms) == 0 {
-		return nil
-	}
-	defs := mod.ExportedFunctionDefinitions()
-	keys := make([]string, 0, len(uniforms))
-	for key := range uniforms {
-		keys = append(keys, key)
+func littleEndianUint(item []byte) uint64 {
+	switch len(item) {
+	case 1:
+		return uint64(item[0])
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(item))
+	default:
+		return binary.LittleEndian.Uint64(item)
 	}
-	sort.Strings(keys)
+}
 
-	for _, key := range keys {
-		fnName := "uniform_set_" + key
-		fn := mod.ExportedFunction(fnName)
-		if fn == nil {
-			return fmt.Errorf("Wasm module does not export %s for query key %q", fnName, key)
-		}
-		def, ok := defs[fnName]
-		if !ok {
-			return fmt.Errorf("Wasm module is missing function definition for %s", fnName)
-		}
-		paramTypes := def.ParamTypes()
-		if len(paramTypes) != 1 {
-			return fmt.Errorf("%s must accept exactly one argument", fnName)
+// appendTypedItem appends one typed array item as a decimal number. In JSON,
+// NaN and infinities, which JSON numbers cannot express, become null.
+func appendTypedItem(buf []byte, encoding dataEncoding, item []byte, json bool) []byte {
+	switch encoding {
+	case dataEncodingArrayI32:
+		return strconv.AppendInt(buf, int64(int32(binary.LittleEndian.Uint32(item))), 10)
+	case dataEncodingArrayI64:
+		return strconv.AppendInt(buf, int64(binary.LittleEndian.Uint64(item)), 10)
+	case dataEncodingArrayU8:
+		return strconv.AppendUint(buf, uint64(item[0]), 10)
+	case dataEncodingArrayF32:
+		v := math.Float32frombits(binary.LittleEndian.Uint32(item))
+		if json && (math.IsNaN(float64(v)) || math.IsInf(float64(v), 0)) {
+			return append(buf, "null"...)
+		}
+		return strconv.AppendFloat(buf, float64(v), 'g', -1, 32)
+	default:
+		v := math.Float64frombits(binary.LittleEndian.Uint64(item))
+		if json && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			return append(buf, "null"...)
 		}
-		value := uniforms[key]
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	}
+}
 
-		var args [1]uint64
-		switch paramTypes[0] {
-		case api.ValueTypeF32:
-			parsed, err := strconv.ParseFloat(value, 32)
-			if err != nil {
-				return fmt.Errorf("invalid value %q for %s (expected f32)", value, fnName)
-			}
-			args[0] = api.EncodeF32(float32(parsed))
-		case api.ValueTypeF64:
-			parsed, err := strconv.ParseFloat(value, 64)
-			if err != nil {
-				return fmt.Errorf("invalid value %q for %s (expected f64)", value, fnName)
-			}
-			args[0] = api.EncodeF64(parsed)
-		case api.ValueTypeI32:
-			parsed, err := strconv.ParseInt(value, 10, 32)
-			if err != nil {
-				return fmt.Errorf("invalid value %q for %s (expected i32)", value, fnName)
-			}
-			args[0] = uint64(uint32(int32(parsed)))
-		case api.ValueTypeI64:
-			parsed, err := strconv.ParseInt(value, 10, 64)
-			if err != nil {
-				return fmt.Errorf("invalid value %q for %s (expected i64)", value, fnName)
-			}
-			args[0] = uint64(parsed)
-		default:
-			return fmt.Errorf("%s has unsupported parameter type", fnName)
-		}
+type benchSample struct {
+	total          time.Duration
+	instantiation  time.Duration
+	run            time.Duration
+	memoryBytes    uint64
+	inputCapBytes  uint64
+	outputCapBytes uint64
+	inputEncoding  dataEncoding
+}
 
-		if _, err := fn.Call(ctx, args[0]); err != nil {
-			return fmt.Errorf("Error running %s(%s): %w", fnName, value, wasmruntime.HumanizeExecutionError(ctx, err))
-		}
-	}
-	return nil
+type durationStats struct {
+	mean   time.Duration
+	min    time.Duration
+	max    time.Duration
+	stddev time.Duration
+	p95    time.Duration
 }
 
-func decodeBMP(input []byte) (*image.RGBA, error) {
-	if len(input) < 54 {
-		return nil, errors.New("BMP input too small")
+type benchSummary struct {
+	total   durationStats
+	run     durationStats
+	inst    durationStats
+	meanMem uint64
+	peakMem uint64
+}
+
+func benchCmd(args []string) {
+	opts := options{}
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var benchVerbose bool
+	var inputPath string
+	var manifestPath string
+	benchRuns := 1000
+	benchtimeStr := ""
+	var profilePath string
+
+	fs.BoolVar(&benchVerbose, "v", false, "enable verbose logging")
+	fs.BoolVar(&benchVerbose, "verbose", false, "enable verbose logging")
+	fs.StringVar(&inputPath, "i", "", "input file path ('-' for stdin)")
+	fs.StringVar(&manifestPath, "f", "", "pipeline manifest whose stages are the modules to compare")
+	fs.IntVar(&benchRuns, "r", benchRuns, "benchmark runs per module")
+	fs.StringVar(&benchtimeStr, "benchtime", benchtimeStr, "target measured time per module (e.g. 3s)")
+	fs.StringVar(&profilePath, "profile", "", "write a pprof profile of time spent in each wasm function")
+	policyFlags := registerPolicyFlags(fs, 250)
+	sourceFlags := modulesource.RegisterFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		gameOver("%s %v", usageBench, err)
 	}
-	if input[0] != 'B' || input[1] != 'M' {
-		return nil, errors.New("Input is not a BMP file")
+	opts.verbose = benchVerbose
+	policy, err := policyFlags.resolve(fs)
+	if err != nil {
+		gameOver("%v", err)
 	}
-
-	dataOffset := int(binary.LittleEndian.Uint32(input[10:14]))
-	dibSize := int(binary.LittleEndian.Uint32(input[14:18]))
-	if dibSize < 40 {
-		return nil, errors.New("Unsupported BMP DIB header")
+	moduleResolver, err := sourceFlags.Resolver()
+	if err != nil {
+		gameOver("%v", err)
 	}
-	width := int32(binary.LittleEndian.Uint32(input[18:22]))
-	height := int32(binary.LittleEndian.Uint32(input[22:26]))
-	planes := binary.LittleEndian.Uint16(input[26:28])
-	bpp := binary.LittleEndian.Uint16(input[28:30])
-	compression := binary.LittleEndian.Uint32(input[30:34])
+	opts.policy = policy
+	opts.modules = moduleResolver
+	// Frozen for every run, so modules granted now_unix_ms give the same
+	// output each time.
+	opts.now = time.Now()
 
-	if width <= 0 || height == 0 {
-		return nil, errors.New("Unsupported BMP dimensions")
+	specs := moduleSpecsFromArgs(fs.Args())
+	if manifestPath != "" {
+		if len(specs) > 0 {
+			gameOver("Use either -f <manifest> or module arguments, not both")
+		}
+		specs, err = loadPipelineManifest(manifestPath)
+		if err != nil {
+			gameOver("%v", err)
+		}
+		if err := rejectUniforms(specs, "bench"); err != nil {
+			gameOver("%v", err)
+		}
 	}
-	if planes != 1 {
-		return nil, errors.New("Unsupported BMP planes")
+	modules := make([]string, len(specs))
+	for i, spec := range specs {
+		modules[i] = spec.path
 	}
-	if compression != 0 {
-		return nil, errors.New("Unsupported BMP compression")
+	if inputPath == "" || len(modules) < 1 {
+		gameOver(usageBench)
 	}
-	if bpp != 24 && bpp != 32 {
-		return nil, errors.New("Unsupported BMP bit depth")
-	}
-
-	topDown := false
-	absHeight := int(height)
-	if height < 0 {
-		topDown = true
-		absHeight = -absHeight
-	}
-	absWidth := int(width)
-	if absWidth <= 0 || absHeight <= 0 {
-		return nil, errors.New("Unsupported BMP dimensions")
+	if benchRuns <= 0 {
+		gameOver("Invalid benchmark runs: %d", benchRuns)
 	}
-
-	bytesPerPixel := int(bpp / 8)
-	rowStride := absWidth * bytesPerPixel
-	if bpp == 24 {
-		if rem := rowStride % 4; rem != 0 {
-			rowStride += 4 - rem
+	var benchtime time.Duration
+	if benchtimeStr != "" {
+		parsed, err := time.ParseDuration(benchtimeStr)
+		if err != nil {
+			gameOver("Invalid benchtime: %v", err)
 		}
+		if parsed <= 0 {
+			gameOver("Invalid benchtime: must be > 0")
+		}
+		benchtime = parsed
 	}
 
-	if dataOffset < 0 || dataOffset > len(input) {
-		return nil, errors.New("Invalid BMP data offset")
-	}
-	if dataOffset+rowStride*absHeight > len(input) {
-		return nil, errors.New("BMP pixel data out of range")
-	}
-
-	img := image.NewRGBA(image.Rect(0, 0, absWidth, absHeight))
-	for y := 0; y < absHeight; y++ {
-		srcY := y
-		if !topDown {
-			srcY = absHeight - 1 - y
+	var inputBytes []byte
+	if inputPath == "-" {
+		inputBytes, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			gameOver("Error reading stdin: %v", err)
 		}
-		srcRow := dataOffset + srcY*rowStride
-		for x := range absWidth {
-			s := srcRow + x*bytesPerPixel
-			b := input[s]
-			g := input[s+1]
-			r := input[s+2]
-			a := byte(0xFF)
-			if bytesPerPixel == 4 {
-				a = input[s+3]
-			}
-			d := img.PixOffset(x, y)
-			img.Pix[d] = r
-			img.Pix[d+1] = g
-			img.Pix[d+2] = b
-			img.Pix[d+3] = a
+	} else {
+		inputBytes, err = os.ReadFile(inputPath)
+		if err != nil {
+			gameOver("Error reading input file: %v", err)
 		}
 	}
 
-	return img, nil
-}
-
-func encodeBMP(img *image.RGBA) ([]byte, error) {
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-	if width <= 0 || height <= 0 {
-		return nil, errors.New("Invalid BMP image size")
-	}
-
-	rowStride := width * 4
-	dataSize := rowStride * height
-	fileSize := 14 + 40 + dataSize
-	buf := make([]byte, fileSize)
-	buf[0] = 'B'
-	buf[1] = 'M'
-	binary.LittleEndian.PutUint32(buf[2:], uint32(fileSize))
-	binary.LittleEndian.PutUint32(buf[10:], 54)
-	binary.LittleEndian.PutUint32(buf[14:], 40)
-	binary.LittleEndian.PutUint32(buf[18:], uint32(width))
-	binary.LittleEndian.PutUint32(buf[22:], uint32(height))
-	binary.LittleEndian.PutUint16(buf[26:], 1)
-	binary.LittleEndian.PutUint16(buf[28:], 32)
-	binary.LittleEndian.PutUint32(buf[30:], 0)
-	binary.LittleEndian.PutUint32(buf[34:], uint32(dataSize))
-
-	for y := range height {
-		srcY := height - 1 - y
-		for x := range width {
-			s := img.PixOffset(bounds.Min.X+x, bounds.Min.Y+srcY)
-			d := 54 + y*rowStride + x*4
-			buf[d] = img.Pix[s+2]
-			buf[d+1] = img.Pix[s+1]
-			buf[d+2] = img.Pix[s]
-			buf[d+3] = img.Pix[s+3]
-		}
+	if opts.verbose {
+		inputDigest := sha256.Sum256(inputBytes)
+		vlogf(opts, "bench input sha256: %x", inputDigest)
 	}
 
-	return buf, nil
-}
-
-func imageCmd(args []string) {
-	opts := options{}
-	var inputImagePath string
-	var outputImagePath string
-	timeoutMS := 4000
-	fs := flag.NewFlagSet("image", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-	var imageVerbose bool
-	fs.BoolVar(&imageVerbose, "v", false, "enable verbose logging")
-	fs.BoolVar(&imageVerbose, "verbose", false, "enable verbose logging")
-	fs.StringVar(&inputImagePath, "i", "", "input image path")
-	fs.StringVar(&outputImagePath, "o", "", "output image path")
-	fs.IntVar(&timeoutMS, "timeout-ms", timeoutMS, "module execution timeout in milliseconds")
-	if err := fs.Parse(args); err != nil {
-		gameOver("%s %v", usageImage, err)
-	}
-	opts.verbose = opts.verbose || imageVerbose
-	moduleSpecs, parseErr := parseImageModuleSpecs(fs.Args())
-	if parseErr != nil {
-		gameOver("Invalid image module args: %v", parseErr)
-	}
-	if len(moduleSpecs) == 0 || inputImagePath == "" || outputImagePath == "" {
-		gameOver(usageImage)
-	}
-	if timeoutMS <= 0 {
-		gameOver("Invalid timeout-ms: %d", timeoutMS)
-	}
+	ctx := context.Background()
+	runtime := wasmruntime.NewWithConfig(ctx, opts.policy.runtimeConfig())
+	defer runtime.Close(ctx)
 
-	moduleBodies := make([][]byte, len(moduleSpecs))
-	for i, spec := range moduleSpecs {
-		body, err := readModulePath(spec.path, opts)
+	moduleCount := len(modules)
+	compiled := make([]wazero.CompiledModule, moduleCount)
+	compileDur := make([]time.Duration, moduleCount)
+	moduleSizes := make([]uint64, moduleCount)
+	moduleGzipSizes := make([]uint64, moduleCount)
+	moduleBodies := make([][]byte, moduleCount)
+	moduleWASI := make([]bool, moduleCount)
+	for i, modulePath := range modules {
+		body, err := readModuleSpec(specs[i], opts)
 		if err != nil {
 			gameOver("%v", err)
 		}
 		moduleBodies[i] = body
-	}
-
-	baseCtx := context.Background()
-
-	var inputImageBytes []byte
-	var err error
-	if inputImagePath == "-" {
-		inputImageBytes, err = io.ReadAll(os.Stdin)
+		moduleSizes[i] = uint64(len(body))
+		gzipSize, err := gzipSizeBytes(body)
 		if err != nil {
-			gameOver("Error reading image stdin: %v", err)
+			gameOver("Error gzipping module %s: %v", modulePath, err)
 		}
-	} else {
-		inputImageBytes, err = os.ReadFile(inputImagePath)
+		moduleGzipSizes[i] = gzipSize
+		start := time.Now()
+		cm, err := runtime.CompileModule(ctx, body)
+		compileDur[i] = time.Since(start)
 		if err != nil {
-			gameOver("Error reading image file: %v", err)
+			gameOver("%v", opts.policy.compileError(err))
 		}
-	}
-	decodeImage := func(r io.Reader) (image.Image, error) {
-		img, _, err := image.Decode(r)
-		return img, err
-	}
-	if len(inputImageBytes) >= 8 && bytes.Equal(inputImageBytes[:8], []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}) {
-		decodeImage = png.Decode
-	}
-	inputImage, err := decodeImage(bytes.NewReader(inputImageBytes))
-	if err != nil {
-		gameOver("Error decoding image file: %v", err)
-	}
-	inputRGBA, ok := inputImage.(*image.RGBA)
-	if !ok {
-		bounds := inputImage.Bounds()
-		inputRGBA = image.NewRGBA(bounds)
-		draw.Draw(inputRGBA, bounds, inputImage, bounds.Min, draw.Src)
-	}
-
-	start := time.Now()
-	defer func() {
-		if opts.verbose {
-			vlogf(opts, "command took %dms", time.Since(start).Milliseconds())
+		compiled[i] = cm
+		defer compiled[i].Close(ctx)
+		if err := specs[i].checkExportedEncodings(cm, body); err != nil {
+			gameOver("bench check failed for %s: %v", modulePath, err)
 		}
-	}()
-
-	execCtx, cancel := wasmruntime.WithExecutionTimeout(baseCtx, time.Duration(timeoutMS)*time.Millisecond)
-	defer cancel()
-
-	r := wasmruntime.New(execCtx)
-	defer r.Close(baseCtx)
-
-	stages := make([]tileStage, len(moduleBodies))
-	for i, body := range moduleBodies {
-		mod, err := r.InstantiateWithConfig(execCtx, body, wazero.NewModuleConfig())
-		if err != nil {
-			gameOver("Wasm module could not be compiled")
+		if err := hostmodule.CheckGrants(cm, specs[i].grants); err != nil {
+			gameOver("%v", stageFailed(i, modulePath, wasmruntime.Errorf(wasmruntime.KindCompile, "%w", err)))
 		}
-		if err := applyImageUniforms(execCtx, mod, moduleSpecs[i].uniforms); err != nil {
-			gameOver("%v", err)
+		if len(hostmodule.Imports(cm)) > 0 {
+			if err := hostmodule.Instantiate(ctx, runtime); err != nil {
+				gameOver("Could not instantiate %s: %v", hostmodule.ModuleName, err)
+			}
 		}
-		stage, err := loadTileStage(execCtx, mod)
-		if err != nil {
-			gameOver("%v", err)
+		moduleWASI[i] = wasmruntime.ImportsWASI(cm)
+		if moduleWASI[i] {
+			if err := wasmruntime.InstantiateWASI(ctx, runtime); err != nil {
+				gameOver("Could not instantiate WASI: %v", err)
+			}
 		}
-		stages[i] = stage
-	}
-	defer closeTileStages(baseCtx, stages)
-	outputRGBA, _, err := runTileStages(execCtx, stages, inputRGBA)
-	if err != nil {
-		gameOver("%v", err)
 	}
 
-	outFile, err := os.Create(outputImagePath)
+	perRunTimeout := opts.policy.stageTimeout
+	moduleInputCaps := make([]uint64, moduleCount)
+	moduleOutputCaps := make([]uint64, moduleCount)
+	firstSample, expected, err := runBenchSample(ctx, runtime, compiled[0], inputBytes, opts, "bench-0-check", specs[0])
 	if err != nil {
-		gameOver("Error creating output image file: %v", err)
+		gameOver("bench check failed for %s: %v", modules[0], err)
 	}
-	defer outFile.Close()
-	encoder := png.Encoder{CompressionLevel: png.NoCompression}
-	if err := encoder.Encode(outFile, outputRGBA); err != nil {
-		gameOver("Error writing output image: %v", err)
+	moduleInputCaps[0] = firstSample.inputCapBytes
+	moduleOutputCaps[0] = firstSample.outputCapBytes
+	for i := 1; i < moduleCount; i++ {
+		sample, output, err := runBenchSample(ctx, runtime, compiled[i], inputBytes, opts, fmt.Sprintf("bench-%d-check", i), specs[i])
+		if err != nil {
+			gameOver("bench check failed for %s: %v", modules[i], err)
+		}
+		moduleInputCaps[i] = sample.inputCapBytes
+		moduleOutputCaps[i] = sample.outputCapBytes
+		if mismatch := describeContentMismatch(expected, output); mismatch != "" {
+			gameOver("bench mismatch for %s vs %s: %s", modules[i], modules[0], mismatch)
+		}
 	}
-}
 
-// getExportedValue tries to get a value from either a global or a function.
-// The bool return indicates whether the export exists.
-func getExportedValue(ctx context.Context, mod api.Module, name string) (uint64, bool, error) {
-	// Try global first
-	if global := mod.ExportedGlobal(name); global != nil {
-		return global.Get(), true, nil
+	samples := make([][]benchSample, moduleCount)
+	for i := range moduleCount {
+		samples[i] = make([]benchSample, 0, benchRuns)
 	}
-
-	// Try function if global doesn't exist
-	if fn := mod.ExportedFunction(name); fn != nil {
-		result, err := fn.Call(ctx)
-		if err != nil {
-			return 0, true, fmt.Errorf("%s() call failed: %w", name, err)
+	benchTimeTotals := make([]time.Duration, moduleCount)
+	for i := 0; ; i++ {
+		if benchtime == 0 && i >= benchRuns {
+			break
 		}
-		if len(result) != 1 {
-			return 0, true, fmt.Errorf("%s() returned %d values, want 1", name, len(result))
+		startIndex := i % moduleCount
+		for j := range moduleCount {
+			moduleIndex := (startIndex + j) % moduleCount
+			sample, output, err := runBenchSample(
+				ctx,
+				runtime,
+				compiled[moduleIndex],
+				inputBytes,
+				opts,
+				fmt.Sprintf("bench-%d-run-%d", moduleIndex, i),
+				specs[moduleIndex],
+			)
+			if err != nil {
+				gameOver("bench run failed for %s (run %d): %v", modules[moduleIndex], i+1, err)
+			}
+			if mismatch := describeContentMismatch(expected, output); mismatch != "" {
+				gameOver("bench output mismatch for %s (run %d): %s", modules[moduleIndex], i+1, mismatch)
+			}
+			samples[moduleIndex] = append(samples[moduleIndex], sample)
+			benchTimeTotals[moduleIndex] += sample.total
+		}
+		if benchtime > 0 && allDurationsAtLeast(benchTimeTotals, benchtime) {
+			break
 		}
-		return result[0], true, nil
 	}
 
-	return 0, false, nil
-}
+	summaries := make([]benchSummary, moduleCount)
+	for i := range moduleCount {
+		summaries[i] = summarizeBench(samples[i])
+	}
 
-type moduleExecutionResult struct {
-	output         contentData
-	instantiation  time.Duration
-	run            time.Duration
-	total          time.Duration
-	memoryBytes    uint64
-	inputCapBytes  uint64
-	outputCapBytes uint64
-}
+	digest := sha256.Sum256(expected.bytes)
+	if moduleCount == 1 {
+		fmt.Printf("bench: baseline output captured\n")
+	} else {
+		fmt.Printf("bench: outputs match\n")
+	}
+	fmt.Printf("  encoding: %s\n", encodingName(expected.encoding))
+	fmt.Printf("  bytes:    %d\n", len(expected.bytes))
+	fmt.Printf("  sha256:   %x\n", digest)
+	if benchtime > 0 {
+		fmt.Printf("  benchtime target: %s per module\n", benchtime)
+	}
+	fmt.Printf("  measured: %d runs/module\n", len(samples[0]))
+	fmt.Printf("  timeout:  %s per run\n\n", perRunTimeout)
 
-func runModuleWithInput(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule, inputBytes []byte, opts options, moduleName string) (output contentData, instantiation time.Duration, returnErr error) {
-	exec, err := executeModuleWithInput(ctx, runtime, compiled, inputBytes, opts, moduleName)
-	if err != nil {
-		return contentData{}, 0, err
+	for i := range moduleCount {
+		printBenchBenchmarkReport(
+			i+1,
+			modules[i],
+			moduleSizes[i],
+			moduleGzipSizes[i],
+			moduleWASI[i],
+			moduleInputCaps[i],
+			moduleOutputCaps[i],
+			compileDur[i],
+			summaries[i],
+		)
 	}
-	return exec.output, exec.instantiation, nil
-}
 
-func executeModuleWithInput(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule, inputBytes []byte, opts options, moduleName string) (exec moduleExecutionResult, returnErr error) {
-	totalStart := time.Now()
-	defer func() {
-		exec.total = time.Since(totalStart)
-	}()
+	if moduleCount > 1 {
+		bestIdx := 0
+		worstIdx := 0
+		lowestPeakMemIdx := 0
+		for i := 1; i < moduleCount; i++ {
+			if summaries[i].total.mean < summaries[bestIdx].total.mean {
+				bestIdx = i
+			}
+			if summaries[i].total.mean > summaries[worstIdx].total.mean {
+				worstIdx = i
+			}
+			if summaries[i].peakMem < summaries[lowestPeakMemIdx].peakMem {
+				lowestPeakMemIdx = i
+			}
+		}
+		fastestMean := summaries[bestIdx].total.mean
+		slowestMean := summaries[worstIdx].total.mean
+		fmt.Printf("Summary\n")
+		fmt.Printf("  fastest: %q (mean total time %s)\n", modules[bestIdx], fastestMean)
+		if fastestMean > 0 && slowestMean > 0 && bestIdx != worstIdx {
+			ratio := float64(slowestMean) / float64(fastestMean)
+			fmt.Printf("  speedup vs slowest: %.2fx over %q\n", ratio, modules[worstIdx])
+		}
+		fmt.Printf("  lowest peak memory: %q (peak %s, mean %s)\n", modules[lowestPeakMemIdx], formatBytesIEC(summaries[lowestPeakMemIdx].peakMem), formatBytesIEC(summaries[lowestPeakMemIdx].meanMem))
+	}
 
-	instStart := time.Now()
-	mod, err := runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName(moduleName))
-	if err != nil {
-		returnErr = errors.New("Wasm module could not be instantiated")
-		return
+	if profilePath != "" {
+		if moduleCount > 1 {
+			fmt.Println()
+		}
+		profileRuns := len(samples[0])
+		if err := writeBenchProfile(ctx, runtime, specs, moduleBodies, inputBytes, opts, profileRuns, profilePath); err != nil {
+			gameOver("%v", err)
+		}
+		fmt.Printf("Profile\n")
+		fmt.Printf("  file: %s\n", profilePath)
+		fmt.Printf("  runs: %d/module, separate from the measured runs\n", profileRuns)
+		fmt.Printf("  view: go tool pprof -top %s\n", profilePath)
 	}
-	defer mod.Close(ctx)
-	exec.instantiation = time.Since(instStart)
+}
 
-	var input contentData
-	// Get input_ptr and input_cap (required)
-	inputPtr, ok, err := getExportedValue(ctx, mod, "input_ptr")
+// writeBenchProfile compiles each module again with function listeners and
+// repeats the benchmark runs to write a pprof profile. Listeners slow every
+// call, so profiled runs are kept apart from the measured ones.
+func writeBenchProfile(
+	ctx context.Context,
+	runtime wazero.Runtime,
+	specs []moduleSpec,
+	bodies [][]byte,
+	inputBytes []byte,
+	opts options,
+	runs int,
+	path string,
+) error {
+	profiler := wasmprofile.New()
+	for i, spec := range specs {
+		compiled, err := runtime.CompileModule(wasmprofile.WithProfiler(ctx, profiler, spec.path), bodies[i])
+		if err != nil {
+			return opts.policy.compileError(err)
+		}
+		for run := range runs {
+			_, _, err := runBenchSample(ctx, runtime, compiled, inputBytes, opts, fmt.Sprintf("bench-%d-profile-%d", i, run), spec)
+			if err != nil {
+				compiled.Close(ctx)
+				return fmt.Errorf("bench profile run failed for %s (run %d): %w", spec.path, run+1, err)
+			}
+		}
+		compiled.Close(ctx)
+	}
+	f, err := os.Create(path)
 	if err != nil {
-		returnErr = wasmruntime.HumanizeExecutionError(ctx, err)
-		return
+		return fmt.Errorf("Error creating profile: %w", err)
 	}
-	if !ok {
-		returnErr = errors.New("Wasm module must export input_ptr as global or function")
-		return
+	if err := profiler.WritePprof(f); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing profile: %w", err)
 	}
+	return f.Close()
+}
 
-	inputCap, ok, err := getExportedValue(ctx, mod, "input_utf8_cap")
+func runBenchSample(
+	parent context.Context,
+	runtime wazero.Runtime,
+	compiled wazero.CompiledModule,
+	inputBytes []byte,
+	opts options,
+	moduleName string,
+	spec moduleSpec,
+) (benchSample, contentData, error) {
+	// Every module compared gets stage 0's random stream, so their outputs
+	// can match.
+	ctx := hostStageContext(parent, opts, 0, 0, spec, opts.now)
+	timeout := opts.policy.timeoutFor(spec)
+	cancel := func() {}
+	if timeout > 0 {
+		ctxWithTimeout, cancelWithTimeout := wasmruntime.WithExecutionTimeout(ctx, timeout)
+		ctx = ctxWithTimeout
+		cancel = cancelWithTimeout
+	}
+	defer cancel()
+
+	exec, err := executeModuleWithInput(ctx, runtime, compiled, inputBytes, nil, opts, moduleName)
 	if err != nil {
-		returnErr = wasmruntime.HumanizeExecutionError(ctx, err)
-		return
+		return benchSample{}, contentData{}, err
 	}
-	if ok {
-		input.encoding = dataEncodingUTF8
-	} else if cap, ok, err := getExportedValue(ctx, mod, "input_bytes_cap"); err != nil {
-		returnErr = wasmruntime.HumanizeExecutionError(ctx, err)
-		return
-	} else if ok {
-		inputCap = cap
-		input.encoding = dataEncodingRaw
-	} else {
-		returnErr = errors.New("Wasm module must export input_utf8_cap or input_bytes_cap as global or function")
-		return
+	sample := benchSample{
+		total:          exec.total,
+		instantiation:  exec.instantiation,
+		run:            exec.run,
+		memoryBytes:    exec.memoryBytes,
+		inputCapBytes:  exec.inputCapBytes,
+		outputCapBytes: exec.outputCapBytes,
+		inputEncoding:  exec.inputEncoding,
 	}
-	exec.inputCapBytes = inputCap
+	return sample, exec.output, nil
+}
 
-	var outputPtr, outputCap uint32
-	if ptr, ok, err := getExportedValue(ctx, mod, "output_ptr"); err != nil {
-		returnErr = wasmruntime.HumanizeExecutionError(ctx, err)
-		return
-	} else if ok {
-		outputPtr = uint32(ptr)
+func summarizeBench(samples []benchSample) benchSummary {
+	totalValues := make([]time.Duration, len(samples))
+	runValues := make([]time.Duration, len(samples))
+	instValues := make([]time.Duration, len(samples))
+	memValues := make([]uint64, len(samples))
 
-		if cap, ok, err := getExportedValue(ctx, mod, "output_utf8_cap"); err != nil {
-			returnErr = wasmruntime.HumanizeExecutionError(ctx, err)
-			return
-		} else if ok {
-			outputCap = uint32(cap)
-			exec.output.encoding = dataEncodingUTF8
-		} else if cap, ok, err := getExportedValue(ctx, mod, "output_i32_cap"); err != nil {
-			returnErr = wasmruntime.HumanizeExecutionError(ctx, err)
-			return
-		} else if ok {
-			outputCap = uint32(cap)
-			exec.output.encoding = dataEncodingArrayI32
-		} else if cap, ok, err := getExportedValue(ctx, mod, "output_bytes_cap"); err != nil {
-			returnErr = wasmruntime.HumanizeExecutionError(ctx, err)
-			return
-		} else if ok {
-			outputCap = uint32(cap)
-			exec.output.encoding = dataEncodingRaw
-		} else {
-			returnErr = errors.New("Wasm module must export output_utf8_cap or output_i32_cap or output_bytes_cap as global or function")
-			return
-		}
+	for i, sample := range samples {
+		totalValues[i] = sample.total
+		runValues[i] = sample.run
+		instValues[i] = sample.instantiation
+		memValues[i] = sample.memoryBytes
 	}
-	exec.outputCapBytes = uint64(outputCap)
 
-	runFunc := mod.ExportedFunction("run")
-
-	var inputSize = uint64(len(inputBytes))
-	if inputSize > inputCap {
-		returnErr = errors.New("Input is too large")
-		return
+	meanMem, peakMem := summarizeMemory(memValues)
+	return benchSummary{
+		total:   summarizeDurations(totalValues),
+		run:     summarizeDurations(runValues),
+		inst:    summarizeDurations(instValues),
+		meanMem: meanMem,
+		peakMem: peakMem,
 	}
+}
 
-	mem := mod.Memory()
-	if !mem.Write(uint32(inputPtr), inputBytes) {
-		returnErr = errors.New("Could not write input")
-		return
+func summarizeDurations(values []time.Duration) durationStats {
+	if len(values) == 0 {
+		return durationStats{}
 	}
 
-	runStart := time.Now()
-	runResult, returnErr := runFunc.Call(ctx, inputSize)
-	exec.run = time.Since(runStart)
-	if returnErr != nil {
-		returnErr = wasmruntime.HumanizeExecutionError(ctx, returnErr)
-		return
+	n := len(values)
+	ns := make([]float64, n)
+	sorted := make([]int64, n)
+	var sum float64
+	for i, value := range values {
+		x := float64(value.Nanoseconds())
+		ns[i] = x
+		sum += x
+		sorted[i] = value.Nanoseconds()
 	}
+	slices.Sort(sorted)
 
-	outputCount := uint32(runResult[0])
-
-	var outputItemFactor uint32
-	if exec.output.encoding == dataEncodingArrayI32 {
-		outputItemFactor = 4
-	} else {
-		outputItemFactor = 1
+	mean := sum / float64(n)
+	var variance float64
+	for _, x := range ns {
+		delta := x - mean
+		variance += delta * delta
 	}
+	variance /= float64(n)
 
-	outputCountBytes := outputItemFactor * outputCount
-
-	if outputCap > 0 {
-		if outputCount > outputCap {
-			returnErr = errors.New("Module returned more bytes than its stated capacity")
-			return
-		}
-		outputBytes, ok := mem.Read(outputPtr, uint32(outputCountBytes))
-		if !ok {
-			returnErr = errors.New("Could not read output")
-			return
-		}
-		// Copy out of wasm memory so callers can safely use the bytes after module close.
-		exec.output.bytes = append([]byte(nil), outputBytes...)
-		if opts.verbose && len(exec.output.bytes) > 0 {
-			sum := sha256.Sum256(exec.output.bytes)
-			vlogf(opts, "output sha256: %x", sum)
-		}
-	} else {
-		fmt.Printf("Ran: %d\n", runResult[0])
+	p95Index := max(int(math.Ceil(0.95*float64(n)))-1, 0)
+	if p95Index >= n {
+		p95Index = n - 1
 	}
 
-	exec.memoryBytes = memorySizeBytes(mem)
-	return
+	return durationStats{
+		mean:   time.Duration(int64(math.Round(mean))),
+		min:    time.Duration(sorted[0]),
+		max:    time.Duration(sorted[n-1]),
+		stddev: time.Duration(int64(math.Round(math.Sqrt(variance)))),
+		p95:    time.Duration(sorted[p95Index]),
+	}
 }
 
-func memorySizeBytes(mem api.Memory) uint64 {
-	size := mem.Size()
-	if size != 0 {
-		return uint64(size)
+func summarizeMemory(values []uint64) (mean, peak uint64) {
+	if len(values) == 0 {
+		return 0, 0
 	}
-	// Work around wazero's uint32 overflow behavior on max memory.
-	pages, ok := mem.Grow(0)
-	if !ok {
-		return 0
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+		if v > peak {
+			peak = v
+		}
 	}
-	return uint64(pages) * 65536
+	return uint64(math.Round(sum / float64(len(values)))), peak
 }
 
-func gameOver(format string, args ...any) {
-	log.SetFlags(0)
-	log.Fatalf(format, args...)
+func allDurationsAtLeast(values []time.Duration, threshold time.Duration) bool {
+	for _, value := range values {
+		if value < threshold {
+			return false
+		}
+	}
+	return true
 }
 
-func vlogf(opts options, format string, args ...any) {
-	if !opts.verbose {
-		return
+func gzipSizeBytes(data []byte) (uint64, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return 0, err
 	}
-	log.SetFlags(0)
-	log.Printf(format, args...)
+	if _, err := zw.Write(data); err != nil {
+		_ = zw.Close()
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return uint64(buf.Len()), nil
 }
 
-type devContentRoute struct {
-	filePath   string
-	sourceMIME string
+func formatBytesIEC(bytes uint64) string {
+	const unit = uint64(1024)
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := unit, 0
+	for n := bytes / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-type recipeCandidate struct {
-	path     string
-	filename string
-	order    int
-	digest   [32]byte
-}
-
-type moduleFileStamp struct {
-	modTimeUnixNano int64
-	sizeBytes       int64
+func printBenchBenchmarkReport(index int, modulePath string, binarySize uint64, gzipSize uint64, wasi bool, inputCapBytes uint64, outputCapBytes uint64, compileDuration time.Duration, summary benchSummary) {
+	fmt.Printf("Benchmark %d: %s\n", index, modulePath)
+	fmt.Printf("  Time (mean ± stddev): %s ± %s [min: %s, p95: %s, max: %s]\n",
+		summary.total.mean,
+		summary.total.stddev,
+		summary.total.min,
+		summary.total.p95,
+		summary.total.max,
+	)
+	fmt.Printf("  Breakdown: run mean %s, instantiation mean %s, compile %s\n",
+		summary.run.mean,
+		summary.inst.mean,
+		compileDuration,
+	)
+	fmt.Printf("  Memory allocated: mean %s, peak %s\n", formatBytesIEC(summary.meanMem), formatBytesIEC(summary.peakMem))
+	inputCap := formatBytesIEC(inputCapBytes)
+	if inputCapBytes == 0 {
+		// Only modules that allocate their input run with no capacity.
+		inputCap = "alloc"
+	}
+	if wasi {
+		fmt.Printf("  Capacity: WASI stdin and stdout\n")
+	} else {
+		fmt.Printf("  Capacity: input %s, output %s\n", inputCap, formatBytesIEC(outputCapBytes))
+	}
+	fmt.Printf("  Binary size: %d bytes, gzip %d bytes\n", binarySize, gzipSize)
+	fmt.Printf("\n")
 }
 
-type devRuntimeState struct {
-	contentRoutes map[string]devContentRoute
-	recipeChains  map[string]*moduleChain
-	recipeDigests map[string][][32]byte
-	recipeStamps  map[string]moduleFileStamp
-	formModules   map[string][]byte
-	formDigests   map[string][32]byte
-}
+// parseModuleSpecs reads module arguments, each optionally followed by a
+// '?key=value' query of uniforms for that module.
+func parseModuleSpecs(args []string) ([]moduleSpec, error) {
+	specs := make([]moduleSpec, 0, len(args))
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "?") {
+			if len(specs) == 0 {
+				return nil, fmt.Errorf("uniform query %q must follow a wasm module path", arg)
+			}
+			if len(arg) == 1 {
+				return nil, errors.New("uniform query must not be empty")
+			}
+			values, err := url.ParseQuery(arg[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid uniform query %q: %w", arg, err)
+			}
+			if len(values) == 0 {
+				return nil, fmt.Errorf("uniform query %q must contain key=value pairs", arg)
+			}
+			last := &specs[len(specs)-1]
+			for key, vals := range values {
+				if key == "" {
+					return nil, fmt.Errorf("invalid uniform query %q: empty key", arg)
+				}
+				if len(vals) == 0 {
+					return nil, fmt.Errorf("invalid uniform query %q: missing value for %q", arg, key)
+				}
+				last.uniforms[key] = vals[len(vals)-1]
+			}
+			continue
+		}
 
-func devCmd(args []string) {
-	opts := options{}
-	var recipesRoot string
-	var formsRoot string
-	var modeRaw string
-	port := 4000
-	fs := flag.NewFlagSet("dev", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-	var devVerbose bool
-	fs.BoolVar(&devVerbose, "v", false, "enable verbose logging")
-	fs.BoolVar(&devVerbose, "verbose", false, "enable verbose logging")
-	fs.StringVar(&recipesRoot, "recipes", "", "recipe modules root directory")
-	fs.StringVar(&formsRoot, "forms", "", "form modules root directory")
-	fs.StringVar(&modeRaw, "mode", string(modeDev), "runtime mode: dev or prod")
-	fs.IntVar(&port, "p", 4000, "port")
-	if err := fs.Parse(normalizeDevArgs(args)); err != nil {
-		gameOver("%s %v", usageDev, err)
+		specs = append(specs, moduleSpec{
+			path:     arg,
+			uniforms: make(map[string]string),
+		})
 	}
+	return specs, nil
+}
 
-	mode, err := parseRuntimeMode(modeRaw)
-	if err != nil {
-		gameOver("%v", err)
-	}
+// pipelineManifest is the JSON file accepted by -f in run, image and bench.
+type pipelineManifest struct {
+	Stages []pipelineManifestStage `json:"stages"`
+}
 
-	opts.verbose = devVerbose
-	opts.mode = mode
-	contentArgs := fs.Args()
-	if len(contentArgs) != 1 {
-		gameOver(usageDev)
-	}
-	contentRoot := contentArgs[0]
-	if port <= 0 || port > 65535 {
-		gameOver("Invalid port: %d", port)
-	}
+type pipelineManifestStage struct {
+	Module    string         `json:"module"`
+	SHA256    string         `json:"sha256"`
+	Uniforms  map[string]any `json:"uniforms"`
+	TimeoutMS int64          `json:"timeout_ms"`
+	Input     string         `json:"input"`
+	Output    string         `json:"output"`
+	Guard     bool           `json:"guard"`
+	Grants    []string       `json:"grants"`
+}
 
-	contentInfo, err := os.Stat(contentRoot)
+// loadPipelineManifest reads a pipeline manifest into module specs. Relative
+// module paths are resolved against the manifest's directory.
+func loadPipelineManifest(manifestPath string) ([]moduleSpec, error) {
+	data, err := os.ReadFile(manifestPath)
 	if err != nil {
-		gameOver("Invalid content directory: %v", err)
+		return nil, fmt.Errorf("Error reading pipeline manifest: %w", err)
 	}
-	if !contentInfo.IsDir() {
-		gameOver("Invalid content directory: %q is not a directory", contentRoot)
+	var manifest pipelineManifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("Invalid pipeline manifest %s: %v", manifestPath, err)
+	}
+	if len(manifest.Stages) == 0 {
+		return nil, fmt.Errorf("Invalid pipeline manifest %s: no stages", manifestPath)
 	}
 
-	if recipesRoot != "" {
-		recipeInfo, err := os.Stat(recipesRoot)
+	baseDir := filepath.Dir(manifestPath)
+	specs := make([]moduleSpec, len(manifest.Stages))
+	for i, stage := range manifest.Stages {
+		spec, err := stage.moduleSpec(baseDir)
 		if err != nil {
-			gameOver("Invalid recipes directory: %v", err)
-		}
-		if !recipeInfo.IsDir() {
-			gameOver("Invalid recipes directory: %q is not a directory", recipesRoot)
+			return nil, fmt.Errorf("Invalid pipeline manifest %s: stage %d: %v", manifestPath, i, err)
 		}
+		specs[i] = spec
 	}
+	return specs, nil
+}
 
-	if formsRoot != "" {
-		formInfo, err := os.Stat(formsRoot)
-		if err != nil {
-			gameOver("Invalid forms directory: %v", err)
+func (stage pipelineManifestStage) moduleSpec(baseDir string) (moduleSpec, error) {
+	if stage.Module == "" {
+		return moduleSpec{}, errors.New("module is required")
+	}
+	spec := moduleSpec{
+		path:     stage.Module,
+		sha256:   strings.ToLower(stage.SHA256),
+		uniforms: make(map[string]string, len(stage.Uniforms)),
+	}
+	if !strings.HasPrefix(spec.path, "https://") && !filepath.IsAbs(spec.path) {
+		spec.path = filepath.Join(baseDir, spec.path)
+	}
+	if spec.sha256 != "" {
+		if decoded, err := hex.DecodeString(spec.sha256); err != nil || len(decoded) != sha256.Size {
+			return moduleSpec{}, fmt.Errorf("sha256 must be 64 hex characters, got %q", stage.SHA256)
 		}
-		if !formInfo.IsDir() {
-			gameOver("Invalid forms directory: %q is not a directory", formsRoot)
+	}
+	for key, value := range stage.Uniforms {
+		switch v := value.(type) {
+		case json.Number:
+			spec.uniforms[key] = v.String()
+		case string:
+			spec.uniforms[key] = v
+		default:
+			return moduleSpec{}, fmt.Errorf("uniform %q must be a number or string", key)
 		}
 	}
-
-	state, err := loadDevRuntimeState(context.Background(), contentRoot, recipesRoot, formsRoot, opts)
-	if err != nil {
-		gameOver("%v", err)
+	if stage.TimeoutMS < 0 {
+		return moduleSpec{}, fmt.Errorf("invalid timeout_ms: %d", stage.TimeoutMS)
 	}
-	var stateMu sync.RWMutex
-	var reloadMu sync.Mutex
-	swapRuntimeState := func(nextState *devRuntimeState) {
-		stateMu.Lock()
-		previous := state
-		state = nextState
-		stateMu.Unlock()
-		if previous != nil {
-			closeModuleChains(context.Background(), previous.recipeChains)
+	spec.timeout = time.Duration(stage.TimeoutMS) * time.Millisecond
+	for _, encoding := range []string{stage.Input, stage.Output} {
+		switch encoding {
+		case "", "utf8", "bytes", "i32", "f32", "f64", "i64", "u8":
+		default:
+			return moduleSpec{}, fmt.Errorf("unknown encoding %q (want utf8, bytes, i32, f32, f64, i64, or u8)", encoding)
 		}
 	}
-	reloadRuntimeState := func(reason string) {
-		reloadMu.Lock()
-		defer reloadMu.Unlock()
-
-		reloadStart := time.Now()
-		nextState, err := loadDevRuntimeState(context.Background(), contentRoot, recipesRoot, formsRoot, opts)
+	spec.inputEncoding = stage.Input
+	spec.outputEncoding = stage.Output
+	spec.guard = stage.Guard
+	if len(stage.Grants) > 0 {
+		grants, err := hostmodule.ParseCapabilities(strings.Join(stage.Grants, ","))
 		if err != nil {
-			log.Printf("dev: reload failed reason=%s error=%v", reason, err)
-			return
+			return moduleSpec{}, err
 		}
-
-		swapRuntimeState(nextState)
-		log.Printf("dev: reloaded reason=%s paths=%d recipe_mimes=%d forms=%d duration_ms=%d", reason, len(nextState.contentRoutes), len(nextState.recipeChains), len(nextState.formModules), time.Since(reloadStart).Milliseconds())
+		spec.grants = grants
 	}
-	reloadRecipesIfChanged := func() {
-		if opts.mode != modeDev || recipesRoot == "" {
-			return
-		}
+	return spec, nil
+}
 
-		reloadMu.Lock()
-		defer reloadMu.Unlock()
+// moduleSpecsFromArgs returns specs for plain module path arguments.
+func moduleSpecsFromArgs(paths []string) []moduleSpec {
+	specs := make([]moduleSpec, len(paths))
+	for i, path := range paths {
+		specs[i] = moduleSpec{path: path}
+	}
+	return specs
+}
 
-		stamps, err := scanRecipeModuleStamps(recipesRoot)
-		if err != nil {
-			log.Printf("dev: recipe change check failed: %v", err)
-			return
+// rejectUniforms reports an error for commands that cannot pass uniforms to
+// their stages.
+func rejectUniforms(specs []moduleSpec, command string) error {
+	for i, spec := range specs {
+		if len(spec.uniforms) > 0 {
+			return fmt.Errorf("Stage %d (%s): uniforms are not supported by qip %s", i, spec.path, command)
 		}
+	}
+	return nil
+}
 
-		stateMu.RLock()
-		currentStamps := state.recipeStamps
-		unchanged := recipeModuleStampsEqual(currentStamps, stamps)
-		stateMu.RUnlock()
-		if unchanged {
-			return
-		}
+// contractEncodingName names an encoding the way the module contract exports
+// do: input_utf8_cap, output_bytes_cap, output_i32_cap.
+func contractEncodingName(encoding dataEncoding) string {
+	switch encoding {
+	case dataEncodingUTF8:
+		return "utf8"
+	case dataEncodingArrayI32:
+		return "i32"
+	case dataEncodingArrayF32:
+		return "f32"
+	case dataEncodingArrayF64:
+		return "f64"
+	case dataEncodingArrayI64:
+		return "i64"
+	case dataEncodingArrayU8:
+		return "u8"
+	default:
+		return "bytes"
+	}
+}
 
-		reloadStart := time.Now()
-		nextState, err := loadDevRuntimeState(context.Background(), contentRoot, recipesRoot, formsRoot, opts)
-		if err != nil {
-			log.Printf("dev: auto-reload failed reason=recipe_change error=%v", err)
-			return
-		}
+// checkEncodings verifies a module's contract against the encodings its spec
+// declares.
+func (spec moduleSpec) checkEncodings(input dataEncoding, output dataEncoding) error {
+	if spec.inputEncoding != "" && spec.inputEncoding != contractEncodingName(input) {
+		return wasmruntime.Errorf(wasmruntime.KindContract, "Module %s takes %s input but the manifest declares %s", spec.path, contractEncodingName(input), spec.inputEncoding)
+	}
+	if spec.outputEncoding != "" && spec.outputEncoding != contractEncodingName(output) {
+		return wasmruntime.Errorf(wasmruntime.KindContract, "Module %s returns %s output but the manifest declares %s", spec.path, contractEncodingName(output), spec.outputEncoding)
+	}
+	return nil
+}
 
-		swapRuntimeState(nextState)
-		log.Printf("dev: reloaded reason=recipe_change paths=%d recipe_mimes=%d forms=%d duration_ms=%d", len(nextState.contentRoutes), len(nextState.recipeChains), len(nextState.formModules), time.Since(reloadStart).Milliseconds())
+// checkExportedEncodings checks spec's manifest encodings against those a
+// run contract module declares with its exports, before it is instantiated.
+// body is the module's binary, read for the names of its exported globals.
+func (spec moduleSpec) checkExportedEncodings(compiled wazero.CompiledModule, body []byte) error {
+	if spec.inputEncoding == "" && spec.outputEncoding == "" {
+		return nil
+	}
+	names := make(map[string]bool)
+	for name := range compiled.ExportedFunctions() {
+		names[name] = true
+	}
+	globals, err := wasmruntime.ExportedGlobalNames(body)
+	if err != nil {
+		return wasmruntime.Errorf(wasmruntime.KindCompile, "%w", err)
+	}
+	for _, name := range globals {
+		names[name] = true
 	}
 
-	defer func() {
-		stateMu.Lock()
-		current := state
-		state = nil
-		stateMu.Unlock()
-		if current != nil {
-			closeModuleChains(context.Background(), current.recipeChains)
+	input := dataEncodingRaw
+	if names["input_utf8_cap"] {
+		input = dataEncodingUTF8
+	}
+	// A module without output exports is a scalar validator, whose "Ran: N"
+	// output is raw bytes.
+	output := dataEncodingRaw
+	if names["output_ptr"] {
+		for _, candidate := range outputCapExports {
+			if names[candidate.name] {
+				output = candidate.encoding
+				break
+			}
 		}
-	}()
+	}
+	return spec.checkEncodings(input, output)
+}
 
-	log.Printf("dev: indexed %d request paths from %s", len(state.contentRoutes), contentRoot)
-	if recipesRoot != "" {
-		log.Printf("dev: loaded %d recipe mime chains from %s", len(state.recipeChains), recipesRoot)
+func formatCapacityBytes(size uint64) string {
+	if size == 0 {
+		return "n/a"
 	}
-	if formsRoot != "" {
-		log.Printf("dev: loaded %d form modules from %s", len(state.formModules), formsRoot)
+	return fmt.Sprintf("%s (%d bytes)", formatBytesIEC(size), size)
+}
+
+func describeContentMismatch(expected, actual contentData) string {
+	if expected.encoding != actual.encoding {
+		return fmt.Sprintf("encoding differs (expected %s, actual %s)", encodingName(expected.encoding), encodingName(actual.encoding))
+	}
+	if bytes.Equal(expected.bytes, actual.bytes) {
+		return ""
+	}
+	diffAt := firstDiffIndex(expected.bytes, actual.bytes)
+	expSum := sha256.Sum256(expected.bytes)
+	actSum := sha256.Sum256(actual.bytes)
+	if diffAt >= 0 {
+		return fmt.Sprintf(
+			"output differs at byte %d (expected len=%d sha256=%x, actual len=%d sha256=%x)",
+			diffAt,
+			len(expected.bytes),
+			expSum,
+			len(actual.bytes),
+			actSum,
+		)
 	}
+	return fmt.Sprintf(
+		"output size differs (expected size=%d sha256=%x, actual size=%d sha256=%x)",
+		len(expected.bytes),
+		expSum,
+		len(actual.bytes),
+		actSum,
+	)
+}
 
-	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	mux := http.NewServeMux()
-	var requestID uint64
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		reqID := atomic.AddUint64(&requestID, 1)
-		if r.Method != http.MethodGet && r.Method != http.MethodHead {
-			emptyDurations := []time.Duration{}
-			emptyInst := []time.Duration{}
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			log.Printf("dev: %s %s %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), emptyDurations, emptyInst))
-			return
+func firstDiffIndex(a, b []byte) int {
+	limit := min(len(b), len(a))
+	for i := range limit {
+		if a[i] != b[i] {
+			return i
 		}
+	}
+	if len(a) != len(b) {
+		return limit
+	}
+	return -1
+}
 
-		reloadRecipesIfChanged()
-
-		stateMu.RLock()
-		route, ok := resolveDevContentRoute(state.contentRoutes, r.URL.Path)
-		if !ok {
-			stateMu.RUnlock()
-			emptyDurations := []time.Duration{}
-			emptyInst := []time.Duration{}
-			http.NotFound(w, r)
-			log.Printf("dev: %s %s status=404 %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), emptyDurations, emptyInst))
-			return
-		}
+func encodingName(encoding dataEncoding) string {
+	switch encoding {
+	case dataEncodingRaw:
+		return "raw"
+	case dataEncodingUTF8:
+		return "utf8"
+	case dataEncodingArrayI32:
+		return "i32[]"
+	case dataEncodingArrayF32:
+		return "f32[]"
+	case dataEncodingArrayF64:
+		return "f64[]"
+	case dataEncodingArrayI64:
+		return "i64[]"
+	case dataEncodingArrayU8:
+		return "u8[]"
+	default:
+		return fmt.Sprintf("unknown(%d)", encoding)
+	}
+}
 
-		inputBytes, err := os.ReadFile(route.filePath)
-		if err != nil {
-			stateMu.RUnlock()
-			emptyDurations := []time.Duration{}
-			emptyInst := []time.Duration{}
-			writeDevError(w, err)
-			log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), emptyDurations, emptyInst))
-			return
-		}
-		sourceDigest := sha256.Sum256(inputBytes)
+func loadTileStage(ctx context.Context, mod api.Module) (tileStage, error) {
+	tileFunc := mod.ExportedFunction("tile_rgba_f32_64x64")
+	if tileFunc == nil {
+		return tileStage{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export tile_rgba_f32_64x64")
+	}
+	uniformFunc := mod.ExportedFunction("uniform_set_width_and_height")
+	haloFunc := mod.ExportedFunction("calculate_halo_px")
+	mem := mod.Memory()
+	inputPtrValue, ok, err := getExportedValue(ctx, mod, "input_ptr")
+	if err != nil {
+		return tileStage{}, wasmruntime.HumanizeExecutionError(ctx, err)
+	}
+	if !ok {
+		return tileStage{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export input_ptr as global or function")
+	}
+	inputCap, ok, err := getExportedValue(ctx, mod, "input_bytes_cap")
+	if err != nil {
+		return tileStage{}, wasmruntime.HumanizeExecutionError(ctx, err)
+	}
+	if !ok {
+		return tileStage{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export input_bytes_cap as global or function")
+	}
+	return tileStage{
+		mod:         mod,
+		mem:         mem,
+		tileFunc:    tileFunc,
+		inputPtr:    uint32(inputPtrValue),
+		uniformFunc: uniformFunc,
+		haloFunc:    haloFunc,
+		inputCap:    inputCap,
+	}, nil
+}
 
-		result := chainResult{
-			output: contentData{bytes: inputBytes, encoding: dataEncodingRaw},
-			metrics: chainMetrics{
-				moduleDurations:        []time.Duration{},
-				instantiationDurations: []time.Duration{},
-			},
-		}
-		_, hasRecipes := state.recipeChains[route.sourceMIME]
-		if hasRecipes {
-			chain := state.recipeChains[route.sourceMIME]
-			ctx := context.Background()
-			ctx, cancel := wasmruntime.WithExecutionTimeout(ctx, 100*time.Millisecond)
-			defer cancel()
-			result, err = chain.run(ctx, inputBytes, reqID)
-			if err != nil {
-				stateMu.RUnlock()
-				writeDevError(w, err)
-				log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics.moduleDurations, result.metrics.instantiationDurations))
-				return
-			}
+// callTile runs tile_rgba_f32_64x64 on the tile at (x, y), recording a span
+// when traced.
+func (stage *tileStage) callTile(ctx context.Context, traced bool, x, y int) error {
+	if traced {
+		var end func()
+		ctx, end = tracing.Start(ctx, "tile", tracing.Int("stage", stage.index), tracing.Int("x", x), tracing.Int("y", y))
+		defer end()
+	}
+	_, err := stage.tileFunc.Call(ctx, api.EncodeF32(float32(x)), api.EncodeF32(float32(y)))
+	return err
+}
+
+func closeTileStages(ctx context.Context, stages []tileStage) {
+	for _, stage := range stages {
+		if stage.mod != nil {
+			_ = stage.mod.Close(ctx)
 		}
+	}
+}
 
-		body, err := formatOutputBytes(result.output)
-		if err != nil {
-			stateMu.RUnlock()
-			writeDevError(w, err)
-			log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics.moduleDurations, result.metrics.instantiationDurations))
-			return
+func runTileStages(ctx context.Context, stages []tileStage, inputRGBA *image.RGBA) (*image.RGBA, []time.Duration, error) {
+	if len(stages) == 0 {
+		return inputRGBA, []time.Duration{}, nil
+	}
+
+	bounds := inputRGBA.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	outputRGBA := image.NewRGBA(bounds)
+
+	for i := range stages {
+		stage := &stages[i]
+		if stage.uniformFunc != nil {
+			if _, err := stage.uniformFunc.Call(
+				ctx,
+				api.EncodeF32(float32(width)),
+				api.EncodeF32(float32(height)),
+			); err != nil {
+				return nil, nil, stageFailed(stage.index, stage.path, fmt.Errorf("Error running uniform_set_width_and_height: %w", wasmruntime.HumanizeExecutionError(ctx, err)))
+			}
 		}
-		contentType := devResponseContentType(route.sourceMIME, hasRecipes, result.output, body)
-		formDigests := make([][32]byte, 0)
-		if strings.HasPrefix(contentType, "text/html") {
-			body, formDigests, err = injectQIPFormRuntime(body, state.formModules, state.formDigests)
+		if stage.haloFunc != nil {
+			values, err := stage.haloFunc.Call(ctx)
 			if err != nil {
-				stateMu.RUnlock()
-				writeDevError(w, err)
-				log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics.moduleDurations, result.metrics.instantiationDurations))
-				return
+				return nil, nil, stageFailed(stage.index, stage.path, fmt.Errorf("Error running calculate_halo_px: %w", wasmruntime.HumanizeExecutionError(ctx, err)))
 			}
-		}
-
-		etag := buildDevETag(sourceDigest, state.recipeDigests[route.sourceMIME], formDigests)
-		stateMu.RUnlock()
-		if etag != "" {
-			w.Header().Set("ETag", etag)
-			if r.Header.Get("If-None-Match") == etag {
-				w.WriteHeader(http.StatusNotModified)
-				log.Printf("dev: %s %s status=304 %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), result.metrics.moduleDurations, result.metrics.instantiationDurations))
-				return
+			if len(values) > 0 {
+				stage.haloPx = int(int32(values[0]))
 			}
 		}
-		w.Header().Set("Content-Type", contentType)
-		w.WriteHeader(http.StatusOK)
-		if r.Method != http.MethodHead {
-			if _, err := w.Write(body); err != nil {
-				log.Printf("dev: %s %s write_error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics.moduleDurations, result.metrics.instantiationDurations))
-				return
-			}
+		if stage.haloPx < 0 {
+			stage.haloPx = 0
 		}
-		log.Printf("dev: %s %s status=200 %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), result.metrics.moduleDurations, result.metrics.instantiationDurations))
-	})
+		stage.tileSpan = tileSize + stage.haloPx*2
+		tileF32Size := uint64(stage.tileSpan) * uint64(stage.tileSpan) * 4 * 4
+		if tileF32Size > stage.inputCap {
+			return nil, nil, stageFailed(stage.index, stage.path, wasmruntime.Errorf(wasmruntime.KindCapacity, "Tile buffer exceeds module input_bytes_cap"))
+		}
+	}
 
-	server := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+	const inv255 = 1.0 / 255.0
+	useHalo := false
+	for _, stage := range stages {
+		if stage.haloPx > 0 {
+			useHalo = true
+			break
+		}
 	}
 
-	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	hupCh := make(chan os.Signal, 1)
-	signal.Notify(hupCh, syscall.SIGHUP)
-	defer signal.Stop(hupCh)
+	stageDurations := make([]time.Duration, len(stages))
+	traced := tracing.Enabled(ctx)
 
-	var reloadWG sync.WaitGroup
-	reloadWG.Go(func() {
-		for {
-			select {
-			case <-signalCtx.Done():
-				return
-			case <-hupCh:
-				reloadRuntimeState("signal_hup")
+	if useHalo {
+		floatSrc := make([]float32, width*height*4)
+		floatDst := make([]float32, len(floatSrc))
+		pix := inputRGBA.Pix
+		stride := inputRGBA.Stride
+		for y := range height {
+			srcRow := y * stride
+			dstRow := y * width * 4
+			for x := range width {
+				s := srcRow + x*4
+				d := dstRow + x*4
+				floatSrc[d] = float32(pix[s]) * inv255
+				floatSrc[d+1] = float32(pix[s+1]) * inv255
+				floatSrc[d+2] = float32(pix[s+2]) * inv255
+				floatSrc[d+3] = float32(pix[s+3]) * inv255
 			}
 		}
-	})
-	defer func() {
-		stop()
-		reloadWG.Wait()
-	}()
 
-	go func() {
-		<-signalCtx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-		_ = server.Shutdown(shutdownCtx)
-	}()
+		for stageIndex := range stages {
+			stageStart := time.Now()
+			stage := &stages[stageIndex]
+			halo := stage.haloPx
+			tileSpan := stage.tileSpan
+			tileFloats := tileSpan * tileSpan * 4
+			tileF32 := make([]float32, tileFloats)
+			tileBytes := unsafe.Slice((*byte)(unsafe.Pointer(&tileF32[0])), len(tileF32)*4)
 
-	log.Printf("dev: listening on http://%s", addr)
-	log.Printf("dev: send SIGHUP to reload routes, recipes, and forms: `kill -HUP %d`", os.Getpid())
+			for y := 0; y < height; y += tileSize {
+				tileH := tileSize
+				if y+tileH > height {
+					tileH = height - y
+				}
+				for x := 0; x < width; x += tileSize {
+					tileW := tileSize
+					if x+tileW > width {
+						tileW = width - x
+					}
+					for row := range tileSpan {
+						srcY := y + row - halo
+						if srcY < 0 {
+							srcY = 0
+						} else if srcY >= height {
+							srcY = height - 1
+						}
+						srcRow := srcY * width * 4
+						dstRow := row * tileSpan * 4
+						for col := range tileSpan {
+							srcX := x + col - halo
+							if srcX < 0 {
+								srcX = 0
+							} else if srcX >= width {
+								srcX = width - 1
+							}
+							s := srcRow + srcX*4
+							d := dstRow + col*4
+							tileF32[d] = floatSrc[s]
+							tileF32[d+1] = floatSrc[s+1]
+							tileF32[d+2] = floatSrc[s+2]
+							tileF32[d+3] = floatSrc[s+3]
+						}
+					}
 
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		gameOver("dev server error: %v", err)
-	}
-}
+					if !stage.mem.Write(stage.inputPtr, tileBytes) {
+						return nil, nil, stageFailed(stage.index, stage.path, wasmruntime.Errorf(wasmruntime.KindContract, "Could not write tile to wasm memory"))
+					}
+					tileX := x - halo
+					tileY := y - halo
+					if err := stage.callTile(ctx, traced, tileX, tileY); err != nil {
+						return nil, nil, stageFailed(stage.index, stage.path, fmt.Errorf("Error running tile_rgba_f32_64x64: %w", wasmruntime.HumanizeExecutionError(ctx, err)))
+					}
+					tileOutBytes, ok := stage.mem.Read(stage.inputPtr, uint32(len(tileBytes)))
+					if !ok {
+						return nil, nil, stageFailed(stage.index, stage.path, wasmruntime.Errorf(wasmruntime.KindContract, "Could not read tile from wasm memory"))
+					}
+					copy(tileBytes, tileOutBytes)
 
-func loadDevRuntimeState(ctx context.Context, contentRoot string, recipesRoot string, formsRoot string, opts options) (*devRuntimeState, error) {
-	contentRoutes, err := buildDevContentRoutes(contentRoot)
-	if err != nil {
-		return nil, err
-	}
-	recipeChains, recipeDigests, err := loadRecipeChains(ctx, recipesRoot, opts)
-	if err != nil {
-		return nil, err
-	}
-	recipeStamps, err := scanRecipeModuleStamps(recipesRoot)
-	if err != nil {
-		closeModuleChains(ctx, recipeChains)
-		return nil, err
-	}
-	formModules, formDigests, err := loadFormModules(formsRoot)
-	if err != nil {
+					srcBase := (halo*tileSpan + halo) * 4
+					for row := 0; row < tileH; row++ {
+						src := srcBase + row*tileSpan*4
+						dst := ((y + row) * width) * 4
+						for col := 0; col < tileW; col++ {
+							s := src + col*4
+							d := dst + (x+col)*4
+							floatDst[d] = tileF32[s]
+							floatDst[d+1] = tileF32[s+1]
+							floatDst[d+2] = tileF32[s+2]
+							floatDst[d+3] = tileF32[s+3]
+						}
+					}
+				}
+			}
+
+			floatSrc, floatDst = floatDst, floatSrc
+			stageDurations[stageIndex] = time.Since(stageStart)
+		}
+
+		outPix := outputRGBA.Pix
+		outStride := outputRGBA.Stride
+		for y := range height {
+			srcRow := y * width * 4
+			dstRow := y * outStride
+			for x := range width {
+				s := srcRow + x*4
+				d := dstRow + x*4
+				v := floatSrc[s]
+				if v <= 0 {
+					outPix[d] = 0
+				} else if v >= 1 {
+					outPix[d] = 255
+				} else {
+					outPix[d] = uint8(v*255 + 0.5)
+				}
+				v = floatSrc[s+1]
+				if v <= 0 {
+					outPix[d+1] = 0
+				} else if v >= 1 {
+					outPix[d+1] = 255
+				} else {
+					outPix[d+1] = uint8(v*255 + 0.5)
+				}
+				v = floatSrc[s+2]
+				if v <= 0 {
+					outPix[d+2] = 0
+				} else if v >= 1 {
+					outPix[d+2] = 255
+				} else {
+					outPix[d+2] = uint8(v*255 + 0.5)
+				}
+				v = floatSrc[s+3]
+				if v <= 0 {
+					outPix[d+3] = 0
+				} else if v >= 1 {
+					outPix[d+3] = 255
+				} else {
+					outPix[d+3] = uint8(v*255 + 0.5)
+				}
+			}
+		}
+	} else {
+		pix := inputRGBA.Pix
+		stride := inputRGBA.Stride
+		outputPix := outputRGBA.Pix
+		outputStride := outputRGBA.Stride
+		tileF32 := make([]float32, tileSize*tileSize*4)
+		tileBytes := unsafe.Slice((*byte)(unsafe.Pointer(&tileF32[0])), len(tileF32)*4)
+		for y := 0; y < height; y += tileSize {
+			tileH := tileSize
+			if y+tileH > height {
+				tileH = height - y
+			}
+			rowBase := y * stride
+			for x := 0; x < width; x += tileSize {
+				tileW := tileSize
+				if x+tileW > width {
+					tileW = width - x
+				}
+				srcRow := rowBase + x*4
+				if tileW != tileSize || tileH != tileSize {
+					clear(tileF32)
+				}
+				for row := 0; row < tileH; row++ {
+					src := srcRow + row*stride
+					dst := row * tileSize * 4
+					for col := 0; col < tileW; col++ {
+						s := src + col*4
+						d := dst + col*4
+						tileF32[d] = float32(pix[s]) * inv255
+						tileF32[d+1] = float32(pix[s+1]) * inv255
+						tileF32[d+2] = float32(pix[s+2]) * inv255
+						tileF32[d+3] = float32(pix[s+3]) * inv255
+					}
+				}
+				for stageIndex := range stages {
+					stageStart := time.Now()
+					stage := &stages[stageIndex]
+					if !stage.mem.Write(stage.inputPtr, tileBytes) {
+						return nil, nil, stageFailed(stage.index, stage.path, wasmruntime.Errorf(wasmruntime.KindContract, "Could not write tile to wasm memory"))
+					}
+					if err := stage.callTile(ctx, traced, x, y); err != nil {
+						return nil, nil, stageFailed(stage.index, stage.path, fmt.Errorf("Error running tile_rgba_f32_64x64: %w", wasmruntime.HumanizeExecutionError(ctx, err)))
+					}
+					tileOutBytes, ok := stage.mem.Read(stage.inputPtr, uint32(len(tileBytes)))
+					if !ok {
+						return nil, nil, stageFailed(stage.index, stage.path, wasmruntime.Errorf(wasmruntime.KindContract, "Could not read tile from wasm memory"))
+					}
+					copy(tileBytes, tileOutBytes)
+					stageDurations[stageIndex] += time.Since(stageStart)
+				}
+				tileOutF32 := tileF32
+				for row := 0; row < tileH; row++ {
+					src := row * tileSize * 4
+					dst := (y+row)*outputStride + x*4
+					for col := 0; col < tileW; col++ {
+						s := src + col*4
+						d := dst + col*4
+						v := tileOutF32[s]
+						if v <= 0 {
+							outputPix[d] = 0
+						} else if v >= 1 {
+							outputPix[d] = 255
+						} else {
+							outputPix[d] = uint8(v*255 + 0.5)
+						}
+						v = tileOutF32[s+1]
+						if v <= 0 {
+							outputPix[d+1] = 0
+						} else if v >= 1 {
+							outputPix[d+1] = 255
+						} else {
+							outputPix[d+1] = uint8(v*255 + 0.5)
+						}
+						v = tileOutF32[s+2]
+						if v <= 0 {
+							outputPix[d+2] = 0
+						} else if v >= 1 {
+							outputPix[d+2] = 255
+						} else {
+							outputPix[d+2] = uint8(v*255 + 0.5)
+						}
+						v = tileOutF32[s+3]
+						if v <= 0 {
+							outputPix[d+3] = 0
+						} else if v >= 1 {
+							outputPix[d+3] = 255
+						} else {
+							outputPix[d+3] = uint8(v*255 + 0.5)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return outputRGBA, stageDurations, nil
+}
+
+// tileBlockMetrics times each stage of a tile block and records its memory
+// size after the last tile.
+type tileBlockMetrics struct {
+	instantiation []time.Duration
+	run           []time.Duration
+	memoryBytes   []uint64
+}
+
+func runTileStagesCompiled(ctx context.Context, runtime wazero.Runtime, compiled []wazero.CompiledModule, specs []moduleSpec, inputRGBA *image.RGBA, moduleNamePrefix string, stageOffset int) (*image.RGBA, tileBlockMetrics, error) {
+	stages := make([]tileStage, len(compiled))
+	metrics := tileBlockMetrics{instantiation: make([]time.Duration, len(compiled))}
+
+	for i, cm := range compiled {
+		instStart := time.Now()
+		_, endSpan := tracing.Start(ctx, "instantiate", tracing.Int("stage", stageOffset+i), tracing.String("module", specs[i].path))
+		mod, err := runtime.InstantiateModule(ctx, cm, wazero.NewModuleConfig().WithName(fmt.Sprintf("%s-%d", moduleNamePrefix, stageOffset+i)))
+		endSpan()
+		metrics.instantiation[i] = time.Since(instStart)
+		if err != nil {
+			closeTileStages(ctx, stages)
+			return nil, metrics, stageFailed(stageOffset+i, specs[i].path, wasmruntime.Errorf(wasmruntime.KindCompile, "Wasm module could not be instantiated"))
+		}
+		if err := applyUniforms(ctx, mod, specs[i].uniforms); err != nil {
+			_ = mod.Close(ctx)
+			closeTileStages(ctx, stages)
+			return nil, metrics, stageFailed(stageOffset+i, specs[i].path, err)
+		}
+		stage, err := loadTileStage(ctx, mod)
+		if err != nil {
+			_ = mod.Close(ctx)
+			closeTileStages(ctx, stages)
+			return nil, metrics, stageFailed(stageOffset+i, specs[i].path, err)
+		}
+		stage.index = stageOffset + i
+		stage.path = specs[i].path
+		stages[i] = stage
+	}
+	defer closeTileStages(ctx, stages)
+
+	outputRGBA, stageDurations, err := runTileStages(ctx, stages, inputRGBA)
+	metrics.run = stageDurations
+	metrics.memoryBytes = make([]uint64, len(stages))
+	for i, stage := range stages {
+		if stage.mem != nil {
+			metrics.memoryBytes[i] = memorySizeBytes(stage.mem)
+		}
+	}
+	if err != nil {
+		return nil, metrics, err
+	}
+	return outputRGBA, metrics, nil
+}
+
+// applyUniforms calls uniform_set_<key> for each uniform, in key order,
+// converting the value to the function's parameter type.
+func applyUniforms(ctx context.Context, mod api.Module, uniforms map[string]string) error {
+	if len(uniforms) == 0 {
+		return nil
+	}
+	defs := mod.ExportedFunctionDefinitions()
+	keys := make([]string, 0, len(uniforms))
+	for key := range uniforms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fnName := "uniform_set_" + key
+		fn := mod.ExportedFunction(fnName)
+		if fn == nil {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module does not export %s for query key %q", fnName, key)
+		}
+		def, ok := defs[fnName]
+		if !ok {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module is missing function definition for %s", fnName)
+		}
+		paramTypes := def.ParamTypes()
+		if len(paramTypes) != 1 {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "%s must accept exactly one argument", fnName)
+		}
+		value := uniforms[key]
+
+		var args [1]uint64
+		switch paramTypes[0] {
+		case api.ValueTypeF32:
+			parsed, err := strconv.ParseFloat(value, 32)
+			if err != nil {
+				return wasmruntime.Errorf(wasmruntime.KindInvalidInput, "invalid value %q for %s (expected f32)", value, fnName)
+			}
+			args[0] = api.EncodeF32(float32(parsed))
+		case api.ValueTypeF64:
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return wasmruntime.Errorf(wasmruntime.KindInvalidInput, "invalid value %q for %s (expected f64)", value, fnName)
+			}
+			args[0] = api.EncodeF64(parsed)
+		case api.ValueTypeI32:
+			parsed, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return wasmruntime.Errorf(wasmruntime.KindInvalidInput, "invalid value %q for %s (expected i32)", value, fnName)
+			}
+			args[0] = uint64(uint32(int32(parsed)))
+		case api.ValueTypeI64:
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return wasmruntime.Errorf(wasmruntime.KindInvalidInput, "invalid value %q for %s (expected i64)", value, fnName)
+			}
+			args[0] = uint64(parsed)
+		default:
+			return wasmruntime.Errorf(wasmruntime.KindContract, "%s has unsupported parameter type", fnName)
+		}
+
+		if _, err := fn.Call(ctx, args[0]); err != nil {
+			return fmt.Errorf("Error running %s(%s): %w", fnName, value, wasmruntime.HumanizeExecutionError(ctx, err))
+		}
+	}
+	return nil
+}
+
+func decodeBMP(input []byte) (*image.RGBA, error) {
+	if len(input) < 54 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "BMP input too small")
+	}
+	if input[0] != 'B' || input[1] != 'M' {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Input is not a BMP file")
+	}
+
+	dataOffset := int(binary.LittleEndian.Uint32(input[10:14]))
+	dibSize := int(binary.LittleEndian.Uint32(input[14:18]))
+	if dibSize < 40 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Unsupported BMP DIB header")
+	}
+	width := int32(binary.LittleEndian.Uint32(input[18:22]))
+	height := int32(binary.LittleEndian.Uint32(input[22:26]))
+	planes := binary.LittleEndian.Uint16(input[26:28])
+	bpp := binary.LittleEndian.Uint16(input[28:30])
+	compression := binary.LittleEndian.Uint32(input[30:34])
+
+	if width <= 0 || height == 0 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Unsupported BMP dimensions")
+	}
+	if planes != 1 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Unsupported BMP planes")
+	}
+	if compression != 0 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Unsupported BMP compression")
+	}
+	if bpp != 24 && bpp != 32 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Unsupported BMP bit depth")
+	}
+
+	topDown := false
+	absHeight := int(height)
+	if height < 0 {
+		topDown = true
+		absHeight = -absHeight
+	}
+	absWidth := int(width)
+	if absWidth <= 0 || absHeight <= 0 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Unsupported BMP dimensions")
+	}
+
+	bytesPerPixel := int(bpp / 8)
+	rowStride := absWidth * bytesPerPixel
+	if bpp == 24 {
+		if rem := rowStride % 4; rem != 0 {
+			rowStride += 4 - rem
+		}
+	}
+
+	if dataOffset < 0 || dataOffset > len(input) {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Invalid BMP data offset")
+	}
+	if dataOffset+rowStride*absHeight > len(input) {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "BMP pixel data out of range")
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, absWidth, absHeight))
+	for y := 0; y < absHeight; y++ {
+		srcY := y
+		if !topDown {
+			srcY = absHeight - 1 - y
+		}
+		srcRow := dataOffset + srcY*rowStride
+		for x := range absWidth {
+			s := srcRow + x*bytesPerPixel
+			b := input[s]
+			g := input[s+1]
+			r := input[s+2]
+			a := byte(0xFF)
+			if bytesPerPixel == 4 {
+				a = input[s+3]
+			}
+			d := img.PixOffset(x, y)
+			img.Pix[d] = r
+			img.Pix[d+1] = g
+			img.Pix[d+2] = b
+			img.Pix[d+3] = a
+		}
+	}
+
+	return img, nil
+}
+
+func encodeBMP(img *image.RGBA) ([]byte, error) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Invalid BMP image size")
+	}
+
+	rowStride := width * 4
+	dataSize := rowStride * height
+	fileSize := 14 + 40 + dataSize
+	buf := make([]byte, fileSize)
+	buf[0] = 'B'
+	buf[1] = 'M'
+	binary.LittleEndian.PutUint32(buf[2:], uint32(fileSize))
+	binary.LittleEndian.PutUint32(buf[10:], 54)
+	binary.LittleEndian.PutUint32(buf[14:], 40)
+	binary.LittleEndian.PutUint32(buf[18:], uint32(width))
+	binary.LittleEndian.PutUint32(buf[22:], uint32(height))
+	binary.LittleEndian.PutUint16(buf[26:], 1)
+	binary.LittleEndian.PutUint16(buf[28:], 32)
+	binary.LittleEndian.PutUint32(buf[30:], 0)
+	binary.LittleEndian.PutUint32(buf[34:], uint32(dataSize))
+
+	for y := range height {
+		srcY := height - 1 - y
+		for x := range width {
+			s := img.PixOffset(bounds.Min.X+x, bounds.Min.Y+srcY)
+			d := 54 + y*rowStride + x*4
+			buf[d] = img.Pix[s+2]
+			buf[d+1] = img.Pix[s+1]
+			buf[d+2] = img.Pix[s]
+			buf[d+3] = img.Pix[s+3]
+		}
+	}
+
+	return buf, nil
+}
+
+func imageCmd(args []string) {
+	opts := options{}
+	var inputImagePaths pathsFlag
+	var outputImagePath string
+	var outputName string
+	var manifestPath string
+	jobs := goruntime.NumCPU()
+	fs := flag.NewFlagSet("image", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var imageVerbose bool
+	fs.BoolVar(&imageVerbose, "v", false, "enable verbose logging")
+	fs.BoolVar(&imageVerbose, "verbose", false, "enable verbose logging")
+	fs.Var(&inputImagePaths, "i", "input image path or glob (repeatable)")
+	fs.StringVar(&outputImagePath, "o", "", "output image path, or output directory with several inputs")
+	fs.StringVar(&outputName, "out-name", "{name}.png", "with several inputs, output file name template using {name} and {ext}")
+	fs.IntVar(&jobs, "jobs", jobs, "images to convert concurrently")
+	traceFlags := registerTraceFlags(fs, "write the output and each stage's timings to a directory")
+	fs.StringVar(&manifestPath, "f", "", "pipeline manifest path")
+	policyFlags := registerPolicyFlags(fs, 4000)
+	sourceFlags := modulesource.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		gameOver("%s %v", usageImage, err)
+	}
+	opts.verbose = opts.verbose || imageVerbose
+	policy, err := policyFlags.resolve(fs)
+	if err != nil {
+		gameOver("%v", err)
+	}
+	moduleResolver, err := sourceFlags.Resolver()
+	if err != nil {
+		gameOver("%v", err)
+	}
+	opts.policy = policy
+	opts.modules = moduleResolver
+	if _, err := traceFlags.resolve(&opts); err != nil {
+		gameOver("%v", err)
+	}
+	moduleSpecs, parseErr := parseModuleSpecs(fs.Args())
+	if parseErr != nil {
+		gameOver("Invalid image module args: %v", parseErr)
+	}
+	if manifestPath != "" {
+		if len(moduleSpecs) > 0 {
+			gameOver("Use either -f <manifest> or module arguments, not both")
+		}
+		moduleSpecs, err = loadPipelineManifest(manifestPath)
+		if err != nil {
+			gameOver("%v", err)
+		}
+		for i, spec := range moduleSpecs {
+			if spec.inputEncoding != "" || spec.outputEncoding != "" || spec.guard {
+				gameOver("Stage %d (%s) is an image stage; input and output encodings and guard do not apply", i, spec.path)
+			}
+		}
+	}
+	if len(moduleSpecs) == 0 || len(inputImagePaths) == 0 || outputImagePath == "" {
+		gameOver(usageImage)
+	}
+	var batch batchConfig
+	if isBatch(inputImagePaths, outputImagePath) {
+		batch, err = parseBatchConfig(inputImagePaths, outputImagePath, outputName, jobs)
+		if err != nil {
+			gameOver("%v", err)
+		}
+	}
+
+	baseCtx, finishTrace := traceFlags.startChrome(context.Background(), "qip image")
+	defer finishTrace()
+	// fail exits like gameOver, first writing the trace.
+	fail := func(format string, args ...any) {
+		finishTrace()
+		gameOver(format, args...)
+	}
+	start := time.Now()
+	defer func() {
+		if opts.verbose {
+			vlogf(opts, "command took %dms", time.Since(start).Milliseconds())
+		}
+	}()
+
+	// Modules compile once; each image instantiates its own stages.
+	chain, err := buildModuleChainFromSpecs(baseCtx, moduleSpecs, opts)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer chain.Close(baseCtx)
+
+	if batch.inputs != nil {
+		summary, err := runBatch(baseCtx, batch, opts, func(ctx context.Context, index int, input []byte) ([]byte, string, error) {
+			result, err := chain.convertImage(ctx, input, uint64(index))
+			if opts.traceDir != "" {
+				if traceErr := chain.writeTrace(filepath.Join(opts.traceDir, filepath.Base(batch.inputs[index])), input, result, err); traceErr != nil && err == nil {
+					err = traceErr
+				}
+			}
+			return result.output.bytes, ".png", err
+		})
+		if err != nil {
+			fail("%v", err)
+		}
+		if opts.verbose {
+			vlogf(opts, "converted %d images with %d jobs", summary.files, batch.jobs)
+		}
+		return
+	}
+
+	inputImagePath := inputImagePaths.single()
+	var inputImageBytes []byte
+	if inputImagePath == "-" {
+		inputImageBytes, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			fail("Error reading image stdin: %v", err)
+		}
+	} else {
+		inputImageBytes, err = os.ReadFile(inputImagePath)
+		if err != nil {
+			fail("Error reading image file: %v", err)
+		}
+	}
+	result, err := chain.convertImage(baseCtx, inputImageBytes, 0)
+	if opts.traceDir != "" {
+		if traceErr := chain.writeTrace(opts.traceDir, inputImageBytes, result, err); traceErr != nil {
+			fail("%v", traceErr)
+		}
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+
+	outFile, err := os.Create(outputImagePath)
+	if err != nil {
+		fail("Error creating output image file: %v", err)
+	}
+	defer outFile.Close()
+	if _, err := outFile.Write(result.output.bytes); err != nil {
+		fail("Error writing output image: %v", err)
+	}
+}
+
+// convertImage decodes a PNG, JPEG, GIF, or BMP image, runs it through the
+// chain's image stages, and encodes the result as PNG.
+func (chain *moduleChain) convertImage(ctx context.Context, input []byte, requestID uint64) (chainResult, error) {
+	if err := chain.opts.policy.checkInputSize(uint64(len(input))); err != nil {
+		return chainResult{}, err
+	}
+	decodeImage := func(r io.Reader) (image.Image, error) {
+		img, _, err := image.Decode(r)
+		return img, err
+	}
+	if len(input) >= 8 && bytes.Equal(input[:8], []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a}) {
+		decodeImage = png.Decode
+	}
+	inputImage, err := decodeImage(bytes.NewReader(input))
+	if err != nil {
+		return chainResult{}, fmt.Errorf("Error decoding image file: %w", err)
+	}
+	inputRGBA, ok := inputImage.(*image.RGBA)
+	if !ok {
+		bounds := inputImage.Bounds()
+		inputRGBA = image.NewRGBA(bounds)
+		draw.Draw(inputRGBA, bounds, inputImage, bounds.Min, draw.Src)
+	}
+
+	compiled := make([]wazero.CompiledModule, len(chain.stages))
+	specs := make([]moduleSpec, len(chain.stages))
+	for i, stage := range chain.stages {
+		compiled[i] = stage.compiled
+		specs[i] = stage.spec
+	}
+	// Image stages run interleaved tile by tile, so they share one deadline
+	// sized for all of them.
+	execCtx, cancel := chain.opts.policy.stageContext(ctx, specs...)
+	defer cancel()
+	outputRGBA, tileMetrics, err := runTileStagesCompiled(execCtx, chain.runtime, compiled, specs, inputRGBA, fmt.Sprintf("image-%d", requestID), 0)
+	result := chainResult{
+		metrics: chainMetrics{
+			moduleDurations:        tileMetrics.run,
+			instantiationDurations: tileMetrics.instantiation,
+			memoryBytes:            tileMetrics.memoryBytes,
+		},
+	}
+	if err == nil {
+		err = chain.opts.policy.checkOutputSize(uint64(len(outputRGBA.Pix)))
+	}
+	if err != nil {
+		return result, err
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&buf, outputRGBA); err != nil {
+		return result, fmt.Errorf("Error writing output image: %w", err)
+	}
+	result.output = contentData{bytes: buf.Bytes(), encoding: dataEncodingRaw, contentType: "image/png"}
+	if chain.opts.traceDir != "" {
+		result.metrics.stageOutputs = make([]*contentData, len(chain.stages))
+		result.metrics.stageOutputs[len(chain.stages)-1] = &result.output
+	}
+	return result, nil
+}
+
+// getExportedValue tries to get a value from either a global or a function.
+// The bool return indicates whether the export exists.
+func getExportedValue(ctx context.Context, mod api.Module, name string) (uint64, bool, error) {
+	// Try global first
+	if global := mod.ExportedGlobal(name); global != nil {
+		return global.Get(), true, nil
+	}
+
+	// Try function if global doesn't exist
+	if fn := mod.ExportedFunction(name); fn != nil {
+		result, err := fn.Call(ctx)
+		if err != nil {
+			return 0, true, fmt.Errorf("%s() call failed: %w", name, err)
+		}
+		if len(result) != 1 {
+			return 0, true, wasmruntime.Errorf(wasmruntime.KindContract, "%s() returned %d values, want 1", name, len(result))
+		}
+		return result[0], true, nil
+	}
+
+	return 0, false, nil
+}
+
+type moduleExecutionResult struct {
+	output         contentData
+	instantiation  time.Duration
+	run            time.Duration
+	total          time.Duration
+	memoryBytes    uint64
+	inputCapBytes  uint64
+	outputCapBytes uint64
+	inputEncoding  dataEncoding
+	reused         bool
+	// scalar is set for modules without output exports, whose run result
+	// is kept in result and formatted as "Ran: N" output.
+	scalar bool
+	result uint64
+}
+
+// instanceSource hands out module instances for single executions. Put takes
+// back an instance after a successful run; Discard takes back one whose run
+// failed. *wasmruntime.Pool keeps instances warm between executions.
+type instanceSource interface {
+	Get(ctx context.Context) (mod api.Module, reused bool, err error)
+	Put(ctx context.Context, mod api.Module)
+	Discard(ctx context.Context, mod api.Module)
+}
+
+// freshInstance instantiates compiled for every execution and closes the
+// instance afterwards.
+type freshInstance struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	name     string
+}
+
+func (f freshInstance) Get(ctx context.Context) (api.Module, bool, error) {
+	mod, err := f.runtime.InstantiateModule(ctx, f.compiled, wazero.NewModuleConfig().WithName(f.name))
+	return mod, false, err
+}
+
+func (f freshInstance) Put(ctx context.Context, mod api.Module) {
+	_ = mod.Close(ctx)
+}
+
+func (f freshInstance) Discard(ctx context.Context, mod api.Module) {
+	_ = mod.Close(ctx)
+}
+
+func executeModuleWithInput(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule, inputBytes []byte, uniforms map[string]string, opts options, moduleName string) (moduleExecutionResult, error) {
+	if wasmruntime.ImportsWASI(compiled) {
+		return executeWASIModule(ctx, runtime, compiled, inputBytes, opts, moduleName)
+	}
+	return executeModuleInstance(ctx, freshInstance{runtime: runtime, compiled: compiled, name: moduleName}, inputBytes, uniforms, opts)
+}
+
+// maxWASIStderrBytes bounds how much of a WASI command's stderr is kept to
+// explain a nonzero exit.
+const maxWASIStderrBytes = 1024
+
+// executeWASIModule runs a WASI preview1 command in the sandbox described by
+// wasmruntime.WASIConfig, with inputBytes as its stdin and its stdout as the
+// stage's raw output. The runtime must have WASI instantiated. A nonzero
+// exit is a module error carrying the start of stderr.
+func executeWASIModule(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule, inputBytes []byte, opts options, moduleName string) (exec moduleExecutionResult, returnErr error) {
+	totalStart := time.Now()
+	defer func() {
+		exec.total = time.Since(totalStart)
+	}()
+	exec.inputEncoding = dataEncodingRaw
+	exec.output.encoding = dataEncodingRaw
+
+	if err := opts.policy.checkInputSize(uint64(len(inputBytes))); err != nil {
+		returnErr = err
+		return
+	}
+
+	var output []byte
+	stdout := &wasiOutput{emit: opts.policy.limitOutput(func(chunk []byte) error {
+		output = append(output, chunk...)
+		return nil
+	})}
+	var stderr bytes.Buffer
+	config := wasmruntime.WASIConfig(moduleName, bytes.NewReader(inputBytes), stdout, &wasiStderr{buf: &stderr})
+
+	instStart := time.Now()
+	_, endSpan := tracing.Start(ctx, "instantiate")
+	mod, err := runtime.InstantiateModule(ctx, compiled, config)
+	endSpan()
+	if err != nil {
+		returnErr = wasmruntime.Errorf(wasmruntime.KindCompile, "Wasm module could not be instantiated")
+		return
+	}
+	defer mod.Close(ctx)
+	exec.instantiation = time.Since(instStart)
+
+	start := mod.ExportedFunction("_start")
+	if start == nil {
+		returnErr = wasmruntime.Errorf(wasmruntime.KindContract, "WASI module must export _start")
+		return
+	}
+	runStart := time.Now()
+	_, err = start.Call(ctx)
+	exec.run = time.Since(runStart)
+	if mem := mod.Memory(); mem != nil {
+		exec.memoryBytes = memorySizeBytes(mem)
+	}
+	if stdout.err != nil {
+		returnErr = stdout.err
+		return
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			returnErr = wasiExitError(exitErr.ExitCode(), stderr.Bytes())
+		} else {
+			returnErr = explainWASITrap(wasmruntime.HumanizeExecutionError(ctx, err), stderr.Bytes())
+		}
+		return
+	}
+	exec.output.bytes = output
+	if opts.verbose && len(exec.output.bytes) > 0 {
+		sum := sha256.Sum256(exec.output.bytes)
+		vlogf(opts, "output sha256: %x", sum)
+	}
+	return
+}
+
+func wasiExitError(code uint32, stderr []byte) error {
+	message := wasiStderrMessage(stderr)
+	if message == "" {
+		return wasmruntime.Errorf(wasmruntime.KindModule, "Module exited with code %d", code)
+	}
+	return wasmruntime.Errorf(wasmruntime.KindModule, "Module exited with code %d: %s", code, message)
+}
+
+// explainWASITrap puts what a WASI command wrote to stderr, such as a panic
+// message, in front of a trap's wazero message.
+func explainWASITrap(err error, stderr []byte) error {
+	var trap *wasmruntime.Error
+	message := wasiStderrMessage(stderr)
+	if !errors.As(err, &trap) || trap.Kind != wasmruntime.KindTrap || message == "" {
+		return err
+	}
+	explained := *trap
+	explained.Message = "Module error: " + message
+	if trap.TrapCode != "" {
+		explained.Message += " (wasm error: " + trap.TrapCode + ")"
+	}
+	return &explained
+}
+
+func wasiStderrMessage(stderr []byte) string {
+	return strings.TrimSpace(strings.ToValidUTF8(string(stderr), "\uFFFD"))
+}
+
+// wasiOutput is a WASI command's stdout. Once the output policy rejects a
+// write, later writes fail too and err is reported instead of the exit.
+type wasiOutput struct {
+	emit func([]byte) error
+	err  error
+}
+
+func (w *wasiOutput) Write(p []byte) (int, error) {
+	if w.err == nil {
+		w.err = w.emit(p)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// wasiStderr keeps the first maxWASIStderrBytes of a WASI command's stderr
+// and discards the rest.
+type wasiStderr struct {
+	buf *bytes.Buffer
+}
+
+func (w *wasiStderr) Write(p []byte) (int, error) {
+	if room := maxWASIStderrBytes - w.buf.Len(); room > 0 {
+		w.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func executeModuleInstance(ctx context.Context, source instanceSource, inputBytes []byte, uniforms map[string]string, opts options) (exec moduleExecutionResult, returnErr error) {
+	totalStart := time.Now()
+	defer func() {
+		exec.total = time.Since(totalStart)
+	}()
+
+	if err := opts.policy.checkInputSize(uint64(len(inputBytes))); err != nil {
+		returnErr = err
+		return
+	}
+
+	instStart := time.Now()
+	_, endSpan := tracing.Start(ctx, "instantiate")
+	mod, reused, err := source.Get(ctx)
+	endSpan()
+	if err != nil {
+		returnErr = wasmruntime.Errorf(wasmruntime.KindCompile, "Wasm module could not be instantiated")
+		return
+	}
+	defer func() {
+		if returnErr != nil {
+			source.Discard(ctx, mod)
+		} else {
+			source.Put(ctx, mod)
+		}
+	}()
+	exec.instantiation = time.Since(instStart)
+	exec.reused = reused
+
+	exports, err := resolveRunExports(ctx, mod)
+	if err != nil {
+		returnErr = err
+		return
+	}
+	// Measured on failure too, so traces show the memory of a failed stage.
+	defer func() {
+		if exports.mem != nil {
+			exec.memoryBytes = memorySizeBytes(exports.mem)
+		}
+	}()
+	exec.inputCapBytes = exports.inputCap
+	exec.outputCapBytes = uint64(exports.outputCap)
+	exec.inputEncoding = exports.inputEncoding
+	exec.output.encoding = exports.outputEncoding
+	if err := checkUTF8(exports.inputEncoding, "Input", inputBytes); err != nil {
+		returnErr = err
+		return
+	}
+	if err := applyUniforms(ctx, mod, uniforms); err != nil {
+		returnErr = err
+		return
+	}
+	if err := exports.writeNamedInputs(ctx, opts); err != nil {
+		returnErr = err
+		return
+	}
+
+	if exports.chunked() {
+		var output []byte
+		collect := opts.policy.limitOutput(func(chunk []byte) error {
+			output = append(output, chunk...)
+			return nil
+		})
+		runStart := time.Now()
+		err := exports.feedChunks(ctx, inputBytes, collect)
+		if err == nil {
+			err = exports.finish(ctx, collect)
+		}
+		exec.run = time.Since(runStart)
+		if err == nil && len(output) == 0 {
+			err = exports.reportedError(ctx)
+		}
+		if err == nil {
+			err = checkUTF8(exports.outputEncoding, "Output", output)
+		}
+		if err == nil {
+			exec.output.contentType, err = exports.contentType(ctx)
+		}
+		if err != nil {
+			returnErr = err
+			return
+		}
+		exec.output.bytes = output
+	} else {
+		inputPtr, err := exports.writeInput(ctx, inputBytes)
+		if err != nil {
+			returnErr = err
+			return
+		}
+
+		runStart := time.Now()
+		runResult, err := exports.call(ctx, exports.runFunc, uint64(len(inputBytes)))
+		exec.run = time.Since(runStart)
+		if err != nil {
+			returnErr = err
+			return
+		}
+		defer func() {
+			if returnErr == nil {
+				returnErr = exports.freeInput(ctx, inputPtr, len(inputBytes))
+			}
+		}()
+
+		if exports.outputCap > 0 {
+			var output []byte
+			returnErr = exports.drainOutput(ctx, uint32(runResult[0]), opts.policy.limitOutput(func(chunk []byte) error {
+				output = append(output, chunk...)
+				return nil
+			}))
+			if returnErr != nil {
+				return
+			}
+			if len(output) == 0 {
+				if returnErr = exports.reportedError(ctx); returnErr != nil {
+					return
+				}
+			}
+			if returnErr = checkUTF8(exports.outputEncoding, "Output", output); returnErr != nil {
+				return
+			}
+			if exec.output.contentType, returnErr = exports.contentType(ctx); returnErr != nil {
+				return
+			}
+			exec.output.bytes = output
+		} else {
+			exec.scalar = true
+			exec.result = runResult[0]
+			exec.output.bytes = fmt.Appendf(nil, "Ran: %d\n", runResult[0])
+		}
+	}
+	if opts.verbose && len(exec.output.bytes) > 0 {
+		sum := sha256.Sum256(exec.output.bytes)
+		vlogf(opts, "output sha256: %x", sum)
+	}
+	return
+}
+
+// runExports holds the run mode contract resolved from an instantiated module.
+type runExports struct {
+	mod            api.Module
+	mem            api.Memory
+	runFunc        api.Function
+	chunkFunc      api.Function
+	finishFunc     api.Function
+	moreFunc       api.Function
+	inputPtr       uint32
+	inputCap       uint64
+	inputEncoding  dataEncoding
+	outputPtr      uint32
+	outputCap      uint32
+	outputEncoding dataEncoding
+	// callTimeout, when set, gives each wasm call its own execution time
+	// limit, so a long stream is not bound by a single deadline.
+	callTimeout time.Duration
+	// allocFunc is set for modules that take input at a pointer returned by
+	// alloc(size) instead of at input_ptr, and freeFunc when they also
+	// export free(ptr, size).
+	allocFunc api.Function
+	freeFunc  api.Function
+}
+
+// outputCapExports lists the output capacity exports in the order they are
+// looked up, with the encoding each declares. Typed array capacities count
+// items, not bytes.
+var outputCapExports = []struct {
+	name     string
+	encoding dataEncoding
+}{
+	{"output_utf8_cap", dataEncodingUTF8},
+	{"output_i32_cap", dataEncodingArrayI32},
+	{"output_bytes_cap", dataEncodingRaw},
+	{"output_i64_cap", dataEncodingArrayI64},
+	{"output_f32_cap", dataEncodingArrayF32},
+	{"output_f64_cap", dataEncodingArrayF64},
+	{"output_u8_cap", dataEncodingArrayU8},
+}
+
+func resolveRunExports(ctx context.Context, mod api.Module) (runExports, error) {
+	exports := runExports{
+		mod:        mod,
+		mem:        mod.Memory(),
+		runFunc:    mod.ExportedFunction("run"),
+		chunkFunc:  mod.ExportedFunction("run_chunk"),
+		finishFunc: mod.ExportedFunction("finish"),
+		moreFunc:   mod.ExportedFunction("output_more"),
+	}
+
+	// Input goes at input_ptr, or where alloc says for modules without it.
+	inputPtr, ok, err := getExportedValue(ctx, mod, "input_ptr")
+	if err != nil {
+		return runExports{}, wasmruntime.HumanizeExecutionError(ctx, err)
+	}
+	if ok {
+		exports.inputPtr = uint32(inputPtr)
+	} else if err := exports.resolveAlloc(); err != nil {
+		return runExports{}, err
+	}
+
+	inputCap, ok, err := getExportedValue(ctx, mod, "input_utf8_cap")
+	if err != nil {
+		return runExports{}, wasmruntime.HumanizeExecutionError(ctx, err)
+	}
+	if ok {
+		exports.inputEncoding = dataEncodingUTF8
+	} else if cap, ok, err := getExportedValue(ctx, mod, "input_bytes_cap"); err != nil {
+		return runExports{}, wasmruntime.HumanizeExecutionError(ctx, err)
+	} else if ok {
+		inputCap = cap
+		exports.inputEncoding = dataEncodingRaw
+	} else if exports.allocates() {
+		exports.inputEncoding = dataEncodingRaw
+	} else {
+		return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export input_utf8_cap or input_bytes_cap as global or function")
+	}
+	exports.inputCap = inputCap
+
+	if ptr, ok, err := getExportedValue(ctx, mod, "output_ptr"); err != nil {
+		return runExports{}, wasmruntime.HumanizeExecutionError(ctx, err)
+	} else if ok {
+		exports.outputPtr = uint32(ptr)
+
+		found := false
+		for _, candidate := range outputCapExports {
+			cap, ok, err := getExportedValue(ctx, mod, candidate.name)
+			if err != nil {
+				return runExports{}, wasmruntime.HumanizeExecutionError(ctx, err)
+			}
+			if ok {
+				exports.outputCap = uint32(cap)
+				exports.outputEncoding = candidate.encoding
+				found = true
+				break
+			}
+		}
+		if !found {
+			return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export one of output_utf8_cap, output_bytes_cap, output_i32_cap, output_i64_cap, output_f32_cap, output_f64_cap, or output_u8_cap as global or function")
+		}
+	}
+
+	if (exports.chunkFunc == nil) != (exports.finishFunc == nil) {
+		return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export both run_chunk and finish to accept chunked input")
+	}
+	if exports.chunked() {
+		if exports.allocates() {
+			return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Chunked wasm module must export input_ptr; alloc only applies to run")
+		}
+		if exports.inputCap == 0 {
+			return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Chunked wasm module must declare a non-zero input capacity")
+		}
+		if exports.outputCap == 0 {
+			return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Chunked wasm module must export output_ptr and an output capacity")
+		}
+	} else if exports.runFunc == nil {
+		return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export run")
+	}
+	if exports.moreFunc != nil && exports.outputCap == 0 {
+		return runExports{}, wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module exporting output_more must export output_ptr and an output capacity")
+	}
+	return exports, nil
+}
+
+// resolveAlloc looks up alloc(size) -> ptr and the optional free(ptr, size)
+// for a module that does not export input_ptr.
+func (exports *runExports) resolveAlloc() error {
+	alloc := exports.mod.ExportedFunction("alloc")
+	if alloc == nil {
+		return wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export input_ptr as global or function, or alloc")
+	}
+	def := alloc.Definition()
+	if !slices.Equal(def.ParamTypes(), []api.ValueType{api.ValueTypeI32}) || !slices.Equal(def.ResultTypes(), []api.ValueType{api.ValueTypeI32}) {
+		return wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export alloc as (param i32) (result i32)")
+	}
+	exports.allocFunc = alloc
+	if free := exports.mod.ExportedFunction("free"); free != nil {
+		def := free.Definition()
+		if !slices.Equal(def.ParamTypes(), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}) || len(def.ResultTypes()) != 0 {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module must export free as (param i32 i32)")
+		}
+		exports.freeFunc = free
+	}
+	return nil
+}
+
+// allocates reports whether the module takes its input at a pointer from
+// alloc. Its input capacity, if declared, is a limit rather than a buffer.
+func (exports runExports) allocates() bool {
+	return exports.allocFunc != nil
+}
+
+// writeInput places the whole input in module memory for run, returning
+// where it was written: at a pointer from alloc(size) for modules that
+// allocate, otherwise at input_ptr.
+func (exports runExports) writeInput(ctx context.Context, input []byte) (uint32, error) {
+	size := uint64(len(input))
+	if size > exports.inputCap && (!exports.allocates() || exports.inputCap > 0) {
+		return 0, wasmruntime.Errorf(wasmruntime.KindCapacity, "Input is too large")
+	}
+	ptr := exports.inputPtr
+	if exports.allocates() {
+		result, err := exports.call(ctx, exports.allocFunc, size)
+		if err != nil {
+			return 0, err
+		}
+		ptr = uint32(result[0])
+	}
+	if !exports.mem.Write(ptr, input) {
+		if exports.allocates() {
+			return 0, wasmruntime.Errorf(wasmruntime.KindContract, "alloc(%d) returned %d, which is outside memory", size, ptr)
+		}
+		return 0, wasmruntime.Errorf(wasmruntime.KindContract, "Could not write input")
+	}
+	return ptr, nil
+}
+
+// freeInput hands input written by writeInput back to a module that exports
+// free, once its output has been read.
+func (exports runExports) freeInput(ctx context.Context, ptr uint32, size int) error {
+	if exports.freeFunc == nil {
+		return nil
+	}
+	_, err := exports.call(ctx, exports.freeFunc, uint64(ptr), uint64(size))
+	return err
+}
+
+// chunked reports whether the module accepts its input window by window via
+// run_chunk(size) followed by a single finish().
+func (exports runExports) chunked() bool {
+	return exports.chunkFunc != nil && exports.finishFunc != nil
+}
+
+func (exports runExports) outputItemSize() uint32 {
+	return uint32(exports.outputEncoding.itemSize())
+}
+
+// readOutput copies count output items out of wasm memory so callers can
+// safely use the bytes after the module is closed or called again.
+func (exports runExports) readOutput(count uint32) ([]byte, error) {
+	if count > exports.outputCap {
+		return nil, wasmruntime.Errorf(wasmruntime.KindContract, "Module returned more bytes than its stated capacity")
+	}
+	outputBytes, ok := exports.mem.Read(exports.outputPtr, count*exports.outputItemSize())
+	if !ok {
+		return nil, wasmruntime.Errorf(wasmruntime.KindContract, "Could not read output")
+	}
+	return append([]byte(nil), outputBytes...), nil
+}
+
+// drainOutput reads count output items, then keeps calling output_more (when
+// exported) and reading the output buffer until it reports nothing pending.
+// With a call timeout, the output_more calls share one timeout between them,
+// so a module that always reports more output is stopped.
+func (exports runExports) drainOutput(ctx context.Context, count uint32, emit func([]byte) error) error {
+	more := exports
+	for {
+		if count > 0 {
+			output, err := exports.readOutput(count)
+			if err != nil {
+				return err
+			}
+			if err := emit(output); err != nil {
+				return err
+			}
+		}
+		if exports.moreFunc == nil {
+			return nil
+		}
+		if exports.callTimeout > 0 && more.callTimeout <= 0 {
+			return exports.outputMoreTimeout()
+		}
+		start := time.Now()
+		result, err := more.call(ctx, exports.moreFunc)
+		more.callTimeout -= time.Since(start)
+		if exports.callTimeout > 0 && wasmruntime.KindOf(err) == wasmruntime.KindTimeout {
+			return exports.outputMoreTimeout()
+		}
+		if err != nil {
+			return fmt.Errorf("Error running output_more: %w", err)
+		}
+		count = uint32(result[0])
+		if count == 0 {
+			return nil
+		}
+	}
+}
+
+func (exports runExports) outputMoreTimeout() error {
+	return wasmruntime.Errorf(wasmruntime.KindTimeout, "Wasm module exceeded the execution time limit (%s) across its output_more calls", exports.callTimeout)
+}
+
+// feedChunks writes input into the module's input window one window at a
+// time, calling run_chunk after each write and passing its output to emit.
+func (exports runExports) feedChunks(ctx context.Context, input []byte, emit func([]byte) error) error {
+	for len(input) > 0 {
+		window := input[:min(uint64(len(input)), exports.inputCap)]
+		input = input[len(window):]
+		if !exports.mem.Write(exports.inputPtr, window) {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "Could not write input")
+		}
+		result, err := exports.call(ctx, exports.chunkFunc, uint64(len(window)))
+		if err != nil {
+			return fmt.Errorf("Error running run_chunk: %w", err)
+		}
+		if err := exports.drainOutput(ctx, uint32(result[0]), emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish signals the end of chunked input and passes any remaining output to emit.
+func (exports runExports) finish(ctx context.Context, emit func([]byte) error) error {
+	result, err := exports.call(ctx, exports.finishFunc)
+	if err != nil {
+		return fmt.Errorf("Error running finish: %w", err)
+	}
+	return exports.drainOutput(ctx, uint32(result[0]), emit)
+}
+
+func (exports runExports) call(ctx context.Context, fn api.Function, params ...uint64) ([]uint64, error) {
+	if tracing.Enabled(ctx) {
+		var end func()
+		ctx, end = tracing.Start(ctx, exportName(fn))
+		defer end()
+	}
+	if exports.callTimeout > 0 {
+		callCtx, cancel := wasmruntime.WithExecutionTimeout(ctx, exports.callTimeout)
+		defer cancel()
+		ctx = callCtx
+	}
+	result, err := fn.Call(ctx, params...)
+	if err != nil {
+		return nil, exports.explainTrap(ctx, wasmruntime.HumanizeExecutionError(ctx, err))
+	}
+	return result, nil
+}
+
+// exportName returns the name fn is exported as.
+func exportName(fn api.Function) string {
+	def := fn.Definition()
+	if names := def.ExportNames(); len(names) > 0 {
+		return names[0]
+	}
+	return def.Name()
+}
+
+// declaredInputNames returns the named inputs a module declares by exporting
+// input_set_<name>_size, sorted by name.
+func declaredInputNames(functions map[string]api.FunctionDefinition) []string {
+	var names []string
+	for export := range functions {
+		name, ok := strings.CutPrefix(export, "input_set_")
+		if !ok {
+			continue
+		}
+		if name, ok = strings.CutSuffix(name, "_size"); ok && name != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func unboundInputError(name string) error {
+	return wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Input %q is not bound; pass -i %s=<path>", name, name)
+}
+
+// writeNamedInputs writes each named input the module declares into its
+// input_<name>_ptr buffer and passes its size to input_set_<name>_size.
+func (exports runExports) writeNamedInputs(ctx context.Context, opts options) error {
+	definitions := exports.mod.ExportedFunctionDefinitions()
+	for _, name := range declaredInputNames(definitions) {
+		data, ok := opts.inputs[name]
+		if !ok {
+			return unboundInputError(name)
+		}
+		setSize := "input_set_" + name + "_size"
+		if len(definitions[setSize].ParamTypes()) != 1 {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "%s must accept exactly one argument", setSize)
+		}
+		if err := opts.policy.checkInputSize(uint64(len(data))); err != nil {
+			return err
+		}
+		ptr, ok, err := getExportedValue(ctx, exports.mod, "input_"+name+"_ptr")
+		if err != nil {
+			return wasmruntime.HumanizeExecutionError(ctx, err)
+		}
+		if !ok {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module declaring input %q must export input_%s_ptr as global or function", name, name)
+		}
+		cap, ok, err := getExportedValue(ctx, exports.mod, "input_"+name+"_cap")
+		if err != nil {
+			return wasmruntime.HumanizeExecutionError(ctx, err)
+		}
+		if !ok {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module declaring input %q must export input_%s_cap as global or function", name, name)
+		}
+		if uint64(len(data)) > cap {
+			return wasmruntime.Errorf(wasmruntime.KindCapacity, "Input %q of %d bytes exceeds its capacity (%d bytes)", name, len(data), cap)
+		}
+		if !exports.mem.Write(uint32(ptr), data) {
+			return wasmruntime.Errorf(wasmruntime.KindContract, "Could not write input %q", name)
+		}
+		if _, err := exports.call(ctx, exports.mod.ExportedFunction(setSize), uint64(len(data))); err != nil {
+			return fmt.Errorf("Error running %s: %w", setSize, err)
+		}
+	}
+	return nil
+}
+
+// maxContentTypeBytes bounds a module-declared output content type.
+const maxContentTypeBytes = 256
+
+// contentType reads the MIME type of the module's output from the optional
+// output_content_type_ptr and output_content_type_size exports. It returns ""
+// when the module declares none.
+func (exports runExports) contentType(ctx context.Context) (string, error) {
+	ptr, ok, err := getExportedValue(ctx, exports.mod, "output_content_type_ptr")
+	if err != nil {
+		return "", wasmruntime.HumanizeExecutionError(ctx, err)
+	}
+	if !ok {
+		return "", nil
+	}
+	size, ok, err := getExportedValue(ctx, exports.mod, "output_content_type_size")
+	if err != nil {
+		return "", wasmruntime.HumanizeExecutionError(ctx, err)
+	}
+	if !ok {
+		return "", wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module exporting output_content_type_ptr must export output_content_type_size")
+	}
+	if uint32(size) == 0 {
+		return "", nil
+	}
+	if uint32(size) > maxContentTypeBytes {
+		return "", wasmruntime.Errorf(wasmruntime.KindContract, "Output content type of %d bytes exceeds %d bytes", uint32(size), maxContentTypeBytes)
+	}
+	raw, ok := exports.mem.Read(uint32(ptr), uint32(size))
+	if !ok {
+		return "", wasmruntime.Errorf(wasmruntime.KindContract, "Could not read output content type")
+	}
+	contentType := string(raw)
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return "", wasmruntime.Errorf(wasmruntime.KindContract, "Wasm module declared an invalid output content type %q", contentType)
+	}
+	return contentType, nil
+}
+
+// maxModuleErrorBytes bounds how much of a module's error message is shown.
+const maxModuleErrorBytes = 4096
+
+// moduleErrorMessage reads the module's own explanation of its failure from
+// the optional error_message_ptr and error_message_size exports. It returns
+// "" when the module exports neither, reports a zero size, or points outside
+// its memory.
+func (exports runExports) moduleErrorMessage(ctx context.Context) string {
+	ptr, ok, err := getExportedValue(ctx, exports.mod, "error_message_ptr")
+	if err != nil || !ok {
+		return ""
+	}
+	size, ok, err := getExportedValue(ctx, exports.mod, "error_message_size")
+	if err != nil || !ok || uint32(size) == 0 {
+		return ""
+	}
+	message, ok := exports.mem.Read(uint32(ptr), min(uint32(size), maxModuleErrorBytes))
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(string(message), "\uFFFD"))
+}
+
+// reportedError returns the module's error message as an error, or nil when
+// it reports none. Callers check it when a module produces no output.
+func (exports runExports) reportedError(ctx context.Context) error {
+	message := exports.moduleErrorMessage(ctx)
+	if message == "" {
+		return nil
+	}
+	return wasmruntime.Errorf(wasmruntime.KindModule, "Module error: %s", message)
+}
+
+// explainTrap puts the module's own error message, when it reports one, in
+// front of a trap's wazero message.
+func (exports runExports) explainTrap(ctx context.Context, err error) error {
+	var trap *wasmruntime.Error
+	if !errors.As(err, &trap) || trap.Kind != wasmruntime.KindTrap {
+		return err
+	}
+	message := exports.moduleErrorMessage(ctx)
+	if message == "" {
+		return err
+	}
+	explained := *trap
+	explained.Message = "Module error: " + message
+	if trap.TrapCode != "" {
+		explained.Message += " (wasm error: " + trap.TrapCode + ")"
+	}
+	return &explained
+}
+
+func memorySizeBytes(mem api.Memory) uint64 {
+	size := mem.Size()
+	if size != 0 {
+		return uint64(size)
+	}
+	// Work around wazero's uint32 overflow behavior on max memory.
+	pages, ok := mem.Grow(0)
+	if !ok {
+		return 0
+	}
+	return uint64(pages) * 65536
+}
+
+// Exit statuses, documented in docs/exit-codes.md. Commands exit with the
+// status for the first error passed to gameOver.
+const (
+	exitCodeError         = 1
+	exitCodeGuardRejected = 3
+	exitCodeTimeout       = 4
+	exitCodeCanceled      = 5
+	exitCodeTrap          = 6
+	exitCodeContract      = 7
+	exitCodeCapacity      = 8
+	exitCodeCompile       = 9
+	exitCodeInvalidInput  = 10
+	exitCodeIO            = 11
+	exitCodeModuleSource  = 12
+	exitCodeModule        = 13
+	exitCodeVerify        = 14
+)
+
+func exitCodeFor(err error) int {
+	if errors.Is(err, errGuardRejected) {
+		return exitCodeGuardRejected
+	}
+	if errors.Is(err, errReceiptMismatch) {
+		return exitCodeVerify
+	}
+	switch wasmruntime.KindOf(err) {
+	case wasmruntime.KindTimeout:
+		return exitCodeTimeout
+	case wasmruntime.KindCanceled:
+		return exitCodeCanceled
+	case wasmruntime.KindTrap:
+		return exitCodeTrap
+	case wasmruntime.KindContract:
+		return exitCodeContract
+	case wasmruntime.KindCapacity:
+		return exitCodeCapacity
+	case wasmruntime.KindCompile:
+		return exitCodeCompile
+	case wasmruntime.KindInvalidInput:
+		return exitCodeInvalidInput
+	case wasmruntime.KindModule:
+		return exitCodeModule
+	}
+	if errors.Is(err, charset.ErrInvalid) || errors.Is(err, modulemeta.ErrInvalidUniform) {
+		return exitCodeInvalidInput
+	}
+	for _, target := range []error{modulesource.ErrInvalidPin, modulesource.ErrDigestMismatch, modulesource.ErrNotLocked, modulesource.ErrOffline} {
+		if errors.Is(err, target) {
+			return exitCodeModuleSource
+		}
+	}
+	var pathErr *fs.PathError
+	var urlErr *url.Error
+	if errors.As(err, &pathErr) || errors.As(err, &urlErr) || errors.Is(err, modulesource.ErrHTTPStatus) || errors.Is(err, modulesource.ErrCacheCorrupt) {
+		return exitCodeIO
+	}
+	return exitCodeError
+}
+
+func gameOver(format string, args ...any) {
+	code := exitCodeError
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			code = exitCodeFor(err)
+			break
+		}
+	}
+	log.SetFlags(0)
+	log.Printf(format, args...)
+	os.Exit(code)
+}
+
+func vlogf(opts options, format string, args ...any) {
+	if !opts.verbose {
+		return
+	}
+	log.SetFlags(0)
+	log.Printf(format, args...)
+}
+
+type devContentRoute struct {
+	filePath   string
+	sourceMIME string
+}
+
+type recipeCandidate struct {
+	path     string
+	filename string
+	order    int
+	digest   [32]byte
+	uniforms map[string]string
+}
+
+type moduleFileStamp struct {
+	modTimeUnixNano int64
+	sizeBytes       int64
+}
+
+type devRuntimeState struct {
+	contentRoutes map[string]devContentRoute
+	recipeChains  map[string]*moduleChain
+	recipeDigests map[string][][32]byte
+	recipeStamps  map[string]moduleFileStamp
+	formModules   map[string][]byte
+	formDigests   map[string][32]byte
+}
+
+func devCmd(args []string) {
+	opts := options{}
+	var recipesRoot string
+	var formsRoot string
+	var modeRaw string
+	port := 4000
+	fs := flag.NewFlagSet("dev", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var devVerbose bool
+	fs.BoolVar(&devVerbose, "v", false, "enable verbose logging")
+	fs.BoolVar(&devVerbose, "verbose", false, "enable verbose logging")
+	fs.StringVar(&recipesRoot, "recipes", "", "recipe modules root directory")
+	fs.StringVar(&formsRoot, "forms", "", "form modules root directory")
+	fs.StringVar(&modeRaw, "mode", string(modeDev), "runtime mode: dev or prod")
+	fs.IntVar(&port, "p", 4000, "port")
+	var noInstanceReuse bool
+	fs.BoolVar(&noInstanceReuse, "no-instance-reuse", false, "instantiate recipe modules fresh for every request")
+	var queryUniforms bool
+	fs.BoolVar(&queryUniforms, "query-uniforms", false, "pass <recipe>.<key>=value request query parameters to recipe uniforms")
+	traceFlags := registerTraceFlags(fs, "write each request's stage outputs and timings to a directory")
+	var otlpEndpoint string
+	fs.StringVar(&otlpEndpoint, "otlp-endpoint", "", "export each request's spans to an OpenTelemetry collector over OTLP/HTTP")
+	policyFlags := registerPolicyFlags(fs, 100)
+	sourceFlags := modulesource.RegisterFlags(fs)
+	if err := fs.Parse(normalizeDevArgs(args)); err != nil {
+		gameOver("%s %v", usageDev, err)
+	}
+	policy, err := policyFlags.resolve(fs)
+	if err != nil {
+		gameOver("%v", err)
+	}
+	moduleResolver, err := sourceFlags.Resolver()
+	if err != nil {
+		gameOver("%v", err)
+	}
+
+	mode, err := parseRuntimeMode(modeRaw)
+	if err != nil {
+		gameOver("%v", err)
+	}
+
+	opts.verbose = devVerbose
+	opts.mode = mode
+	opts.policy = policy
+	opts.modules = moduleResolver
+	opts.reuseInstances = !noInstanceReuse
+	format, err := traceFlags.resolve(&opts)
+	if err != nil {
+		gameOver("%v", err)
+	}
+	tracer := &devTracer{}
+	if format == traceFormatChrome {
+		tracer.chromeDir = traceFlags.dir
+	}
+	if otlpEndpoint != "" {
+		exporter, err := tracing.NewOTLPExporter(otlpEndpoint, "qip dev")
+		if err != nil {
+			gameOver("%v", err)
+		}
+		tracer.startExporting(exporter)
+	}
+	contentArgs := fs.Args()
+	if len(contentArgs) != 1 {
+		gameOver(usageDev)
+	}
+	contentRoot := contentArgs[0]
+	if port <= 0 || port > 65535 {
+		gameOver("Invalid port: %d", port)
+	}
+
+	contentInfo, err := os.Stat(contentRoot)
+	if err != nil {
+		gameOver("Invalid content directory: %v", err)
+	}
+	if !contentInfo.IsDir() {
+		gameOver("Invalid content directory: %q is not a directory", contentRoot)
+	}
+
+	if recipesRoot != "" {
+		recipeInfo, err := os.Stat(recipesRoot)
+		if err != nil {
+			gameOver("Invalid recipes directory: %v", err)
+		}
+		if !recipeInfo.IsDir() {
+			gameOver("Invalid recipes directory: %q is not a directory", recipesRoot)
+		}
+	}
+
+	if formsRoot != "" {
+		formInfo, err := os.Stat(formsRoot)
+		if err != nil {
+			gameOver("Invalid forms directory: %v", err)
+		}
+		if !formInfo.IsDir() {
+			gameOver("Invalid forms directory: %q is not a directory", formsRoot)
+		}
+	}
+
+	loadCtx, finishLoadTrace := tracer.startLoad("start")
+	state, err := loadDevRuntimeState(loadCtx, contentRoot, recipesRoot, formsRoot, opts)
+	finishLoadTrace()
+	if err != nil {
+		gameOver("%v", err)
+	}
+	var stateMu sync.RWMutex
+	var reloadMu sync.Mutex
+	swapRuntimeState := func(nextState *devRuntimeState) {
+		stateMu.Lock()
+		previous := state
+		state = nextState
+		stateMu.Unlock()
+		if previous != nil {
+			closeModuleChains(context.Background(), previous.recipeChains)
+		}
+	}
+	reloadRuntimeState := func(reason string) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		reloadStart := time.Now()
+		loadCtx, finishLoadTrace := tracer.startLoad(reason)
+		nextState, err := loadDevRuntimeState(loadCtx, contentRoot, recipesRoot, formsRoot, opts)
+		finishLoadTrace()
+		if err != nil {
+			log.Printf("dev: reload failed reason=%s error=%v", reason, err)
+			return
+		}
+
+		swapRuntimeState(nextState)
+		log.Printf("dev: reloaded reason=%s paths=%d recipe_mimes=%d forms=%d duration_ms=%d", reason, len(nextState.contentRoutes), len(nextState.recipeChains), len(nextState.formModules), time.Since(reloadStart).Milliseconds())
+	}
+	reloadRecipesIfChanged := func() {
+		if opts.mode != modeDev || recipesRoot == "" {
+			return
+		}
+
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		stamps, err := scanRecipeModuleStamps(recipesRoot)
+		if err != nil {
+			log.Printf("dev: recipe change check failed: %v", err)
+			return
+		}
+
+		stateMu.RLock()
+		currentStamps := state.recipeStamps
+		unchanged := recipeModuleStampsEqual(currentStamps, stamps)
+		stateMu.RUnlock()
+		if unchanged {
+			return
+		}
+
+		reloadStart := time.Now()
+		loadCtx, finishLoadTrace := tracer.startLoad("recipe_change")
+		nextState, err := loadDevRuntimeState(loadCtx, contentRoot, recipesRoot, formsRoot, opts)
+		finishLoadTrace()
+		if err != nil {
+			log.Printf("dev: auto-reload failed reason=recipe_change error=%v", err)
+			return
+		}
+
+		swapRuntimeState(nextState)
+		log.Printf("dev: reloaded reason=recipe_change paths=%d recipe_mimes=%d forms=%d duration_ms=%d", len(nextState.contentRoutes), len(nextState.recipeChains), len(nextState.formModules), time.Since(reloadStart).Milliseconds())
+	}
+
+	defer func() {
+		stateMu.Lock()
+		current := state
+		state = nil
+		stateMu.Unlock()
+		if current != nil {
+			closeModuleChains(context.Background(), current.recipeChains)
+		}
+	}()
+
+	log.Printf("dev: indexed %d request paths from %s", len(state.contentRoutes), contentRoot)
+	if recipesRoot != "" {
+		log.Printf("dev: loaded %d recipe mime chains from %s", len(state.recipeChains), recipesRoot)
+	}
+	if formsRoot != "" {
+		log.Printf("dev: loaded %d form modules from %s", len(state.formModules), formsRoot)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	mux := http.NewServeMux()
+	var requestID uint64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqID := atomic.AddUint64(&requestID, 1)
+		ctx, finishTrace := tracer.startRequest(reqID, r)
+		defer finishTrace()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			log.Printf("dev: %s %s %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), chainMetrics{}))
+			return
+		}
+
+		reloadRecipesIfChanged()
+
+		stateMu.RLock()
+		route, ok := resolveDevContentRoute(state.contentRoutes, r.URL.Path)
+		if !ok {
+			stateMu.RUnlock()
+			http.NotFound(w, r)
+			log.Printf("dev: %s %s status=404 %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), chainMetrics{}))
+			return
+		}
+
+		inputBytes, err := os.ReadFile(route.filePath)
+		if err != nil {
+			stateMu.RUnlock()
+			writeDevError(w, err)
+			log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), chainMetrics{}))
+			return
+		}
+		sourceDigest := sha256.Sum256(inputBytes)
+
+		result := chainResult{
+			output: contentData{bytes: inputBytes, encoding: dataEncodingRaw},
+			metrics: chainMetrics{
+				moduleDurations:        []time.Duration{},
+				instantiationDurations: []time.Duration{},
+			},
+		}
+		_, hasRecipes := state.recipeChains[route.sourceMIME]
+		recipeDigests := state.recipeDigests[route.sourceMIME]
+		if hasRecipes {
+			chain := state.recipeChains[route.sourceMIME]
+			var overrides []map[string]string
+			if queryUniforms {
+				var overridesDigest [32]byte
+				overrides, overridesDigest = recipeQueryUniforms(chain, r.URL.Query())
+				if overrides != nil {
+					recipeDigests = append(slices.Clone(recipeDigests), overridesDigest)
+				}
+			}
+			result, err = chain.runWithUniforms(ctx, inputBytes, reqID, overrides)
+			if opts.traceDir != "" {
+				if traceErr := chain.writeTrace(filepath.Join(opts.traceDir, fmt.Sprintf("request-%d", reqID)), inputBytes, result, err); traceErr != nil {
+					log.Printf("dev: %v", traceErr)
+				}
+			}
+			if err != nil {
+				stateMu.RUnlock()
+				writeDevError(w, err)
+				log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics))
+				return
+			}
+		}
+
+		format := outputFormatDefault
+		if acceptsJSON(r.Header.Get("Accept")) && result.output.encoding.typedArray() {
+			format = outputFormatJSON
+			recipeDigests = append(slices.Clone(recipeDigests), sha256.Sum256([]byte(format)))
+		}
+		body, err := formatOutputBytes(result.output, format)
+		if err != nil {
+			stateMu.RUnlock()
+			writeDevError(w, err)
+			log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics))
+			return
+		}
+		contentType := devResponseContentType(route.sourceMIME, hasRecipes, result.output, format, body)
+		formDigests := make([][32]byte, 0)
+		if strings.HasPrefix(contentType, "text/html") {
+			body, formDigests, err = injectQIPFormRuntime(body, state.formModules, state.formDigests)
+			if err != nil {
+				stateMu.RUnlock()
+				writeDevError(w, err)
+				log.Printf("dev: %s %s error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics))
+				return
+			}
+		}
+
+		etag := buildDevETag(sourceDigest, recipeDigests, formDigests)
+		stateMu.RUnlock()
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				log.Printf("dev: %s %s status=304 %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), result.metrics))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Vary", "Accept")
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			if _, err := w.Write(body); err != nil {
+				log.Printf("dev: %s %s write_error=%v %s", r.Method, r.URL.Path, err, formatDurationParts(time.Since(start), result.metrics))
+				return
+			}
+		}
+		log.Printf("dev: %s %s status=200 %s", r.Method, r.URL.Path, formatDurationParts(time.Since(start), result.metrics))
+	})
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	var reloadWG sync.WaitGroup
+	reloadWG.Go(func() {
+		for {
+			select {
+			case <-signalCtx.Done():
+				return
+			case <-hupCh:
+				reloadRuntimeState("signal_hup")
+			}
+		}
+	})
+	defer func() {
+		stop()
+		reloadWG.Wait()
+	}()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-signalCtx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		tracer.flush(flushCtx)
+	}()
+
+	log.Printf("dev: listening on http://%s", addr)
+	log.Printf("dev: send SIGHUP to reload routes, recipes, and forms: `kill -HUP %d`", os.Getpid())
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		gameOver("dev server error: %v", err)
+	}
+	<-shutdownDone
+}
+
+func loadDevRuntimeState(ctx context.Context, contentRoot string, recipesRoot string, formsRoot string, opts options) (*devRuntimeState, error) {
+	contentRoutes, err := buildDevContentRoutes(contentRoot)
+	if err != nil {
+		return nil, err
+	}
+	recipeChains, recipeDigests, err := loadRecipeChains(ctx, recipesRoot, opts)
+	if err != nil {
+		return nil, err
+	}
+	recipeStamps, err := scanRecipeModuleStamps(recipesRoot)
+	if err != nil {
+		closeModuleChains(ctx, recipeChains)
+		return nil, err
+	}
+	formModules, formDigests, err := loadFormModules(formsRoot)
+	if err != nil {
 		closeModuleChains(ctx, recipeChains)
 		return nil, err
 	}
-	return &devRuntimeState{
-		contentRoutes: contentRoutes,
-		recipeChains:  recipeChains,
-		recipeDigests: recipeDigests,
-		recipeStamps:  recipeStamps,
-		formModules:   formModules,
-		formDigests:   formDigests,
-	}, nil
+	return &devRuntimeState{
+		contentRoutes: contentRoutes,
+		recipeChains:  recipeChains,
+		recipeDigests: recipeDigests,
+		recipeStamps:  recipeStamps,
+		formModules:   formModules,
+		formDigests:   formDigests,
+	}, nil
+}
+
+func normalizeDevArgs(args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	first := args[0]
+	if strings.HasPrefix(first, "-") {
+		return args
+	}
+
+	normalized := make([]string, 0, len(args))
+	normalized = append(normalized, args[1:]...)
+	normalized = append(normalized, first)
+	return normalized
+}
+
+func parseRuntimeMode(raw string) (runtimeMode, error) {
+	mode := runtimeMode(strings.ToLower(strings.TrimSpace(raw)))
+	switch mode {
+	case modeDev, modeProd:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid mode %q (expected dev or prod)", raw)
+	}
+}
+
+func buildDevContentRoutes(contentRoot string) (map[string]devContentRoute, error) {
+	files := make([]struct {
+		rel  string
+		full string
+	}, 0, 32)
+	err := filepath.WalkDir(contentRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("content entry %q must be a regular file", fullPath)
+		}
+		relPath, err := filepath.Rel(contentRoot, fullPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if !utf8.ValidString(relPath) {
+			return fmt.Errorf("content path %q must be valid UTF-8", relPath)
+		}
+		if strings.Contains(relPath, "\\") {
+			return fmt.Errorf("content path %q must not contain backslash", relPath)
+		}
+		if strings.HasPrefix(relPath, "/") {
+			return fmt.Errorf("content path %q must not start with /", relPath)
+		}
+		cleanRel := path.Clean(relPath)
+		if cleanRel != relPath || cleanRel == "." || cleanRel == ".." || strings.HasPrefix(cleanRel, "../") {
+			return fmt.Errorf("content path %q is not canonical", relPath)
+		}
+		files = append(files, struct {
+			rel  string
+			full string
+		}{rel: relPath, full: fullPath})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].rel < files[j].rel
+	})
+
+	routes := make(map[string]devContentRoute, len(files))
+	for _, entry := range files {
+		aliases := contentRequestPaths(entry.rel)
+		route := devContentRoute{
+			filePath:   entry.full,
+			sourceMIME: detectSourceMIME(entry.rel),
+		}
+		for _, requestPath := range aliases {
+			if prev, exists := routes[requestPath]; exists && prev.filePath != route.filePath {
+				return nil, fmt.Errorf("duplicate route path %q for %q and %q", requestPath, prev.filePath, route.filePath)
+			}
+			routes[requestPath] = route
+		}
+	}
+
+	return routes, nil
+}
+
+func contentRequestPaths(relPath string) []string {
+	out := make([]string, 0, 4)
+	appendUnique := func(value string) {
+		if slices.Contains(out, value) {
+			return
+		}
+		out = append(out, value)
+	}
+
+	appendUnique("/" + relPath)
+	ext := path.Ext(relPath)
+	lowerExt := strings.ToLower(ext)
+	if lowerExt == ".html" || lowerExt == ".md" || lowerExt == ".markdown" {
+		base := path.Base(relPath)
+		if strings.EqualFold(base, "index"+ext) {
+			dir := path.Dir(relPath)
+			if dir == "." {
+				appendUnique("/")
+			} else {
+				appendUnique("/" + dir)
+				appendUnique("/" + dir + "/")
+			}
+		} else {
+			appendUnique("/" + strings.TrimSuffix(relPath, ext))
+		}
+	}
+	return out
+}
+
+// extensionForContentType returns the file extension for a content type, or
+// "" when none is known.
+func extensionForContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "text/markdown":
+		return ".md"
+	case "text/html":
+		return ".html"
+	case "text/plain":
+		return ".txt"
+	case "text/calendar":
+		return ".ics"
+	case "text/vcard":
+		return ".vcf"
+	case "image/bmp":
+		return ".bmp"
+	case "image/x-icon", "image/vnd.microsoft.icon":
+		return ".ico"
+	}
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0]
+}
+
+func detectSourceMIME(relPath string) string {
+	ext := strings.ToLower(path.Ext(relPath))
+	switch ext {
+	case ".md", ".markdown":
+		return "text/markdown"
+	}
+
+	mimeType := mime.TypeByExtension(ext)
+	if mimeType == "" {
+		return "application/octet-stream"
+	}
+	if cut := strings.IndexByte(mimeType, ';'); cut != -1 {
+		mimeType = strings.TrimSpace(mimeType[:cut])
+	}
+	if mimeType == "" {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
+
+func resolveDevContentRoute(routes map[string]devContentRoute, requestPath string) (devContentRoute, bool) {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	if !strings.HasPrefix(requestPath, "/") {
+		requestPath = "/" + requestPath
+	}
+
+	candidates := []string{requestPath}
+	clean := path.Clean(requestPath)
+	if clean == "." {
+		clean = "/"
+	}
+	if !strings.HasPrefix(clean, "/") {
+		clean = "/" + clean
+	}
+	if clean != requestPath {
+		candidates = append(candidates, clean)
+	}
+	if requestPath != "/" {
+		if before, ok := strings.CutSuffix(requestPath, "/"); ok {
+			candidates = append(candidates, before)
+		} else {
+			candidates = append(candidates, requestPath+"/")
+		}
+	}
+
+	seen := make(map[string]struct{}, len(candidates))
+	for _, candidate := range candidates {
+		if _, ok := seen[candidate]; ok {
+			continue
+		}
+		seen[candidate] = struct{}{}
+		if route, ok := routes[candidate]; ok {
+			return route, true
+		}
+	}
+	return devContentRoute{}, false
+}
+
+func parseRecipeFilename(filename string) (order int, disabled bool, err error) {
+	if !isASCII(filename) {
+		return 0, false, errors.New("filename must be ASCII")
+	}
+	if !strings.HasSuffix(filename, ".wasm") {
+		return 0, false, errors.New("filename must end with .wasm")
+	}
+
+	trimmed := filename
+	if strings.HasPrefix(trimmed, "-") {
+		disabled = true
+		trimmed = trimmed[1:]
+	}
+
+	if len(trimmed) < len("00-a.wasm") {
+		return 0, disabled, errors.New("filename must match NN-name.wasm")
+	}
+	if trimmed[0] < '0' || trimmed[0] > '9' || trimmed[1] < '0' || trimmed[1] > '9' {
+		return 0, disabled, errors.New("filename prefix must be two digits")
+	}
+	if trimmed[2] != '-' {
+		return 0, disabled, errors.New("filename must match NN-name.wasm")
+	}
+	namePart := strings.TrimSuffix(trimmed, ".wasm")[3:]
+	if namePart == "" {
+		return 0, disabled, errors.New("recipe name must not be empty")
+	}
+
+	order = int(trimmed[0]-'0')*10 + int(trimmed[1]-'0')
+	return order, disabled, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func loadRecipeChains(ctx context.Context, recipesRoot string, opts options) (map[string]*moduleChain, map[string][][32]byte, error) {
+	chains := make(map[string]*moduleChain)
+	digestsByMIME := make(map[string][][32]byte)
+	if recipesRoot == "" {
+		return chains, digestsByMIME, nil
+	}
+
+	candidatesByMIME := make(map[string][]recipeCandidate)
+	err := filepath.WalkDir(recipesRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("recipe entry %q must be a regular file", fullPath)
+		}
+
+		relPath, err := filepath.Rel(recipesRoot, fullPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		filename := path.Base(relPath)
+		if !strings.HasSuffix(filename, ".wasm") {
+			return nil
+		}
+		parts := strings.Split(relPath, "/")
+		if len(parts) != 3 {
+			return fmt.Errorf("recipe path %q must match <type>/<subtype>/<file>", relPath)
+		}
+		mimeType := parts[0] + "/" + parts[1]
+		filename = parts[2]
+
+		order, disabled, err := parseRecipeFilename(filename)
+		if err != nil {
+			return fmt.Errorf("invalid recipe filename %q: %w", relPath, err)
+		}
+		if disabled {
+			return nil
+		}
+
+		body, err := os.ReadFile(fullPath)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(body)
+		uniforms, sidecar, err := readRecipeUniforms(fullPath)
+		if err != nil {
+			return fmt.Errorf("invalid recipe uniforms for %q: %w", relPath, err)
+		}
+		if sidecar != nil {
+			digest = sha256.Sum256(append(body, sidecar...))
+		}
+		candidatesByMIME[mimeType] = append(candidatesByMIME[mimeType], recipeCandidate{
+			path:     fullPath,
+			filename: filename,
+			order:    order,
+			digest:   digest,
+			uniforms: uniforms,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mimeTypes := make([]string, 0, len(candidatesByMIME))
+	for mimeType := range candidatesByMIME {
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+	sort.Strings(mimeTypes)
+
+	for _, mimeType := range mimeTypes {
+		candidates := candidatesByMIME[mimeType]
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].order != candidates[j].order {
+				return candidates[i].order < candidates[j].order
+			}
+			return candidates[i].filename < candidates[j].filename
+		})
+		seenOrder := make(map[int]string, len(candidates))
+		for _, candidate := range candidates {
+			if prevPath, exists := seenOrder[candidate.order]; exists {
+				return nil, nil, fmt.Errorf("duplicate recipe prefix for %s: %02d in %q and %q", mimeType, candidate.order, prevPath, candidate.path)
+			}
+			seenOrder[candidate.order] = candidate.path
+		}
+		specs := make([]moduleSpec, len(candidates))
+		digests := make([][32]byte, len(candidates))
+		for i, candidate := range candidates {
+			specs[i] = moduleSpec{path: candidate.path, uniforms: candidate.uniforms}
+			digests[i] = candidate.digest
+		}
+		chain, err := buildModuleChainFromSpecs(ctx, specs, opts)
+		if err != nil {
+			closeModuleChains(ctx, chains)
+			return nil, nil, err
+		}
+		chains[mimeType] = chain
+		digestsByMIME[mimeType] = digests
+	}
+
+	return chains, digestsByMIME, nil
+}
+
+// readRecipeUniforms reads the NN-name.uniforms sidecar next to a recipe
+// module. Each line holds key=value pairs in query string form; blank lines
+// and lines starting with # are ignored. It returns nil when there is no
+// sidecar, along with the raw file for digesting.
+func readRecipeUniforms(modulePath string) (map[string]string, []byte, error) {
+	data, err := os.ReadFile(strings.TrimSuffix(modulePath, ".wasm") + ".uniforms")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	uniforms := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values, err := url.ParseQuery(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		for key, vals := range values {
+			if key == "" {
+				return nil, nil, fmt.Errorf("line %d: empty key", n+1)
+			}
+			uniforms[key] = vals[len(vals)-1]
+		}
+	}
+	return uniforms, data, nil
+}
+
+// recipeStageName returns the name part of an NN-name.wasm recipe path, used
+// to address the stage in query uniforms.
+func recipeStageName(modulePath string) string {
+	name := strings.TrimSuffix(filepath.Base(modulePath), ".wasm")
+	if _, rest, ok := strings.Cut(name, "-"); ok && rest != "" {
+		return rest
+	}
+	return name
+}
+
+// recipeQueryUniforms picks '<name>.<key>=value' parameters out of a request
+// query for the chain's recipe stages, ignoring parameters that name no
+// stage. It returns nil when none apply, or per-stage overrides and a digest
+// of them for the ETag.
+func recipeQueryUniforms(chain *moduleChain, query url.Values) ([]map[string]string, [32]byte) {
+	var overrides []map[string]string
+	for i, stage := range chain.stages {
+		prefix := recipeStageName(stage.spec.path) + "."
+		for param, vals := range query {
+			key, ok := strings.CutPrefix(param, prefix)
+			if !ok || key == "" || len(vals) == 0 {
+				continue
+			}
+			if overrides == nil {
+				overrides = make([]map[string]string, len(chain.stages))
+			}
+			if overrides[i] == nil {
+				overrides[i] = make(map[string]string)
+			}
+			overrides[i][key] = vals[len(vals)-1]
+		}
+	}
+	if overrides == nil {
+		return nil, [32]byte{}
+	}
+	var canonical strings.Builder
+	for i, uniforms := range overrides {
+		keys := slices.Sorted(maps.Keys(uniforms))
+		for _, key := range keys {
+			fmt.Fprintf(&canonical, "%d.%s=%s\n", i, key, uniforms[key])
+		}
+	}
+	return overrides, sha256.Sum256([]byte(canonical.String()))
+}
+
+func scanRecipeModuleStamps(recipesRoot string) (map[string]moduleFileStamp, error) {
+	stamps := make(map[string]moduleFileStamp)
+	if recipesRoot == "" {
+		return stamps, nil
+	}
+
+	err := filepath.WalkDir(recipesRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("recipe entry %q must be a regular file", fullPath)
+		}
+		if ext := strings.ToLower(path.Ext(fullPath)); ext != ".wasm" && ext != ".uniforms" {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(recipesRoot, fullPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		stamps[relPath] = moduleFileStamp{
+			modTimeUnixNano: info.ModTime().UnixNano(),
+			sizeBytes:       info.Size(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stamps, nil
+}
+
+func recipeModuleStampsEqual(a map[string]moduleFileStamp, b map[string]moduleFileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, stampA := range a {
+		stampB, ok := b[path]
+		if !ok {
+			return false
+		}
+		if stampA != stampB {
+			return false
+		}
+	}
+	return true
+}
+
+func loadFormModules(formsRoot string) (map[string][]byte, map[string][32]byte, error) {
+	modules := make(map[string][]byte)
+	digests := make(map[string][32]byte)
+	if formsRoot == "" {
+		return modules, digests, nil
+	}
+
+	modulePaths := make(map[string]string)
+	err := filepath.WalkDir(formsRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("form entry %q must be a regular file", fullPath)
+		}
+
+		relPath, err := filepath.Rel(formsRoot, fullPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if !utf8.ValidString(relPath) {
+			return fmt.Errorf("form path %q must be valid UTF-8", relPath)
+		}
+		if strings.HasPrefix(relPath, "/") {
+			return fmt.Errorf("form path %q must not start with /", relPath)
+		}
+		cleanRel := path.Clean(relPath)
+		if cleanRel != relPath || cleanRel == "." || cleanRel == ".." || strings.HasPrefix(cleanRel, "../") {
+			return fmt.Errorf("form path %q is not canonical", relPath)
+		}
+		if strings.ToLower(path.Ext(relPath)) != ".wasm" {
+			return nil
+		}
+
+		formName := strings.TrimSuffix(relPath, path.Ext(relPath))
+		if formName == "" {
+			return fmt.Errorf("form path %q must include a name before .wasm", relPath)
+		}
+
+		if prev, exists := modulePaths[formName]; exists {
+			return fmt.Errorf("duplicate form module name %q in %q and %q", formName, prev, fullPath)
+		}
+
+		body, err := os.ReadFile(fullPath)
+		if err != nil {
+			return err
+		}
+		modules[formName] = body
+		digests[formName] = sha256.Sum256(body)
+		modulePaths[formName] = fullPath
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return modules, digests, nil
+}
+
+func closeModuleChains(ctx context.Context, chains map[string]*moduleChain) {
+	for _, chain := range chains {
+		chain.Close(ctx)
+	}
+}
+
+func buildDevETag(sourceDigest [32]byte, recipeDigests [][32]byte, formDigests [][32]byte) string {
+	if len(recipeDigests) == 0 && len(formDigests) == 0 {
+		return fmt.Sprintf("\"%x\"", sourceDigest)
+	}
+	h := sha256.New()
+	_, _ = h.Write(sourceDigest[:])
+	for _, digest := range recipeDigests {
+		_, _ = h.Write(digest[:])
+	}
+	for _, digest := range formDigests {
+		_, _ = h.Write(digest[:])
+	}
+	return fmt.Sprintf("\"%x\"", h.Sum(nil))
+}
+
+func injectQIPFormRuntime(body []byte, formModules map[string][]byte, formDigests map[string][32]byte) ([]byte, [][32]byte, error) {
+	formNames, err := extractQIPFormNames(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(formNames) == 0 {
+		return body, nil, nil
+	}
+	if len(formModules) == 0 {
+		return nil, nil, errors.New("qip-form tags detected, but no form modules are loaded (pass --forms <forms_dir>)")
+	}
+
+	usedDigests := make([][32]byte, len(formNames))
+	for i, name := range formNames {
+		if _, ok := formModules[name]; !ok {
+			return nil, nil, fmt.Errorf("qip-form name %q has no matching module in --forms", name)
+		}
+		digest, ok := formDigests[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("qip-form name %q is missing digest metadata", name)
+		}
+		usedDigests[i] = digest
+	}
+
+	script, err := buildQIPFormInlineScript(formNames, formModules)
+	if err != nil {
+		return nil, nil, err
+	}
+	return injectInlineModuleScript(body, script), usedDigests, nil
+}
+
+func extractQIPFormNames(body []byte) ([]string, error) {
+	tags := qipFormTagPattern.FindAll(body, -1)
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	seen := make(map[string]struct{}, len(tags))
+	names := make([]string, 0, len(tags))
+	for _, tagBytes := range tags {
+		matches := qipFormNamePattern.FindSubmatch(tagBytes)
+		if len(matches) == 0 {
+			return nil, errors.New("<qip-form> tag is missing required name attribute")
+		}
+
+		var rawName string
+		for i := 1; i <= 3; i++ {
+			if len(matches[i]) > 0 {
+				rawName = string(matches[i])
+				break
+			}
+		}
+		name := strings.TrimSpace(html.UnescapeString(rawName))
+		if name == "" {
+			return nil, errors.New("<qip-form> name attribute must not be empty")
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func buildQIPFormInlineScript(formNames []string, formModules map[string][]byte) ([]byte, error) {
+	var b strings.Builder
+	b.Grow(4096 + len(formNames)*256)
+	b.WriteString("<script type=\"module\">\n")
+	b.WriteString("const qipFormModules = new Map([\n")
+	for _, name := range formNames {
+		moduleBytes := formModules[name]
+		nameJSON, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		encodedJSON, err := json.Marshal(base64.StdEncoding.EncodeToString(moduleBytes))
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString("  [")
+		b.Write(nameJSON)
+		b.WriteString(", ")
+		b.Write(encodedJSON)
+		b.WriteString("],\n")
+	}
+	b.WriteString("]);\n")
+	b.WriteString(qipFormClientRuntimeModuleJS)
+	b.WriteString("\n</script>")
+	return []byte(b.String()), nil
+}
+
+func injectInlineModuleScript(body []byte, script []byte) []byte {
+	lower := strings.ToLower(string(body))
+	idx := strings.LastIndex(lower, "</body>")
+	if idx == -1 {
+		out := make([]byte, 0, len(body)+len(script))
+		out = append(out, body...)
+		out = append(out, script...)
+		return out
+	}
+
+	out := make([]byte, 0, len(body)+len(script))
+	out = append(out, body[:idx]...)
+	out = append(out, script...)
+	out = append(out, body[idx:]...)
+	return out
+}
+
+const qipFormClientRuntimeModuleJS = `
+const qipFormTextEncoder = new TextEncoder();
+const qipFormTextDecoder = new TextDecoder("utf-8", { fatal: true });
+const qipFormRequiredExports = [
+  "memory",
+  "input_ptr",
+  "input_utf8_cap",
+  "run",
+  "output_ptr",
+  "output_utf8_cap",
+  "input_key_ptr",
+  "input_key_size",
+  "input_label_ptr",
+  "input_label_size",
+  "error_message_ptr",
+  "error_message_size",
+];
+
+function qipFormDecodeBase64(input) {
+  const binary = atob(input);
+  const out = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i += 1) {
+    out[i] = binary.charCodeAt(i);
+  }
+  return out;
+}
+
+function qipFormCallI32(exportsObj, fnName, args) {
+  const fn = exportsObj[fnName];
+  if (typeof fn !== "function") {
+    throw new Error("form module missing export " + fnName);
+  }
+  const result = fn(...(args || []));
+  return result | 0;
+}
+
+function qipFormReadSlice(exportsObj, ptr, len, label) {
+  if (ptr < 0 || len < 0) {
+    throw new Error(label + " returned negative pointer/size");
+  }
+  const mem = new Uint8Array(exportsObj.memory.buffer);
+  const start = ptr >>> 0;
+  const size = len >>> 0;
+  const end = start + size;
+  if (end < start || end > mem.length) {
+    throw new Error(label + " exceeds wasm memory bounds");
+  }
+  return mem.slice(start, end);
 }
 
-func normalizeDevArgs(args []string) []string {
-	if len(args) == 0 {
-		return args
-	}
-	first := args[0]
-	if strings.HasPrefix(first, "-") {
-		return args
-	}
+function qipFormReadExportedString(exportsObj, ptrExport, lenExport) {
+  const ptr = qipFormCallI32(exportsObj, ptrExport);
+  const len = qipFormCallI32(exportsObj, lenExport);
+  if (len === 0) {
+    return "";
+  }
+  const bytes = qipFormReadSlice(exportsObj, ptr, len, ptrExport + "/" + lenExport);
+  return qipFormTextDecoder.decode(bytes);
+}
+
+function qipFormReadOutput(exportsObj, outLen) {
+  if (outLen < 0) {
+    throw new Error("run returned negative output size: " + String(outLen));
+  }
+  if (outLen === 0) {
+    return "";
+  }
+  const outPtr = qipFormCallI32(exportsObj, "output_ptr");
+  const outCap = qipFormCallI32(exportsObj, "output_utf8_cap");
+  if (outPtr < 0 || outCap < 0) {
+    throw new Error("module returned invalid output pointer/capacity");
+  }
+  if (outLen > outCap) {
+    throw new Error("run output size exceeds output_utf8_cap");
+  }
+  const bytes = qipFormReadSlice(exportsObj, outPtr, outLen, "output_ptr/output_utf8_cap");
+  return qipFormTextDecoder.decode(bytes);
+}
+
+function qipFormWriteInput(exportsObj, value) {
+  const inputPtr = qipFormCallI32(exportsObj, "input_ptr");
+  const inputCap = qipFormCallI32(exportsObj, "input_utf8_cap");
+  if (inputPtr < 0 || inputCap < 0) {
+    throw new Error("module returned invalid input pointer/capacity");
+  }
+  const bytes = qipFormTextEncoder.encode(value);
+  if (bytes.length > inputCap) {
+    throw new Error("input value exceeds module input_utf8_cap");
+  }
+
+  const mem = new Uint8Array(exportsObj.memory.buffer);
+  const start = inputPtr >>> 0;
+  const end = start + bytes.length;
+  if (end < start || end > mem.length) {
+    throw new Error("input write exceeds wasm memory bounds");
+  }
+  mem.set(bytes, start);
+  return bytes.length;
+}
+
+class QIPFormElement extends HTMLElement {
+  constructor() {
+    super();
+    this._started = false;
+    this._exports = null;
+    this._hasRun = false;
+    this._lastOutputLen = 0;
+  }
+
+  async connectedCallback() {
+    if (this._started) {
+      return;
+    }
+    this._started = true;
+    try {
+      await this._init();
+      this._render();
+    } catch (err) {
+      this._renderFatal(err);
+    }
+  }
+
+  async _init() {
+    const formName = (this.getAttribute("name") || "").trim();
+    if (formName === "") {
+      throw new Error("qip-form requires a non-empty name attribute");
+    }
+    const encodedModule = qipFormModules.get(formName);
+    if (typeof encodedModule !== "string") {
+      throw new Error("qip-form module not found for name " + formName);
+    }
+    const moduleBytes = qipFormDecodeBase64(encodedModule);
+    const instantiated = await WebAssembly.instantiate(moduleBytes, {});
+    const exportsObj = instantiated.instance.exports;
+    for (const exportName of qipFormRequiredExports) {
+      if (!(exportName in exportsObj)) {
+        throw new Error("form module missing export " + exportName);
+      }
+    }
+    if (!(exportsObj.memory instanceof WebAssembly.Memory)) {
+      throw new Error("form module export memory must be WebAssembly.Memory");
+    }
+    this._exports = exportsObj;
+  }
+
+  _render() {
+    const exportsObj = this._exports;
+    if (!exportsObj) {
+      throw new Error("form module is not initialized");
+    }
+
+    const inputKey = qipFormReadExportedString(exportsObj, "input_key_ptr", "input_key_size").trim();
+    if (inputKey === "") {
+      if (!this._hasRun) {
+        this._lastOutputLen = qipFormCallI32(exportsObj, "run", [0]);
+        this._hasRun = true;
+      }
+      const outputText = qipFormReadOutput(exportsObj, this._lastOutputLen);
+      const pre = document.createElement("pre");
+      pre.textContent = outputText;
+      this.replaceChildren(pre);
+      return;
+    }
+
+    const errorMessage = qipFormReadExportedString(exportsObj, "error_message_ptr", "error_message_size");
+    const inputLabel = qipFormReadExportedString(exportsObj, "input_label_ptr", "input_label_size");
+    const prompt = inputLabel.trim() || inputKey;
+
+    const container = document.createElement("form");
+    container.noValidate = true;
+
+    if (errorMessage !== "") {
+      const errorNode = document.createElement("p");
+      errorNode.setAttribute("role", "alert");
+      errorNode.textContent = errorMessage;
+      container.appendChild(errorNode);
+    }
+
+    const labelNode = document.createElement("label");
+    labelNode.textContent = prompt;
+    container.appendChild(labelNode);
 
-	normalized := make([]string, 0, len(args))
-	normalized = append(normalized, args[1:]...)
-	normalized = append(normalized, first)
-	return normalized
-}
+    const inputNode = document.createElement("input");
+    inputNode.type = "text";
+    inputNode.required = true;
+    inputNode.name = inputKey;
+    inputNode.autocomplete = "off";
+    container.appendChild(inputNode);
 
-func parseRuntimeMode(raw string) (runtimeMode, error) {
-	mode := runtimeMode(strings.ToLower(strings.TrimSpace(raw)))
-	switch mode {
-	case modeDev, modeProd:
-		return mode, nil
-	default:
-		return "", fmt.Errorf("invalid mode %q (expected dev or prod)", raw)
-	}
-}
+    const submitNode = document.createElement("button");
+    submitNode.type = "submit";
+    submitNode.textContent = "Continue";
+    container.appendChild(submitNode);
 
-func buildDevContentRoutes(contentRoot string) (map[string]devContentRoute, error) {
-	files := make([]struct {
-		rel  string
-		full string
-	}, 0, 32)
-	err := filepath.WalkDir(contentRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if !d.Type().IsRegular() {
-			return fmt.Errorf("content entry %q must be a regular file", fullPath)
-		}
-		relPath, err := filepath.Rel(contentRoot, fullPath)
-		if err != nil {
-			return err
-		}
-		relPath = filepath.ToSlash(relPath)
-		if !utf8.ValidString(relPath) {
-			return fmt.Errorf("content path %q must be valid UTF-8", relPath)
-		}
-		if strings.Contains(relPath, "\\") {
-			return fmt.Errorf("content path %q must not contain backslash", relPath)
-		}
-		if strings.HasPrefix(relPath, "/") {
-			return fmt.Errorf("content path %q must not start with /", relPath)
-		}
-		cleanRel := path.Clean(relPath)
-		if cleanRel != relPath || cleanRel == "." || cleanRel == ".." || strings.HasPrefix(cleanRel, "../") {
-			return fmt.Errorf("content path %q is not canonical", relPath)
-		}
-		files = append(files, struct {
-			rel  string
-			full string
-		}{rel: relPath, full: fullPath})
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
+    container.addEventListener("submit", (event) => {
+      event.preventDefault();
+      try {
+        const inputLen = qipFormWriteInput(exportsObj, inputNode.value);
+        this._lastOutputLen = qipFormCallI32(exportsObj, "run", [inputLen]);
+        this._hasRun = true;
+        this._render();
+      } catch (err) {
+        this._renderFatal(err);
+      }
+    });
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].rel < files[j].rel
-	})
+    this.replaceChildren(container);
+    inputNode.focus();
+  }
 
-	routes := make(map[string]devContentRoute, len(files))
-	for _, entry := range files {
-		aliases := contentRequestPaths(entry.rel)
-		route := devContentRoute{
-			filePath:   entry.full,
-			sourceMIME: detectSourceMIME(entry.rel),
-		}
-		for _, requestPath := range aliases {
-			if prev, exists := routes[requestPath]; exists && prev.filePath != route.filePath {
-				return nil, fmt.Errorf("duplicate route path %q for %q and %q", requestPath, prev.filePath, route.filePath)
-			}
-			routes[requestPath] = route
-		}
-	}
+  _renderFatal(err) {
+    const message = err instanceof Error ? err.message : String(err);
+    const pre = document.createElement("pre");
+    pre.textContent = "Form error: " + message;
+    this.replaceChildren(pre);
+  }
+}
 
-	return routes, nil
+if (!customElements.get("qip-form")) {
+  customElements.define("qip-form", QIPFormElement);
 }
+`
 
-func contentRequestPaths(relPath string) []string {
-	out := make([]string, 0, 4)
-	appendUnique := func(value string) {
-		if slices.Contains(out, value) {
-			return
+// acceptsJSON reports whether an Accept header lists application/json, in
+// which case qip dev serves typed array output as a JSON array.
+func acceptsJSON(accept string) bool {
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(mediaType) != "application/json" {
+			continue
 		}
-		out = append(out, value)
+		return strings.ReplaceAll(params, " ", "") != "q=0"
 	}
+	return false
+}
 
-	appendUnique("/" + relPath)
-	ext := path.Ext(relPath)
-	lowerExt := strings.ToLower(ext)
-	if lowerExt == ".html" || lowerExt == ".md" || lowerExt == ".markdown" {
-		base := path.Base(relPath)
-		if strings.EqualFold(base, "index"+ext) {
-			dir := path.Dir(relPath)
-			if dir == "." {
-				appendUnique("/")
-			} else {
-				appendUnique("/" + dir)
-				appendUnique("/" + dir + "/")
-			}
-		} else {
-			appendUnique("/" + strings.TrimSuffix(relPath, ext))
+// devResponseContentType picks the Content-Type for a dev response: the
+// type the final module declared, or one guessed from the source and output.
+func devResponseContentType(sourceMIME string, recipesApplied bool, output contentData, format outputFormat, body []byte) string {
+	if output.encoding.typedArray() {
+		if format.resolve(output.encoding) == outputFormatJSON {
+			return "application/json"
 		}
+		return "text/plain; charset=utf-8"
 	}
-	return out
-}
-
-func detectSourceMIME(relPath string) string {
-	ext := strings.ToLower(path.Ext(relPath))
-	switch ext {
-	case ".md", ".markdown":
-		return "text/markdown"
+	if output.contentType != "" {
+		return output.contentType
 	}
-
-	mimeType := mime.TypeByExtension(ext)
-	if mimeType == "" {
-		return "application/octet-stream"
+	if recipesApplied && sourceMIME == "text/markdown" {
+		return "text/html; charset=utf-8"
 	}
-	if cut := strings.IndexByte(mimeType, ';'); cut != -1 {
-		mimeType = strings.TrimSpace(mimeType[:cut])
+	if output.encoding == dataEncodingRaw {
+		if isICOBytes(body) {
+			return "image/x-icon"
+		}
+		if isBMPBytes(body) {
+			return "image/bmp"
+		}
 	}
-	if mimeType == "" {
+	if sourceMIME == "" {
 		return "application/octet-stream"
 	}
-	return mimeType
-}
-
-func resolveDevContentRoute(routes map[string]devContentRoute, requestPath string) (devContentRoute, bool) {
-	if requestPath == "" {
-		requestPath = "/"
-	}
-	if !strings.HasPrefix(requestPath, "/") {
-		requestPath = "/" + requestPath
+	if strings.HasPrefix(sourceMIME, "text/") {
+		return sourceMIME + "; charset=utf-8"
 	}
+	return sourceMIME
+}
 
-	candidates := []string{requestPath}
-	clean := path.Clean(requestPath)
-	if clean == "." {
-		clean = "/"
-	}
-	if !strings.HasPrefix(clean, "/") {
-		clean = "/" + clean
-	}
-	if clean != requestPath {
-		candidates = append(candidates, clean)
-	}
-	if requestPath != "/" {
-		if before, ok := strings.CutSuffix(requestPath, "/"); ok {
-			candidates = append(candidates, before)
-		} else {
-			candidates = append(candidates, requestPath+"/")
-		}
-	}
+type chainMetrics struct {
+	moduleDurations        []time.Duration
+	instantiationDurations []time.Duration
+	memoryBytes            []uint64
+	// stageOutputs holds what each stage passed on, when the chain is
+	// traced. Stages that did not run, and tile stages before the last of
+	// their block, are nil.
+	stageOutputs []*contentData
+	// poolHits and poolMisses count pooled stage executions that reused a
+	// warm instance and that had to instantiate one.
+	poolHits   int
+	poolMisses int
+}
 
-	seen := make(map[string]struct{}, len(candidates))
-	for _, candidate := range candidates {
-		if _, ok := seen[candidate]; ok {
-			continue
-		}
-		seen[candidate] = struct{}{}
-		if route, ok := routes[candidate]; ok {
-			return route, true
-		}
-	}
-	return devContentRoute{}, false
+type chainResult struct {
+	output  contentData
+	metrics chainMetrics
 }
 
-func parseRecipeFilename(filename string) (order int, disabled bool, err error) {
-	if !isASCII(filename) {
-		return 0, false, errors.New("filename must be ASCII")
-	}
-	if !strings.HasSuffix(filename, ".wasm") {
-		return 0, false, errors.New("filename must end with .wasm")
-	}
+type stageKind uint8
 
-	trimmed := filename
-	if strings.HasPrefix(trimmed, "-") {
-		disabled = true
-		trimmed = trimmed[1:]
-	}
+const (
+	stageKindRun stageKind = iota
+	stageKindTile
+	// stageKindWASI is a WASI preview1 command, whose stdin is the stage
+	// input and whose stdout is the stage output.
+	stageKindWASI
+)
 
-	if len(trimmed) < len("00-a.wasm") {
-		return 0, disabled, errors.New("filename must match NN-name.wasm")
-	}
-	if trimmed[0] < '0' || trimmed[0] > '9' || trimmed[1] < '0' || trimmed[1] > '9' {
-		return 0, disabled, errors.New("filename prefix must be two digits")
-	}
-	if trimmed[2] != '-' {
-		return 0, disabled, errors.New("filename must match NN-name.wasm")
-	}
-	namePart := strings.TrimSuffix(trimmed, ".wasm")[3:]
-	if namePart == "" {
-		return 0, disabled, errors.New("recipe name must not be empty")
-	}
+type moduleStage struct {
+	compiled wazero.CompiledModule
+	kind     stageKind
+	chunked  bool
+	spec     moduleSpec
+	// digest is the hex sha256 of the module's bytes.
+	digest string
+	// pool is set for run stages when opts.reuseInstances is on and the
+	// module does not export instance_no_reuse.
+	pool *wasmruntime.Pool
+	// meta is the module's qip.meta section, or nil if it has none.
+	meta *modulemeta.Meta
+}
 
-	order = int(trimmed[0]-'0')*10 + int(trimmed[1]-'0')
-	return order, disabled, nil
+type moduleChain struct {
+	runtime          wazero.Runtime
+	stages           []moduleStage
+	opts             options
+	compileDurations []time.Duration
 }
 
-func isASCII(s string) bool {
-	for i := 0; i < len(s); i++ {
-		if s[i] > 0x7f {
-			return false
-		}
-	}
-	return true
+func buildModuleChain(ctx context.Context, modules []string, opts options) (*moduleChain, error) {
+	return buildModuleChainFromSpecs(ctx, moduleSpecsFromArgs(modules), opts)
 }
 
-func loadRecipeChains(ctx context.Context, recipesRoot string, opts options) (map[string]*moduleChain, map[string][][32]byte, error) {
-	chains := make(map[string]*moduleChain)
-	digestsByMIME := make(map[string][][32]byte)
-	if recipesRoot == "" {
-		return chains, digestsByMIME, nil
+func buildModuleChainFromSpecs(ctx context.Context, specs []moduleSpec, opts options) (*moduleChain, error) {
+	if len(specs) == 0 {
+		return &moduleChain{opts: opts}, nil
 	}
 
-	candidatesByMIME := make(map[string][]recipeCandidate)
-	err := filepath.WalkDir(recipesRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if !d.Type().IsRegular() {
-			return fmt.Errorf("recipe entry %q must be a regular file", fullPath)
-		}
+	runtime := wasmruntime.NewWithConfig(ctx, opts.policy.runtimeConfig())
+	stages := make([]moduleStage, len(specs))
+	compileDurations := make([]time.Duration, len(specs))
+	usedInputs := make(map[string]bool, len(opts.inputs))
 
-		relPath, err := filepath.Rel(recipesRoot, fullPath)
+	for i, spec := range specs {
+		body, err := readModuleSpec(spec, opts)
 		if err != nil {
-			return err
-		}
-		relPath = filepath.ToSlash(relPath)
-		filename := path.Base(relPath)
-		if !strings.HasSuffix(filename, ".wasm") {
-			return nil
-		}
-		parts := strings.Split(relPath, "/")
-		if len(parts) != 3 {
-			return fmt.Errorf("recipe path %q must match <type>/<subtype>/<file>", relPath)
+			_ = runtime.Close(ctx)
+			return nil, stageFailed(i, spec.path, err)
 		}
-		mimeType := parts[0] + "/" + parts[1]
-		filename = parts[2]
-
-		order, disabled, err := parseRecipeFilename(filename)
+		start := time.Now()
+		_, endSpan := tracing.Start(ctx, "compile", tracing.Int("stage", i), tracing.String("module", spec.path))
+		cm, err := runtime.CompileModule(ctx, body)
+		endSpan()
+		compileDurations[i] = time.Since(start)
 		if err != nil {
-			return fmt.Errorf("invalid recipe filename %q: %w", relPath, err)
+			_ = runtime.Close(ctx)
+			return nil, stageFailed(i, spec.path, opts.policy.compileError(err))
 		}
-		if disabled {
-			return nil
+		exportedFuncs := cm.ExportedFunctions()
+		kind := stageKindRun
+		if _, ok := exportedFuncs["tile_rgba_f32_64x64"]; ok {
+			kind = stageKindTile
 		}
-
-		body, err := os.ReadFile(fullPath)
-		if err != nil {
-			return err
+		_, chunked := exportedFuncs["run_chunk"]
+		if kind == stageKindTile && (spec.inputEncoding != "" || spec.outputEncoding != "" || spec.guard) {
+			_ = runtime.Close(ctx)
+			return nil, fmt.Errorf("Stage %d (%s) is an image stage; input and output encodings and guard do not apply", i, spec.path)
 		}
-		digest := sha256.Sum256(body)
-		candidatesByMIME[mimeType] = append(candidatesByMIME[mimeType], recipeCandidate{
-			path:     fullPath,
-			filename: filename,
-			order:    order,
-			digest:   digest,
-		})
-		return nil
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-
-	mimeTypes := make([]string, 0, len(candidatesByMIME))
-	for mimeType := range candidatesByMIME {
-		mimeTypes = append(mimeTypes, mimeType)
-	}
-	sort.Strings(mimeTypes)
-
-	for _, mimeType := range mimeTypes {
-		candidates := candidatesByMIME[mimeType]
-		sort.Slice(candidates, func(i, j int) bool {
-			if candidates[i].order != candidates[j].order {
-				return candidates[i].order < candidates[j].order
+		if err := hostmodule.CheckGrants(cm, spec.grants); err != nil {
+			_ = runtime.Close(ctx)
+			return nil, stageFailed(i, spec.path, wasmruntime.Errorf(wasmruntime.KindCompile, "%w", err))
+		}
+		if imports := hostmodule.Imports(cm); len(imports) > 0 {
+			if kind == stageKindTile {
+				_ = runtime.Close(ctx)
+				return nil, fmt.Errorf("Stage %d (%s) is an image stage; %s host functions do not apply", i, spec.path, hostmodule.ModuleName)
 			}
-			return candidates[i].filename < candidates[j].filename
-		})
-		seenOrder := make(map[int]string, len(candidates))
-		for _, candidate := range candidates {
-			if prevPath, exists := seenOrder[candidate.order]; exists {
-				return nil, nil, fmt.Errorf("duplicate recipe prefix for %s: %02d in %q and %q", mimeType, candidate.order, prevPath, candidate.path)
+			if err := hostmodule.Instantiate(ctx, runtime); err != nil {
+				_ = runtime.Close(ctx)
+				return nil, fmt.Errorf("Could not instantiate %s: %w", hostmodule.ModuleName, err)
+			}
+			if opts.verbose {
+				vlogf(opts, "module[%d] imports %s: %v", i, hostmodule.ModuleName, imports)
 			}
-			seenOrder[candidate.order] = candidate.path
 		}
-		modulePaths := make([]string, len(candidates))
-		digests := make([][32]byte, len(candidates))
-		for i, candidate := range candidates {
-			modulePaths[i] = candidate.path
-			digests[i] = candidate.digest
+		if kind == stageKindRun && wasmruntime.ImportsWASI(cm) {
+			kind = stageKindWASI
+			if spec.inputEncoding != "" || spec.outputEncoding != "" || len(spec.uniforms) > 0 {
+				_ = runtime.Close(ctx)
+				return nil, fmt.Errorf("Stage %d (%s) is a WASI stage; input and output encodings and uniforms do not apply", i, spec.path)
+			}
+			if err := wasmruntime.InstantiateWASI(ctx, runtime); err != nil {
+				_ = runtime.Close(ctx)
+				return nil, fmt.Errorf("Could not instantiate WASI: %w", err)
+			}
 		}
-		chain, err := buildModuleChain(ctx, modulePaths, opts)
+		meta, err := modulemeta.FromCompiled(cm)
 		if err != nil {
-			closeModuleChains(ctx, chains)
-			return nil, nil, err
+			_ = runtime.Close(ctx)
+			return nil, stageFailed(i, spec.path, wasmruntime.Errorf(wasmruntime.KindContract, "%w", err))
 		}
-		chains[mimeType] = chain
-		digestsByMIME[mimeType] = digests
-	}
-
-	return chains, digestsByMIME, nil
-}
-
-func scanRecipeModuleStamps(recipesRoot string) (map[string]moduleFileStamp, error) {
-	stamps := make(map[string]moduleFileStamp)
-	if recipesRoot == "" {
-		return stamps, nil
-	}
-
-	err := filepath.WalkDir(recipesRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
+		if detected := stageABI(kind, chunked); meta != nil && meta.ABI != "" && meta.ABI != "form" && meta.ABI != "router" && meta.ABI != detected {
+			_ = runtime.Close(ctx)
+			return nil, stageFailed(i, spec.path, wasmruntime.Errorf(wasmruntime.KindContract, "Module declares abi %q in %s but follows the %s contract", meta.ABI, modulemeta.SectionName, detected))
 		}
-		if d.IsDir() {
-			return nil
+		if err := meta.CheckUniforms(spec.uniforms); err != nil {
+			_ = runtime.Close(ctx)
+			return nil, stageFailed(i, spec.path, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "%w", err))
 		}
-		if !d.Type().IsRegular() {
-			return fmt.Errorf("recipe entry %q must be a regular file", fullPath)
+		if meta != nil && opts.verbose {
+			vlogf(opts, "module[%d] describes itself as %s %s", i, cmp.Or(meta.Name, "(unnamed)"), meta.Version)
 		}
-		if strings.ToLower(path.Ext(fullPath)) != ".wasm" {
-			return nil
+		if kind == stageKindRun {
+			if err := spec.checkExportedEncodings(cm, body); err != nil {
+				_ = runtime.Close(ctx)
+				return nil, stageFailed(i, spec.path, err)
+			}
 		}
-
-		info, err := d.Info()
-		if err != nil {
-			return err
+		for _, name := range declaredInputNames(exportedFuncs) {
+			if _, ok := opts.inputs[name]; !ok {
+				_ = runtime.Close(ctx)
+				return nil, stageFailed(i, spec.path, unboundInputError(name))
+			}
+			usedInputs[name] = true
 		}
-		relPath, err := filepath.Rel(recipesRoot, fullPath)
-		if err != nil {
-			return err
+		digest := sha256.Sum256(body)
+		stages[i] = moduleStage{
+			compiled: cm,
+			kind:     kind,
+			chunked:  chunked && kind == stageKindRun,
+			spec:     spec,
+			digest:   hex.EncodeToString(digest[:]),
+			meta:     meta,
+		}
+		if opts.reuseInstances && kind == stageKindRun {
+			stages[i].pool = newStagePool(ctx, runtime, cm, body, fmt.Sprintf("pool-%d", i))
+			if stages[i].pool == nil && opts.verbose {
+				vlogf(opts, "module[%d] is not pooled", i)
+			}
 		}
-		relPath = filepath.ToSlash(relPath)
-		stamps[relPath] = moduleFileStamp{
-			modTimeUnixNano: info.ModTime().UnixNano(),
-			sizeBytes:       info.Size(),
+		if opts.verbose {
+			vlogf(opts, "compiled module[%d] in %dms", i, compileDurations[i].Milliseconds())
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
-	return stamps, nil
-}
 
-func recipeModuleStampsEqual(a map[string]moduleFileStamp, b map[string]moduleFileStamp) bool {
-	if len(a) != len(b) {
-		return false
+	for _, name := range slices.Sorted(maps.Keys(opts.inputs)) {
+		if !usedInputs[name] {
+			_ = runtime.Close(ctx)
+			return nil, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "No stage declares input %q", name)
+		}
 	}
-	for path, stampA := range a {
-		stampB, ok := b[path]
-		if !ok {
-			return false
+
+	seenTile := false
+	seenRunAfterTile := false
+	for i, stage := range stages {
+		if stage.kind == stageKindTile {
+			if seenRunAfterTile {
+				_ = runtime.Close(ctx)
+				return nil, fmt.Errorf("Image stages must be contiguous to compose (module %d)", i)
+			}
+			seenTile = true
+			continue
 		}
-		if stampA != stampB {
-			return false
+		if seenTile {
+			seenRunAfterTile = true
 		}
 	}
-	return true
+
+	return &moduleChain{
+		runtime:          runtime,
+		stages:           stages,
+		opts:             opts,
+		compileDurations: compileDurations,
+	}, nil
 }
 
-func loadFormModules(formsRoot string) (map[string][]byte, map[string][32]byte, error) {
-	modules := make(map[string][]byte)
-	digests := make(map[string][32]byte)
-	if formsRoot == "" {
-		return modules, digests, nil
+// newStagePool pools instances of a run stage, or returns nil for a module
+// that opts out with instance_no_reuse or cannot be rewritten for pooling. A
+// pooled instance is reset through its exports, so a module with private
+// mutable globals, like a stack pointer, is compiled again with them
+// exported. Only pooled instances use that copy.
+func newStagePool(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule, body []byte, name string) *wasmruntime.Pool {
+	if _, optOut := compiled.ExportedFunctions()["instance_no_reuse"]; optOut {
+		return nil
 	}
-
-	modulePaths := make(map[string]string)
-	err := filepath.WalkDir(formsRoot, func(fullPath string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		if d.IsDir() {
+	exported, err := wasmruntime.ExportMutableGlobals(body)
+	if err != nil {
+		return nil
+	}
+	globals, err := wasmruntime.ExportedGlobalNames(exported)
+	if err != nil || slices.Contains(globals, "instance_no_reuse") {
+		return nil
+	}
+	if !bytes.Equal(exported, body) {
+		if compiled, err = runtime.CompileModule(ctx, exported); err != nil {
 			return nil
 		}
-		if !d.Type().IsRegular() {
-			return fmt.Errorf("form entry %q must be a regular file", fullPath)
-		}
+	}
+	return wasmruntime.NewPool(runtime, compiled, globals, name, goruntime.NumCPU())
+}
 
-		relPath, err := filepath.Rel(formsRoot, fullPath)
-		if err != nil {
-			return err
-		}
-		relPath = filepath.ToSlash(relPath)
-		if !utf8.ValidString(relPath) {
-			return fmt.Errorf("form path %q must be valid UTF-8", relPath)
-		}
-		if strings.HasPrefix(relPath, "/") {
-			return fmt.Errorf("form path %q must not start with /", relPath)
-		}
-		cleanRel := path.Clean(relPath)
-		if cleanRel != relPath || cleanRel == "." || cleanRel == ".." || strings.HasPrefix(cleanRel, "../") {
-			return fmt.Errorf("form path %q is not canonical", relPath)
-		}
-		if strings.ToLower(path.Ext(relPath)) != ".wasm" {
-			return nil
-		}
+// stageABI names the qip.meta abi of a stage of kind. Form and router
+// modules follow the run contract, so a chain cannot tell them apart.
+func stageABI(kind stageKind, chunked bool) string {
+	switch {
+	case kind == stageKindTile:
+		return "image"
+	case kind == stageKindWASI:
+		return "wasi"
+	case chunked:
+		return "chunked"
+	}
+	return "run"
+}
 
-		formName := strings.TrimSuffix(relPath, path.Ext(relPath))
-		if formName == "" {
-			return fmt.Errorf("form path %q must include a name before .wasm", relPath)
+func (chain *moduleChain) Close(ctx context.Context) {
+	for _, stage := range chain.stages {
+		if stage.pool != nil {
+			stage.pool.Close(ctx)
 		}
+		_ = stage.compiled.Close(ctx)
+	}
+	if chain.runtime != nil {
+		_ = chain.runtime.Close(ctx)
+	}
+}
 
-		if prev, exists := modulePaths[formName]; exists {
-			return fmt.Errorf("duplicate form module name %q in %q and %q", formName, prev, fullPath)
-		}
+// stageError attributes a failure to one stage of a chain.
+type stageError struct {
+	stage int
+	path  string
+	err   error
+}
 
-		body, err := os.ReadFile(fullPath)
-		if err != nil {
-			return err
-		}
-		modules[formName] = body
-		digests[formName] = sha256.Sum256(body)
-		modulePaths[formName] = fullPath
-		return nil
-	})
-	if err != nil {
-		return nil, nil, err
-	}
+func (e *stageError) Error() string {
+	return fmt.Sprintf("Stage %d (%s): %v", e.stage, e.path, e.err)
+}
 
-	return modules, digests, nil
+func (e *stageError) Unwrap() error {
+	return e.err
 }
 
-func closeModuleChains(ctx context.Context, chains map[string]*moduleChain) {
-	for _, chain := range chains {
-		chain.Close(ctx)
+// stageFailed wraps err with the stage it came from, unless it already
+// names one.
+func stageFailed(stage int, path string, err error) error {
+	var named *stageError
+	if err == nil || errors.As(err, &named) {
+		return err
 	}
+	return &stageError{stage: stage, path: path, err: err}
 }
 
-func buildDevETag(sourceDigest [32]byte, recipeDigests [][32]byte, formDigests [][32]byte) string {
-	if len(recipeDigests) == 0 && len(formDigests) == 0 {
-		return fmt.Sprintf("\"%x\"", sourceDigest)
+// errGuardRejected is returned when a guard stage rejects its input.
+var errGuardRejected = errors.New("Guard rejected the input")
+
+// guardReason turns a guard stage's reported error, which it gives instead
+// of output, into a rejection that carries the module's message.
+func guardReason(err error) error {
+	if wasmruntime.KindOf(err) == wasmruntime.KindModule {
+		return fmt.Errorf("%w: %w", errGuardRejected, err)
 	}
-	h := sha256.New()
-	_, _ = h.Write(sourceDigest[:])
-	for _, digest := range recipeDigests {
-		_, _ = h.Write(digest[:])
+	return err
+}
+
+// guard applies stage i's result when the stage is a guard: a module without
+// output exports that is followed by another stage, or one marked guard in a
+// pipeline manifest. An accepting guard passes its input through unchanged;
+// a rejecting one stops the chain. Scalar guards accept a nonzero result,
+// marked guards any nonempty output. Other stages' outputs are returned
+// unchanged.
+func (chain *moduleChain) guard(i int, exec moduleExecutionResult, input contentData) (contentData, error) {
+	spec := chain.stages[i].spec
+	var accepted bool
+	switch {
+	case spec.guard && !exec.scalar:
+		accepted = len(exec.output.bytes) > 0
+	case exec.scalar && (spec.guard || i < len(chain.stages)-1):
+		accepted = exec.result != 0
+	default:
+		return exec.output, nil
 	}
-	for _, digest := range formDigests {
-		_, _ = h.Write(digest[:])
+	if !accepted {
+		return contentData{}, errGuardRejected
 	}
-	return fmt.Sprintf("\"%x\"", h.Sum(nil))
+	return input, nil
 }
 
-func injectQIPFormRuntime(body []byte, formModules map[string][]byte, formDigests map[string][32]byte) ([]byte, [][32]byte, error) {
-	formNames, err := extractQIPFormNames(body)
-	if err != nil {
-		return nil, nil, err
+// now returns the time qip_v1.now_unix_ms reports for a run starting now.
+func (chain *moduleChain) now() time.Time {
+	if chain.opts.now.IsZero() {
+		return time.Now()
 	}
-	if len(formNames) == 0 {
-		return body, nil, nil
+	return chain.opts.now
+}
+
+// hostContext returns the context for calls into stage i while running
+// record, which started at now.
+func (chain *moduleChain) hostContext(ctx context.Context, i int, record uint64, now time.Time) context.Context {
+	return hostStageContext(ctx, chain.opts, i, record, chain.stages[i].spec, now)
+}
+
+// hostStageContext gives a stage's qip_v1 host functions the run's clock, a
+// fresh random stream for the record, and a log naming the stage. Stages
+// without grants cannot import them, so they get ctx unchanged.
+func hostStageContext(ctx context.Context, opts options, i int, record uint64, spec moduleSpec, now time.Time) context.Context {
+	if len(spec.grants) == 0 {
+		return ctx
+	}
+	return hostmodule.WithStage(ctx, hostmodule.Stage{
+		Index:     i,
+		NowUnixMS: now.UnixMilli(),
+		Seed:      opts.seed,
+		Record:    record,
+		Log: func(message string) {
+			if opts.moduleLog != nil {
+				fmt.Fprintf(opts.moduleLog, "Stage %d (%s) log: %s\n", i, spec.path, message)
+			} else {
+				vlogf(opts, "Stage %d (%s) log: %s", i, spec.path, message)
+			}
+		},
+	})
+}
+
+func (chain *moduleChain) run(ctx context.Context, input []byte, requestID uint64) (chainResult, error) {
+	return chain.runWithUniforms(ctx, input, requestID, nil)
+}
+
+// runWithUniforms runs the chain like run, with per-request uniforms layered
+// over each stage's own. overrides is indexed by stage and may be nil. A
+// pooled stage given overrides runs on a fresh instance, since uniforms often
+// live in globals the pool cannot reset.
+func (chain *moduleChain) runWithUniforms(ctx context.Context, input []byte, requestID uint64, overrides []map[string]string) (chainResult, error) {
+	stageUniforms := func(i int) map[string]string {
+		if i >= len(overrides) || len(overrides[i]) == 0 {
+			return chain.stages[i].spec.uniforms
+		}
+		merged := maps.Clone(chain.stages[i].spec.uniforms)
+		if merged == nil {
+			merged = make(map[string]string, len(overrides[i]))
+		}
+		maps.Copy(merged, overrides[i])
+		return merged
 	}
-	if len(formModules) == 0 {
-		return nil, nil, errors.New("qip-form tags detected, but no form modules are loaded (pass --forms <forms_dir>)")
+	if len(chain.stages) == 0 {
+		return chainResult{
+			output: contentData{bytes: input, encoding: dataEncodingRaw},
+			metrics: chainMetrics{
+				moduleDurations:        []time.Duration{},
+				instantiationDurations: []time.Duration{},
+			},
+		}, nil
 	}
 
-	usedDigests := make([][32]byte, len(formNames))
-	for i, name := range formNames {
-		if _, ok := formModules[name]; !ok {
-			return nil, nil, fmt.Errorf("qip-form name %q has no matching module in --forms", name)
+	moduleDurations := make([]time.Duration, len(chain.stages))
+	instantiationDurations := make([]time.Duration, len(chain.stages))
+	memoryBytes := make([]uint64, len(chain.stages))
+	var stageOutputs []*contentData
+	if chain.opts.traceDir != "" {
+		stageOutputs = make([]*contentData, len(chain.stages))
+	}
+	var poolHits, poolMisses int
+	metrics := func() chainMetrics {
+		return chainMetrics{
+			moduleDurations:        moduleDurations,
+			instantiationDurations: instantiationDurations,
+			memoryBytes:            memoryBytes,
+			stageOutputs:           stageOutputs,
+			poolHits:               poolHits,
+			poolMisses:             poolMisses,
 		}
-		digest, ok := formDigests[name]
-		if !ok {
-			return nil, nil, fmt.Errorf("qip-form name %q is missing digest metadata", name)
+	}
+	for i, stage := range chain.stages {
+		if i < len(overrides) && len(overrides[i]) > 0 {
+			if err := stage.meta.CheckUniforms(overrides[i]); err != nil {
+				return chainResult{metrics: metrics()}, stageFailed(i, stage.spec.path, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "%w", err))
+			}
 		}
-		usedDigests[i] = digest
 	}
+	var output contentData
+	cur := input
+	now := chain.now()
 
-	script, err := buildQIPFormInlineScript(formNames, formModules)
-	if err != nil {
-		return nil, nil, err
+	tileStart := -1
+	tileEnd := -1
+	for i, stage := range chain.stages {
+		if stage.kind == stageKindTile {
+			if tileStart == -1 {
+				tileStart = i
+			}
+			tileEnd = i
+		}
 	}
-	return injectInlineModuleScript(body, script), usedDigests, nil
-}
 
-func extractQIPFormNames(body []byte) ([]string, error) {
-	tags := qipFormTagPattern.FindAll(body, -1)
-	if len(tags) == 0 {
-		return nil, nil
+	runRunStages := func(start, end int, inputBytes []byte) (contentData, []byte, error) {
+		curBytes := inputBytes
+		localOutput := contentData{bytes: inputBytes, encoding: dataEncodingRaw}
+		for i := start; i < end; i++ {
+			stage := chain.stages[i]
+			moduleName := fmt.Sprintf("req-%d-%d", requestID, i)
+			runStart := time.Now()
+			spanCtx, endSpan := tracing.Start(ctx, "stage", tracing.Int("stage", i), tracing.String("module", stage.spec.path))
+			stageCtx, cancel := chain.opts.policy.stageContext(chain.hostContext(spanCtx, i, requestID, now), stage.spec)
+			var exec moduleExecutionResult
+			var err error
+			uniforms := stageUniforms(i)
+			if stage.pool != nil && (i >= len(overrides) || len(overrides[i]) == 0) {
+				exec, err = executeModuleInstance(stageCtx, stage.pool, curBytes, uniforms, chain.opts)
+				if exec.reused {
+					poolHits++
+				} else {
+					poolMisses++
+				}
+			} else {
+				exec, err = executeModuleWithInput(stageCtx, chain.runtime, stage.compiled, curBytes, uniforms, chain.opts, moduleName)
+			}
+			cancel()
+			endSpan()
+			moduleDurations[i] = time.Since(runStart)
+			instantiationDurations[i] = exec.instantiation
+			memoryBytes[i] = exec.memoryBytes
+			if stage.spec.guard {
+				err = guardReason(err)
+			}
+			var nextOutput contentData
+			if err == nil {
+				nextOutput, err = chain.guard(i, exec, localOutput)
+			}
+			if err != nil {
+				return localOutput, curBytes, stageFailed(i, stage.spec.path, err)
+			}
+			localOutput = nextOutput
+			curBytes = nextOutput.bytes
+			if stageOutputs != nil {
+				stageOutputs[i] = &nextOutput
+			}
+		}
+		return localOutput, curBytes, nil
 	}
 
-	seen := make(map[string]struct{}, len(tags))
-	names := make([]string, 0, len(tags))
-	for _, tagBytes := range tags {
-		matches := qipFormNamePattern.FindSubmatch(tagBytes)
-		if len(matches) == 0 {
-			return nil, errors.New("<qip-form> tag is missing required name attribute")
+	if tileStart == -1 {
+		out, curBytes, err := runRunStages(0, len(chain.stages), cur)
+		if err != nil {
+			return chainResult{
+				output:  out,
+				metrics: metrics(),
+			}, err
 		}
-
-		var rawName string
-		for i := 1; i <= 3; i++ {
-			if len(matches[i]) > 0 {
-				rawName = string(matches[i])
-				break
+		output = out
+		cur = curBytes
+	} else {
+		if tileStart > 0 {
+			out, curBytes, err := runRunStages(0, tileStart, cur)
+			if err != nil {
+				return chainResult{
+					output:  out,
+					metrics: metrics(),
+				}, err
 			}
+			output = out
+			cur = curBytes
+			if output.encoding != dataEncodingRaw {
+				return chainResult{
+					output:  output,
+					metrics: metrics(),
+				}, wasmruntime.Errorf(wasmruntime.KindInvalidInput, "Image stage requires raw BMP bytes as input")
+			}
+		} else {
+			output = contentData{bytes: cur, encoding: dataEncodingRaw}
 		}
-		name := strings.TrimSpace(html.UnescapeString(rawName))
-		if name == "" {
-			return nil, errors.New("<qip-form> name attribute must not be empty")
+
+		inputRGBA, err := decodeBMP(cur)
+		if err == nil {
+			err = chain.opts.policy.checkInputSize(uint64(len(cur)))
 		}
-		if _, ok := seen[name]; ok {
-			continue
+		if err != nil {
+			return chainResult{
+				output:  output,
+				metrics: metrics(),
+			}, err
 		}
-		seen[name] = struct{}{}
-		names = append(names, name)
-	}
-
-	sort.Strings(names)
-	return names, nil
-}
-
-func buildQIPFormInlineScript(formNames []string, formModules map[string][]byte) ([]byte, error) {
-	var b strings.Builder
-	b.Grow(4096 + len(formNames)*256)
-	b.WriteString("<script type=\"module\">\n")
-	b.WriteString("const qipFormModules = new Map([\n")
-	for _, name := range formNames {
-		moduleBytes := formModules[name]
-		nameJSON, err := json.Marshal(name)
+		tileCompiled := make([]wazero.CompiledModule, tileEnd-tileStart+1)
+		tileSpecs := make([]moduleSpec, len(tileCompiled))
+		for i := tileStart; i <= tileEnd; i++ {
+			tileCompiled[i-tileStart] = chain.stages[i].compiled
+			tileSpecs[i-tileStart] = chain.stages[i].spec
+			tileSpecs[i-tileStart].uniforms = stageUniforms(i)
+		}
+		moduleNamePrefix := fmt.Sprintf("req-%d", requestID)
+		// Tile stages run interleaved tile by tile, so the block shares one
+		// deadline sized for all of its stages.
+		tileCtx, cancel := chain.opts.policy.stageContext(ctx, tileSpecs...)
+		tileOutput, tileMetrics, err := runTileStagesCompiled(tileCtx, chain.runtime, tileCompiled, tileSpecs, inputRGBA, moduleNamePrefix, tileStart)
+		cancel()
+		copy(instantiationDurations[tileStart:], tileMetrics.instantiation)
+		copy(moduleDurations[tileStart:], tileMetrics.run)
+		copy(memoryBytes[tileStart:], tileMetrics.memoryBytes)
 		if err != nil {
-			return nil, err
+			return chainResult{
+				output:  output,
+				metrics: metrics(),
+			}, err
+		}
+		bmpBytes, err := encodeBMP(tileOutput)
+		if err == nil {
+			err = chain.opts.policy.checkOutputSize(uint64(len(bmpBytes)))
 		}
-		encodedJSON, err := json.Marshal(base64.StdEncoding.EncodeToString(moduleBytes))
 		if err != nil {
-			return nil, err
+			return chainResult{
+				output:  output,
+				metrics: metrics(),
+			}, err
+		}
+		output = contentData{bytes: bmpBytes, encoding: dataEncodingRaw, contentType: "image/bmp"}
+		cur = bmpBytes
+		if stageOutputs != nil {
+			tileOutput := output
+			stageOutputs[tileEnd] = &tileOutput
+		}
+
+		if tileEnd+1 < len(chain.stages) {
+			out, curBytes, err := runRunStages(tileEnd+1, len(chain.stages), cur)
+			if err != nil {
+				return chainResult{
+					output:  out,
+					metrics: metrics(),
+				}, err
+			}
+			output = out
+			cur = curBytes
 		}
-		b.WriteString("  [")
-		b.Write(nameJSON)
-		b.WriteString(", ")
-		b.Write(encodedJSON)
-		b.WriteString("],\n")
 	}
-	b.WriteString("]);\n")
-	b.WriteString(qipFormClientRuntimeModuleJS)
-	b.WriteString("\n</script>")
-	return []byte(b.String()), nil
+
+	return chainResult{
+		output:  output,
+		metrics: metrics(),
+	}, nil
 }
 
-func injectInlineModuleScript(body []byte, script []byte) []byte {
-	lower := strings.ToLower(string(body))
-	idx := strings.LastIndex(lower, "</body>")
-	if idx == -1 {
-		out := make([]byte, 0, len(body)+len(script))
-		out = append(out, body...)
-		out = append(out, script...)
-		return out
-	}
+// traceFormat selects what --trace writes.
+type traceFormat string
 
-	out := make([]byte, 0, len(body)+len(script))
-	out = append(out, body[:idx]...)
-	out = append(out, script...)
-	out = append(out, body[idx:]...)
-	return out
+const (
+	// traceFormatDump writes each stage's output and a trace.json report.
+	traceFormatDump traceFormat = "dump"
+	// traceFormatChrome writes spans as Chrome trace event JSON.
+	traceFormatChrome traceFormat = "chrome"
+)
+
+// chromeTraceFile is the file a chrome format trace is written to.
+const chromeTraceFile = "chrome-trace.json"
+
+// traceFlags are the --trace options shared by run, image, and dev.
+type traceFlags struct {
+	dir    string
+	format string
 }
 
-const qipFormClientRuntimeModuleJS = `
-const qipFormTextEncoder = new TextEncoder();
-const qipFormTextDecoder = new TextDecoder("utf-8", { fatal: true });
-const qipFormRequiredExports = [
-  "memory",
-  "input_ptr",
-  "input_utf8_cap",
-  "run",
-  "output_ptr",
-  "output_utf8_cap",
-  "input_key_ptr",
-  "input_key_size",
-  "input_label_ptr",
-  "input_label_size",
-  "error_message_ptr",
-  "error_message_size",
-];
+func registerTraceFlags(fs *flag.FlagSet, usage string) *traceFlags {
+	tf := &traceFlags{}
+	fs.StringVar(&tf.dir, "trace", "", usage)
+	fs.StringVar(&tf.format, "trace-format", string(traceFormatDump), "what --trace writes: dump (stage outputs and trace.json) or chrome (trace event JSON)")
+	return tf
+}
 
-function qipFormDecodeBase64(input) {
-  const binary = atob(input);
-  const out = new Uint8Array(binary.length);
-  for (let i = 0; i < binary.length; i += 1) {
-    out[i] = binary.charCodeAt(i);
-  }
-  return out;
+// resolve checks the flags. A dump trace sets opts.traceDir so module
+// chains keep every stage's output.
+func (tf *traceFlags) resolve(opts *options) (traceFormat, error) {
+	format := traceFormat(tf.format)
+	switch format {
+	case traceFormatDump:
+		opts.traceDir = tf.dir
+	case traceFormatChrome:
+		if tf.dir == "" {
+			return "", errors.New("--trace-format=chrome needs --trace <dir>")
+		}
+	default:
+		return "", fmt.Errorf("Invalid trace format: %q (want dump or chrome)", tf.format)
+	}
+	return format, nil
 }
 
-function qipFormCallI32(exportsObj, fnName, args) {
-  const fn = exportsObj[fnName];
-  if (typeof fn !== "function") {
-    throw new Error("form module missing export " + fnName);
-  }
-  const result = fn(...(args || []));
-  return result | 0;
+// startChrome records spans for the rest of a command when the trace format
+// is chrome. The returned function ends the command's span and writes the
+// trace; callers also run it before failing through gameOver, which exits
+// without running deferred calls.
+func (tf *traceFlags) startChrome(ctx context.Context, name string) (context.Context, func()) {
+	if tf.dir == "" || traceFormat(tf.format) != traceFormatChrome {
+		return ctx, func() {}
+	}
+	recorder := tracing.NewRecorder()
+	ctx, end := tracing.Start(tracing.WithRecorder(ctx, recorder), name)
+	var once sync.Once
+	finish := func() {
+		once.Do(func() {
+			end()
+			if err := writeChromeTrace(tf.dir, recorder.Spans()); err != nil {
+				log.Printf("%v", err)
+			}
+		})
+	}
+	return ctx, finish
+}
+
+func writeChromeTrace(dir string, spans []tracing.Span) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("Error creating trace directory: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tracing.WriteChrome(&buf, spans); err != nil {
+		return fmt.Errorf("Error writing trace: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, chromeTraceFile), buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("Error writing trace: %w", err)
+	}
+	return nil
 }
 
-function qipFormReadSlice(exportsObj, ptr, len, label) {
-  if (ptr < 0 || len < 0) {
-    throw new Error(label + " returned negative pointer/size");
-  }
-  const mem = new Uint8Array(exportsObj.memory.buffer);
-  const start = ptr >>> 0;
-  const size = len >>> 0;
-  const end = start + size;
-  if (end < start || end > mem.length) {
-    throw new Error(label + " exceeds wasm memory bounds");
-  }
-  return mem.slice(start, end);
+// devTracer records spans for qip dev, writing them as Chrome traces to
+// chromeDir and exporting them over OTLP when either is set. Every request
+// is its own trace, identified by its request ID; compiling recipes on load
+// and reload is traced separately.
+type devTracer struct {
+	chromeDir string
+	exporter  *tracing.OTLPExporter
+	loads     atomic.Uint64
+
+	mu       sync.Mutex
+	exports  chan devTraceExport // nil once flushed
+	exported chan struct{}
 }
 
-function qipFormReadExportedString(exportsObj, ptrExport, lenExport) {
-  const ptr = qipFormCallI32(exportsObj, ptrExport);
-  const len = qipFormCallI32(exportsObj, lenExport);
-  if (len === 0) {
-    return "";
-  }
-  const bytes = qipFormReadSlice(exportsObj, ptr, len, ptrExport + "/" + lenExport);
-  return qipFormTextDecoder.decode(bytes);
+// devTraceQueueSize bounds the traces waiting for OTLP export. Traces
+// ending while the queue is full are dropped rather than piling up behind a
+// slow collector.
+const devTraceQueueSize = 64
+
+type devTraceExport struct {
+	traceID tracing.TraceID
+	spans   []tracing.Span
 }
 
-function qipFormReadOutput(exportsObj, outLen) {
-  if (outLen < 0) {
-    throw new Error("run returned negative output size: " + String(outLen));
-  }
-  if (outLen === 0) {
-    return "";
-  }
-  const outPtr = qipFormCallI32(exportsObj, "output_ptr");
-  const outCap = qipFormCallI32(exportsObj, "output_utf8_cap");
-  if (outPtr < 0 || outCap < 0) {
-    throw new Error("module returned invalid output pointer/capacity");
-  }
-  if (outLen > outCap) {
-    throw new Error("run output size exceeds output_utf8_cap");
-  }
-  const bytes = qipFormReadSlice(exportsObj, outPtr, outLen, "output_ptr/output_utf8_cap");
-  return qipFormTextDecoder.decode(bytes);
+// startExporting exports traces through exporter, one at a time.
+func (t *devTracer) startExporting(exporter *tracing.OTLPExporter) {
+	t.exporter = exporter
+	t.exports = make(chan devTraceExport, devTraceQueueSize)
+	t.exported = make(chan struct{})
+	go func() {
+		defer close(t.exported)
+		for e := range t.exports {
+			if err := exporter.Export(context.Background(), e.traceID, e.spans); err != nil {
+				log.Printf("dev: trace export failed: %v", err)
+			}
+		}
+	}()
 }
 
-function qipFormWriteInput(exportsObj, value) {
-  const inputPtr = qipFormCallI32(exportsObj, "input_ptr");
-  const inputCap = qipFormCallI32(exportsObj, "input_utf8_cap");
-  if (inputPtr < 0 || inputCap < 0) {
-    throw new Error("module returned invalid input pointer/capacity");
-  }
-  const bytes = qipFormTextEncoder.encode(value);
-  if (bytes.length > inputCap) {
-    throw new Error("input value exceeds module input_utf8_cap");
-  }
+func (t *devTracer) export(traceID tracing.TraceID, spans []tracing.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exports == nil {
+		return
+	}
+	select {
+	case t.exports <- devTraceExport{traceID: traceID, spans: spans}:
+	default:
+		log.Printf("dev: trace export queue full; dropping trace")
+	}
+}
 
-  const mem = new Uint8Array(exportsObj.memory.buffer);
-  const start = inputPtr >>> 0;
-  const end = start + bytes.length;
-  if (end < start || end > mem.length) {
-    throw new Error("input write exceeds wasm memory bounds");
-  }
-  mem.set(bytes, start);
-  return bytes.length;
+// flush stops accepting traces and waits for the queued ones to be
+// exported, or for ctx to end.
+func (t *devTracer) flush(ctx context.Context) {
+	t.mu.Lock()
+	exports := t.exports
+	t.exports = nil
+	t.mu.Unlock()
+	if exports == nil {
+		return
+	}
+	close(exports)
+	select {
+	case <-t.exported:
+	case <-ctx.Done():
+		log.Printf("dev: gave up exporting queued traces: %v", ctx.Err())
+	}
 }
 
-class QIPFormElement extends HTMLElement {
-  constructor() {
-    super();
-    this._started = false;
-    this._exports = null;
-    this._hasRun = false;
-    this._lastOutputLen = 0;
-  }
+func (t *devTracer) enabled() bool {
+	return t.chromeDir != "" || t.exporter != nil
+}
 
-  async connectedCallback() {
-    if (this._started) {
-      return;
-    }
-    this._started = true;
-    try {
-      await this._init();
-      this._render();
-    } catch (err) {
-      this._renderFatal(err);
-    }
-  }
+// startRequest begins the trace of request reqID. The returned function
+// ends it and writes or exports its spans.
+func (t *devTracer) startRequest(reqID uint64, r *http.Request) (context.Context, func()) {
+	ctx := context.Background()
+	if !t.enabled() {
+		return ctx, func() {}
+	}
+	return t.start(ctx, r.Method+" "+r.URL.Path, fmt.Sprintf("request-%d", reqID), tracing.RequestTraceID(reqID),
+		tracing.String("http.method", r.Method),
+		tracing.String("http.target", r.URL.RequestURI()),
+		tracing.String("qip.request_id", strconv.FormatUint(reqID, 10)),
+	)
+}
 
-  async _init() {
-    const formName = (this.getAttribute("name") || "").trim();
-    if (formName === "") {
-      throw new Error("qip-form requires a non-empty name attribute");
-    }
-    const encodedModule = qipFormModules.get(formName);
-    if (typeof encodedModule !== "string") {
-      throw new Error("qip-form module not found for name " + formName);
-    }
-    const moduleBytes = qipFormDecodeBase64(encodedModule);
-    const instantiated = await WebAssembly.instantiate(moduleBytes, {});
-    const exportsObj = instantiated.instance.exports;
-    for (const exportName of qipFormRequiredExports) {
-      if (!(exportName in exportsObj)) {
-        throw new Error("form module missing export " + exportName);
-      }
-    }
-    if (!(exportsObj.memory instanceof WebAssembly.Memory)) {
-      throw new Error("form module export memory must be WebAssembly.Memory");
-    }
-    this._exports = exportsObj;
-  }
+// startLoad begins the trace of loading recipe chains.
+func (t *devTracer) startLoad(reason string) (context.Context, func()) {
+	ctx := context.Background()
+	if !t.enabled() {
+		return ctx, func() {}
+	}
+	load := t.loads.Add(1)
+	return t.start(ctx, "load", fmt.Sprintf("load-%d", load), tracing.NewTraceID(), tracing.String("reason", reason))
+}
 
-  _render() {
-    const exportsObj = this._exports;
-    if (!exportsObj) {
-      throw new Error("form module is not initialized");
-    }
+func (t *devTracer) start(ctx context.Context, name string, dirName string, traceID tracing.TraceID, attributes ...tracing.Attribute) (context.Context, func()) {
+	recorder := tracing.NewRecorder()
+	ctx, end := tracing.Start(tracing.WithRecorder(ctx, recorder), name, attributes...)
+	return ctx, func() {
+		end()
+		spans := recorder.Spans()
+		if t.chromeDir != "" {
+			if err := writeChromeTrace(filepath.Join(t.chromeDir, dirName), spans); err != nil {
+				log.Printf("dev: %v", err)
+			}
+		}
+		if t.exporter != nil {
+			t.export(traceID, spans)
+		}
+	}
+}
 
-    const inputKey = qipFormReadExportedString(exportsObj, "input_key_ptr", "input_key_size").trim();
-    if (inputKey === "") {
-      if (!this._hasRun) {
-        this._lastOutputLen = qipFormCallI32(exportsObj, "run", [0]);
-        this._hasRun = true;
-      }
-      const outputText = qipFormReadOutput(exportsObj, this._lastOutputLen);
-      const pre = document.createElement("pre");
-      pre.textContent = outputText;
-      this.replaceChildren(pre);
-      return;
-    }
+// traceReport is the trace.json written by --trace: what went into a chain,
+// and what every stage produced and cost.
+type traceReport struct {
+	Input  traceData    `json:"input"`
+	Stages []traceStage `json:"stages"`
+	Output *traceData   `json:"output,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
 
-    const errorMessage = qipFormReadExportedString(exportsObj, "error_message_ptr", "error_message_size");
-    const inputLabel = qipFormReadExportedString(exportsObj, "input_label_ptr", "input_label_size");
-    const prompt = inputLabel.trim() || inputKey;
+type traceStage struct {
+	Index         int        `json:"index"`
+	Module        string     `json:"module"`
+	Kind          string     `json:"kind"`
+	CompileUS     int64      `json:"compile_us"`
+	InstantiateUS int64      `json:"instantiate_us"`
+	RunUS         int64      `json:"run_us"`
+	MemoryBytes   uint64     `json:"memory_bytes"`
+	Output        *traceData `json:"output,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
 
-    const container = document.createElement("form");
-    container.noValidate = true;
+type traceData struct {
+	File        string `json:"file,omitempty"`
+	Encoding    string `json:"encoding"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+}
 
-    if (errorMessage !== "") {
-      const errorNode = document.createElement("p");
-      errorNode.setAttribute("role", "alert");
-      errorNode.textContent = errorMessage;
-      container.appendChild(errorNode);
-    }
+func newTraceData(data contentData, file string) traceData {
+	digest := sha256.Sum256(data.bytes)
+	return traceData{
+		File:        file,
+		Encoding:    contractEncodingName(data.encoding),
+		ContentType: data.contentType,
+		Size:        len(data.bytes),
+		SHA256:      hex.EncodeToString(digest[:]),
+	}
+}
 
-    const labelNode = document.createElement("label");
-    labelNode.textContent = prompt;
-    container.appendChild(labelNode);
+// traceFileExtension picks an extension for a stage's dumped output so it
+// opens in a suitable viewer.
+func traceFileExtension(data contentData) string {
+	if extension := extensionForContentType(data.contentType); extension != "" {
+		return extension
+	}
+	if data.encoding == dataEncodingUTF8 {
+		return ".txt"
+	}
+	return ".bin"
+}
 
-    const inputNode = document.createElement("input");
-    inputNode.type = "text";
-    inputNode.required = true;
-    inputNode.name = inputKey;
-    inputNode.autocomplete = "off";
-    container.appendChild(inputNode);
+// writeTrace writes a run of the chain to dir: each stage's output as
+// stage-<index><ext> and a trace.json report. runErr is the run's error, if
+// it failed; the stage it names is marked as the one that failed.
+func (chain *moduleChain) writeTrace(dir string, input []byte, result chainResult, runErr error) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("Error creating trace directory: %w", err)
+	}
+	report := traceReport{
+		Input:  newTraceData(contentData{bytes: input, encoding: dataEncodingRaw}, ""),
+		Stages: make([]traceStage, len(chain.stages)),
+	}
+	failedStage := -1
+	var stageErr *stageError
+	if errors.As(runErr, &stageErr) {
+		failedStage = stageErr.stage
+	}
+	metrics := result.metrics
+	for i, stage := range chain.stages {
+		entry := traceStage{
+			Index:  i,
+			Module: stage.spec.path,
+			Kind:   "run",
+		}
+		if stage.kind == stageKindTile {
+			entry.Kind = "image"
+		}
+		if i < len(chain.compileDurations) {
+			entry.CompileUS = chain.compileDurations[i].Microseconds()
+		}
+		if i < len(metrics.instantiationDurations) {
+			entry.InstantiateUS = metrics.instantiationDurations[i].Microseconds()
+		}
+		if i < len(metrics.moduleDurations) {
+			entry.RunUS = metrics.moduleDurations[i].Microseconds()
+		}
+		if i < len(metrics.memoryBytes) {
+			entry.MemoryBytes = metrics.memoryBytes[i]
+		}
+		if i < len(metrics.stageOutputs) && metrics.stageOutputs[i] != nil {
+			output := *metrics.stageOutputs[i]
+			file := fmt.Sprintf("stage-%d%s", i, traceFileExtension(output))
+			if err := os.WriteFile(filepath.Join(dir, file), output.bytes, 0o644); err != nil {
+				return fmt.Errorf("Error writing trace: %w", err)
+			}
+			data := newTraceData(output, file)
+			entry.Output = &data
+		}
+		if i == failedStage {
+			entry.Error = errors.Unwrap(stageErr).Error()
+		}
+		report.Stages[i] = entry
+	}
+	if runErr != nil {
+		report.Error = runErr.Error()
+	} else {
+		output := newTraceData(result.output, "")
+		report.Output = &output
+	}
 
-    const submitNode = document.createElement("button");
-    submitNode.type = "submit";
-    submitNode.textContent = "Continue";
-    container.appendChild(submitNode);
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error writing trace: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "trace.json"), append(body, '\n'), 0o644); err != nil {
+		return fmt.Errorf("Error writing trace: %w", err)
+	}
+	return nil
+}
 
-    container.addEventListener("submit", (event) => {
-      event.preventDefault();
-      try {
-        const inputLen = qipFormWriteInput(exportsObj, inputNode.value);
-        this._lastOutputLen = qipFormCallI32(exportsObj, "run", [inputLen]);
-        this._hasRun = true;
-        this._render();
-      } catch (err) {
-        this._renderFatal(err);
-      }
-    });
+// runReceipt records what a qip run executed: the digests of its input,
+// modules, and output, and everything else the output depends on, so qip
+// verify can replay it.
+type runReceipt struct {
+	Host  receiptHost `json:"host"`
+	Input traceData   `json:"input"`
+	// InputCharset is the charset input was transcoded from, when not UTF-8.
+	InputCharset string               `json:"input_charset,omitempty"`
+	Inputs       map[string]traceData `json:"inputs,omitempty"`
+	// NowUnixMS and Seed are what qip_v1.now_unix_ms and random_fill were
+	// given, kept when a stage was granted them.
+	NowUnixMS *int64         `json:"now_unix_ms,omitempty"`
+	Seed      uint64         `json:"seed,omitempty"`
+	Stages    []receiptStage `json:"stages"`
+	Output    traceData      `json:"output"`
+}
 
-    this.replaceChildren(container);
-    inputNode.focus();
-  }
+type receiptHost struct {
+	QIP    string `json:"qip"`
+	Wazero string `json:"wazero"`
+	Go     string `json:"go"`
+}
 
-  _renderFatal(err) {
-    const message = err instanceof Error ? err.message : String(err);
-    const pre = document.createElement("pre");
-    pre.textContent = "Form error: " + message;
-    this.replaceChildren(pre);
-  }
+type receiptStage struct {
+	Module   string            `json:"module"`
+	SHA256   string            `json:"sha256"`
+	Uniforms map[string]string `json:"uniforms,omitempty"`
+	Input    string            `json:"input,omitempty"`
+	Output   string            `json:"output,omitempty"`
+	Guard    bool              `json:"guard,omitempty"`
+	Grants   []string          `json:"grants,omitempty"`
 }
 
-if (!customElements.get("qip-form")) {
-  customElements.define("qip-form", QIPFormElement);
+// errReceiptMismatch is returned when qip verify finds a digest that differs
+// from its receipt.
+var errReceiptMismatch = errors.New("Receipt does not match")
+
+// hostVersion reports the versions of qip, wazero, and Go in this binary.
+func hostVersion() receiptHost {
+	host := receiptHost{QIP: "(devel)", Go: goruntime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return host
+	}
+	if info.Main.Version != "" {
+		host.QIP = info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/tetratelabs/wazero" {
+			host.Wazero = dep.Version
+		}
+	}
+	return host
 }
-`
 
-func devResponseContentType(sourceMIME string, recipesApplied bool, output contentData, body []byte) string {
-	if recipesApplied && sourceMIME == "text/markdown" {
-		return "text/html; charset=utf-8"
+// receipt describes a completed run of the chain on input, given in
+// inputCharset, producing output.
+func (chain *moduleChain) receipt(input traceData, inputCharset charset.Charset, output traceData) runReceipt {
+	receipt := runReceipt{
+		Host:   hostVersion(),
+		Input:  input,
+		Stages: make([]receiptStage, len(chain.stages)),
+		Output: output,
 	}
-	if output.encoding == dataEncodingRaw {
-		if isICOBytes(body) {
-			return "image/x-icon"
+	if inputCharset != charset.UTF8 {
+		receipt.InputCharset = string(inputCharset)
+	}
+	if len(chain.opts.inputs) > 0 {
+		receipt.Inputs = make(map[string]traceData, len(chain.opts.inputs))
+		for name, data := range chain.opts.inputs {
+			receipt.Inputs[name] = newTraceData(contentData{bytes: data, encoding: dataEncodingRaw}, "")
 		}
-		if isBMPBytes(body) {
-			return "image/bmp"
+	}
+	for i, stage := range chain.stages {
+		receipt.Stages[i] = receiptStage{
+			Module: stage.spec.path,
+			SHA256: stage.digest,
+			Input:  stage.spec.inputEncoding,
+			Output: stage.spec.outputEncoding,
+			Guard:  stage.spec.guard,
+		}
+		if len(stage.spec.uniforms) > 0 {
+			receipt.Stages[i].Uniforms = stage.spec.uniforms
+		}
+		for _, c := range stage.spec.grants {
+			receipt.Stages[i].Grants = append(receipt.Stages[i].Grants, string(c))
+			switch c {
+			case hostmodule.NowUnixMS:
+				now := chain.opts.now.UnixMilli()
+				receipt.NowUnixMS = &now
+			case hostmodule.RandomFill:
+				receipt.Seed = chain.opts.seed
+			}
 		}
 	}
-	if sourceMIME == "" {
-		return "application/octet-stream"
+	return receipt
+}
+
+func writeReceipt(path string, receipt runReceipt) error {
+	body, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error writing receipt: %w", err)
+	}
+	if err := os.WriteFile(path, append(body, '\n'), 0o644); err != nil {
+		return fmt.Errorf("Error writing receipt: %w", err)
+	}
+	return nil
+}
+
+func readReceipt(path string) (runReceipt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return runReceipt{}, fmt.Errorf("Error reading receipt: %w", err)
+	}
+	var receipt runReceipt
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&receipt); err != nil {
+		return runReceipt{}, fmt.Errorf("Invalid receipt %s: %v", path, err)
+	}
+	if len(receipt.Stages) == 0 {
+		return runReceipt{}, fmt.Errorf("Invalid receipt %s: no stages", path)
+	}
+	if _, err := charset.Parse(receipt.InputCharset); err != nil {
+		return runReceipt{}, fmt.Errorf("Invalid receipt %s: %v", path, err)
 	}
-	if strings.HasPrefix(sourceMIME, "text/") {
-		return sourceMIME + "; charset=utf-8"
+	for i, stage := range receipt.Stages {
+		if stage.Module == "" {
+			return runReceipt{}, fmt.Errorf("Invalid receipt %s: stage %d: module is required", path, i)
+		}
 	}
-	return sourceMIME
+	return receipt, nil
 }
 
-type chainMetrics struct {
-	moduleDurations        []time.Duration
-	instantiationDurations []time.Duration
+// digestWriter hashes and counts the bytes written to it, for digests of
+// streamed input and output.
+type digestWriter struct {
+	hash hash.Hash
+	size int
 }
 
-type chainResult struct {
-	output  contentData
-	metrics chainMetrics
+func newDigestWriter() *digestWriter {
+	return &digestWriter{hash: sha256.New()}
 }
 
-type stageKind uint8
-
-const (
-	stageKindRun stageKind = iota
-	stageKindTile
-)
+func (w *digestWriter) Write(p []byte) (int, error) {
+	w.size += len(p)
+	return w.hash.Write(p)
+}
 
-type moduleStage struct {
-	compiled wazero.CompiledModule
-	kind     stageKind
+func (w *digestWriter) data(encoding dataEncoding, contentType string) traceData {
+	return traceData{
+		Encoding:    contractEncodingName(encoding),
+		ContentType: contentType,
+		Size:        w.size,
+		SHA256:      hex.EncodeToString(w.hash.Sum(nil)),
+	}
 }
 
-type moduleChain struct {
-	runtime          wazero.Runtime
-	stages           []moduleStage
-	opts             options
-	compileDurations []time.Duration
+// receiptCheck is one digest compared by qip verify.
+type receiptCheck struct {
+	name   string
+	ok     bool
+	detail string
 }
 
-func buildModuleChain(ctx context.Context, modules []string, opts options) (*moduleChain, error) {
-	if len(modules) == 0 {
-		return &moduleChain{opts: opts}, nil
+func checkDigest(name string, got string, want string) receiptCheck {
+	if got == want {
+		return receiptCheck{name: name, ok: true}
 	}
+	return receiptCheck{name: name, detail: fmt.Sprintf("sha256 is %s, receipt has %s", got, want)}
+}
 
-	runtime := wasmruntime.New(ctx)
-	stages := make([]moduleStage, len(modules))
-	compileDurations := make([]time.Duration, len(modules))
-
-	for i, modulePath := range modules {
-		body, err := readModulePath(modulePath, opts)
-		if err != nil {
-			_ = runtime.Close(ctx)
-			return nil, err
-		}
-		start := time.Now()
-		cm, err := runtime.CompileModule(ctx, body)
-		compileDurations[i] = time.Since(start)
-		if err != nil {
-			_ = runtime.Close(ctx)
-			return nil, errors.New("Wasm module could not be compiled")
-		}
-		kind := stageKindRun
-		if _, ok := cm.ExportedFunctions()["tile_rgba_f32_64x64"]; ok {
-			kind = stageKindTile
-		}
-		stages[i] = moduleStage{
-			compiled: cm,
-			kind:     kind,
-		}
-		if opts.verbose {
-			vlogf(opts, "compiled module[%d] in %dms", i, compileDurations[i].Milliseconds())
+// verifyReceipt re-runs the chain recorded in receipt on input and compares
+// every digest. Modules are loaded whatever their digest so that each
+// mismatch is reported rather than only the first.
+func verifyReceipt(ctx context.Context, receipt runReceipt, input []byte, opts options) ([]receiptCheck, error) {
+	inputData := newTraceData(contentData{bytes: input, encoding: dataEncodingRaw}, "")
+	checks := []receiptCheck{checkDigest("input", inputData.SHA256, receipt.Input.SHA256)}
+	for _, name := range slices.Sorted(maps.Keys(receipt.Inputs)) {
+		data, ok := opts.inputs[name]
+		if !ok {
+			return nil, fmt.Errorf("Receipt has input %q; give it with -i %s=<path>", name, name)
 		}
+		got := newTraceData(contentData{bytes: data, encoding: dataEncodingRaw}, "")
+		checks = append(checks, checkDigest("input "+name, got.SHA256, receipt.Inputs[name].SHA256))
 	}
 
-	seenTile := false
-	seenRunAfterTile := false
-	for i, stage := range stages {
-		if stage.kind == stageKindTile {
-			if seenRunAfterTile {
-				_ = runtime.Close(ctx)
-				return nil, fmt.Errorf("Image stages must be contiguous to compose (module %d)", i)
-			}
-			seenTile = true
-			continue
+	specs := make([]moduleSpec, len(receipt.Stages))
+	for i, stage := range receipt.Stages {
+		specs[i] = moduleSpec{
+			path:           stage.Module,
+			uniforms:       stage.Uniforms,
+			inputEncoding:  stage.Input,
+			outputEncoding: stage.Output,
+			guard:          stage.Guard,
 		}
-		if seenTile {
-			seenRunAfterTile = true
+		if len(stage.Grants) > 0 {
+			grants, err := hostmodule.ParseCapabilities(strings.Join(stage.Grants, ","))
+			if err != nil {
+				return nil, fmt.Errorf("Receipt stage %d: %w", i, err)
+			}
+			specs[i].grants = grants
 		}
 	}
+	opts.now = time.Now()
+	if receipt.NowUnixMS != nil {
+		opts.now = time.UnixMilli(*receipt.NowUnixMS)
+	}
+	opts.seed = receipt.Seed
+	chain, err := buildModuleChainFromSpecs(ctx, specs, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer chain.Close(context.Background())
+	for i, stage := range chain.stages {
+		checks = append(checks, checkDigest(fmt.Sprintf("stage %d (%s)", i, stage.spec.path), stage.digest, receipt.Stages[i].SHA256))
+	}
 
-	return &moduleChain{
-		runtime:          runtime,
-		stages:           stages,
-		opts:             opts,
-		compileDurations: compileDurations,
-	}, nil
+	inputCharset, _ := charset.Parse(receipt.InputCharset)
+	input, err = charset.Decode(input, inputCharset)
+	if err != nil {
+		return nil, err
+	}
+	result, err := chain.run(ctx, input, 0)
+	if err != nil {
+		return nil, err
+	}
+	output := newTraceData(result.output, "")
+	check := checkDigest("output", output.SHA256, receipt.Output.SHA256)
+	if check.ok && output.Encoding != receipt.Output.Encoding {
+		check = receiptCheck{name: "output", detail: fmt.Sprintf("encoding is %s, receipt has %s", output.Encoding, receipt.Output.Encoding)}
+	}
+	return append(checks, check), nil
 }
 
-func (chain *moduleChain) Close(ctx context.Context) {
-	for _, stage := range chain.stages {
-		_ = stage.compiled.Close(ctx)
+// verifyCmd re-executes a receipt's chain and checks its digests.
+func verifyCmd(args []string) {
+	opts := options{}
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var verifyVerbose bool
+	var inputs runInputFlag
+	fs.BoolVar(&verifyVerbose, "v", false, "enable verbose logging")
+	fs.BoolVar(&verifyVerbose, "verbose", false, "enable verbose logging")
+	fs.Var(&inputs, "i", "input file path, or name=path for a named input (repeatable)")
+	policyFlags := registerPolicyFlags(fs, 100)
+	sourceFlags := modulesource.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		gameOver("%s %v", usageVerify, err)
 	}
-	if chain.runtime != nil {
-		_ = chain.runtime.Close(ctx)
+	// The receipt usually comes first, so parse the flags after it too.
+	if fs.NArg() == 0 {
+		gameOver(usageVerify)
+	}
+	receiptPath := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		gameOver("%s %v", usageVerify, err)
+	}
+	if fs.NArg() > 0 || len(inputs.paths) > 1 {
+		gameOver(usageVerify)
+	}
+	opts.verbose = verifyVerbose
+	policy, err := policyFlags.resolve(fs)
+	if err != nil {
+		gameOver("%v", err)
+	}
+	moduleResolver, err := sourceFlags.Resolver()
+	if err != nil {
+		gameOver("%v", err)
+	}
+	opts.policy = policy
+	opts.modules = moduleResolver
+	opts.inputs, err = inputs.read()
+	if err != nil {
+		gameOver("%v", err)
 	}
-}
 
-func (chain *moduleChain) run(ctx context.Context, input []byte, requestID uint64) (chainResult, error) {
-	if len(chain.stages) == 0 {
-		return chainResult{
-			output: contentData{bytes: input, encoding: dataEncodingRaw},
-			metrics: chainMetrics{
-				moduleDurations:        []time.Duration{},
-				instantiationDurations: []time.Duration{},
-			},
-		}, nil
+	receipt, err := readReceipt(receiptPath)
+	if err != nil {
+		gameOver("%v", err)
+	}
+	inputReader, err := openRunInput(inputs.paths.single())
+	if err != nil {
+		gameOver("%v", err)
+	}
+	input, err := io.ReadAll(inputReader)
+	inputReader.Close()
+	if err != nil {
+		gameOver("Error reading input: %v", err)
 	}
 
-	moduleDurations := make([]time.Duration, len(chain.stages))
-	instantiationDurations := make([]time.Duration, len(chain.stages))
-	var output contentData
-	cur := input
+	checks, err := verifyReceipt(context.Background(), receipt, input, opts)
+	if err != nil {
+		gameOver("%v", err)
+	}
+	failed := 0
+	for _, check := range checks {
+		if check.ok {
+			fmt.Printf("  ok        %s\n", check.name)
+			continue
+		}
+		failed++
+		fmt.Printf("  mismatch  %s: %s\n", check.name, check.detail)
+	}
+	if host := hostVersion(); host != receipt.Host {
+		fmt.Printf("  note      receipt was made by qip %s (wazero %s, %s); this is qip %s (wazero %s, %s)\n",
+			receipt.Host.QIP, receipt.Host.Wazero, receipt.Host.Go, host.QIP, host.Wazero, host.Go)
+	}
+	if failed > 0 {
+		gameOver("%v", fmt.Errorf("%w: %d of %d digests differ", errReceiptMismatch, failed, len(checks)))
+	}
+	fmt.Printf("verify: %s matches\n", receiptPath)
+}
 
-	tileStart := -1
-	tileEnd := -1
-	for i, stage := range chain.stages {
+// streaming reports whether the chain should pipe input through its stages
+// chunk by chunk rather than buffering whole byte slices between stages.
+func (chain *moduleChain) streaming() bool {
+	anyChunked := false
+	for _, stage := range chain.stages {
 		if stage.kind == stageKindTile {
-			if tileStart == -1 {
-				tileStart = i
-			}
-			tileEnd = i
+			return false
+		}
+		if stage.chunked {
+			anyChunked = true
 		}
 	}
+	return anyChunked
+}
 
-	runRunStages := func(start, end int, inputBytes []byte) (contentData, []byte, error) {
-		curBytes := inputBytes
-		var localOutput contentData
-		for i := start; i < end; i++ {
-			stage := chain.stages[i]
-			moduleName := fmt.Sprintf("req-%d-%d", requestID, i)
-			runStart := time.Now()
-			nextOutput, instDur, err := runModuleWithInput(ctx, chain.runtime, stage.compiled, curBytes, chain.opts, moduleName)
-			moduleDurations[i] = time.Since(runStart)
-			instantiationDurations[i] = instDur
-			if err != nil {
-				return localOutput, curBytes, err
+// streamStage is one stage of a streaming chain. Chunked stages keep a live
+// instance that is fed window by window; other run stages buffer their input
+// and run once it has all arrived.
+type streamStage struct {
+	// ctx is the context for calls into the stage, carrying its host
+	// function state across calls.
+	ctx      context.Context
+	mod      api.Module
+	exports  runExports
+	buffered []byte
+	// bufferedEncoding is the encoding of buffered, passed on when the
+	// stage is a guard that accepts its input.
+	bufferedEncoding dataEncoding
+	received         uint64
+	emitted          uint64
+	// inputText and outputText validate UTF-8 across chunks.
+	inputText  *utf8Checker
+	outputText *utf8Checker
+}
+
+// runStream reads input incrementally and pipes it from stage to stage,
+// passing the final stage's output to emit as soon as it is produced.
+// Each wasm call gets the policy's stage timeout. It returns the output
+// encoding and content type of the final stage, without bytes.
+func (chain *moduleChain) runStream(ctx context.Context, input io.Reader, requestID uint64, emit func(contentData) error) (contentData, error) {
+	policy := chain.opts.policy
+	stages := make([]streamStage, len(chain.stages))
+	now := chain.now()
+	for i := range stages {
+		stages[i].ctx = chain.hostContext(ctx, i, requestID, now)
+	}
+	defer func() {
+		for _, stage := range stages {
+			if stage.mod != nil {
+				_ = stage.mod.Close(ctx)
 			}
-			localOutput = nextOutput
-			curBytes = nextOutput.bytes
 		}
-		return localOutput, curBytes, nil
-	}
-
-	if tileStart == -1 {
-		out, curBytes, err := runRunStages(0, len(chain.stages), cur)
+	}()
+	for i, stage := range chain.stages {
+		// Guards decide only once they have seen all of their input.
+		if !stage.chunked || stage.spec.guard {
+			continue
+		}
+		_, endSpan := tracing.Start(ctx, "instantiate", tracing.Int("stage", i), tracing.String("module", stage.spec.path))
+		mod, err := chain.runtime.InstantiateModule(stages[i].ctx, stage.compiled, wazero.NewModuleConfig().WithName(fmt.Sprintf("req-%d-%d", requestID, i)))
+		endSpan()
 		if err != nil {
-			return chainResult{
-				output: out,
-				metrics: chainMetrics{
-					moduleDurations:        moduleDurations,
-					instantiationDurations: instantiationDurations,
-				},
-			}, err
+			return contentData{}, stageFailed(i, stage.spec.path, wasmruntime.Errorf(wasmruntime.KindCompile, "Wasm module could not be instantiated"))
+		}
+		stages[i].mod = mod
+		callCtx, cancel := policy.stageContext(stages[i].ctx, stage.spec)
+		exports, err := resolveRunExports(callCtx, mod)
+		cancel()
+		if err == nil {
+			callCtx, cancel = policy.stageContext(stages[i].ctx, stage.spec)
+			err = applyUniforms(callCtx, mod, stage.spec.uniforms)
+			if err == nil {
+				err = exports.writeNamedInputs(callCtx, chain.opts)
+			}
+			cancel()
 		}
-		output = out
-		cur = curBytes
-	} else {
-		if tileStart > 0 {
-			out, curBytes, err := runRunStages(0, tileStart, cur)
-			if err != nil {
-				return chainResult{
-					output: out,
-					metrics: chainMetrics{
-						moduleDurations:        moduleDurations,
-						instantiationDurations: instantiationDurations,
-					},
-				}, err
+		if err != nil {
+			return contentData{}, stageFailed(i, stage.spec.path, err)
+		}
+		exports.callTimeout = policy.timeoutFor(stage.spec)
+		stages[i].exports = exports
+		stages[i].inputText = newUTF8Checker(exports.inputEncoding, "Input")
+		stages[i].outputText = newUTF8Checker(exports.outputEncoding, "Output")
+	}
+
+	final := contentData{encoding: dataEncodingRaw}
+	var push func(i int, data contentData) error
+	// forward passes chunked stage i's output on to the next stage, holding
+	// the total across all of its calls to the policy's output limit.
+	forward := func(i int) func([]byte) error {
+		stage := &stages[i]
+		return func(chunk []byte) error {
+			stage.emitted += uint64(len(chunk))
+			if err := policy.checkOutputSize(stage.emitted); err != nil {
+				return err
 			}
-			output = out
-			cur = curBytes
-			if output.encoding != dataEncodingRaw {
-				return chainResult{
-					output: output,
-					metrics: chainMetrics{
-						moduleDurations:        moduleDurations,
-						instantiationDurations: instantiationDurations,
-					},
-				}, errors.New("Image stage requires raw BMP bytes as input")
+			if err := stage.outputText.check(chunk); err != nil {
+				return err
 			}
-		} else {
-			output = contentData{bytes: cur, encoding: dataEncodingRaw}
+			return push(i+1, contentData{bytes: chunk, encoding: stage.exports.outputEncoding})
 		}
-
-		inputRGBA, err := decodeBMP(cur)
-		if err != nil {
-			return chainResult{
-				output: output,
-				metrics: chainMetrics{
-					moduleDurations:        moduleDurations,
-					instantiationDurations: instantiationDurations,
-				},
-			}, err
+	}
+	push = func(i int, data contentData) error {
+		if i == len(stages) {
+			final = contentData{encoding: data.encoding, contentType: data.contentType}
+			if len(data.bytes) == 0 {
+				return nil
+			}
+			return emit(data)
 		}
-		tileCompiled := make([]wazero.CompiledModule, tileEnd-tileStart+1)
-		for i := tileStart; i <= tileEnd; i++ {
-			tileCompiled[i-tileStart] = chain.stages[i].compiled
+		stage := &stages[i]
+		stage.received += uint64(len(data.bytes))
+		if err := policy.checkInputSize(stage.received); err != nil {
+			return stageFailed(i, chain.stages[i].spec.path, err)
 		}
-		moduleNamePrefix := fmt.Sprintf("req-%d", requestID)
-		tileOutput, instDurs, stageDurs, err := runTileStagesCompiled(ctx, chain.runtime, tileCompiled, inputRGBA, moduleNamePrefix, tileStart)
-		for i := range instDurs {
-			instantiationDurations[tileStart+i] = instDurs[i]
+		if stage.mod == nil {
+			stage.buffered = append(stage.buffered, data.bytes...)
+			stage.bufferedEncoding = data.encoding
+			return nil
 		}
-		for i := range stageDurs {
-			moduleDurations[tileStart+i] = stageDurs[i]
+		if err := stage.inputText.check(data.bytes); err != nil {
+			return stageFailed(i, chain.stages[i].spec.path, err)
 		}
-		if err != nil {
-			return chainResult{
-				output: output,
-				metrics: chainMetrics{
-					moduleDurations:        moduleDurations,
-					instantiationDurations: instantiationDurations,
-				},
-			}, err
+		return stageFailed(i, chain.stages[i].spec.path, stage.exports.feedChunks(stage.ctx, data.bytes, forward(i)))
+	}
+
+	readSize := 64 * 1024
+	if first := stages[0]; first.mod != nil && first.exports.inputCap < uint64(readSize) {
+		readSize = int(first.exports.inputCap)
+	}
+	buf := make([]byte, readSize)
+	for {
+		n, err := input.Read(buf)
+		if n > 0 {
+			// Stages may retain buffered input, so never hand them the read buffer.
+			chunk := append([]byte(nil), buf[:n]...)
+			if err := push(0, contentData{bytes: chunk, encoding: dataEncodingRaw}); err != nil {
+				return final, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
 		}
-		bmpBytes, err := encodeBMP(tileOutput)
 		if err != nil {
-			return chainResult{
-				output: output,
-				metrics: chainMetrics{
-					moduleDurations:        moduleDurations,
-					instantiationDurations: instantiationDurations,
-				},
-			}, err
+			return final, fmt.Errorf("Error reading input: %w", err)
 		}
-		output = contentData{bytes: bmpBytes, encoding: dataEncodingRaw}
-		cur = bmpBytes
+	}
 
-		if tileEnd+1 < len(chain.stages) {
-			out, curBytes, err := runRunStages(tileEnd+1, len(chain.stages), cur)
-			if err != nil {
-				return chainResult{
-					output: out,
-					metrics: chainMetrics{
-						moduleDurations:        moduleDurations,
-						instantiationDurations: instantiationDurations,
-					},
-				}, err
+	for i := range stages {
+		stage := &stages[i]
+		var output contentData
+		var err error
+		if stage.mod != nil {
+			output.encoding = stage.exports.outputEncoding
+			err = stage.inputText.finish()
+			if err == nil {
+				err = stage.exports.finish(stage.ctx, forward(i))
 			}
-			output = out
-			cur = curBytes
+			if err == nil {
+				err = stage.outputText.finish()
+			}
+			if err == nil && stage.emitted == 0 {
+				err = stage.exports.reportedError(stage.ctx)
+			}
+			if err == nil {
+				output.contentType, err = stage.exports.contentType(stage.ctx)
+			}
+		} else {
+			moduleName := fmt.Sprintf("req-%d-%d", requestID, i)
+			spec := chain.stages[i].spec
+			callCtx, cancel := policy.stageContext(stage.ctx, spec)
+			var exec moduleExecutionResult
+			exec, err = executeModuleWithInput(callCtx, chain.runtime, chain.stages[i].compiled, stage.buffered, spec.uniforms, chain.opts, moduleName)
+			cancel()
+			if spec.guard {
+				err = guardReason(err)
+			}
+			if err == nil {
+				output, err = chain.guard(i, exec, contentData{bytes: stage.buffered, encoding: stage.bufferedEncoding})
+			}
+			stage.buffered = nil
+		}
+		if err != nil {
+			return final, stageFailed(i, chain.stages[i].spec.path, err)
+		}
+		if err := push(i+1, output); err != nil {
+			return final, err
 		}
 	}
-
-	return chainResult{
-		output: output,
-		metrics: chainMetrics{
-			moduleDurations:        moduleDurations,
-			instantiationDurations: instantiationDurations,
-		},
-	}, nil
+	return final, nil
 }
 
-func formatOutputBytes(output contentData) ([]byte, error) {
-	switch output.encoding {
-	case dataEncodingRaw, dataEncodingUTF8:
+// formatOutputBytes renders output as a response body, with typed arrays
+// in format.
+func formatOutputBytes(output contentData, format outputFormat) ([]byte, error) {
+	if !output.encoding.typedArray() {
 		return output.bytes, nil
-	case dataEncodingArrayI32:
-		count := len(output.bytes) / 4
-		var buf bytes.Buffer
-		buf.Grow(count * 9)
-		for i := range count {
-			v := binary.LittleEndian.Uint32(output.bytes[i*4:])
-			fmt.Fprintf(&buf, "%08x\n", v)
-		}
-		return buf.Bytes(), nil
-	default:
-		return nil, errors.New("Unknown output encoding")
 	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := newRunOutputWriter(w, format).writeComplete(output); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func isBMPBytes(data []byte) bool {
@@ -3157,11 +7235,17 @@ func isICOBytes(data []byte) bool {
 func writeDevError(w http.ResponseWriter, err error) {
 	ts := time.Now().Format(time.RFC3339)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusInternalServerError)
+	status := http.StatusInternalServerError
+	if errors.Is(err, modulemeta.ErrInvalidUniform) {
+		// A query uniform the recipe's qip.meta does not allow.
+		status = http.StatusBadRequest
+	}
+	w.WriteHeader(status)
 	fmt.Fprintf(w, "<!doctype html><meta charset=\"utf-8\"><title>qip dev error</title><pre>%s\n%s</pre>", ts, html.EscapeString(err.Error()))
 }
 
-func formatDurationParts(total time.Duration, moduleDurations []time.Duration, instantiationDurations []time.Duration) string {
+func formatDurationParts(total time.Duration, metrics chainMetrics) string {
+	moduleDurations := metrics.moduleDurations
 	totalMs := total.Milliseconds()
 	if len(moduleDurations) == 0 {
 		return fmt.Sprintf("duration_ms=%d", totalMs)
@@ -3171,7 +7255,7 @@ func formatDurationParts(total time.Duration, moduleDurations []time.Duration, i
 	b.WriteString("duration_ms=")
 	b.WriteString(strconv.FormatInt(totalMs, 10))
 	b.WriteString(" instantiation_ms=")
-	b.WriteString(strconv.FormatInt(sumDurations(instantiationDurations), 10))
+	b.WriteString(strconv.FormatInt(sumDurations(metrics.instantiationDurations), 10))
 	b.WriteString(" module_durations_ms=[")
 	for i, part := range moduleDurations {
 		if i > 0 {
@@ -3180,6 +7264,9 @@ func formatDurationParts(total time.Duration, moduleDurations []time.Duration, i
 		b.WriteString(strconv.FormatInt(part.Milliseconds(), 10))
 	}
 	b.WriteByte(']')
+	if metrics.poolHits+metrics.poolMisses > 0 {
+		fmt.Fprintf(&b, " pool_hits=%d pool_misses=%d", metrics.poolHits, metrics.poolMisses)
+	}
 	return b.String()
 }
 
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/royalicing/qip/internal/charset"
+	"github.com/royalicing/qip/internal/hostmodule"
+	"github.com/royalicing/qip/internal/modulemeta"
+	"github.com/royalicing/qip/internal/wasmruntime"
+	"github.com/tetratelabs/wazero"
 )
 
 func TestParseRecipeFilename(t *testing.T) {
@@ -310,6 +324,66 @@ func TestLoadRecipeChainsRejectsInvalidFilename(t *testing.T) {
 	}
 }
 
+func TestLoadRecipeChainsAppliesUniforms(t *testing.T) {
+	root := t.TempDir()
+	recipeDir := filepath.Join(root, "text", "plain")
+	if err := os.MkdirAll(recipeDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	wasmBytes, err := os.ReadFile(filepath.Join("examples", "text-to-bmp.wasm"))
+	if err != nil {
+		t.Fatalf("read wasm fixture: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(recipeDir, "10-bmp.wasm"), wasmBytes, 0o644); err != nil {
+		t.Fatalf("write wasm: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(recipeDir, "10-bmp.uniforms"), []byte("# line spacing\nleading=12\n"), 0o644); err != nil {
+		t.Fatalf("write uniforms: %v", err)
+	}
+
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: time.Second}}
+	chains, _, err := loadRecipeChains(ctx, root, opts)
+	if err != nil {
+		t.Fatalf("loadRecipeChains error: %v", err)
+	}
+	defer closeModuleChains(ctx, chains)
+	chain := chains["text/plain"]
+
+	want, err := buildModuleChainFromSpecs(ctx, []moduleSpec{{path: "examples/text-to-bmp.wasm", uniforms: map[string]string{"leading": "12"}}}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChainFromSpecs error: %v", err)
+	}
+	defer want.Close(ctx)
+	input := []byte("a\nb")
+	got, err := chain.run(ctx, input, 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	wantResult, err := want.run(ctx, input, 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if !bytes.Equal(got.output.bytes, wantResult.output.bytes) {
+		t.Fatal("sidecar uniforms were not applied")
+	}
+
+	overrides, _ := recipeQueryUniforms(chain, url.Values{"bmp.leading": {"2"}, "v": {"3"}})
+	if len(overrides) != 1 || len(overrides[0]) != 1 || overrides[0]["leading"] != "2" {
+		t.Fatalf("overrides=%v", overrides)
+	}
+	if overrides, _ := recipeQueryUniforms(chain, url.Values{"v": {"3"}}); overrides != nil {
+		t.Fatalf("unrelated query produced overrides=%v", overrides)
+	}
+	overridden, err := chain.runWithUniforms(ctx, input, 1, overrides)
+	if err != nil {
+		t.Fatalf("runWithUniforms error: %v", err)
+	}
+	if bytes.Equal(overridden.output.bytes, got.output.bytes) {
+		t.Fatal("query uniforms did not override the sidecar")
+	}
+}
+
 func TestLoadRecipeChainsRejectsDuplicatePrefix(t *testing.T) {
 	root := t.TempDir()
 	recipeDir := filepath.Join(root, "text", "markdown")
@@ -333,16 +407,16 @@ func TestLoadRecipeChainsRejectsDuplicatePrefix(t *testing.T) {
 	}
 }
 
-func TestParseImageModuleSpecs(t *testing.T) {
+func TestParseModuleSpecs(t *testing.T) {
 	t.Run("module with query", func(t *testing.T) {
-		specs, err := parseImageModuleSpecs([]string{
+		specs, err := parseModuleSpecs([]string{
 			"examples/rgba/color-halftone.wasm",
 			"?max_radius=2.0",
 			"examples/rgba/brightness.wasm",
 			"?brightness=0.2",
 		})
 		if err != nil {
-			t.Fatalf("parseImageModuleSpecs error: %v", err)
+			t.Fatalf("parseModuleSpecs error: %v", err)
 		}
 		if len(specs) != 2 {
 			t.Fatalf("spec count=%d, want 2", len(specs))
@@ -362,13 +436,13 @@ func TestParseImageModuleSpecs(t *testing.T) {
 	})
 
 	t.Run("query before module is error", func(t *testing.T) {
-		if _, err := parseImageModuleSpecs([]string{"?max_radius=2.0"}); err == nil {
+		if _, err := parseModuleSpecs([]string{"?max_radius=2.0"}); err == nil {
 			t.Fatal("expected error for query before module")
 		}
 	})
 
 	t.Run("empty query is error", func(t *testing.T) {
-		if _, err := parseImageModuleSpecs([]string{"examples/rgba/brightness.wasm", "?"}); err == nil {
+		if _, err := parseModuleSpecs([]string{"examples/rgba/brightness.wasm", "?"}); err == nil {
 			t.Fatal("expected error for empty query")
 		}
 	})
@@ -468,3 +542,1015 @@ func TestInjectQIPFormRuntimeMissingModule(t *testing.T) {
 		t.Fatal("expected error for missing form module")
 	}
 }
+
+func TestChunkedModuleAcceptsInputLargerThanWindow(t *testing.T) {
+	ctx := context.Background()
+	chain, err := buildModuleChain(ctx, []string{
+		"examples/ascii-uppercase-chunked.wasm",
+		"examples/ascii-uppercase-chunked.wasm",
+	}, options{policy: resourcePolicy{stageTimeout: time.Second}})
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	t.Cleanup(func() {
+		chain.Close(ctx)
+	})
+	if !chain.streaming() {
+		t.Fatal("expected chain of chunked modules to stream")
+	}
+
+	// Larger than the module's 64 KiB input window.
+	input := bytes.Repeat([]byte("qip + wasm\n"), 20000)
+	want := bytes.ToUpper(input)
+
+	t.Run("stream", func(t *testing.T) {
+		var out bytes.Buffer
+		final, err := chain.runStream(ctx, bytes.NewReader(input), 0, func(output contentData) error {
+			out.Write(output.bytes)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("runStream error: %v", err)
+		}
+		if final.encoding != dataEncodingUTF8 {
+			t.Fatalf("encoding=%s, want utf8", encodingName(final.encoding))
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Fatalf("streamed output mismatch (len=%d, want %d)", out.Len(), len(want))
+		}
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		result, err := chain.run(ctx, input, 1)
+		if err != nil {
+			t.Fatalf("run error: %v", err)
+		}
+		if !bytes.Equal(result.output.bytes, want) {
+			t.Fatalf("buffered output mismatch (len=%d, want %d)", len(result.output.bytes), len(want))
+		}
+	})
+}
+
+func TestOutputMoreDrainsOutputBeyondCapacity(t *testing.T) {
+	ctx := context.Background()
+	chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm"}, options{})
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	t.Cleanup(func() {
+		chain.Close(ctx)
+	})
+
+	// Hex output is twice the input, which exceeds the 64 KiB output cap.
+	input := bytes.Repeat([]byte{0x00, 0x7f, 0xff}, 20000)
+	result, err := chain.run(ctx, input, 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if got, want := string(result.output.bytes), hex.EncodeToString(input); got != want {
+		t.Fatalf("output len=%d, want len=%d", len(got), len(want))
+	}
+}
+
+func TestChainReusesPooledInstances(t *testing.T) {
+	ctx := context.Background()
+	chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm", "examples/hex-encode.wasm"}, options{policy: resourcePolicy{stageTimeout: time.Second}, reuseInstances: true})
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	t.Cleanup(func() {
+		chain.Close(ctx)
+	})
+
+	for i, input := range []string{"hello", "hi"} {
+		result, err := chain.run(ctx, []byte(input), uint64(i))
+		if err != nil {
+			t.Fatalf("run %d error: %v", i, err)
+		}
+		want := hex.EncodeToString([]byte(hex.EncodeToString([]byte(input))))
+		if got := string(result.output.bytes); got != want {
+			t.Fatalf("run %d output=%q, want %q", i, got, want)
+		}
+		wantHits, wantMisses := 0, 2
+		if i > 0 {
+			wantHits, wantMisses = 2, 0
+		}
+		if result.metrics.poolHits != wantHits || result.metrics.poolMisses != wantMisses {
+			t.Fatalf("run %d pool_hits=%d pool_misses=%d, want %d and %d", i, result.metrics.poolHits, result.metrics.poolMisses, wantHits, wantMisses)
+		}
+	}
+}
+
+func TestGuardStagePassesOrRejectsInput(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: time.Second}}
+	chain, err := buildModuleChain(ctx, []string{"examples/ascii-only.wasm", "examples/hex-encode.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	t.Cleanup(func() {
+		chain.Close(ctx)
+	})
+
+	result, err := chain.run(ctx, []byte("abc"), 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if got := string(result.output.bytes); got != "616263" {
+		t.Fatalf("output=%q, want the guard's input hex encoded", got)
+	}
+
+	_, err = chain.run(ctx, []byte("ab\xc3\xa7"), 1)
+	var failed *stageError
+	if !errors.Is(err, errGuardRejected) || !errors.As(err, &failed) || failed.stage != 0 {
+		t.Fatalf("expected stage 0 to reject, got: %v", err)
+	}
+	if code := exitCodeFor(err); code != exitCodeGuardRejected {
+		t.Fatalf("exit code=%d, want %d", code, exitCodeGuardRejected)
+	}
+
+	last, err := buildModuleChain(ctx, []string{"examples/ascii-only.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer last.Close(ctx)
+	result, err = last.run(ctx, []byte("ab\xc3\xa7"), 0)
+	if err != nil || string(result.output.bytes) != "Ran: 0\n" {
+		t.Fatalf("final scalar stage output=%q err=%v, want Ran: 0", result.output.bytes, err)
+	}
+}
+
+func TestModuleReportsErrorMessage(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: time.Second}}
+	chain, err := buildModuleChain(ctx, []string{"examples/digits-only.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+
+	if result, err := chain.run(ctx, []byte("123"), 0); err != nil || string(result.output.bytes) != "123" {
+		t.Fatalf("output=%q err=%v, want 123", result.output.bytes, err)
+	}
+	_, err = chain.run(ctx, []byte("1a3"), 1)
+	want := "Stage 0 (examples/digits-only.wasm): Module error: Input must contain only the digits 0-9"
+	if err == nil || err.Error() != want {
+		t.Fatalf("error=%v, want %q", err, want)
+	}
+	if code := exitCodeFor(err); code != exitCodeModule {
+		t.Fatalf("exit code=%d, want %d", code, exitCodeModule)
+	}
+
+	guarded, err := buildModuleChainFromSpecs(ctx, []moduleSpec{{path: "examples/digits-only.wasm", guard: true}, {path: "examples/hex-encode.wasm"}}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChainFromSpecs error: %v", err)
+	}
+	defer guarded.Close(ctx)
+	_, err = guarded.run(ctx, []byte("1a3"), 2)
+	if !errors.Is(err, errGuardRejected) || !strings.Contains(err.Error(), "only the digits") {
+		t.Fatalf("expected guard rejection with the module's message, got: %v", err)
+	}
+}
+
+func TestRunOutputWriterFormats(t *testing.T) {
+	i32s := contentData{bytes: []byte{0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00}, encoding: dataEncodingArrayI32}
+	f64s := contentData{bytes: []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f, 0, 0, 0, 0, 0, 0, 0xf8, 0x7f}, encoding: dataEncodingArrayF64}
+	cases := []struct {
+		format outputFormat
+		output contentData
+		want   string
+	}{
+		{outputFormatDefault, i32s, "ffffffff\n00000002\n"},
+		{outputFormatDec, i32s, "-1\n2\n"},
+		{outputFormatDefault, f64s, "1.5\nNaN\n"},
+		{outputFormatHex, f64s, "3ff8000000000000\n7ff8000000000000\n"},
+		{outputFormatJSON, f64s, "[1.5,null]"},
+		{outputFormatCSV, i32s, "-1,2"},
+		{outputFormatRaw, i32s, string(i32s.bytes)},
+		{outputFormatJSON, contentData{encoding: dataEncodingArrayU8}, "[]"},
+		{outputFormatJSON, contentData{bytes: []byte("text"), encoding: dataEncodingUTF8}, "text"},
+	}
+	for _, tc := range cases {
+		body, err := formatOutputBytes(tc.output, tc.format)
+		if err != nil {
+			t.Fatalf("format %q error: %v", tc.format, err)
+		}
+		if string(body) != tc.want {
+			t.Fatalf("format %q of %s = %q, want %q", tc.format, encodingName(tc.output.encoding), body, tc.want)
+		}
+	}
+
+	// Streamed output arrives in several writes but forms one JSON array.
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	out := newRunOutputWriter(w, outputFormatJSON)
+	for _, chunk := range [][]byte{i32s.bytes[:4], i32s.bytes[4:]} {
+		if err := out.write(contentData{bytes: chunk, encoding: dataEncodingArrayI32}); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	if err := out.end(dataEncodingArrayI32); err != nil {
+		t.Fatalf("end error: %v", err)
+	}
+	w.Flush()
+	if got := buf.String(); got != "[-1,2]" {
+		t.Fatalf("streamed JSON = %q, want [-1,2]", got)
+	}
+
+	if !acceptsJSON("text/html, application/json;q=0.9") || acceptsJSON("text/html, */*") || acceptsJSON("application/json; q=0") {
+		t.Fatal("acceptsJSON did not match Accept headers")
+	}
+}
+
+func TestNamedInputsBindToDeclaringStages(t *testing.T) {
+	var inputs runInputFlag
+	for _, value := range []string{"template=fixtures/greeting-template.txt", "./a=b.txt", "Data=x"} {
+		if err := inputs.Set(value); err != nil {
+			t.Fatalf("Set(%q) error: %v", value, err)
+		}
+	}
+	if !reflect.DeepEqual([]string(inputs.paths), []string{"./a=b.txt", "Data=x"}) || !reflect.DeepEqual(inputs.named, map[string]string{"template": "fixtures/greeting-template.txt"}) {
+		t.Fatalf("paths=%q named=%v", inputs.paths, inputs.named)
+	}
+	if err := inputs.Set("template=other.txt"); err == nil {
+		t.Fatal("expected error for repeated named input")
+	}
+
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: time.Second}}
+	opts.inputs, _ = inputs.read()
+	chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm", "examples/template-fill.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+	result, err := chain.run(ctx, []byte("qip"), 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if got := string(result.output.bytes); got != "Hello, 716970!\n" {
+		t.Fatalf("output=%q", got)
+	}
+
+	if _, err := buildModuleChain(ctx, []string{"examples/template-fill.wasm"}, options{}); err == nil || !strings.Contains(err.Error(), `Input "template" is not bound`) {
+		t.Fatalf("expected unbound input error, got: %v", err)
+	}
+	opts.inputs["other"] = nil
+	if _, err := buildModuleChain(ctx, []string{"examples/template-fill.wasm"}, opts); err == nil || !strings.Contains(err.Error(), `No stage declares input "other"`) {
+		t.Fatalf("expected undeclared input error, got: %v", err)
+	}
+}
+
+func TestModuleDeclaresContentType(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: time.Second}}
+	chain, err := buildModuleChain(ctx, []string{"examples/text-to-svg.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+	result, err := chain.run(ctx, []byte("a<b"), 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if result.output.contentType != "image/svg+xml" {
+		t.Fatalf("contentType=%q", result.output.contentType)
+	}
+	if !strings.Contains(string(result.output.bytes), ">a&lt;b</text>") {
+		t.Fatalf("output=%q", result.output.bytes)
+	}
+	if got := devResponseContentType("text/plain", false, result.output, "", result.output.bytes); got != "image/svg+xml" {
+		t.Fatalf("devResponseContentType=%q", got)
+	}
+
+	for contentType, want := range map[string]string{
+		"image/svg+xml":            ".svg",
+		"text/html; charset=utf-8": ".html",
+		"image/bmp":                ".bmp",
+		"not a type":               "",
+	} {
+		if got := extensionForContentType(contentType); got != want {
+			t.Fatalf("extensionForContentType(%q)=%q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestResourcePolicyFlagsOverrideFile(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policyPath, []byte(`{"max_memory_pages": 16, "timeout_ms": 500, "max_output_bytes": 1024}`), 0o644); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	policyFlags := registerPolicyFlags(fs, 100)
+	if err := fs.Parse([]string{"--policy", policyPath, "--timeout-ms", "50", "--max-input-bytes", "64"}); err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	got, err := policyFlags.resolve(fs)
+	if err != nil {
+		t.Fatalf("resolve error: %v", err)
+	}
+	want := resourcePolicy{
+		maxMemoryPages: 16,
+		stageTimeout:   50 * time.Millisecond,
+		maxOutputBytes: 1024,
+		maxInputBytes:  64,
+	}
+	if got != want {
+		t.Fatalf("policy=%+v, want %+v", got, want)
+	}
+
+	for name, data := range map[string]string{
+		"unknown key":      `{"timeout": 500}`,
+		"trailing content": `{"timeout_ms": 5}{"timeout_ms": 9999}`,
+	} {
+		if err := os.WriteFile(policyPath, []byte(data), 0o644); err != nil {
+			t.Fatalf("write policy: %v", err)
+		}
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		policyFlags = registerPolicyFlags(fs, 100)
+		if err := fs.Parse([]string{"--policy", policyPath}); err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		if _, err := policyFlags.resolve(fs); err == nil {
+			t.Fatalf("expected error for policy with %s", name)
+		}
+	}
+}
+
+func TestResourcePolicyLimitsStages(t *testing.T) {
+	ctx := context.Background()
+	input := []byte("qip")
+
+	t.Run("output", func(t *testing.T) {
+		chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm"}, options{policy: resourcePolicy{stageTimeout: time.Second, maxOutputBytes: 4}})
+		if err != nil {
+			t.Fatalf("buildModuleChain error: %v", err)
+		}
+		t.Cleanup(func() {
+			chain.Close(ctx)
+		})
+		if _, err := chain.run(ctx, input, 0); err == nil || !strings.Contains(err.Error(), "max_output_bytes") {
+			t.Fatalf("expected output limit error, got: %v", err)
+		}
+	})
+
+	t.Run("input", func(t *testing.T) {
+		chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm"}, options{policy: resourcePolicy{stageTimeout: time.Second, maxInputBytes: 2}})
+		if err != nil {
+			t.Fatalf("buildModuleChain error: %v", err)
+		}
+		t.Cleanup(func() {
+			chain.Close(ctx)
+		})
+		if _, err := chain.run(ctx, input, 0); err == nil || !strings.Contains(err.Error(), "max_input_bytes") {
+			t.Fatalf("expected input limit error, got: %v", err)
+		}
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		_, err := buildModuleChain(ctx, []string{"examples/ascii-uppercase-chunked.wasm"}, options{policy: resourcePolicy{stageTimeout: time.Second, maxMemoryPages: 1}})
+		if err == nil || !strings.Contains(err.Error(), "max_memory_pages") {
+			t.Fatalf("expected memory limit error, got: %v", err)
+		}
+	})
+}
+
+func TestEndlessOutputMore(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: 50 * time.Millisecond}}
+	chain, err := buildModuleChain(ctx, []string{"examples/endless-output.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+
+	// Streaming gives each call its own timeout, so the output_more calls
+	// must share one between them.
+	_, err = chain.runStream(ctx, strings.NewReader("x"), 0, func(contentData) error { return nil })
+	if kind := wasmruntime.KindOf(err); kind != wasmruntime.KindTimeout || !strings.Contains(err.Error(), "across its output_more calls") {
+		t.Fatalf("streaming err=%v, want a timeout across output_more calls", err)
+	}
+	if _, err := chain.run(ctx, []byte("x"), 0); wasmruntime.KindOf(err) != wasmruntime.KindTimeout {
+		t.Fatalf("err=%v, want KindTimeout", err)
+	}
+}
+
+func TestStageErrorsCarryKindAndExitCode(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: 50 * time.Millisecond}}
+	chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm", "examples/infinite-loop.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+
+	_, err = chain.run(ctx, []byte("x"), 0)
+	var failed *stageError
+	if !errors.As(err, &failed) || failed.stage != 1 || failed.path != "examples/infinite-loop.wasm" {
+		t.Fatalf("expected stage 1 to fail, got: %v", err)
+	}
+	if kind := wasmruntime.KindOf(err); kind != wasmruntime.KindTimeout {
+		t.Fatalf("kind=%v, want KindTimeout", kind)
+	}
+	if code := exitCodeFor(err); code != exitCodeTimeout {
+		t.Fatalf("exit code=%d, want %d", code, exitCodeTimeout)
+	}
+	if want := "Stage 1 (examples/infinite-loop.wasm): Wasm module exceeded the execution time limit (50ms)"; err.Error() != want {
+		t.Fatalf("error=%q, want %q", err.Error(), want)
+	}
+
+	if _, err := os.ReadFile(filepath.Join(t.TempDir(), "missing")); exitCodeFor(fmt.Errorf("Error reading input file: %w", err)) != exitCodeIO {
+		t.Fatalf("expected I/O exit code for %v", err)
+	}
+}
+
+func TestRunSplitWritesRecordsInOrder(t *testing.T) {
+	ctx := context.Background()
+	chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm"}, options{policy: resourcePolicy{stageTimeout: time.Second, maxInputBytes: 3}})
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	t.Cleanup(func() {
+		chain.Close(ctx)
+	})
+
+	input := "a\r\nbb\ntoo long\nccc\n"
+	tests := []struct {
+		onError onErrorPolicy
+		want    string
+		wantErr bool
+	}{
+		{onError: onErrorSkip, want: "61\n6262\n636363\n"},
+		{onError: onErrorMark, want: "61\n6262\nerror: Stage 0 (examples/hex-encode.wasm): Input of 8 bytes exceeds policy max_input_bytes (3)\n636363\n"},
+		{onError: onErrorFail, want: "61\n6262\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.onError), func(t *testing.T) {
+			split, err := parseSplitConfig("line", string(tt.onError), 4)
+			if err != nil {
+				t.Fatalf("parseSplitConfig error: %v", err)
+			}
+			var out bytes.Buffer
+			w := bufio.NewWriter(&out)
+			summary, err := chain.runSplit(ctx, strings.NewReader(input), split, w)
+			w.Flush()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runSplit error=%v, wantErr=%v", err, tt.wantErr)
+			}
+			if out.String() != tt.want {
+				t.Fatalf("output=%q, want %q", out.String(), tt.want)
+			}
+			if summary.failed != 1 {
+				t.Fatalf("failed=%d, want 1", summary.failed)
+			}
+		})
+	}
+}
+
+func TestRunBatchWritesEachInput(t *testing.T) {
+	ctx := context.Background()
+	chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm"}, options{policy: resourcePolicy{stageTimeout: time.Second, maxInputBytes: 3}})
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	t.Cleanup(func() {
+		chain.Close(ctx)
+	})
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.txt": "a", "b.txt": "bb", "long.txt": "too long"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outDir := filepath.Join(dir, "out")
+	if !isBatch([]string{filepath.Join(dir, "*.txt")}, outDir) || isBatch([]string{"a.txt"}, "") {
+		t.Fatal("isBatch mismatch")
+	}
+	config, err := parseBatchConfig([]string{filepath.Join(dir, "*.txt"), filepath.Join(dir, "a.txt")}, outDir, "{name}.hex", 2)
+	if err != nil {
+		t.Fatalf("parseBatchConfig error: %v", err)
+	}
+	if len(config.inputs) != 3 {
+		t.Fatalf("inputs=%q", config.inputs)
+	}
+	summary, err := runBatch(ctx, config, options{}, func(ctx context.Context, index int, input []byte) ([]byte, string, error) {
+		result, err := chain.run(ctx, input, uint64(index))
+		return result.output.bytes, "", err
+	})
+	var batchErr *batchError
+	if !errors.As(err, &batchErr) || exitCodeFor(err) != exitCodeCapacity {
+		t.Fatalf("expected batch error with capacity exit code, got: %v", err)
+	}
+	if summary.files != 3 || len(summary.failed) != 1 || filepath.Base(summary.failed[0].input) != "long.txt" {
+		t.Fatalf("summary=%+v", summary)
+	}
+	for name, want := range map[string]string{"a.hex": "61", "b.hex": "6262"} {
+		got, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil || string(got) != want {
+			t.Fatalf("%s=%q, %v; want %q", name, got, err, want)
+		}
+	}
+
+	for _, name := range []string{"x/a.txt", "y/a.txt", "x/a.md"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, err = parseBatchConfig([]string{filepath.Join(dir, "x/*"), filepath.Join(dir, "y/a.txt")}, filepath.Join(dir, "collide"), defaultBatchNameTemplate, 1)
+	if err != nil {
+		t.Fatalf("parseBatchConfig error for inputs differing by extension: %v", err)
+	}
+	summary, err = runBatch(ctx, config, options{}, func(ctx context.Context, index int, input []byte) ([]byte, string, error) {
+		return input, "", nil
+	})
+	if len(summary.failed) != 1 || filepath.Base(filepath.Dir(summary.failed[0].input)) != "y" || !strings.Contains(summary.failed[0].err.Error(), "would both write") {
+		t.Fatalf("summary=%+v err=%v, want y/a.txt to collide with x/a.txt", summary, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "collide", "a.txt")); err != nil || string(got) != "x/a.txt" {
+		t.Fatalf("a.txt=%q, %v; want the first input's output kept", got, err)
+	}
+	if _, err := parseBatchConfig([]string{"a.txt"}, outDir, "{name}/../x", 1); err == nil {
+		t.Fatal("expected error for output name outside the directory")
+	}
+}
+
+func TestWriteTraceRecordsEachStage(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: time.Second}, traceDir: t.TempDir()}
+	chain, err := buildModuleChain(ctx, []string{"examples/hex-encode.wasm", "examples/digits-only.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+
+	for _, tt := range []struct {
+		input      string
+		wantFiles  []string
+		wantFailed int
+	}{
+		{input: "ab", wantFiles: []string{"stage-0.txt", "stage-1.txt"}, wantFailed: -1},
+		{input: "\xab", wantFiles: []string{"stage-0.txt"}, wantFailed: 1},
+	} {
+		dir := filepath.Join(opts.traceDir, hex.EncodeToString([]byte(tt.input)))
+		result, runErr := chain.run(ctx, []byte(tt.input), 0)
+		if err := chain.writeTrace(dir, []byte(tt.input), result, runErr); err != nil {
+			t.Fatalf("writeTrace error: %v", err)
+		}
+		body, err := os.ReadFile(filepath.Join(dir, "trace.json"))
+		if err != nil {
+			t.Fatalf("reading trace.json: %v", err)
+		}
+		var report traceReport
+		if err := json.Unmarshal(body, &report); err != nil {
+			t.Fatalf("trace.json: %v", err)
+		}
+		if len(report.Stages) != 2 || report.Input.Size != len(tt.input) {
+			t.Fatalf("report=%+v", report)
+		}
+		var files []string
+		for i, stage := range report.Stages {
+			if stage.Module != chain.stages[i].spec.path || stage.Kind != "run" || stage.MemoryBytes == 0 {
+				t.Fatalf("stage %d=%+v", i, stage)
+			}
+			if stage.Output != nil {
+				files = append(files, stage.Output.File)
+				data, err := os.ReadFile(filepath.Join(dir, stage.Output.File))
+				if err != nil || len(data) != stage.Output.Size {
+					t.Fatalf("stage %d output %q: %v", i, data, err)
+				}
+			}
+			if (stage.Error != "") != (i == tt.wantFailed) {
+				t.Fatalf("stage %d error=%q, want failure at %d", i, stage.Error, tt.wantFailed)
+			}
+		}
+		if !reflect.DeepEqual(files, tt.wantFiles) {
+			t.Fatalf("files=%q, want %q", files, tt.wantFiles)
+		}
+		if (report.Output == nil) != (runErr != nil) {
+			t.Fatalf("output=%+v with run error %v", report.Output, runErr)
+		}
+	}
+}
+
+func TestLoadPipelineManifest(t *testing.T) {
+	specs, err := loadPipelineManifest("examples/e164-hex.pipeline.json")
+	if err != nil {
+		t.Fatalf("loadPipelineManifest error: %v", err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("spec count=%d, want 2", len(specs))
+	}
+	if specs[0].path != filepath.Join("examples", "e164.wasm") {
+		t.Fatalf("spec[0].path=%q, want path relative to manifest", specs[0].path)
+	}
+	if specs[1].timeout != 50*time.Millisecond {
+		t.Fatalf("spec[1].timeout=%s, want 50ms", specs[1].timeout)
+	}
+
+	ctx := context.Background()
+	chain, err := buildModuleChainFromSpecs(ctx, specs, options{policy: resourcePolicy{stageTimeout: time.Second}})
+	if err != nil {
+		t.Fatalf("buildModuleChainFromSpecs error: %v", err)
+	}
+	t.Cleanup(func() {
+		chain.Close(ctx)
+	})
+	result, err := chain.run(ctx, []byte("+1 (212) 555-0100"), 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if got := string(result.output.bytes); got != "2b3132313235353530313030" {
+		t.Fatalf("output=%q", got)
+	}
+
+	t.Run("uniforms", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "pipeline.json")
+		if err := os.WriteFile(path, []byte(`{"stages": [{"module": "brightness.wasm", "uniforms": {"brightness": 0.2, "mode": "fast"}}]}`), 0o644); err != nil {
+			t.Fatalf("write manifest: %v", err)
+		}
+		specs, err := loadPipelineManifest(path)
+		if err != nil {
+			t.Fatalf("loadPipelineManifest error: %v", err)
+		}
+		want := map[string]string{"brightness": "0.2", "mode": "fast"}
+		if !reflect.DeepEqual(specs[0].uniforms, want) {
+			t.Fatalf("uniforms=%v, want %v", specs[0].uniforms, want)
+		}
+		if err := rejectUniforms(specs, "run"); err == nil {
+			t.Fatal("expected run to reject uniforms")
+		}
+	})
+
+	t.Run("sha256 mismatch", func(t *testing.T) {
+		pinned := []moduleSpec{{path: "examples/e164.wasm", sha256: strings.Repeat("0", 64)}}
+		if _, err := buildModuleChainFromSpecs(ctx, pinned, options{}); err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+			t.Fatalf("expected sha256 mismatch, got: %v", err)
+		}
+	})
+
+	t.Run("encoding mismatch", func(t *testing.T) {
+		// The mismatch is found from the module's exports, before it runs.
+		declared := []moduleSpec{{path: "examples/e164.wasm", inputEncoding: "bytes"}}
+		if _, err := buildModuleChainFromSpecs(ctx, declared, options{}); wasmruntime.KindOf(err) != wasmruntime.KindContract || !strings.Contains(err.Error(), "takes utf8 input") {
+			t.Fatalf("expected encoding mismatch error, got: %v", err)
+		}
+		declared = []moduleSpec{{path: "examples/e164.wasm", inputEncoding: "utf8", outputEncoding: "utf8"}}
+		chain, err := buildModuleChainFromSpecs(ctx, declared, options{})
+		if err != nil {
+			t.Fatalf("buildModuleChainFromSpecs error: %v", err)
+		}
+		chain.Close(ctx)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "pipeline.json")
+		if err := os.WriteFile(path, []byte(`{"stages": [{"module": "a.wasm", "timeout": 5}]}`), 0o644); err != nil {
+			t.Fatalf("write manifest: %v", err)
+		}
+		if _, err := loadPipelineManifest(path); err == nil {
+			t.Fatal("expected error for unknown key")
+		}
+	})
+}
+
+func TestReceiptVerifiesReplay(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: time.Second}}
+	chain, err := buildModuleChain(ctx, []string{"examples/e164.wasm", "examples/hex-encode.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+
+	input := []byte("+1 (212) 555-0100")
+	result, err := chain.run(ctx, input, 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "receipt.json")
+	receipt := chain.receipt(newTraceData(contentData{bytes: input, encoding: dataEncodingRaw}, ""), charset.UTF8, newTraceData(result.output, ""))
+	if err := writeReceipt(path, receipt); err != nil {
+		t.Fatalf("writeReceipt error: %v", err)
+	}
+	receipt, err = readReceipt(path)
+	if err != nil {
+		t.Fatalf("readReceipt error: %v", err)
+	}
+	if len(receipt.Stages) != 2 || receipt.Stages[1].Module != "examples/hex-encode.wasm" || len(receipt.Stages[1].SHA256) != 64 {
+		t.Fatalf("stages=%+v", receipt.Stages)
+	}
+
+	mismatched := func(checks []receiptCheck) []string {
+		var names []string
+		for _, check := range checks {
+			if !check.ok {
+				names = append(names, check.name)
+			}
+		}
+		return names
+	}
+	checks, err := verifyReceipt(ctx, receipt, input, opts)
+	if err != nil {
+		t.Fatalf("verifyReceipt error: %v", err)
+	}
+	if len(checks) != 4 || len(mismatched(checks)) != 0 {
+		t.Fatalf("checks=%+v", checks)
+	}
+
+	checks, err = verifyReceipt(ctx, receipt, []byte("+1 (212) 555-0199"), opts)
+	if err != nil {
+		t.Fatalf("verifyReceipt error: %v", err)
+	}
+	if got := mismatched(checks); !slices.Equal(got, []string{"input", "output"}) {
+		t.Fatalf("mismatched=%q, want [input output]", got)
+	}
+
+	receipt.Stages[0].SHA256 = strings.Repeat("0", 64)
+	checks, err = verifyReceipt(ctx, receipt, input, opts)
+	if err != nil {
+		t.Fatalf("verifyReceipt error: %v", err)
+	}
+	if got := mismatched(checks); !slices.Equal(got, []string{"stage 0 (examples/e164.wasm)"}) {
+		t.Fatalf("mismatched=%q, want stage 0", got)
+	}
+}
+
+func TestUTF8CheckerAcrossChunks(t *testing.T) {
+	text := []byte("a€😀b")
+	for split := range len(text) + 1 {
+		checker := newUTF8Checker(dataEncodingUTF8, "Output")
+		if err := checker.check(text[:split]); err != nil {
+			t.Fatalf("split %d: first chunk error: %v", split, err)
+		}
+		if err := checker.check(text[split:]); err != nil {
+			t.Fatalf("split %d: second chunk error: %v", split, err)
+		}
+		if err := checker.finish(); err != nil {
+			t.Fatalf("split %d: finish error: %v", split, err)
+		}
+	}
+
+	checker := newUTF8Checker(dataEncodingUTF8, "Output")
+	_ = checker.check([]byte("ab\xe2\x82"))
+	err := checker.check([]byte("c"))
+	if wasmruntime.KindOf(err) != wasmruntime.KindContract || !strings.Contains(err.Error(), "at byte 2") {
+		t.Fatalf("err=%v, want contract error at byte 2", err)
+	}
+	checker = newUTF8Checker(dataEncodingUTF8, "Input")
+	_ = checker.check([]byte("ab\xe2\x82"))
+	if err := checker.finish(); wasmruntime.KindOf(err) != wasmruntime.KindInvalidInput {
+		t.Fatalf("err=%v, want invalid input for truncated character", err)
+	}
+	if newUTF8Checker(dataEncodingRaw, "Input") != nil {
+		t.Fatal("expected no checker for bytes")
+	}
+
+	ctx := context.Background()
+	chain, err := buildModuleChain(ctx, []string{"examples/base64-decode.wasm", "examples/e164.wasm"}, options{policy: resourcePolicy{stageTimeout: time.Second}})
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+	// "KzH/" decodes to "+1\xff", which e164 cannot take as text.
+	_, err = chain.run(ctx, []byte("KzH/"), 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "Stage 1 (examples/e164.wasm): Input is not valid UTF-8 at byte 2") {
+		t.Fatalf("err=%v", err)
+	}
+}
+
+func TestAllocatedInput(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: 10 * time.Second}, reuseInstances: true}
+	chain, err := buildModuleChain(ctx, []string{"examples/line-count-alloc.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+
+	// Larger than the module's initial memory, so the instance grows and is
+	// not returned to the pool.
+	input := bytes.Repeat([]byte("a line\n"), 20000)
+	result, err := chain.run(ctx, input, 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if got := string(result.output.bytes); got != "20000" {
+		t.Fatalf("output=%q, want 20000", got)
+	}
+
+	// Small inputs fit, so the first small run starts a fresh instance and
+	// the second reuses it, allocating again after the first's free.
+	for i := range 2 {
+		result, err := chain.run(ctx, []byte("one\ntwo\n"), 0)
+		if err != nil {
+			t.Fatalf("run error: %v", err)
+		}
+		if got := string(result.output.bytes); got != "2" {
+			t.Fatalf("output=%q, want 2", got)
+		}
+		if result.metrics.poolHits != i {
+			t.Fatalf("run %d pool hits=%d, want %d", i, result.metrics.poolHits, i)
+		}
+	}
+	if _, err := chain.run(ctx, []byte("\xff\n"), 0); wasmruntime.KindOf(err) != wasmruntime.KindInvalidInput {
+		t.Fatalf("err=%v, want invalid UTF-8 input", err)
+	}
+}
+
+func TestOnlyPooledStagesExportPrivateGlobals(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: 10 * time.Second}, reuseInstances: true}
+	for _, tt := range []struct {
+		path   string
+		pooled bool
+		// private names the global ExportMutableGlobals would export.
+		private string
+	}{
+		{"examples/rgba/brightness.wasm", false, "qip.global.2"},
+		{"examples/line-count-alloc.wasm", true, "qip.global.0"},
+	} {
+		chain, err := buildModuleChain(ctx, []string{tt.path}, opts)
+		if err != nil {
+			t.Fatalf("buildModuleChain(%s) error: %v", tt.path, err)
+		}
+		defer chain.Close(ctx)
+		if pooled := chain.stages[0].pool != nil; pooled != tt.pooled {
+			t.Fatalf("%s pooled=%t, want %t", tt.path, pooled, tt.pooled)
+		}
+		// The stage itself always runs the module as it was given.
+		mod, err := chain.runtime.InstantiateModule(ctx, chain.stages[0].compiled, wazero.NewModuleConfig().WithName(""))
+		if err != nil {
+			t.Fatalf("InstantiateModule(%s) error: %v", tt.path, err)
+		}
+		if mod.ExportedGlobal(tt.private) != nil {
+			t.Fatalf("%s stage exports rewritten global %s", tt.path, tt.private)
+		}
+		_ = mod.Close(ctx)
+	}
+}
+
+func TestWASIStage(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: 10 * time.Second}, reuseInstances: true}
+	chain, err := buildModuleChain(ctx, []string{"examples/wasi-ascii-upper.wasm", "examples/hex-encode.wasm"}, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChain error: %v", err)
+	}
+	defer chain.Close(ctx)
+	if chain.stages[0].kind != stageKindWASI || chain.stages[0].pool != nil {
+		t.Fatalf("stage 0 kind=%d pooled=%t, want an unpooled WASI stage", chain.stages[0].kind, chain.stages[0].pool != nil)
+	}
+
+	// Longer than the module's 4096 byte read buffer.
+	input := bytes.Repeat([]byte("ab"), 3000)
+	result, err := chain.run(ctx, input, 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if want := strings.Repeat("4142", 3000); string(result.output.bytes) != want {
+		t.Fatalf("output has %d bytes, want %d of 4142...", len(result.output.bytes), len(want))
+	}
+
+	_, err = chain.run(ctx, []byte("caf\xc3\xa9"), 0)
+	if wasmruntime.KindOf(err) != wasmruntime.KindModule || !strings.Contains(err.Error(), "Module exited with code 1: Input is not ASCII") {
+		t.Fatalf("err=%v, want exit code 1 with stderr", err)
+	}
+}
+
+func TestHostModuleGrants(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: 10 * time.Second}}
+	if _, err := buildModuleChain(ctx, []string{"examples/stamp.wasm"}, opts); wasmruntime.KindOf(err) != wasmruntime.KindCompile || !strings.Contains(err.Error(), "not granted log") {
+		t.Fatalf("err=%v, want ungranted import to fail", err)
+	}
+
+	var logged bytes.Buffer
+	opts.now = time.UnixMilli(1700000000000)
+	opts.seed = 42
+	opts.moduleLog = &logged
+	specs := moduleSpecsFromArgs([]string{"examples/stamp.wasm"})
+	specs[0].grants = []hostmodule.Capability{hostmodule.Log, hostmodule.NowUnixMS, hostmodule.RandomFill}
+	chain, err := buildModuleChainFromSpecs(ctx, specs, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChainFromSpecs error: %v", err)
+	}
+	defer chain.Close(ctx)
+
+	first, err := chain.run(ctx, []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	fields := strings.Fields(string(first.output.bytes))
+	if len(fields) != 3 || fields[0] != "1700000000000" || len(fields[1]) != 16 || fields[2] != "hello" {
+		t.Fatalf("output=%q, want time, nonce and input", first.output.bytes)
+	}
+	again, err := chain.run(ctx, []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if !bytes.Equal(first.output.bytes, again.output.bytes) {
+		t.Fatalf("outputs differ with the same seed: %q and %q", first.output.bytes, again.output.bytes)
+	}
+	next, err := chain.run(ctx, []byte("hello"), 1)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	if nonce := strings.Fields(string(next.output.bytes))[1]; nonce == fields[1] {
+		t.Fatalf("record 1 got record 0's nonce %s", nonce)
+	}
+	if want := "Stage 0 (examples/stamp.wasm) log: stamped input\n"; logged.String() != want+want+want {
+		t.Fatalf("log=%q, want three %q", logged.String(), want)
+	}
+
+	// A run at the Unix epoch still records its time for qip verify.
+	opts.now = time.UnixMilli(0)
+	epoch, err := buildModuleChainFromSpecs(ctx, specs, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChainFromSpecs error: %v", err)
+	}
+	defer epoch.Close(ctx)
+	result, err := epoch.run(ctx, []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("run error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "receipt.json")
+	if err := writeReceipt(path, epoch.receipt(newTraceData(contentData{bytes: []byte("hello"), encoding: dataEncodingRaw}, ""), charset.UTF8, newTraceData(result.output, ""))); err != nil {
+		t.Fatalf("writeReceipt error: %v", err)
+	}
+	receipt, err := readReceipt(path)
+	if err != nil {
+		t.Fatalf("readReceipt error: %v", err)
+	}
+	opts.now = time.Time{}
+	checks, err := verifyReceipt(ctx, receipt, []byte("hello"), opts)
+	if err != nil {
+		t.Fatalf("verifyReceipt error: %v", err)
+	}
+	for _, check := range checks {
+		if !check.ok {
+			t.Fatalf("check %s failed: %s", check.name, check.detail)
+		}
+	}
+}
+
+func TestModuleMetaUniforms(t *testing.T) {
+	ctx := context.Background()
+	opts := options{policy: resourcePolicy{stageTimeout: 10 * time.Second}}
+	specs := moduleSpecsFromArgs([]string{"examples/rgba/brightness.wasm"})
+	specs[0].uniforms = map[string]string{"brightness": "1.5"}
+	_, err := buildModuleChainFromSpecs(ctx, specs, opts)
+	if exitCodeFor(err) != exitCodeInvalidInput || !strings.Contains(err.Error(), "between -1 and 1") {
+		t.Fatalf("err=%v, want out of range uniform to be invalid input", err)
+	}
+
+	specs[0].uniforms = map[string]string{"brightness": "0.5"}
+	chain, err := buildModuleChainFromSpecs(ctx, specs, opts)
+	if err != nil {
+		t.Fatalf("buildModuleChainFromSpecs error: %v", err)
+	}
+	defer chain.Close(ctx)
+	if meta := chain.stages[0].meta; meta == nil || meta.Name != "brightness" || meta.ABI != "image" {
+		t.Fatalf("meta=%+v, want brightness image module", meta)
+	}
+	_, err = chain.runWithUniforms(ctx, nil, 0, []map[string]string{{"contrast": "1"}})
+	if !errors.Is(err, modulemeta.ErrInvalidUniform) || !strings.Contains(err.Error(), "it takes brightness") {
+		t.Fatalf("err=%v, want undeclared override rejected", err)
+	}
+
+	var help bytes.Buffer
+	if err := moduleHelp(&help, "examples/rgba/brightness.wasm"); err != nil {
+		t.Fatalf("moduleHelp error: %v", err)
+	}
+	if !strings.Contains(help.String(), "brightness (f32, between -1 and 1, default 0)") {
+		t.Fatalf("help=%q, want the brightness uniform described", help.String())
+	}
+}
+
+func TestRunOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	failed, err := createRunOutputFile(filepath.Join(dir, "failed"))
+	if err != nil {
+		t.Fatalf("createRunOutputFile error: %v", err)
+	}
+	failed.discard()
+
+	file, err := createRunOutputFile(filepath.Join(dir, "badge"))
+	if err != nil {
+		t.Fatalf("createRunOutputFile error: %v", err)
+	}
+	w := bufio.NewWriter(file.temp)
+	w.WriteString("<svg/>")
+	if err := closeRunOutput(w, file, "image/svg+xml", options{}); err != nil {
+		t.Fatalf("closeRunOutput error: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "badge.svg" {
+		t.Fatalf("entries=%v err=%v, want only badge.svg", entries, err)
+	}
+}